@@ -47,21 +47,79 @@
 #include <string.h>
 
 #define CHUNK (1 << 14) // file input buffer size
+/* upper bound of the size of a compressed window, as computed by compressBound */
+#define WINDOW_BOUND (WINSIZE + (WINSIZE >> 12) + (WINSIZE >> 14) + (WINSIZE >> 25) + 13)
 
 void free_index(struct gzip_index *index)
 {
     if (index != NULL) {
+        if (index->list != NULL) {
+            for (int i = 0; i < index->have; i++)
+                free(index->list[i].window);
+        }
         free(index->list);
         free(index);
     }
 }
 
+/* Store the window of the access point compressed if that makes it smaller,
+   and as is otherwise. */
+static int compress_window(struct gzip_index_point *point, unsigned char *window)
+{
+    unsigned char compressed[WINDOW_BOUND];
+    uLongf size = WINDOW_BOUND;
+    unsigned char *src = compressed;
+
+    if (compress2(compressed, &size, window, WINSIZE, Z_BEST_COMPRESSION) != Z_OK || size >= WINSIZE) {
+        /* incompressible window */
+        src = window;
+        size = WINSIZE;
+    }
+    point->window = malloc(size);
+    if (point->window == NULL)
+        return Z_MEM_ERROR;
+    memcpy(point->window, src, size);
+    point->window_size = size;
+    return Z_OK;
+}
+
+int get_window(struct gzip_index* index, int point_index, void* window)
+{
+    struct gzip_index_point *point = &index->list[point_index];
+    uLongf size = WINSIZE;
+    int ret;
+
+    if (point->window_size == 0)
+        return 0;
+    if (point->window_size == WINSIZE) {
+        memcpy(window, point->window, WINSIZE);
+        return WINSIZE;
+    }
+    ret = uncompress(window, &size, point->window, point->window_size);
+    if (ret != Z_OK)
+        return ret;
+    if (size != WINSIZE)
+        return Z_DATA_ERROR;
+    return WINSIZE;
+}
+
+/* Set the window of the access point as the dictionary of strm */
+static int set_window(z_stream *strm, struct gzip_index* index, int point_index)
+{
+    unsigned char window[WINSIZE];
+    int ret = get_window(index, point_index, window);
+    if (ret <= 0)
+        return ret;
+    return inflateSetDictionary(strm, window, ret);
+}
+
 /* Add an entry to the access point list.  If out of memory, deallocate the
    existing list and return NULL. */
 static struct gzip_index *addpoint(struct gzip_index *index, uint8_t bits,
     off_t in, off_t out, unsigned left, unsigned char *window)
 {
     struct gzip_index_point *next;
+    unsigned char linear[WINSIZE];
 
     /* if list is empty, create it (start with eight points) */
     if (index == NULL) {
@@ -92,10 +150,19 @@ static struct gzip_index *addpoint(struct gzip_index *index, uint8_t bits,
     next->bits = bits;
     next->in = in;
     next->out = out;
-    if (left)
-        memcpy(next->window, window + WINSIZE - left, left);
-    if (left < WINSIZE)
-        memcpy(next->window + left, window, WINSIZE - left);
+    next->window_size = 0;
+    next->window = NULL;
+    /* there is no preceding data at the start of the stream */
+    if (out != 0) {
+        if (left)
+            memcpy(linear, window + WINSIZE - left, left);
+        if (left < WINSIZE)
+            memcpy(linear + left, window, WINSIZE - left);
+        if (compress_window(next, linear) != Z_OK) {
+            free_index(index);
+            return NULL;
+        }
+    }
     index->have++;
 
     /* return list, possibly reallocated */
@@ -104,106 +171,162 @@ static struct gzip_index *addpoint(struct gzip_index *index, uint8_t bits,
 
 
 
-/* Pretty much the same as from zran.c */
-int generate_index_fp(FILE* in, off_t span, struct gzip_index** idx)
+static int min(int lhs, int rhs)
+{
+    return lhs < rhs ? lhs : rhs;
+}
+
+int init_index_builder(off_t span, struct gzip_index_builder** builder)
 {
     int ret;
-    off_t totin, totout;        /* our own total counters to avoid 4GB limit */
-    off_t last;                 /* totout value of last access point */
-    struct gzip_index *index;       /* access points being generated */
-    z_stream strm;
-    unsigned char input[CHUNK];
-    unsigned char window[WINSIZE];
-    memset(window, 0, WINSIZE);
+    struct gzip_index_builder* b = malloc(sizeof(struct gzip_index_builder));
+    if (b == NULL)
+        return GZIP_INDEXER_CANNOT_ALLOC;
+    memset(b, 0, sizeof(struct gzip_index_builder));
+    b->span = span;
 
     /* initialize inflate */
-    strm.zalloc = Z_NULL;
-    strm.zfree = Z_NULL;
-    strm.opaque = Z_NULL;
-    strm.avail_in = 0;
-    strm.next_in = Z_NULL;
-    ret = inflateInit2(&strm, 47);      /* automatic zlib or gzip decoding */
-    if (ret != Z_OK)
+    b->strm.zalloc = Z_NULL;
+    b->strm.zfree = Z_NULL;
+    b->strm.opaque = Z_NULL;
+    b->strm.avail_in = 0;
+    b->strm.next_in = Z_NULL;
+    ret = inflateInit2(&b->strm, 47);      /* automatic zlib or gzip decoding */
+    if (ret != Z_OK) {
+        free(b);
         return ret;
+    }
+    *builder = b;
+    return GZIP_INDEXER_OK;
+}
 
-    /* inflate the input, maintain a sliding window, and build an index -- this
-       also validates the integrity of the compressed data using the check
-       information at the end of the gzip or zlib stream */
-    totin = totout = last = 0;
-    index = NULL;               /* will be allocated by first addpoint() */
-    strm.avail_out = 0;
-    do {
-        /* get some compressed data from input file */
-        memset(input, 0, CHUNK);
-        strm.avail_in = fread(input, 1, CHUNK, in);
-        if (ferror(in)) {
-            ret = Z_ERRNO;
-            goto build_index_error;
-        }
-        if (strm.avail_in == 0) {
+/* Pretty much the same as the loop of build_index from zran.c, except that the
+   input is provided by the caller and the uncompressed data is copied to out */
+int index_builder_inflate(struct gzip_index_builder* b, void* in, unsigned in_len, unsigned* consumed,
+    void* out, unsigned out_len, unsigned* produced)
+{
+    int ret = Z_OK;
+    unsigned have;
+    z_stream* strm = &b->strm;
+
+    *consumed = 0;
+    *produced = 0;
+    b->at_block_end = 0;
+    if (b->done)
+        return Z_STREAM_END;
+
+    strm->next_in = in;
+    strm->avail_in = in_len;
+    while (strm->avail_in != 0 && *produced < out_len) {
+        /* reset sliding window if necessary */
+        if (b->pos == WINSIZE)
+            b->pos = 0;
+        strm->next_out = b->window + b->pos;
+        strm->avail_out = min(WINSIZE - b->pos, out_len - *produced);
+        have = strm->avail_out;
+
+        /* inflate until out of input, output, or at end of block --
+           update the total input and output counters */
+        b->totin += strm->avail_in;
+        ret = inflate(strm, Z_BLOCK);      /* return at end of block */
+        b->totin -= strm->avail_in;
+        have -= strm->avail_out;
+        memcpy((uchar*)out + *produced, b->window + b->pos, have);
+        b->pos += have;
+        b->totout += have;
+        *produced += have;
+
+        if (ret == Z_NEED_DICT)
             ret = Z_DATA_ERROR;
-            goto build_index_error;
+        if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
+            break;
+        if (ret == Z_STREAM_END) {
+            b->done = 1;
+            break;
+        }
+        if (ret == Z_BUF_ERROR) {
+            /* no progress is possible, more input is needed */
+            ret = Z_OK;
+            break;
         }
-        strm.next_in = input;
 
-        /* process all of that, or until end of stream */
-        do {
-            /* reset sliding window if necessary */
-            if (strm.avail_out == 0) {
-                strm.avail_out = WINSIZE;
-                strm.next_out = window;
+        /* if at end of block, consider adding an index entry (note that if
+           data_type indicates an end-of-block, then all of the
+           uncompressed data from that block has been delivered, and none
+           of the compressed data after that block has been consumed,
+           except for up to seven bits) -- the totout == 0 provides an
+           entry point after the zlib or gzip header, and assures that the
+           index always has at least one access point; we avoid creating an
+           access point after the last block by checking bit 6 of data_type
+         */
+        if ((strm->data_type & 128) && !(strm->data_type & 64) &&
+            b->totout != 0 && b->manual) {
+            /* return so that the caller can decide to add an access point here */
+            b->at_block_end = 1;
+            break;
+        }
+        if ((strm->data_type & 128) && !(strm->data_type & 64) &&
+            (b->totout == 0 || b->totout - b->last > b->span)) {
+            b->index = addpoint(b->index, (uint8_t)(strm->data_type & 7), b->totin,
+                                b->totout, WINSIZE - b->pos, b->window);
+            if (b->index == NULL) {
+                ret = Z_MEM_ERROR;
+                break;
             }
+            b->last = b->totout;
+            /* return so that the caller knows where the access point is */
+            break;
+        }
+    }
+    *consumed = in_len - strm->avail_in;
+    strm->next_in = Z_NULL;
+    strm->avail_in = 0;
+    return ret;
+}
 
-            /* inflate until out of input, output, or at end of block --
-               update the total input and output counters */
-            totin += strm.avail_in;
-            totout += strm.avail_out;
-            ret = inflate(&strm, Z_BLOCK);      /* return at end of block */
-            totin -= strm.avail_in;
-            totout -= strm.avail_out;
-            if (ret == Z_NEED_DICT)
-                ret = Z_DATA_ERROR;
-            if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
-                goto build_index_error;
-            if (ret == Z_STREAM_END)
-                break;
+int index_builder_add_point(struct gzip_index_builder* b)
+{
+    if (!b->at_block_end)
+        return Z_DATA_ERROR;
+    b->index = addpoint(b->index, (uint8_t)(b->strm.data_type & 7), b->totin,
+                        b->totout, WINSIZE - b->pos, b->window);
+    if (b->index == NULL)
+        return Z_MEM_ERROR;
+    b->last = b->totout;
+    b->at_block_end = 0;
+    return GZIP_INDEXER_OK;
+}
 
-            /* if at end of block, consider adding an index entry (note that if
-               data_type indicates an end-of-block, then all of the
-               uncompressed data from that block has been delivered, and none
-               of the compressed data after that block has been consumed,
-               except for up to seven bits) -- the totout == 0 provides an
-               entry point after the zlib or gzip header, and assures that the
-               index always has at least one access point; we avoid creating an
-               access point after the last block by checking bit 6 of data_type
-             */
-            if ((strm.data_type & 128) && !(strm.data_type & 64) &&
-                (totout == 0 || totout - last > span)) {
-                index = addpoint(index, (uint8_t)(strm.data_type & 7), totin,
-                                 totout, strm.avail_out, window);
-                if (index == NULL) {
-                    ret = Z_MEM_ERROR;
-                    goto build_index_error;
-                }
-                last = totout;
-            }
-        } while (strm.avail_in != 0);
-    } while (ret != Z_STREAM_END);
+int index_builder_finish(struct gzip_index_builder* b, struct gzip_index** idx)
+{
+    struct gzip_index* index = b->index;
+    if (!b->done || index == NULL)
+        return Z_DATA_ERROR;
 
-    /* clean up and return index (release unused entries in list) */
-    (void)inflateEnd(&strm);
+    /* release unused entries in list */
     index->list = realloc(index->list, sizeof(struct gzip_index_point) * index->have);
     index->size = index->have;
-    index->span_size = span;
+    index->span_size = b->span;
+    b->index = NULL;
     *idx = index;
     return index->size;
+}
 
-    /* return error */
-  build_index_error:
-    (void)inflateEnd(&strm);
-    free_index(index);
-    return ret;
+int index_builder_next_member(struct gzip_index_builder* b)
+{
+    if (!b->done)
+        return Z_DATA_ERROR;
+    b->done = 0;
+    return inflateReset(&b->strm);
+}
 
+void free_index_builder(struct gzip_index_builder* b)
+{
+    if (b != NULL) {
+        (void)inflateEnd(&b->strm);
+        free_index(b->index);
+        free(b);
+    }
 }
 
 int has_bits(struct gzip_index* index, int point_index)
@@ -230,20 +353,34 @@ off_t get_comp_off(struct gzip_index* index, int point_index)
     return index->list[point_index].in;
 }
 
-static int min(int lhs, int rhs)
+/* Prepares strm to inflate the gzip member following the one which just ended, so that
+   data can be extracted from layers made of several members, e.g. eStargz layers.
+   Extraction starts with a raw inflate, so the trailer of the first member has to be
+   skipped by the caller; the following members are inflated with their gzip wrapper. */
+static int next_member(z_stream *strm, int *raw, unsigned *trailer)
 {
-    return lhs < rhs ? lhs : rhs;
+    if (*raw) {
+        *raw = 0;
+        *trailer = 8;
+        return inflateReset2(strm, 31);
+    }
+    return inflateReset(strm);
 }
 
 // This is the same as extract_data_fp, but instead of a file, it decompresses data from a buffer which contains the exact data to decompress 
 int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, off_t offset, void* buffer, off_t len, int first_point_index)
 {
     int ret, skip;
+    int raw = 1;                /* whether the first member is being inflated */
+    int member_end = 0;         /* whether a gzip member just ended */
+    int done = 0;               /* whether the end of the data was reached */
+    unsigned trailer = 0;       /* bytes of the trailer of the first member left to skip */
     z_stream strm;
     unsigned char input[CHUNK];
     unsigned char discard[WINSIZE];
     uchar* buf = buffer; 
     uchar* data = d;
+    off_t remaining = datalen;
     /* proceed only if something reasonable to do */
     if (len < 0)
         return 0;
@@ -263,12 +400,14 @@ int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, o
         int ret = data[0];
         inflatePrime(&strm, bits, ret >> (8 - bits));
         data++;
+        remaining--;
     }
-    (void)inflateSetDictionary(&strm, index->list[first_point_index].window, WINSIZE);
+    ret = set_window(&strm, index, first_point_index);
+    if (ret != Z_OK)
+        goto extract_ret;
     offset -= index->list[first_point_index].out;
     strm.avail_in = 0;
     skip = 1;                               /* while skipping to offset */
-    int remaining = datalen;
     do {
         /* define where to put uncompressed data, and how much */
         if (offset == 0 && skip) {          /* at offset now */
@@ -286,30 +425,50 @@ int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, o
             strm.next_out = discard;
             offset = 0;
         }
-        /* uncompress until avail_out filled, or end of stream */
+        /* uncompress until avail_out filled, or end of data */
         do {
             if (strm.avail_in == 0) {
-                int read = min(remaining, CHUNK);
+                int read = remaining < CHUNK ? (int)remaining : CHUNK;
+                if (read == 0) {
+                    /* the data ends at the end of a member, or is truncated */
+                    if (!member_end) {
+                        ret = Z_DATA_ERROR;
+                        goto extract_ret;
+                    }
+                    done = 1;
+                    break;
+                }
                 remaining -= read;
                 memcpy(input, data, read);
                 data += read;
                 strm.avail_in = read;
                 strm.next_in = input;
             }
+            if (trailer) {
+                unsigned n = min(trailer, strm.avail_in);
+                strm.next_in += n;
+                strm.avail_in -= n;
+                trailer -= n;
+                continue;
+            }
             ret = inflate(&strm, Z_NO_FLUSH);       /* normal inflate */
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            member_end = ret == Z_STREAM_END;
+            if (member_end) {
+                ret = next_member(&strm, &raw, &trailer);
+                if (ret != Z_OK)
+                    goto extract_ret;
+            }
         } while (strm.avail_out != 0);
 
-        /* if reach end of stream, then don't keep trying to get more */
-        if (ret == Z_STREAM_END)
+        /* if reach end of data, then don't keep trying to get more */
+        if (done)
             break;
 
-        /* do until offset reached and requested data read, or stream ends */
+        /* do until offset reached and requested data read, or data ends */
     } while (skip);
 
     /* compute number of uncompressed bytes read after offset */
@@ -325,6 +484,10 @@ int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, o
 int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buffer, int len)
 {
     int ret, skip;
+    int raw = 1;                /* whether the first member is being inflated */
+    int member_end = 0;         /* whether a gzip member just ended */
+    int done = 0;               /* whether the end of the file was reached */
+    unsigned trailer = 0;       /* bytes of the trailer of the first member left to skip */
     z_stream strm;
     struct gzip_index_point *here;
     unsigned char input[CHUNK];
@@ -361,7 +524,9 @@ int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buff
         }
         (void)inflatePrime(&strm, here->bits, ret >> (8 - here->bits));
     }
-    (void)inflateSetDictionary(&strm, here->window, WINSIZE);
+    ret = set_window(&strm, index, here - index->list);
+    if (ret != Z_OK)
+        goto extract_ret;
     /* skip uncompressed bytes until offset reached, then satisfy request */
     offset -= here->out;
     strm.avail_in = 0;
@@ -383,7 +548,7 @@ int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buff
             strm.next_out = discard;
             offset = 0;
         }
-        /* uncompress until avail_out filled, or end of stream */
+        /* uncompress until avail_out filled, or end of file */
         do {
             if (strm.avail_in == 0) {
                 strm.avail_in = fread(input, 1, CHUNK, in);
@@ -392,26 +557,41 @@ int extract_data_fp(FILE *in, struct gzip_index *index, off_t offset, void *buff
                     goto extract_ret;
                 }
                 if (strm.avail_in == 0) {
-                    ret = Z_DATA_ERROR;
-                    goto extract_ret;
+                    /* the file ends at the end of a member, or is truncated */
+                    if (!member_end) {
+                        ret = Z_DATA_ERROR;
+                        goto extract_ret;
+                    }
+                    done = 1;
+                    break;
                 }
                 strm.next_in = input;
             }
+            if (trailer) {
+                unsigned n = min(trailer, strm.avail_in);
+                strm.next_in += n;
+                strm.avail_in -= n;
+                trailer -= n;
+                continue;
+            }
             ret = inflate(&strm, Z_NO_FLUSH);       /* normal inflate */
             if (ret == Z_NEED_DICT)
                 ret = Z_DATA_ERROR;
             if (ret == Z_MEM_ERROR || ret == Z_DATA_ERROR)
                 goto extract_ret;
-            if (ret == Z_STREAM_END)
-                break;
+            member_end = ret == Z_STREAM_END;
+            if (member_end) {
+                ret = next_member(&strm, &raw, &trailer);
+                if (ret != Z_OK)
+                    goto extract_ret;
+            }
         } while (strm.avail_out != 0);
 
-        /* if reach end of stream, then don't keep trying to get more */
-        if (ret == Z_STREAM_END)
-        {
+        /* if reach end of file, then don't keep trying to get more */
+        if (done)
             break;
-        }
-        /* do until offset reached and requested data read, or stream ends */
+
+        /* do until offset reached and requested data read, or file ends */
     } while (skip);
 
     /* compute number of uncompressed bytes read after offset */
@@ -436,18 +616,6 @@ int extract_data(const char* file, struct gzip_index* index, off_t offset, void*
     return ret;
 }
 
-int generate_index(const char* filepath, off_t span, struct gzip_index** index)
-{
-    FILE* fp = fopen(filepath, "rb");
-    if (fp == NULL)
-    {
-        return GZIP_INDEXER_FILE_NOT_FOUND;
-    }
-    int ret = generate_index_fp(fp, span, index);
-    fclose(fp);
-    return ret;
-}
-
 int span_indices_for_file(struct gzip_index* index, off_t start, off_t end, void* is, void* ie)
 {
     if (index == NULL)
@@ -488,6 +656,36 @@ int pt_index_from_ucmp_offset(struct gzip_index* index, off_t off)
 }
 
 
+/*
+    The buffer is tightly packed. The layout of the buffer is:
+    -   4 bytes, 0, to tell it apart from the legacy layout, which starts with
+        the number of span entries and therefore never with 0
+    -   4 bytes, version of the layout (BLOB_VERSION)
+    -   4 bytes, number of span entries
+    -   8 bytes, size of span
+    -   for each entry
+        -  8 bytes, compressed offset
+        -  8 bytes, uncompressed offset
+        -  1 byte, bits
+        -  4 bytes, size of the window
+        -  window, compressed with zlib unless its size is WINSIZE. The window of
+           the entry at the start of the stream is empty.
+
+    The legacy layout is:
+    -   4 bytes, number of span entries
+    -   8 bytes, size of span
+    -   for each entry (except span 0)
+        -  8 bytes, compressed offset
+        -  8 bytes, uncompressed offset
+        -  1 byte, bits
+        -  32768 bytes, window
+*/
+#define BLOB_VERSION 1
+#define BLOB_HEADER_SIZE 20
+#define BLOB_ENTRY_HEADER_SIZE 21
+#define LEGACY_BLOB_HEADER_SIZE 12
+#define LEGACY_BLOB_ENTRY_SIZE (17 + WINSIZE)
+
 unsigned get_blob_size(struct gzip_index* index)
 {
     if (index == NULL)
@@ -495,19 +693,12 @@ unsigned get_blob_size(struct gzip_index* index)
         return 0;
     }
 
-    unsigned size = index->size; 
-
-    /*
-        The buffer will be tightly packed. The layout of the buffer is: 
-        -   4 bytes, number of span entries
-        -   8 bytes, size of span
-        -   for each entry (except span 0)
-            -  8 bytes, compressed offset
-            -  8 bytes, uncompressed offset
-            -  1 byte, bits
-            -  32768 bytes, window
-    */
-    return  ((2 << 14) + 17) * (size - 1)  + 12;
+    unsigned size = BLOB_HEADER_SIZE;
+    for (int i = 0; i < index->have; i++)
+    {
+        size += BLOB_ENTRY_HEADER_SIZE + index->list[i].window_size;
+    }
+    return size;
 }
 
 int index_to_blob(struct gzip_index* index, void* buf)
@@ -524,14 +715,19 @@ int index_to_blob(struct gzip_index* index, void* buf)
        return 0;
     }
 
+    uint32_t marker = 0;
+    uint32_t version = BLOB_VERSION;
     uchar* cur = buf;
+    memcpy(cur, &marker, 4);
+    cur += 4;
+    memcpy(cur, &version, 4);
+    cur += 4;
     memcpy(cur, &index->have, 4);
     cur += 4;
     memcpy(cur, &index->span_size, 8);
     cur += 8;
 
-    // The values of dictionary 0 are known, so no need to save it
-    for(int i = 1; i < index->have; i++)
+    for(int i = 0; i < index->have; i++)
     {
         struct gzip_index_point* pt = &index->list[i];
         memcpy(cur, &pt->in, 8);
@@ -540,39 +736,52 @@ int index_to_blob(struct gzip_index* index, void* buf)
         cur += 8;
         memcpy(cur, &pt->bits, 1);
         cur += 1;
-        memcpy(cur, &pt->window, WINSIZE);
-        cur += WINSIZE;
+        memcpy(cur, &pt->window_size, 4);
+        cur += 4;
+        if (pt->window_size)
+            memcpy(cur, pt->window, pt->window_size);
+        cur += pt->window_size;
     }
 
     return get_blob_size(index);
 }
 
-struct gzip_index* blob_to_index(void* buf)
+static struct gzip_index* alloc_index(unsigned size, off_t span_size)
 {
-    if (buf == NULL)
+    struct gzip_index* index = malloc(sizeof(struct gzip_index));
+    if (index == NULL)
     {
         return NULL;
     }
-
-    struct gzip_index* index = malloc(sizeof(struct gzip_index));
-    if (index == NULL)
+    index->list = calloc(size, sizeof(struct gzip_index_point));
+    if (index->list == NULL)
     {
+        free(index);
         return NULL;
     }
+    index->have = 0;
+    index->size = size;
+    index->span_size = span_size;
+    return index;
+}
 
+static struct gzip_index* legacy_blob_to_index(uchar* cur, unsigned len)
+{
     unsigned size;
     off_t span_size;
 
-    uchar* cur = buf;
     memcpy(&size, cur, 4);
     cur += 4;
     memcpy(&span_size, cur, 8);
     cur += 8;
+    if (size == 0 || len != LEGACY_BLOB_HEADER_SIZE + (size - 1) * LEGACY_BLOB_ENTRY_SIZE)
+    {
+        return NULL;
+    }
 
-    index->list = malloc(sizeof(struct gzip_index_point) * size);
-    if (index->list == NULL)
+    struct gzip_index* index = alloc_index(size, span_size);
+    if (index == NULL)
     {
-        free_index(index);
         return NULL;
     }
 
@@ -581,7 +790,9 @@ struct gzip_index* blob_to_index(void* buf)
     // gzip header takes the first 10 bytes, so span 0 always starts at offset 10 in compressed file
     pt0->in = 10; 
     pt0->out = 0;
-    memset(pt0->window, 0, WINSIZE);
+    pt0->window_size = 0;
+    pt0->window = NULL;
+    index->have = 1;
 
     for(int i = 1; i < size; i++)
     {
@@ -592,13 +803,103 @@ struct gzip_index* blob_to_index(void* buf)
         cur += 8;
         memcpy(&pt->bits, cur, 1);
         cur += 1;
-        memcpy(&pt->window, cur, WINSIZE);
+        pt->window = malloc(WINSIZE);
+        if (pt->window == NULL)
+        {
+            free_index(index);
+            return NULL;
+        }
+        memcpy(pt->window, cur, WINSIZE);
+        pt->window_size = WINSIZE;
         cur += WINSIZE;
+        index->have++;
     }
 
-    index->have = size;
-    index->size = size;
-    index->span_size = span_size;
+    return index;
+}
+
+struct gzip_index* blob_to_index(void* buf, unsigned len)
+{
+    if (buf == NULL || len < LEGACY_BLOB_HEADER_SIZE)
+    {
+        return NULL;
+    }
 
+    uchar* cur = buf;
+    uchar* end = cur + len;
+    uint32_t marker, version;
+    memcpy(&marker, cur, 4);
+    if (marker != 0)
+    {
+        return legacy_blob_to_index(cur, len);
+    }
+    if (len < BLOB_HEADER_SIZE)
+    {
+        return NULL;
+    }
+    cur += 4;
+    memcpy(&version, cur, 4);
+    cur += 4;
+    if (version != BLOB_VERSION)
+    {
+        return NULL;
+    }
+
+    unsigned size;
+    off_t span_size;
+    memcpy(&size, cur, 4);
+    cur += 4;
+    memcpy(&span_size, cur, 8);
+    cur += 8;
+    if (size == 0 || size > (len - BLOB_HEADER_SIZE) / BLOB_ENTRY_HEADER_SIZE)
+    {
+        return NULL;
+    }
+
+    struct gzip_index* index = alloc_index(size, span_size);
+    if (index == NULL)
+    {
+        return NULL;
+    }
+
+    for(int i = 0; i < size; i++)
+    {
+        struct gzip_index_point* pt = &index->list[i];
+        if (end - cur < BLOB_ENTRY_HEADER_SIZE)
+        {
+            goto blob_error;
+        }
+        memcpy(&pt->in, cur, 8);
+        cur += 8;
+        memcpy(&pt->out, cur, 8);
+        cur += 8;
+        memcpy(&pt->bits, cur, 1);
+        cur += 1;
+        memcpy(&pt->window_size, cur, 4);
+        cur += 4;
+        if (pt->window_size > WINSIZE || end - cur < pt->window_size)
+        {
+            goto blob_error;
+        }
+        if (pt->window_size)
+        {
+            pt->window = malloc(pt->window_size);
+            if (pt->window == NULL)
+            {
+                goto blob_error;
+            }
+            memcpy(pt->window, cur, pt->window_size);
+            cur += pt->window_size;
+        }
+        index->have++;
+    }
+    if (cur != end)
+    {
+        goto blob_error;
+    }
     return index;
+
+  blob_error:
+    free_index(index);
+    return NULL;
 }
@@ -67,7 +67,11 @@ struct gzip_index_point
     off_t out;          /* corresponding offset in uncompressed data */
     off_t in;           /* offset in input file of first full byte */
     uint8_t bits;           /* number of bits (1-7) from byte at in - 1, or 0 */
-    unsigned char window[WINSIZE];  /* preceding 32K of uncompressed data */    
+    unsigned window_size;   /* size of window: WINSIZE if it is stored as is,
+                               0 at the start of the stream, where there is no
+                               preceding data, and the compressed size otherwise */
+    unsigned char *window;  /* preceding 32K of uncompressed data, compressed with
+                               zlib unless window_size is WINSIZE */
 };
 
 struct gzip_index 
@@ -84,8 +88,53 @@ struct gzip_index
 */
 int pt_index_from_ucmp_offset(struct gzip_index* index, off_t off);
 
-int generate_index_fp(FILE* fp, off_t span, struct gzip_index** index);
-int generate_index(const char* filepath, off_t span, struct gzip_index** index);
+/* State of an index being built from a gzip stream which is provided
+   incrementally, e.g. while it is being downloaded */
+struct gzip_index_builder
+{
+    z_stream strm;
+    off_t totin;        /* compressed bytes consumed so far */
+    off_t totout;       /* uncompressed bytes produced so far */
+    off_t last;         /* totout value of last access point */
+    off_t span;
+    unsigned pos;       /* position of the next uncompressed byte in window */
+    int done;           /* whether the end of the gzip stream was reached */
+    int manual;         /* whether access points after the first one are added by the caller
+                           with index_builder_add_point instead of every span bytes */
+    int at_block_end;   /* whether inflation stopped at the end of a block, where the caller
+                           may add an access point */
+    struct gzip_index *index;   /* access points found so far, or NULL */
+    unsigned char window[WINSIZE];  /* sliding window of uncompressed data */
+};
+
+int init_index_builder(off_t span, struct gzip_index_builder** builder);
+
+/* Inflates in_len bytes of compressed data from in and copies at most out_len
+   bytes of uncompressed data to out. Returns right after adding an access point
+   to the index, so that all consumed input precedes the new access point.
+   Sets consumed and produced to the number of input bytes consumed and output
+   bytes produced. Returns Z_STREAM_END at the end of the gzip stream, Z_OK
+   otherwise or a zlib error.
+*/
+int index_builder_inflate(struct gzip_index_builder* builder, void* in, unsigned in_len, unsigned* consumed,
+    void* out, unsigned out_len, unsigned* produced);
+
+/* Adds an access point where inflation stopped, which must be the end of a block
+   as reported by at_block_end. Only used by manual builders, which stop at the end
+   of every block. Returns GZIP_INDEXER_OK or a zlib error.
+*/
+int index_builder_add_point(struct gzip_index_builder* builder);
+
+/* Moves the index out of the builder once the end of the gzip stream was reached.
+   Returns the number of access points or a zlib error. The builder must still be freed.
+*/
+int index_builder_finish(struct gzip_index_builder* builder, struct gzip_index** index);
+/* Continues with the gzip member following the one whose end was reached, for
+   layers made of several members. The input passed to the next call must start
+   with the header of that member. Returns Z_OK or a zlib error.
+*/
+int index_builder_next_member(struct gzip_index_builder* builder);
+void free_index_builder(struct gzip_index_builder* builder);
 
 // TODO: Improve this
 int extract_data_from_buffer(void* d, off_t datalen, struct gzip_index* index, off_t offset, void* buffer, off_t len, int first_point_index);
@@ -94,6 +143,12 @@ int extract_data(const char* file, struct gzip_index* index, off_t offset, void*
 
 
 int has_bits(struct gzip_index* index, int point_index);
+
+/* Expands the window of an access point into window, which must be able to hold
+   WINSIZE bytes. Returns the size of the window, 0 if the access point has no
+   window or a zlib error.
+*/
+int get_window(struct gzip_index* index, int point_index, void* window);
 off_t get_ucomp_off(struct gzip_index* index, int point_index);
 off_t get_comp_off(struct gzip_index* index, int point_index);
 
@@ -113,7 +168,7 @@ unsigned get_blob_size(struct gzip_index* index);
    to hold the entire index
 */ 
 int index_to_blob(struct gzip_index* index, void* buf);
-struct gzip_index* blob_to_index(void* buf);
+struct gzip_index* blob_to_index(void* buf, unsigned len);
 
 void free_index(struct gzip_index *index);
 
@@ -4,6 +4,7 @@ go 1.17
 
 require (
 	github.com/awslabs/soci-snapshotter v0.0.0-local
+	github.com/containerd/console v1.0.3
 	github.com/containerd/containerd v1.6.8
 	github.com/containerd/go-cni v1.1.6
 	github.com/coreos/go-systemd/v22 v22.3.2
@@ -31,7 +32,6 @@ require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/containerd/cgroups v1.0.3 // indirect
-	github.com/containerd/console v1.0.3 // indirect
 	github.com/containerd/continuity v0.2.2 // indirect
 	github.com/containerd/fifo v1.0.0 // indirect
 	github.com/containerd/ttrpc v1.1.0 // indirect
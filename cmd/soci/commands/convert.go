@@ -0,0 +1,143 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/platforms"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// ConvertCommand converts an image into a new image whose gzip layers are recompressed with
+// a full flush at the start of every span, and creates the SOCI index of the new image.
+// The spans of the new layers can be decompressed on their own, so their zTOCs need no windows.
+var ConvertCommand = cli.Command{
+	Name:      "convert",
+	Usage:     "convert an image to lazily load its layers without decompression windows, and create its SOCI index",
+	ArgsUsage: "[flags] <src_ref> <dst_ref>",
+	Flags: append([]cli.Flag{
+		cli.Int64Flag{
+			Name:  spanSizeFlag,
+			Usage: "Span size of index. Default is 4 MiB",
+			Value: 1 << 22,
+		},
+		cli.Int64Flag{
+			Name:  minLayerSizeFlag,
+			Usage: "The minimum layer size in bytes to convert and build zTOC for. Smaller layers are left as is and marked in the index for the snapshotter to download eagerly. Default is 0.",
+			Value: 0,
+		},
+		cli.BoolFlag{
+			Name:  createORASManifestFlag,
+			Usage: "If set, will create an ORAS manifest instead of an OCI Artifact manifest. Default is false.",
+		},
+		cli.BoolFlag{
+			Name:  imageManifestFlag,
+			Usage: "If set, create the SOCI index as an OCI 1.1 image manifest with a subject, which registries supporting OCI 1.1 list in the referrers of the image. Default is false.",
+		},
+		cli.BoolFlag{
+			Name:  fileDigestsFlag,
+			Usage: "If set, record the digest of each regular file in the zTOCs, so that file contents can be verified when read. Default is false.",
+		},
+	}, platformFlags...),
+	Action: func(cliContext *cli.Context) error {
+		srcRef := cliContext.Args().Get(0)
+		dstRef := cliContext.Args().Get(1)
+		if srcRef == "" || dstRef == "" {
+			return errors.New("source and destination images need to be specified")
+		}
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		cs := client.ContentStore()
+		srcImg, err := client.ImageService().Get(ctx, srcRef)
+		if err != nil {
+			return err
+		}
+		ps, err := getPlatforms(ctx, cliContext, cs, srcImg)
+		if err != nil {
+			return err
+		}
+		manifestType, err := getManifestType(cliContext)
+		if err != nil {
+			return err
+		}
+		blobStore, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+
+		spanSize := cliContext.Int64(spanSizeFlag)
+		opts := []soci.BuildOption{
+			soci.WithMinLayerSize(cliContext.Int64(minLayerSizeFlag)),
+			soci.WithBuildToolIdentifier(buildToolIdentifier),
+			soci.WithBuildToolVersion(buildToolVersion),
+			soci.WithManifestType(manifestType),
+		}
+		if cliContext.Bool(fileDigestsFlag) {
+			opts = append(opts, soci.WithFileDigests())
+		}
+		convertLayer, err := soci.ConvertLayerFunc(spanSize, blobStore, opts...)
+		if err != nil {
+			return err
+		}
+		dstImg, err := converter.Convert(ctx, client, dstRef, srcRef,
+			converter.WithLayerConvertFunc(convertLayer),
+			converter.WithPlatform(platforms.Any(ps...)))
+		if err != nil {
+			return fmt.Errorf("cannot convert image %s: %w", srcRef, err)
+		}
+		fmt.Printf("image %s converted to %s\n", srcRef, dstRef)
+
+		// the zTOCs of the converted layers were built while converting them, and are reused
+		for _, platform := range ps {
+			display := &plainProgress{out: os.Stdout}
+			platformOpts := append([]soci.BuildOption{soci.WithPlatform(platform), soci.WithProgress(display)}, opts...)
+			sociIndexWithMetadata, err := soci.BuildSociIndex(ctx, cs, *dstImg, spanSize, blobStore, platformOpts...)
+			if err != nil {
+				return fmt.Errorf("could not build SOCI index for platform %s: %w", platforms.Format(platform), err)
+			}
+			if err := soci.WriteSociIndex(ctx, *sociIndexWithMetadata, blobStore); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// getManifestType returns the type of the manifest of the SOCI index selected by the
+// `--oras` and `--image-manifest` flags.
+func getManifestType(cliContext *cli.Context) (soci.ManifestType, error) {
+	switch {
+	case cliContext.Bool(createORASManifestFlag) && cliContext.Bool(imageManifestFlag):
+		return 0, fmt.Errorf("--%s and --%s cannot be used together", createORASManifestFlag, imageManifestFlag)
+	case cliContext.Bool(createORASManifestFlag):
+		return soci.ManifestORAS, nil
+	case cliContext.Bool(imageManifestFlag):
+		return soci.ManifestOCIImage, nil
+	}
+	return soci.ManifestOCIArtifact, nil
+}
@@ -17,10 +17,23 @@
 package commands
 
 import (
+	"bufio"
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	"oras.land/oras-go/v2/content/oci"
@@ -33,8 +46,34 @@ const (
 	spanSizeFlag           = "span-size"
 	minLayerSizeFlag       = "min-layer-size"
 	createORASManifestFlag = "oras"
+	imageManifestFlag      = "image-manifest"
+	platformFlag           = "platform"
+	allPlatformsFlag       = "all-platforms"
+	signKeyFlag            = "sign-key"
+	noZtocReuseFlag        = "no-ztoc-reuse"
+	fileDigestsFlag        = "file-digests"
+	prefetchListFlag       = "prefetch-list"
+	spanPlacementFlag      = "span-placement"
+	ociLayoutFlag          = "oci-layout"
+	tarballFlag            = "tarball"
+	writeToLayoutFlag      = "write-to-layout"
+	remoteFlag             = "remote"
+	pushFlag               = "push"
+	concurrencyFlag        = "concurrency"
+	progressFlag           = "progress"
 )
 
+var platformFlags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  platformFlag + ", p",
+		Usage: "Platform(s) of the image manifests to use, e.g. linux/arm64. Can be repeated. Default is the platform of the host.",
+	},
+	cli.BoolFlag{
+		Name:  allPlatformsFlag,
+		Usage: "If set, use the image manifests of all platforms in the image. Default is false.",
+	},
+}
+
 // CreateCommand creates SOCI index for an image
 // Output of this command is SOCI layers and SOCI index stored in a local directory
 // SOCI layer is named as <image-layer-digest>.soci.layer
@@ -42,8 +81,8 @@ const (
 var CreateCommand = cli.Command{
 	Name:      "create",
 	Usage:     "create SOCI index",
-	ArgsUsage: "[flags] <image_ref>",
-	Flags: []cli.Flag{
+	ArgsUsage: "[flags] [<image_ref>]",
+	Flags: append([]cli.Flag{
 		cli.Int64Flag{
 			Name:  spanSizeFlag,
 			Usage: "Span size of index. Default is 4 MiB",
@@ -51,68 +90,321 @@ var CreateCommand = cli.Command{
 		},
 		cli.Int64Flag{
 			Name:  minLayerSizeFlag,
-			Usage: "The minimum layer size in bytes to build zTOC for. Default is 0.",
+			Usage: "The minimum layer size in bytes to build zTOC for. Smaller layers are marked in the index for the snapshotter to download eagerly. Default is 0.",
 			Value: 0,
 		},
 		cli.BoolFlag{
 			Name:  createORASManifestFlag,
 			Usage: "If set, will create an ORAS manifest instead of an OCI Artifact manifest. Default is false.",
 		},
-	},
+		cli.BoolFlag{
+			Name:  imageManifestFlag,
+			Usage: "If set, create the SOCI index as an OCI 1.1 image manifest with a subject, which registries supporting OCI 1.1 list in the referrers of the image. Default is false.",
+		},
+		cli.StringFlag{
+			Name:  signKeyFlag,
+			Usage: "Path to a PEM encoded private key. If set, the SOCI index is signed with the key.",
+		},
+		cli.BoolFlag{
+			Name:  fileDigestsFlag,
+			Usage: "If set, record the digest of each regular file in the zTOCs, so that file contents can be verified when read. Default is false.",
+		},
+		cli.StringFlag{
+			Name:  prefetchListFlag,
+			Usage: "Path to a file listing the files of the image to fetch first when the image is lazily loaded, one path per line, in order of priority.",
+		},
+		cli.StringFlag{
+			Name:  spanPlacementFlag,
+			Usage: "Where spans start: \"fixed\" starts a span every span-size bytes, \"file-boundary\" moves span starts up to span-size bytes further so that small files are in a single span.",
+			Value: string(soci.SpanPlacementFixed),
+		},
+		cli.StringFlag{
+			Name:  ociLayoutFlag,
+			Usage: "Path to an OCI image layout directory to read the image from instead of the containerd content store. The image reference is the name of the image in the layout, and can be omitted if the layout holds a single image.",
+		},
+		cli.StringFlag{
+			Name:  tarballFlag,
+			Usage: "Path to an image tarball written by docker save, or an OCI layout archive, to read the image from instead of the containerd content store. The image reference can be omitted if the tarball holds a single image.",
+		},
+		cli.BoolFlag{
+			Name:  writeToLayoutFlag,
+			Usage: "If set with --oci-layout, write the zTOCs and the SOCI index into the OCI image layout, as a referrer of the image manifest, instead of the local SOCI store. Default is false.",
+		},
+		cli.BoolFlag{
+			Name:  remoteFlag,
+			Usage: "If set, read the image from its registry instead of the containerd content store. Layers are streamed from the registry through the zTOC builder without being stored locally. Default is false.",
+		},
+		cli.StringFlag{
+			Name:  snapshotterConfigFlag,
+			Usage: "Path to the snapshotter config file, whose resolver config is used to access registries with --remote.",
+			Value: defaultSnapshotterConfigPath,
+		},
+		cli.BoolFlag{
+			Name:  pushFlag,
+			Usage: "If set with --remote, push the SOCI indices to the registry of the image once they are created. Default is false.",
+		},
+		cli.IntFlag{
+			Name:  concurrencyFlag,
+			Usage: "Maximum number of layers to build zTOCs for concurrently. Default is the number of CPUs.",
+		},
+		cli.StringFlag{
+			Name:  progressFlag,
+			Usage: "How to show the progress of the layers: \"tty\" redraws the state of each layer, \"plain\" prints a line per layer once done, \"json\" prints a JSON event per update. \"auto\" is tty if stdout is a terminal, plain otherwise.",
+			Value: progressAuto,
+		},
+		cli.BoolFlag{
+			Name:  noZtocReuseFlag,
+			Usage: "If set, build the zTOCs of all layers instead of reusing existing zTOCs built with the same parameters. Default is false.",
+		},
+	}, append(platformFlags, commands.RegistryFlags...)...),
 	Action: func(cliContext *cli.Context) error {
 		srcRef := cliContext.Args().Get(0)
-		if srcRef == "" {
-			return errors.New("source image needs to be specified")
+		layoutPath := cliContext.String(ociLayoutFlag)
+		tarballPath := cliContext.String(tarballFlag)
+		if layoutPath != "" && tarballPath != "" {
+			return fmt.Errorf("--%s and --%s cannot be used together", ociLayoutFlag, tarballFlag)
+		}
+		writeToLayout := cliContext.Bool(writeToLayoutFlag)
+		if writeToLayout && layoutPath == "" {
+			return fmt.Errorf("--%s requires --%s", writeToLayoutFlag, ociLayoutFlag)
+		}
+		remote := cliContext.Bool(remoteFlag)
+		if remote && (layoutPath != "" || tarballPath != "") {
+			return fmt.Errorf("--%s cannot be used with --%s or --%s", remoteFlag, ociLayoutFlag, tarballFlag)
+		}
+		push := cliContext.Bool(pushFlag)
+		if push && !remote {
+			return fmt.Errorf("--%s requires --%s", pushFlag, remoteFlag)
 		}
 
-		client, ctx, cancel, err := commands.NewClient(cliContext)
+		var (
+			ctx    context.Context
+			cancel context.CancelFunc
+			cs     content.Provider
+			srcImg images.Image
+			err    error
+		)
+		switch {
+		case layoutPath != "":
+			ctx, cancel = commands.AppContext(cliContext)
+			defer cancel()
+			layout, err := soci.NewOCILayout(layoutPath)
+			if err != nil {
+				return err
+			}
+			cs = layout
+			srcImg, err = layout.Resolve(ctx, srcRef)
+			if err != nil {
+				return err
+			}
+		case tarballPath != "":
+			ctx, cancel = commands.AppContext(cliContext)
+			defer cancel()
+			tarball, err := soci.OpenImageTarball(tarballPath)
+			if err != nil {
+				return err
+			}
+			defer tarball.Close()
+			cs = tarball
+			srcImg, err = tarball.Resolve(ctx, srcRef)
+			if err != nil {
+				return err
+			}
+		case remote:
+			if srcRef == "" {
+				return errors.New("source image needs to be specified")
+			}
+			ctx, cancel = commands.AppContext(cliContext)
+			defer cancel()
+			srcImg, cs, err = resolveRemoteImage(ctx, cliContext, srcRef)
+			if err != nil {
+				return err
+			}
+		default:
+			if srcRef == "" {
+				return errors.New("source image needs to be specified")
+			}
+			client, clientCtx, clientCancel, err := commands.NewClient(cliContext)
+			if err != nil {
+				return err
+			}
+			defer clientCancel()
+			ctx = clientCtx
+			cs = client.ContentStore()
+			srcImg, err = client.ImageService().Get(ctx, srcRef)
+			if err != nil {
+				return err
+			}
+		}
+		spanSize := cliContext.Int64(spanSizeFlag)
+		minLayerSize := cliContext.Int64(minLayerSizeFlag)
+		storePath := config.SociContentStorePath
+		if writeToLayout {
+			storePath = layoutPath
+		}
+		blobStore, err := oci.New(storePath)
 		if err != nil {
 			return err
 		}
-		defer cancel()
 
-		cs := client.ContentStore()
-		is := client.ImageService()
-		srcImg, err := is.Get(ctx, srcRef)
+		manifestType, err := getManifestType(cliContext)
 		if err != nil {
 			return err
 		}
-		spanSize := cliContext.Int64(spanSizeFlag)
-		minLayerSize := cliContext.Int64(minLayerSizeFlag)
-		blobStore, err := oci.New(config.SociContentStorePath)
+		if push && manifestType == soci.ManifestOCIArtifact {
+			return fmt.Errorf("--%s requires --%s or --%s, since OCI artifact manifests cannot be pushed", pushFlag, createORASManifestFlag, imageManifestFlag)
+		}
+
+		ps, err := getPlatforms(ctx, cliContext, cs, srcImg)
 		if err != nil {
 			return err
 		}
 
-		manifestType := soci.ManifestOCIArtifact
-		if cliContext.Bool(createORASManifestFlag) {
-			manifestType = soci.ManifestORAS
+		var signKey crypto.Signer
+		if path := cliContext.String(signKeyFlag); path != "" {
+			signKey, err = soci.LoadPrivateKey(path)
+			if err != nil {
+				return err
+			}
 		}
 
-		sociIndex, err := soci.BuildSociIndex(ctx, cs, srcImg, spanSize, blobStore,
-			soci.WithMinLayerSize(minLayerSize),
-			soci.WithBuildToolIdentifier(buildToolIdentifier),
-			soci.WithBuildToolVersion(buildToolVersion),
-			soci.WithManifestType(manifestType))
-
+		spanPlacement, err := soci.ParseSpanPlacement(cliContext.String(spanPlacementFlag))
 		if err != nil {
 			return err
 		}
 
-		sociIndexWithMetadata := soci.IndexWithMetadata{
-			Index:       sociIndex,
-			ImageDigest: srcImg.Target.Digest,
-			// TODO: This is not strictly correct because the default platform matcher used in BuildSociIndex
-			// might match a compatible version (i.e. linux/amd64 will match linux/i386). Building indices for
-			// multiple/non-default platforms will be needed at some point and this should be fixed with that change as well.
-			Platform: platforms.DefaultSpec(),
+		var prefetchFiles []string
+		if path := cliContext.String(prefetchListFlag); path != "" {
+			prefetchFiles, err = readPrefetchList(path)
+			if err != nil {
+				return err
+			}
 		}
 
-		err = soci.WriteSociIndex(ctx, sociIndexWithMetadata, blobStore)
-		if err != nil {
-			return err
+		concurrency := cliContext.Int(concurrencyFlag)
+		if concurrency <= 0 {
+			concurrency = runtime.NumCPU()
 		}
 
+		var indexDescriptors []soci.IndexDescriptorInfo
+		for _, platform := range ps {
+			opts := []soci.BuildOption{
+				soci.WithMinLayerSize(minLayerSize),
+				soci.WithBuildToolIdentifier(buildToolIdentifier),
+				soci.WithBuildToolVersion(buildToolVersion),
+				soci.WithManifestType(manifestType),
+				soci.WithPlatform(platform),
+				soci.WithSpanPlacement(spanPlacement),
+				soci.WithConcurrency(concurrency),
+			}
+			if cliContext.Bool(noZtocReuseFlag) {
+				opts = append(opts, soci.WithNoZtocReuse())
+			}
+			if cliContext.Bool(fileDigestsFlag) {
+				opts = append(opts, soci.WithFileDigests())
+			}
+			if len(prefetchFiles) > 0 {
+				opts = append(opts, soci.WithPrefetchFiles(prefetchFiles))
+			}
+			if writeToLayout {
+				opts = append(opts, soci.WithNoArtifactsDB())
+			}
+			display, err := newProgressDisplay(cliContext.String(progressFlag), platforms.Format(platform))
+			if err != nil {
+				return err
+			}
+			opts = append(opts, soci.WithProgress(display))
+			sociIndexWithMetadata, err := soci.BuildSociIndex(ctx, cs, srcImg, spanSize, blobStore, opts...)
+			display.Stop()
+			if err != nil {
+				return fmt.Errorf("could not build SOCI index for platform %s: %w", platforms.Format(platform), err)
+			}
+
+			if writeToLayout {
+				desc, err := soci.WriteSociIndexAsReferrer(ctx, *sociIndexWithMetadata, blobStore)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("soci index %s written to %s\n", desc.Digest, layoutPath)
+			} else {
+				err = soci.WriteSociIndex(ctx, *sociIndexWithMetadata, blobStore)
+				if err != nil {
+					return err
+				}
+			}
+
+			if signKey != nil {
+				if _, err := soci.SignSociIndex(ctx, blobStore, *sociIndexWithMetadata, signKey); err != nil {
+					return err
+				}
+			}
+
+			if push {
+				manifest, err := json.Marshal(sociIndexWithMetadata.Index)
+				if err != nil {
+					return err
+				}
+				indexDescriptors = append(indexDescriptors, soci.IndexDescriptorInfo{
+					Descriptor: ocispec.Descriptor{
+						MediaType: sociIndexWithMetadata.Index.MediaType,
+						Digest:    digest.FromBytes(manifest),
+						Size:      int64(len(manifest)),
+					},
+					Platform: platform,
+				})
+			}
+		}
+
+		if push {
+			return pushSociIndices(ctx, cliContext, srcRef, blobStore, indexDescriptors)
+		}
 		return nil
 	},
 }
+
+// readPrefetchList reads the files listed in a prefetch list, one path per line.
+// Empty lines and lines starting with '#' are ignored.
+func readPrefetchList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open prefetch list: %w", err)
+	}
+	defer f.Close()
+	var files []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read prefetch list: %w", err)
+	}
+	return files, nil
+}
+
+// getPlatforms returns the platforms selected by the `--platform` and `--all-platforms` flags.
+// If neither flag is set, the default platform is returned.
+func getPlatforms(ctx context.Context, cliContext *cli.Context, cs content.Provider, img images.Image) ([]ocispec.Platform, error) {
+	if cliContext.Bool(allPlatformsFlag) {
+		if len(cliContext.StringSlice(platformFlag)) != 0 {
+			return nil, fmt.Errorf("--%s and --%s cannot be used together", platformFlag, allPlatformsFlag)
+		}
+		return soci.GetImagePlatforms(ctx, cs, img)
+	}
+
+	var ps []ocispec.Platform
+	for _, p := range cliContext.StringSlice(platformFlag) {
+		platform, err := platforms.Parse(p)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse platform %s: %w", p, err)
+		}
+		ps = append(ps, platform)
+	}
+	if len(ps) == 0 {
+		ps = append(ps, platforms.DefaultSpec())
+	}
+	return ps, nil
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli"
+)
+
+const dryRunFlag = "dry-run"
+
+// GCCommand removes the SOCI artifacts which are no longer needed from the local store
+var GCCommand = cli.Command{
+	Name:  "gc",
+	Usage: "remove unused SOCI artifacts from the local store",
+	Description: `Remove the SOCI indices whose image no longer exists in containerd and
+the ztocs which are not referenced by any remaining index.`,
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  dryRunFlag,
+			Usage: "print the artifacts which would be removed without removing them",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+
+		is := client.ImageService()
+		cs := client.ContentStore()
+		imageExists := func(ae *soci.ArtifactEntry) (bool, error) {
+			if ae.ImageDigest == "" {
+				// entries written before the image digest was recorded
+				dgst, err := digest.Parse(ae.OriginalDigest)
+				if err != nil {
+					return false, nil
+				}
+				_, err = cs.Info(ctx, dgst)
+				if errdefs.IsNotFound(err) {
+					return false, nil
+				}
+				return err == nil, err
+			}
+			imgs, err := is.List(ctx, fmt.Sprintf("target.digest==%s", ae.ImageDigest))
+			if err != nil {
+				return false, err
+			}
+			return len(imgs) > 0, nil
+		}
+
+		removed, err := soci.GarbageCollect(ctx, db, config.SociContentStorePath, imageExists, cliContext.Bool(dryRunFlag))
+		for _, ae := range removed {
+			fmt.Printf("%s %s\n", ae.Type, ae.Digest)
+		}
+		return err
+	},
+}
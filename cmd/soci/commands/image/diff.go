@@ -0,0 +1,288 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+
+	// maxManifestSize is the maximum size of the image manifests, image indices and SOCI
+	// indices read from the registry.
+	maxManifestSize = 4 << 20
+)
+
+// diffResult is the result of `soci image diff` printed with --format json.
+type diffResult struct {
+	Changes []soci.FileChange `json:"changes"`
+	// UnindexedLayers are the layers without a ztoc, whose files aren't compared.
+	UnindexedLayers []string `json:"unindexedLayers,omitempty"`
+}
+
+var diffCommand = cli.Command{
+	Name:      "diff",
+	Usage:     "compare the files of two images from their SOCI indices, without downloading their layers",
+	ArgsUsage: "[flags] <ref_a> <ref_b>",
+	Description: `Compare the files of two images in their registries.
+
+Only the image manifests, the SOCI indices and their zTOCs are fetched: the files of each
+image are the merged view of the files recorded in the zTOCs of its layers, with the
+whiteouts of each layer applied to the layers below it. Files are compared by name, type,
+size, mode, modification time, owner, link target and xattrs, and by contents when both
+zTOCs recorded file digests. The files of layers without a zTOC are unknown, and are listed
+as unindexed.
+`,
+	Flags: append(commands.RegistryFlags,
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Compare the images of the given platform. Default is the platform of the host.",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, either text or json",
+			Value: formatText,
+		},
+	),
+	Action: func(cliContext *cli.Context) error {
+		format := cliContext.String("format")
+		if format != formatText && format != formatJSON {
+			return fmt.Errorf("unknown output format %q", format)
+		}
+		refA := cliContext.Args().Get(0)
+		refB := cliContext.Args().Get(1)
+		if refA == "" || refB == "" {
+			return errors.New("please provide two image references")
+		}
+		platform := platforms.DefaultSpec()
+		if p := cliContext.String("platform"); p != "" {
+			var err error
+			platform, err = platforms.Parse(p)
+			if err != nil {
+				return err
+			}
+		}
+		ctx, cancel := commands.AppContext(cliContext)
+		defer cancel()
+
+		layersA, err := fetchLayerZtocs(ctx, cliContext, refA, platform)
+		if err != nil {
+			return err
+		}
+		layersB, err := fetchLayerZtocs(ctx, cliContext, refB, platform)
+		if err != nil {
+			return err
+		}
+		result := diffResult{
+			Changes: soci.DiffImageFiles(soci.MergeLayerFiles(layersA), soci.MergeLayerFiles(layersB)),
+		}
+		if result.Changes == nil {
+			result.Changes = []soci.FileChange{}
+		}
+		for _, layers := range [][]soci.LayerZtoc{layersA, layersB} {
+			for _, l := range layers {
+				if l.Ztoc == nil {
+					result.UnindexedLayers = append(result.UnindexedLayers, l.Layer.String())
+				}
+			}
+		}
+
+		if format == formatJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(result)
+		}
+		for _, l := range result.UnindexedLayers {
+			fmt.Fprintf(os.Stderr, "warning: layer %s has no ztoc, its files are not compared\n", l)
+		}
+		for _, c := range result.Changes {
+			fmt.Println(c)
+		}
+		return nil
+	},
+}
+
+// fetchLayerZtocs fetches the ztocs of the layers of the image manifest of the platform of the
+// image ref from its registry, with the SOCI index referring to the manifest. No layer is fetched.
+func fetchLayerZtocs(ctx context.Context, cliContext *cli.Context, ref string, platform ocispec.Platform) ([]soci.LayerZtoc, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := newRepository(cliContext, refspec)
+	if err != nil {
+		return nil, err
+	}
+	object := refspec.Object
+	if dgst := refspec.Digest(); dgst != "" {
+		object = dgst.String()
+	}
+	desc, err := repo.Resolve(ctx, object)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s: %w", ref, err)
+	}
+	if images.IsIndexType(desc.MediaType) {
+		var index ocispec.Index
+		if err := fetchJSON(ctx, repo, desc, &index); err != nil {
+			return nil, err
+		}
+		desc, err = selectPlatformManifest(index.Manifests, platforms.Only(platform))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", ref, err)
+		}
+	}
+	var manifest ocispec.Manifest
+	if err := fetchJSON(ctx, repo, desc, &manifest); err != nil {
+		return nil, err
+	}
+
+	referrers, err := soci.ListReferrers(ctx, repo, desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list referrers of image manifest %v: %w", desc.Digest, err)
+	}
+	var indexDesc *ocispec.Descriptor
+	for _, r := range referrers {
+		if r.ArtifactType == soci.SociIndexArtifactType {
+			d := r.Descriptor()
+			indexDesc = &d
+			break
+		}
+	}
+	if indexDesc == nil {
+		return nil, fmt.Errorf("no SOCI index found for image manifest %v of %s", desc.Digest, ref)
+	}
+	var index soci.Index
+	if err := fetchJSON(ctx, repo, *indexDesc, &index); err != nil {
+		return nil, err
+	}
+
+	layers := make([]soci.LayerZtoc, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		l := soci.LayerZtoc{Layer: layer.Digest}
+		for _, blob := range index.Blobs {
+			if blob.Annotations[soci.IndexAnnotationImageLayerDigest] != layer.Digest.String() || soci.IsEagerLayer(blob) {
+				continue
+			}
+			l.Ztoc, err = fetchZtoc(ctx, repo, blob)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+		layers = append(layers, l)
+	}
+	return layers, nil
+}
+
+// newRepository returns the repository of refspec in its registry, accessed with the
+// credentials of the --user flag or, if it isn't set, of the docker config.
+func newRepository(cliContext *cli.Context, refspec reference.Spec) (*remote.Repository, error) {
+	repo, err := remote.NewRepository(refspec.Locator)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create repository %s: %w", refspec.Locator, err)
+	}
+	username := cliContext.String("user")
+	var secret string
+	if i := strings.IndexByte(username, ':'); i > 0 {
+		secret = username[i+1:]
+		username = username[0:i]
+	}
+	authClient := auth.DefaultClient
+	authClient.Cache = auth.DefaultCache
+	authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
+		if username != "" {
+			return auth.Credential{Username: username, Password: secret}, nil
+		}
+		username, secret, err := dockerconfig.DockerCreds(host)
+		if err != nil {
+			return auth.EmptyCredential, err
+		}
+		if username == "" && secret != "" {
+			return auth.Credential{RefreshToken: secret}, nil
+		}
+		return auth.Credential{Username: username, Password: secret}, nil
+	}
+	repo.Client = authClient
+	repo.PlainHTTP = cliContext.Bool("plain-http")
+	return repo, nil
+}
+
+// selectPlatformManifest returns the descriptor of the manifest of the best platform matching platform.
+func selectPlatformManifest(manifests []ocispec.Descriptor, platform platforms.MatchComparer) (ocispec.Descriptor, error) {
+	var selected *ocispec.Descriptor
+	for i, m := range manifests {
+		if m.Platform == nil || !platform.Match(*m.Platform) {
+			continue
+		}
+		if selected == nil || platform.Less(*m.Platform, *selected.Platform) {
+			selected = &manifests[i]
+		}
+	}
+	if selected == nil {
+		return ocispec.Descriptor{}, errors.New("no image manifest matches the platform")
+	}
+	return *selected, nil
+}
+
+// fetchJSON fetches the manifest described by desc from repo, and decodes it into v.
+func fetchJSON(ctx context.Context, repo *remote.Repository, desc ocispec.Descriptor, v interface{}) error {
+	rc, err := repo.Fetch(ctx, desc)
+	if err != nil {
+		return fmt.Errorf("cannot fetch %v: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, maxManifestSize))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("cannot decode %v: %w", desc.Digest, err)
+	}
+	return nil
+}
+
+func fetchZtoc(ctx context.Context, repo *remote.Repository, desc ocispec.Descriptor) (*soci.Ztoc, error) {
+	rc, err := repo.Blobs().Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch ztoc %v: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	ztoc, err := soci.GetZtoc(rc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read ztoc %v: %w", desc.Digest, err)
+	}
+	return ztoc, nil
+}
@@ -24,5 +24,7 @@ var Command = cli.Command{
 	Subcommands: []cli.Command{
 		rpullCommand,
 		listIndicesCommand,
+		diffCommand,
+		inspectCommand,
 	},
 }
@@ -0,0 +1,185 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package image
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// inspectResult is the result of `soci image inspect` printed with --format json.
+type inspectResult struct {
+	Image    string             `json:"image"`
+	Platform string             `json:"platform"`
+	Manifest digest.Digest      `json:"manifest"`
+	Index    digest.Digest      `json:"index"`
+	Layers   []soci.LayerReport `json:"layers"`
+	// FullDownloadLayers are the layers without a ztoc, which are downloaded as a whole.
+	FullDownloadLayers []digest.Digest `json:"fullDownloadLayers"`
+}
+
+var inspectCommand = cli.Command{
+	Name:      "inspect",
+	Usage:     "report how the layers of an image are lazily loaded with its SOCI index",
+	ArgsUsage: "[flags] <ref>",
+	Description: `Report, for each layer of the image, its size, its zTOC and the zTOC size, the number
+of spans and the span size, the number of files, and the ratio of the zTOC size to the
+layer size. Layers without a zTOC, which are downloaded as a whole when the image is
+mounted, are listed at the end. If the image has several SOCI indices, the most recent
+one is inspected.
+`,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "platform",
+			Usage: "Inspect the SOCI index of the given platform. Default is the platform of the host.",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, either text or json",
+			Value: formatText,
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		format := cliContext.String("format")
+		if format != formatText && format != formatJSON {
+			return fmt.Errorf("unknown output format %q", format)
+		}
+		ref := cliContext.Args().First()
+		if ref == "" {
+			return errors.New("please provide an image reference")
+		}
+		platform := platforms.DefaultSpec()
+		if p := cliContext.String("platform"); p != "" {
+			var err error
+			platform, err = platforms.Parse(p)
+			if err != nil {
+				return err
+			}
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+		cs := client.ContentStore()
+		img, err := client.ImageService().Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+
+		manifestDesc, err := soci.GetImageManifestDescriptor(ctx, cs, img, platforms.Only(platform))
+		if err != nil {
+			return err
+		}
+		b, err := content.ReadBlob(ctx, cs, *manifestDesc)
+		if err != nil {
+			return err
+		}
+		var manifest ocispec.Manifest
+		if err := json.Unmarshal(b, &manifest); err != nil {
+			return fmt.Errorf("cannot decode image manifest %v: %w", manifestDesc.Digest, err)
+		}
+
+		indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img, []ocispec.Platform{platform})
+		if err != nil {
+			return err
+		}
+		if len(indexDescriptors) == 0 {
+			return fmt.Errorf("could not find any soci index for %s and platform %s", ref, platforms.Format(platform))
+		}
+		indexDesc := indexDescriptors[len(indexDescriptors)-1]
+		store, err := oci.New(config.SociContentStorePath)
+		if err != nil {
+			return err
+		}
+		rc, err := store.Fetch(ctx, indexDesc.Descriptor)
+		if err != nil {
+			return fmt.Errorf("cannot fetch soci index %v: %w", indexDesc.Digest, err)
+		}
+		defer rc.Close()
+		index, err := soci.NewIndexFromReader(rc)
+		if err != nil {
+			return err
+		}
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+		reports, err := soci.InspectIndex(ctx, manifest, index, store, db)
+		if err != nil {
+			return err
+		}
+
+		result := inspectResult{
+			Image:              img.Name,
+			Platform:           platforms.Format(platform),
+			Manifest:           manifestDesc.Digest,
+			Index:              indexDesc.Digest,
+			Layers:             reports,
+			FullDownloadLayers: []digest.Digest{},
+		}
+		for _, r := range reports {
+			if !r.LazilyLoaded() {
+				result.FullDownloadLayers = append(result.FullDownloadLayers, r.Layer)
+			}
+		}
+		if format == formatJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(result)
+		}
+
+		fmt.Printf("soci index %v for image manifest %v (%s)\n\n", result.Index, result.Manifest, result.Platform)
+		writer := tabwriter.NewWriter(os.Stdout, 8, 8, 4, ' ', 0)
+		writer.Write([]byte("LAYER\tSIZE\tZTOC\tZTOC SIZE\tSPANS\tSPAN SIZE\tFILES\tZTOC/LAYER\t\n"))
+		for _, r := range reports {
+			if !r.LazilyLoaded() {
+				writer.Write([]byte(fmt.Sprintf("%s\t%d\t-\t-\t-\t-\t-\t-\t\n", r.Layer, r.Size)))
+				continue
+			}
+			spanSize := "-"
+			if r.SpanSize != 0 {
+				spanSize = fmt.Sprint(r.SpanSize)
+			}
+			writer.Write([]byte(fmt.Sprintf("%s\t%d\t%s\t%d\t%d\t%s\t%d\t%.2f%%\t\n",
+				r.Layer, r.Size, r.Ztoc, r.ZtocSize, r.Spans, spanSize, r.Files, r.ZtocRatio*100)))
+		}
+		writer.Flush()
+
+		if len(result.FullDownloadLayers) > 0 {
+			fmt.Printf("\nlayers downloaded as a whole:\n")
+			for _, l := range result.FullDownloadLayers {
+				fmt.Println(l)
+			}
+		}
+		return nil
+	},
+}
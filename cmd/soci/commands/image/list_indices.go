@@ -48,7 +48,7 @@ var listIndicesCommand = cli.Command{
 			return err
 		}
 
-		indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img)
+		indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img, nil)
 		if err != nil {
 			return err
 		}
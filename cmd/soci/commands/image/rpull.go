@@ -69,7 +69,7 @@ command.
 		// This is a standin for the snapshotter receiving the index digest from container runtimes.
 		cli.StringFlag{
 			Name:  "soci-index-digest",
-			Usage: "The SOCI index digest.",
+			Usage: "The SOCI index digest. If not set, the snapshotter discovers the index from the image manifest.",
 		},
 	), commands.SnapshotterFlags...),
 	Action: func(context *cli.Context) error {
@@ -84,7 +84,7 @@ command.
 		sociIndexDigest := context.String("soci-index-digest")
 
 		if sociIndexDigest == "" {
-			fmt.Printf("unable to find SOCI index digest for %v: the container image will be pulled in non-SOCI mode\n", ref)
+			fmt.Printf("no SOCI index digest given for %v: the snapshotter will look for an index referring to the image\n", ref)
 		} else {
 			fmt.Printf("using SOCI index digest: %v\n", sociIndexDigest)
 		}
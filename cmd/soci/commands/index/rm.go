@@ -0,0 +1,70 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/urfave/cli"
+)
+
+var rmCommand = cli.Command{
+	Name:      "rm",
+	Aliases:   []string{"remove"},
+	Usage:     "remove indices",
+	ArgsUsage: "<digest> [<digest>...]",
+	Description: "remove indices from the local store, along with their signatures. The ztocs of a removed " +
+		"index are kept, use `soci gc` to remove the ztocs which are no longer referenced by any index",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the indices which would be removed without removing them",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		args := cliContext.Args()
+		if len(args) == 0 {
+			return errors.New("please provide at least one index digest")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cliContext.GlobalDuration("timeout"))
+		defer cancel()
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+		for _, digest := range args {
+			ae, err := db.GetArtifactEntry(digest)
+			if err != nil {
+				return err
+			}
+			if ae.Type != soci.ArtifactEntryTypeIndex {
+				return fmt.Errorf("%s is not an index", digest)
+			}
+			if !cliContext.Bool("dry-run") {
+				if err := soci.RemoveIndex(ctx, db, config.SociContentStorePath, ae); err != nil {
+					return err
+				}
+			}
+			fmt.Println(digest)
+		}
+		return nil
+	},
+}
@@ -0,0 +1,204 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/console"
+	"github.com/containerd/containerd/pkg/progress"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	progressAuto  = "auto"
+	progressTTY   = "tty"
+	progressPlain = "plain"
+	progressJSON  = "json"
+)
+
+// progressDisplay shows the progress of the build of a SOCI index.
+// Stop must be called once the build is done.
+type progressDisplay interface {
+	soci.ProgressReporter
+	Stop()
+}
+
+// newProgressDisplay returns the progress display of the given mode, writing to stdout.
+// The auto mode is tty if stdout is a terminal, and plain otherwise.
+func newProgressDisplay(mode string, platform string) (progressDisplay, error) {
+	if mode == progressAuto {
+		mode = progressPlain
+		if _, err := console.ConsoleFromFile(os.Stdout); err == nil {
+			mode = progressTTY
+		}
+	}
+	switch mode {
+	case progressTTY:
+		return newTTYProgress(os.Stdout), nil
+	case progressPlain:
+		return &plainProgress{out: os.Stdout}, nil
+	case progressJSON:
+		return &jsonProgress{enc: json.NewEncoder(os.Stdout), platform: platform}, nil
+	}
+	return nil, fmt.Errorf("unknown progress mode %q, must be %s, %s, %s or %s", mode, progressAuto, progressTTY, progressPlain, progressJSON)
+}
+
+// plainProgress prints a line for each layer once its ztoc is done.
+type plainProgress struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func (p *plainProgress) ReportLayerProgress(lp soci.LayerProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch lp.State {
+	case soci.LayerStateBuilt:
+		fmt.Fprintf(p.out, "layer %s -> ztoc %s\n", lp.Layer.Digest, lp.Ztoc.Digest)
+	case soci.LayerStateReused:
+		fmt.Fprintf(p.out, "layer %s -> ztoc %s (reused)\n", lp.Layer.Digest, lp.Ztoc.Digest)
+	case soci.LayerStateSkipped:
+		fmt.Fprintf(p.out, "layer %s -> ztoc skipped, marked for eager download\n", lp.Layer.Digest)
+	}
+}
+
+func (p *plainProgress) Stop() {}
+
+// progressEvent is the JSON event emitted for each progress report.
+type progressEvent struct {
+	Platform       string        `json:"platform"`
+	Layer          digest.Digest `json:"layer"`
+	Size           int64         `json:"size"`
+	State          string        `json:"state"`
+	BytesProcessed int64         `json:"bytes_processed"`
+	Ztoc           digest.Digest `json:"ztoc,omitempty"`
+	Error          string        `json:"error,omitempty"`
+}
+
+// jsonProgress emits each progress report as a JSON event on its own line.
+type jsonProgress struct {
+	mu       sync.Mutex
+	enc      *json.Encoder
+	platform string
+}
+
+func (p *jsonProgress) ReportLayerProgress(lp soci.LayerProgress) {
+	ev := progressEvent{
+		Platform:       p.platform,
+		Layer:          lp.Layer.Digest,
+		Size:           lp.Layer.Size,
+		State:          string(lp.State),
+		BytesProcessed: lp.BytesProcessed,
+	}
+	if lp.Ztoc != nil {
+		ev.Ztoc = lp.Ztoc.Digest
+	}
+	if lp.Err != nil {
+		ev.Error = lp.Err.Error()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.enc.Encode(ev)
+}
+
+func (p *jsonProgress) Stop() {}
+
+// ttyProgress redraws the state of all layers periodically, with a progress bar for the
+// layers being built.
+type ttyProgress struct {
+	mu     sync.Mutex
+	pw     *progress.Writer
+	layers []digest.Digest
+	status map[digest.Digest]soci.LayerProgress
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newTTYProgress(out io.Writer) *ttyProgress {
+	p := &ttyProgress{
+		pw:     progress.NewWriter(out),
+		status: make(map[digest.Digest]soci.LayerProgress),
+		done:   make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(100 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.render()
+			case <-p.done:
+				p.render()
+				return
+			}
+		}
+	}()
+	return p
+}
+
+func (p *ttyProgress) ReportLayerProgress(lp soci.LayerProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.status[lp.Layer.Digest]; !ok {
+		p.layers = append(p.layers, lp.Layer.Digest)
+	}
+	p.status[lp.Layer.Digest] = lp
+}
+
+func (p *ttyProgress) Stop() {
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *ttyProgress) render() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	tw := tabwriter.NewWriter(p.pw, 1, 8, 1, ' ', 0)
+	for _, dgst := range p.layers {
+		lp := p.status[dgst]
+		switch lp.State {
+		case soci.LayerStateBuilding:
+			var bar progress.Bar
+			if lp.Layer.Size > 0 {
+				bar = progress.Bar(float64(lp.BytesProcessed) / float64(lp.Layer.Size))
+			}
+			fmt.Fprintf(tw, "layer %s:\t%s\t%40r\t%8.8s/%s\t\n",
+				dgst, lp.State, bar,
+				progress.Bytes(lp.BytesProcessed), progress.Bytes(lp.Layer.Size))
+		case soci.LayerStateBuilt, soci.LayerStateReused:
+			fmt.Fprintf(tw, "layer %s:\t%s\tztoc %s\t\t\n", dgst, lp.State, lp.Ztoc.Digest)
+		case soci.LayerStateSkipped:
+			fmt.Fprintf(tw, "layer %s:\t%s\tmarked for eager download\t\t\n", dgst, lp.State)
+		case soci.LayerStateFailed:
+			fmt.Fprintf(tw, "layer %s:\t%s\t%v\t\t\n", dgst, lp.State, lp.Err)
+		default:
+			fmt.Fprintf(tw, "layer %s:\t%s\t\t\t\n", dgst, lp.State)
+		}
+	}
+	tw.Flush()
+	p.pw.Flush()
+}
@@ -25,7 +25,9 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/config"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/containerd/containerd/platforms"
 	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/urfave/cli"
 	oraslib "oras.land/oras-go/v2"
@@ -40,7 +42,11 @@ var PushCommand = cli.Command{
 	Usage:     "push SOCI artifacts to a registry",
 	ArgsUsage: "[flags] <ref>",
 	Description: `Push SOCI artifacts to a registry by image reference.
-If multiple soci indices exist for the given image, the most recent one will be pushed.
+By default, the SOCI indices of all platforms of the image are pushed. Use --platform to
+push only the indices of specific platforms.
+If multiple soci indices exist for the given image and platform, the most recent one will be pushed.
+The signature of an index, created by "soci create --sign-key" or by "soci push --sign-key",
+is pushed along with the index.
 
 After pushing the soci artifacts, they should be available in the registry. Soci artifacts will be pushed only
 if they are available in the snapshotter's local content store.
@@ -50,6 +56,14 @@ if they are available in the snapshotter's local content store.
 			Name:  "max-concurrent-uploads",
 			Usage: "Max concurrent uploads. Default is 10",
 			Value: 10,
+		},
+		cli.StringSliceFlag{
+			Name:  platformFlag + ", p",
+			Usage: "Push the SOCI indices of the given platform(s), e.g. linux/arm64. Can be repeated. Default is all platforms.",
+		},
+		cli.StringFlag{
+			Name:  signKeyFlag,
+			Usage: "Path to a PEM encoded private key. If set, the SOCI indices are signed with the key before they are pushed.",
 		}),
 	Action: func(cliContext *cli.Context) error {
 		ref := cliContext.Args().First()
@@ -70,20 +84,30 @@ if they are available in the snapshotter's local content store.
 			return err
 		}
 
-		indexDescriptors, err := soci.GetIndexDescriptorCollection(ctx, cs, img)
+		var ps []ocispec.Platform
+		if len(cliContext.StringSlice(platformFlag)) == 0 {
+			ps, err = soci.GetImagePlatforms(ctx, cs, img)
+		} else {
+			ps, err = getPlatforms(ctx, cliContext, cs, img)
+		}
 		if err != nil {
 			return err
 		}
 
-		if len(indexDescriptors) == 0 {
-			return fmt.Errorf("could not find any soci indices to push")
+		var indexDescriptors []soci.IndexDescriptorInfo
+		for _, platform := range ps {
+			descs, err := soci.GetIndexDescriptorCollection(ctx, cs, img, []ocispec.Platform{platform})
+			if err != nil {
+				return err
+			}
+			if len(descs) == 0 {
+				continue
+			}
+			indexDescriptors = append(indexDescriptors, descs[len(descs)-1])
 		}
 
-		username := cliContext.String("user")
-		var secret string
-		if i := strings.IndexByte(username, ':'); i > 0 {
-			secret = username[i+1:]
-			username = username[0:i]
+		if len(indexDescriptors) == 0 {
+			return fmt.Errorf("could not find any soci indices to push")
 		}
 
 		src, err := oci.New(config.SociContentStorePath)
@@ -91,58 +115,147 @@ if they are available in the snapshotter's local content store.
 			return fmt.Errorf("cannot create OCI local store: %w", err)
 		}
 
-		indexDesc := indexDescriptors[len(indexDescriptors)-1]
-		if indexDesc.MediaType == soci.OCIArtifactManifestMediaType {
-			return fmt.Errorf("cannot push index %v to remote since it is not an ORAS manifest", indexDesc.Digest.String()[7:15])
-		}
-		refspec, err := reference.Parse(ref)
-		if err != nil {
-			return err
+		for _, indexDesc := range indexDescriptors {
+			if indexDesc.MediaType == soci.OCIArtifactManifestMediaType {
+				return fmt.Errorf("cannot push index %v to remote since it is not an ORAS manifest or an OCI image manifest", indexDesc.Digest.String()[7:15])
+			}
 		}
 
-		dst, err := remote.NewRepository(refspec.Locator)
-		if err != nil {
-			return err
-		}
-		authClient := auth.DefaultClient
-		authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
-			return auth.Credential{
-				Username: username,
-				Password: secret,
-			}, nil
+		if path := cliContext.String(signKeyFlag); path != "" {
+			signKey, err := soci.LoadPrivateKey(path)
+			if err != nil {
+				return err
+			}
+			for _, indexDesc := range indexDescriptors {
+				if _, err := soci.SignIndex(ctx, src, indexDesc.Descriptor, signKey); err != nil {
+					return err
+				}
+			}
 		}
 
+		return pushSociIndices(ctx, cliContext, ref, src, indexDescriptors)
+	},
+}
+
+// pushSociIndices pushes the SOCI indices, along with their zTOCs and signatures, from the
+// local SOCI store to the repository of the image ref.
+func pushSociIndices(ctx context.Context, cliContext *cli.Context, ref string, src *oci.Store, indexDescriptors []soci.IndexDescriptorInfo) error {
+	username := cliContext.String("user")
+	var secret string
+	if i := strings.IndexByte(username, ':'); i > 0 {
+		secret = username[i+1:]
+		username = username[0:i]
+	}
+
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return err
+	}
+
+	dst, err := remote.NewRepository(refspec.Locator)
+	if err != nil {
+		return err
+	}
+	authClient := auth.DefaultClient
+	authClient.Credential = func(_ context.Context, host string) (auth.Credential, error) {
+		return auth.Credential{
+			Username: username,
+			Password: secret,
+		}, nil
+	}
+
+	dst.Client = authClient
+	dst.PlainHTTP = cliContext.Bool("plain-http")
+
+	debug := cliContext.GlobalBool("debug")
+	if debug {
+		dst.Client = &debugClient{client: authClient}
+	} else {
 		dst.Client = authClient
-		dst.PlainHTTP = cliContext.Bool("plain-http")
+	}
 
-		debug := cliContext.GlobalBool("debug")
-		if debug {
-			dst.Client = &debugClient{client: authClient}
-		} else {
-			dst.Client = authClient
-		}
+	options := oraslib.DefaultCopyGraphOptions
+	options.PreCopy = func(_ context.Context, desc ocispec.Descriptor) error {
+		fmt.Printf("pushing artifact with digest: %v\n", desc.Digest)
+		return nil
+	}
+	options.PostCopy = func(_ context.Context, desc ocispec.Descriptor) error {
+		fmt.Printf("successfully pushed artifact with digest: %v\n", desc.Digest)
+		return nil
+	}
+	options.OnCopySkipped = func(ctx context.Context, desc ocispec.Descriptor) error {
+		fmt.Printf("skipped artifact with digest: %v\n", desc.Digest)
+		return nil
+	}
 
-		options := oraslib.DefaultCopyGraphOptions
-		options.PreCopy = func(_ context.Context, desc ocispec.Descriptor) error {
-			fmt.Printf("pushing artifact with digest: %v\n", desc.Digest)
-			return nil
+	pushed := make(map[digest.Digest]struct{})
+	for _, indexDesc := range indexDescriptors {
+		if _, ok := pushed[indexDesc.Digest]; ok {
+			continue
 		}
-		options.PostCopy = func(_ context.Context, desc ocispec.Descriptor) error {
-			fmt.Printf("successfully pushed artifact with digest: %v\n", desc.Digest)
-			return nil
+		fmt.Printf("pushing soci index %v for platform %s\n", indexDesc.Digest, platforms.Format(indexDesc.Platform))
+		err = oraslib.CopyGraph(context.Background(), src, dst, indexDesc.Descriptor, options)
+		if err != nil {
+			return fmt.Errorf("error pushing graph to remote: %w", err)
 		}
-		options.OnCopySkipped = func(ctx context.Context, desc ocispec.Descriptor) error {
-			fmt.Printf("skipped artifact with digest: %v\n", desc.Digest)
-			return nil
+		pushed[indexDesc.Digest] = struct{}{}
+		if err := updateReferrers(ctx, src, dst, indexDesc.Descriptor); err != nil {
+			return err
 		}
 
-		err = oraslib.CopyGraph(context.Background(), src, dst, indexDesc.Descriptor, options)
+		// push the signature of the index, if any, and tag it so that it can be found from the index
+		tag := soci.SignatureTag(indexDesc.Digest)
+		sigDesc, err := src.Resolve(ctx, tag)
 		if err != nil {
-			return fmt.Errorf("error pushing graph to remote: %w", err)
+			continue
+		}
+		fmt.Printf("pushing signature %v of soci index %v\n", sigDesc.Digest, indexDesc.Digest)
+		err = oraslib.CopyGraph(context.Background(), src, dst, sigDesc, options)
+		if err != nil {
+			return fmt.Errorf("error pushing signature to remote: %w", err)
 		}
+		if err := dst.Tag(context.Background(), sigDesc, tag); err != nil {
+			return fmt.Errorf("error tagging signature in remote: %w", err)
+		}
+		if err := updateReferrers(ctx, src, dst, sigDesc); err != nil {
+			return err
+		}
+	}
 
+	return nil
+}
+
+// updateReferrers makes the OCI image manifest described by desc discoverable from its subject
+// in registries which don't support the referrers API, by adding it to the referrers index of
+// the subject in the referrers tag schema. Other manifests are left as they are.
+func updateReferrers(ctx context.Context, src oraslib.Target, dst *remote.Repository, desc ocispec.Descriptor) error {
+	if desc.MediaType != soci.OCIImageManifestMediaType {
 		return nil
-	},
+	}
+	rc, err := src.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	index, err := soci.NewIndexFromReader(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+	if index.Subject == nil {
+		return nil
+	}
+	supported, err := soci.ReferrersAPISupported(ctx, dst, index.Subject.Digest)
+	if err != nil {
+		return fmt.Errorf("cannot check support of the referrers API: %w", err)
+	}
+	if supported {
+		return nil
+	}
+	fmt.Printf("registry doesn't support the referrers API, adding %v to referrers tag %s\n", desc.Digest, soci.ReferrersTag(index.Subject.Digest))
+	if err := soci.AddReferrer(ctx, dst, desc, index); err != nil {
+		return fmt.Errorf("error updating referrers tag in remote: %w", err)
+	}
+	return nil
 }
 
 type debugClient struct {
@@ -0,0 +1,109 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package commands
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
+	"github.com/awslabs/soci-snapshotter/service/resolver"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/pelletier/go-toml"
+	"github.com/urfave/cli"
+)
+
+const (
+	snapshotterConfigFlag = "snapshotter-config"
+
+	defaultSnapshotterConfigPath = "/etc/soci-snapshotter-grpc/config.toml"
+)
+
+// resolveRemoteImage resolves the image ref in its registry, and returns the image with a
+// content provider streaming its blobs from the registry. Registries are accessed like the
+// snapshotter does, with the hosts of the snapshotter's resolver config and the credentials
+// of the --user flag or the docker config.
+func resolveRemoteImage(ctx context.Context, cliContext *cli.Context, ref string) (images.Image, content.Provider, error) {
+	refspec, err := reference.Parse(ref)
+	if err != nil {
+		return images.Image{}, nil, err
+	}
+	cfg, err := loadResolverConfig(cliContext.String(snapshotterConfigFlag))
+	if err != nil {
+		return images.Image{}, nil, err
+	}
+	if cliContext.Bool("plain-http") {
+		// mirrors are tried before the host itself, so the host is accessed over HTTP first
+		host := cfg.Host[refspec.Hostname()]
+		host.Mirrors = append(host.Mirrors, resolver.MirrorConfig{Host: refspec.Hostname(), Insecure: true})
+		cfg.Host[refspec.Hostname()] = host
+	}
+
+	username := cliContext.String("user")
+	var secret string
+	if i := strings.IndexByte(username, ':'); i > 0 {
+		secret = username[i+1:]
+		username = username[0:i]
+	}
+	userCreds := func(string, reference.Spec) (string, string, error) {
+		return username, secret, nil
+	}
+	hosts := resolver.RegistryHostsFromConfig(cfg, userCreds, dockerconfig.NewDockerConfigKeychain(ctx))
+
+	r := docker.NewResolver(docker.ResolverOptions{
+		Hosts: func(string) ([]docker.RegistryHost, error) {
+			return hosts(refspec)
+		},
+	})
+	name, desc, err := r.Resolve(ctx, ref)
+	if err != nil {
+		return images.Image{}, nil, fmt.Errorf("cannot resolve %s: %w", ref, err)
+	}
+	fetcher, err := r.Fetcher(ctx, name)
+	if err != nil {
+		return images.Image{}, nil, err
+	}
+	return images.Image{Name: name, Target: desc}, soci.NewFetcherProvider(fetcher), nil
+}
+
+// loadResolverConfig loads the resolver config of the snapshotter config file at path.
+// A missing config file at the default path is the same as an empty config.
+func loadResolverConfig(path string) (resolver.Config, error) {
+	var config struct {
+		Resolver resolver.Config `toml:"resolver"`
+	}
+	tree, err := toml.LoadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && path == defaultSnapshotterConfigPath {
+			return resolver.Config{Host: make(map[string]resolver.HostConfig)}, nil
+		}
+		return resolver.Config{}, fmt.Errorf("cannot load config file %q: %w", path, err)
+	}
+	if err := tree.Unmarshal(&config); err != nil {
+		return resolver.Config{}, fmt.Errorf("cannot unmarshal config file %q: %w", path, err)
+	}
+	if config.Resolver.Host == nil {
+		config.Resolver.Host = make(map[string]resolver.HostConfig)
+	}
+	return config.Resolver, nil
+}
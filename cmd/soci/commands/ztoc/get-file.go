@@ -76,20 +76,26 @@ var getFileCommand = cli.Command{
 			return err
 		}
 		extractConfig := soci.FileExtractConfig{
-			UncompressedSize:   fileMetadata.UncompressedSize,
-			UncompressedOffset: fileMetadata.UncompressedOffset,
-			SpanStart:          fileMetadata.SpanStart,
-			SpanEnd:            fileMetadata.SpanEnd,
-			FirstSpanHasBits:   fileMetadata.FirstSpanHasBits,
-			IndexByteData:      ztoc.IndexByteData,
-			CompressedFileSize: ztoc.CompressedFileSize,
-			MaxSpanId:          ztoc.MaxSpanId,
+			UncompressedSize:     fileMetadata.UncompressedSize,
+			UncompressedOffset:   fileMetadata.UncompressedOffset,
+			SpanStart:            fileMetadata.SpanStart,
+			SpanEnd:              fileMetadata.SpanEnd,
+			FirstSpanHasBits:     fileMetadata.FirstSpanHasBits,
+			IndexByteData:        ztoc.IndexByteData,
+			CompressedFileSize:   ztoc.CompressedFileSize,
+			MaxSpanId:            ztoc.MaxSpanId,
+			CompressionAlgorithm: ztoc.CompressionAlgorithm,
 		}
 
 		data, err := soci.ExtractFile(io.NewSectionReader(layerReader, 0, int64(ztoc.CompressedFileSize)), &extractConfig)
 		if err != nil {
 			return err
 		}
+		if len(fileMetadata.SparseMap) > 0 {
+			if data, err = soci.ExpandSparse(data, fileMetadata.SparseMap); err != nil {
+				return err
+			}
+		}
 
 		outfile := cliContext.String("output")
 		if outfile != "" {
@@ -117,18 +123,23 @@ func getZtoc(ctx context.Context, d digest.Digest) (*soci.Ztoc, error) {
 }
 
 func getLayer(ctx context.Context, ztocDigest digest.Digest, cs content.Store) (content.ReaderAt, error) {
-	metadata, err := soci.NewDB()
+	layerDigest, err := getLayerDigest(ztocDigest)
 	if err != nil {
 		return nil, err
 	}
-	artifact, err := metadata.GetArtifactEntry(ztocDigest.String())
+
+	return cs.ReaderAt(ctx, v1.Descriptor{Digest: layerDigest})
+}
+
+// getLayerDigest returns the digest of the layer the ztoc was built for.
+func getLayerDigest(ztocDigest digest.Digest) (digest.Digest, error) {
+	metadata, err := soci.NewDB()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	layerDigest, err := digest.Parse(artifact.OriginalDigest)
+	artifact, err := metadata.GetArtifactEntry(ztocDigest.String())
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-
-	return cs.ReaderAt(ctx, v1.Descriptor{Digest: layerDigest})
+	return digest.Parse(artifact.OriginalDigest)
 }
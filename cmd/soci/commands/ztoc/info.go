@@ -52,8 +52,19 @@ var infoCommand = cli.Command{
 		if err != nil {
 			return err
 		}
+		stats, err := soci.GetFileFetchStats(ztoc)
+		if err != nil {
+			return err
+		}
+		spanPlacement := ztoc.SpanPlacement
+		if spanPlacement == "" {
+			spanPlacement = string(soci.SpanPlacementFixed)
+		}
 		fmt.Printf("version: %s\n", ztoc.Version)
-		fmt.Printf("build tool: %s\n\n\n", ztoc.BuildToolIdentifier)
+		fmt.Printf("build tool: %s\n", ztoc.BuildToolIdentifier)
+		fmt.Printf("span placement: %s\n", spanPlacement)
+		fmt.Printf("files split across spans: %d of %d\n", stats.SplitFiles, stats.Files)
+		fmt.Printf("average compressed bytes fetched per file read: %d\n\n\n", stats.AverageFetchedBytes())
 
 		for _, v := range ztoc.Metadata {
 			fmt.Printf("filename: %s, offset: %d, size: %d, span_start: %d, span_end: %d\n", v.Name, v.UncompressedOffset, v.UncompressedSize, v.SpanStart, v.SpanEnd)
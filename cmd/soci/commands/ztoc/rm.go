@@ -0,0 +1,67 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/urfave/cli"
+)
+
+var rmCommand = cli.Command{
+	Name:      "rm",
+	Aliases:   []string{"remove"},
+	Usage:     "remove ztocs",
+	ArgsUsage: "<digest> [<digest>...]",
+	Description: "remove ztocs from the local store. A ztoc is removed even if an index still references it, " +
+		"use `soci gc` to only remove the ztocs which are no longer referenced by any index",
+	Flags: []cli.Flag{
+		cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "print the ztocs which would be removed without removing them",
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		args := cliContext.Args()
+		if len(args) == 0 {
+			return errors.New("please provide at least one ztoc digest")
+		}
+		db, err := soci.NewDB()
+		if err != nil {
+			return err
+		}
+		for _, digest := range args {
+			ae, err := db.GetArtifactEntry(digest)
+			if err != nil {
+				return err
+			}
+			if ae.Type != soci.ArtifactEntryTypeLayer {
+				return fmt.Errorf("%s is not a ztoc", digest)
+			}
+			if !cliContext.Bool("dry-run") {
+				if err := soci.RemoveArtifact(db, config.SociContentStorePath, ae); err != nil {
+					return err
+				}
+			}
+			fmt.Println(digest)
+		}
+		return nil
+	},
+}
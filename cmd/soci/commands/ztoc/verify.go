@@ -0,0 +1,124 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package ztoc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/cmd/ctr/commands"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/urfave/cli"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// verifyResult is the result of `soci ztoc verify` printed with --format json.
+type verifyResult struct {
+	Ztoc          digest.Digest          `json:"ztoc"`
+	Layer         digest.Digest          `json:"layer"`
+	Valid         bool                   `json:"valid"`
+	Discrepancies []soci.ZtocDiscrepancy `json:"discrepancies"`
+}
+
+var verifyCommand = cli.Command{
+	Name:      "verify",
+	Usage:     "verify that a ztoc is consistent with its local image layer",
+	ArgsUsage: "<digest>",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "output format, either text or json",
+			Value: formatText,
+		},
+	},
+	Action: func(cliContext *cli.Context) error {
+		format := cliContext.String("format")
+		if format != formatText && format != formatJSON {
+			return fmt.Errorf("unknown output format %q", format)
+		}
+		if len(cliContext.Args()) != 1 {
+			return errors.New("please provide a ztoc digest")
+		}
+		ztocDigest, err := digest.Parse(cliContext.Args()[0])
+		if err != nil {
+			return err
+		}
+
+		client, ctx, cancel, err := commands.NewClient(cliContext)
+		if err != nil {
+			return err
+		}
+		defer cancel()
+
+		ztoc, err := getZtoc(ctx, ztocDigest)
+		if err != nil {
+			return err
+		}
+		layerDigest, err := getLayerDigest(ztocDigest)
+		if err != nil {
+			return err
+		}
+		layerReader, err := client.ContentStore().ReaderAt(ctx, v1.Descriptor{Digest: layerDigest})
+		if err != nil {
+			return err
+		}
+		defer layerReader.Close()
+
+		discrepancies, err := soci.VerifyZtoc(ztoc, io.NewSectionReader(layerReader, 0, layerReader.Size()))
+		if err != nil {
+			return err
+		}
+
+		result := verifyResult{
+			Ztoc:          ztocDigest,
+			Layer:         layerDigest,
+			Valid:         len(discrepancies) == 0,
+			Discrepancies: discrepancies,
+		}
+		if result.Discrepancies == nil {
+			result.Discrepancies = []soci.ZtocDiscrepancy{}
+		}
+		if format == formatJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(result); err != nil {
+				return err
+			}
+		} else {
+			for _, d := range discrepancies {
+				fmt.Println(d)
+			}
+		}
+
+		if !result.Valid {
+			return fmt.Errorf("ztoc %v doesn't match layer %v: %d discrepancies found", ztocDigest, layerDigest, len(discrepancies))
+		}
+		if format == formatText {
+			fmt.Printf("ztoc %v matches layer %v\n", ztocDigest, layerDigest)
+		}
+		return nil
+	},
+}
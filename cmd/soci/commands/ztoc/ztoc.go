@@ -25,5 +25,7 @@ var Command = cli.Command{
 		infoCommand,
 		getFileCommand,
 		listCommand,
+		verifyCommand,
+		rmCommand,
 	},
 }
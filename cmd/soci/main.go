@@ -82,7 +82,9 @@ func main() {
 		index.Command,
 		ztoc.Command,
 		commands.CreateCommand,
+		commands.ConvertCommand,
 		commands.PushCommand,
+		commands.GCCommand,
 		run.Command,
 	}
 
@@ -20,13 +20,11 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
 	"io"
 
 	"github.com/awslabs/soci-snapshotter/service/keychain/dockerconfig"
 	"github.com/awslabs/soci-snapshotter/soci"
-	"github.com/awslabs/soci-snapshotter/util/ioutils"
 	"github.com/containerd/containerd/log"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes"
@@ -68,7 +66,7 @@ func newArtifactFetcher(refspec reference.Spec, localStore, remoteStore content.
 	}, nil
 }
 
-func newRemoteStore(refspec reference.Spec) (content.Storage, error) {
+func newRemoteStore(refspec reference.Spec) (*remote.Repository, error) {
 	repo, err := remote.NewRepository(refspec.Locator)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create repository %s: %w", refspec.Locator, err)
@@ -166,7 +164,15 @@ func (f *artifactFetcher) Store(ctx context.Context, desc ocispec.Descriptor, re
 	return nil
 }
 
+// FetchSociArtifacts fetches the SOCI index with the given digest and its zTOCs
+// into the local store, without verifying the signature of the index.
 func FetchSociArtifacts(ctx context.Context, imageRef, indexDigest string, store content.Storage) (*soci.Index, error) {
+	return fetchVerifiedSociArtifacts(ctx, imageRef, indexDigest, store, nil)
+}
+
+// fetchVerifiedSociArtifacts is like FetchSociArtifacts, but verifies the signature of the
+// index with verifier before any of its zTOCs are fetched.
+func fetchVerifiedSociArtifacts(ctx context.Context, imageRef, indexDigest string, store content.Storage, verifier *signatureVerifier) (*soci.Index, error) {
 	refspec, err := reference.Parse(imageRef)
 	if err != nil {
 		return nil, fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
@@ -193,22 +199,27 @@ func FetchSociArtifacts(ctx context.Context, imageRef, indexDigest string, store
 	}
 	defer indexReader.Close()
 
-	cw := new(ioutils.CountWriter)
-	tee := io.TeeReader(indexReader, cw)
+	b, err := io.ReadAll(indexReader)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read SOCI index: %w", err)
+	}
+	if digest.FromBytes(b) != dgst {
+		return nil, fmt.Errorf("content of SOCI index doesn't match its digest %v", dgst)
+	}
 
-	index, err := soci.NewIndexFromReader(tee)
+	index, err := soci.NewIndexFromReader(bytes.NewReader(b))
 	if err != nil {
 		return nil, fmt.Errorf("cannot deserialize byte data to index: %w", err)
 	}
 
+	if err := verifier.verify(ctx, fetcher, dgst); err != nil {
+		return nil, fmt.Errorf("cannot verify SOCI index signature: %w", err)
+	}
+
 	if !local {
-		b, err := json.Marshal(index)
-		if err != nil {
-			return nil, err
-		}
 		err = store.Push(ctx, ocispec.Descriptor{
 			Digest: dgst,
-			Size:   cw.Size(),
+			Size:   int64(len(b)),
 		}, bytes.NewReader(b))
 
 		if err != nil {
@@ -219,6 +230,10 @@ func FetchSociArtifacts(ctx context.Context, imageRef, indexDigest string, store
 	eg, ctx := errgroup.WithContext(ctx)
 	for _, blob := range index.Blobs {
 		blob := blob
+		if soci.IsEagerLayer(blob) {
+			// eager layers have no zTOC, they're downloaded when mounted
+			continue
+		}
 		eg.Go(func() error {
 			rc, local, err := fetcher.Fetch(ctx, blob)
 			if err != nil {
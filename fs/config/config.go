@@ -70,6 +70,13 @@ type Config struct {
 	DirectoryCacheConfig `toml:"directory_cache"`
 
 	FuseConfig `toml:"fuse"`
+
+	// SignatureConfig is config for verifying the signatures of SOCI indices.
+	SignatureConfig `toml:"signature"`
+
+	// IndexDiscoveryConfig is config for finding the SOCI index of images
+	// mounted without the soci index digest label.
+	IndexDiscoveryConfig `toml:"index_discovery"`
 }
 
 type BlobConfig struct {
@@ -99,3 +106,40 @@ type FuseConfig struct {
 	// EntryTimeout defines TTL for directory, name lookup in seconds.
 	EntryTimeout int64 `toml:"entry_timeout"`
 }
+
+// Policies for verifying the signatures of SOCI indices.
+const (
+	// SignaturePolicyOff doesn't verify signatures.
+	SignaturePolicyOff = "off"
+	// SignaturePolicyWarn verifies signatures and logs a warning if an index
+	// isn't signed by a trusted key, but uses the index anyway.
+	SignaturePolicyWarn = "warn"
+	// SignaturePolicyEnforce refuses to use an index which isn't signed by a trusted key.
+	SignaturePolicyEnforce = "enforce"
+)
+
+type SignatureConfig struct {
+	// Policy is the default signature policy: "off" (default), "warn" or "enforce".
+	Policy string `toml:"policy"`
+	// PublicKeys are the paths of the PEM encoded public keys trusted to sign SOCI indices.
+	PublicKeys []string `toml:"public_keys"`
+	// Registries overrides the policy and the trusted keys per registry host, e.g. "docker.io".
+	Registries map[string]RegistrySignatureConfig `toml:"registries"`
+}
+
+type RegistrySignatureConfig struct {
+	// Policy is the signature policy of the registry. Defaults to SignatureConfig.Policy.
+	Policy string `toml:"policy"`
+	// PublicKeys are trusted in addition to SignatureConfig.PublicKeys for the registry.
+	PublicKeys []string `toml:"public_keys"`
+}
+
+type IndexDiscoveryConfig struct {
+	// Disable turns off the discovery, so that images without the soci index digest label
+	// are never lazily loaded.
+	Disable bool `toml:"disable"`
+	// BuildToolPreference lists build tool identifiers in order of preference. When several
+	// SOCI indices refer to an image, the one built by the first tool of the list is used.
+	// Indices of other tools are used only if none of the listed tools built an index.
+	BuildToolPreference []string `toml:"build_tool_preference"`
+}
@@ -68,6 +68,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
 	orascontent "oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/content/oci"
 	"oras.land/oras-go/v2/errdef"
@@ -76,7 +77,9 @@ import (
 const (
 	defaultFuseTimeout    = time.Second
 	defaultMaxConcurrency = 2
-	fusermountBin         = "fusermount"
+	// eagerLayerFetchTimeout is the timeout of the background download of a layer marked for eager download
+	eagerLayerFetchTimeout = 10 * time.Minute
+	fusermountBin          = "fusermount"
 )
 
 type Option func(*options)
@@ -149,6 +152,11 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		return nil, fmt.Errorf("cannot create local store: %w", err)
 	}
 
+	signatureVerifier, err := newSignatureVerifier(cfg.SignatureConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature config: %w", err)
+	}
+
 	tm := task.NewBackgroundTaskManager(maxConcurrency, 5*time.Second)
 	r, err := layer.NewResolver(root, tm, cfg, fsOpts.resolveHandlers, metadataStore, store, fsOpts.overlayOpaqueType)
 	if err != nil {
@@ -176,8 +184,12 @@ func NewFilesystem(root string, cfg config.Config, opts ...Option) (_ snapshot.F
 		metricsController:     c,
 		attrTimeout:           attrTimeout,
 		entryTimeout:          entryTimeout,
+		indices:               make(map[string]*soci.Index),
+		discoveredIndices:     make(map[string]string),
 		imageLayerToSociDesc:  make(map[string]ocispec.Descriptor),
 		orasStore:             store,
+		signatureVerifier:     signatureVerifier,
+		indexDiscovery:        cfg.IndexDiscoveryConfig,
 	}, nil
 }
 
@@ -194,26 +206,92 @@ type filesystem struct {
 	metricsController     *layermetrics.Controller
 	attrTimeout           time.Duration
 	entryTimeout          time.Duration
-	sociIndex             *soci.Index
-	imageLayerToSociDesc  map[string]ocispec.Descriptor
-	loadIndexOnce         sync.Once
-	orasStore             orascontent.Storage
+	// indices are the SOCI indices fetched and verified so far, by digest
+	indices map[string]*soci.Index
+	// imageLayerToSociDesc maps the layers of the images to their blobs in the SOCI indices
+	imageLayerToSociDesc map[string]ocispec.Descriptor
+	indexMu              sync.Mutex
+	// loadIndex shares the fetches of the SOCI indices. Failed fetches aren't remembered,
+	// so that the next mount tries again.
+	loadIndex singleflight.Group
+	// discoveredIndices are the digests of the SOCI indices discovered so far, by image manifest.
+	// Failed discoveries, including the ones that found no index, aren't remembered.
+	discoveredIndices map[string]string
+	discoverIndex     singleflight.Group
+	orasStore         orascontent.Storage
+	signatureVerifier *signatureVerifier
+	indexDiscovery    config.IndexDiscoveryConfig
+	// eagerLayers shares the downloads of the layers marked for eager download in the SOCI index
+	eagerLayers singleflight.Group
 }
 
-func (fs *filesystem) fetchSociArtifacts(ctx context.Context, imageRef, indexDigest string) error {
-	var retErr error
-	fs.loadIndexOnce.Do(func() {
-		index, err := FetchSociArtifacts(ctx, imageRef, indexDigest, fs.orasStore)
+// fetchSociArtifacts fetches the SOCI index with the given digest and its zTOCs. If indexDigest
+// is empty, the index is discovered from the manifests referring to the image manifest.
+func (fs *filesystem) fetchSociArtifacts(ctx context.Context, imageRef, indexDigest, manifestDigest string) error {
+	if indexDigest == "" {
+		refspec, err := reference.Parse(imageRef)
+		if err != nil {
+			return fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
+		}
+		indexDigest, err = fs.discoverIndexDigest(ctx, refspec, manifestDigest)
+		if err != nil {
+			return fmt.Errorf("error trying to discover SOCI index: %w", err)
+		}
+	}
+	_, err, _ := fs.loadIndex.Do(indexDigest, func() (interface{}, error) {
+		fs.indexMu.Lock()
+		_, ok := fs.indices[indexDigest]
+		fs.indexMu.Unlock()
+		if ok {
+			return nil, nil
+		}
+		index, err := fetchVerifiedSociArtifacts(ctx, imageRef, indexDigest, fs.orasStore, fs.signatureVerifier)
 		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
-			retErr = fmt.Errorf("error trying to fetch SOCI artifacts: %w", err)
-			return
+			return nil, fmt.Errorf("error trying to fetch SOCI artifacts: %w", err)
+		}
+		if index != nil {
+			fs.indexMu.Lock()
+			fs.indices[indexDigest] = index
+			fs.populateImageLayerToSociMapping(index)
+			fs.indexMu.Unlock()
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// discoverIndexDigest returns the digest of the SOCI index of the image manifest. Discovered
+// indices are remembered by repository and manifest digest. Without a manifest digest, the
+// manifest is resolved from the tag, which can move, so the index is always discovered.
+func (fs *filesystem) discoverIndexDigest(ctx context.Context, refspec reference.Spec, manifestDigest string) (string, error) {
+	if manifestDigest == "" {
+		dgst, err := discoverSociIndex(ctx, refspec, manifestDigest, fs.indexDiscovery.BuildToolPreference)
+		return dgst.String(), err
+	}
+	key := refspec.Locator + "@" + manifestDigest
+	fs.indexMu.Lock()
+	indexDigest, ok := fs.discoveredIndices[key]
+	fs.indexMu.Unlock()
+	if ok {
+		return indexDigest, nil
+	}
+	v, err, _ := fs.discoverIndex.Do(key, func() (interface{}, error) {
+		dgst, err := discoverSociIndex(ctx, refspec, manifestDigest, fs.indexDiscovery.BuildToolPreference)
+		if err != nil {
+			return "", err
 		}
-		fs.sociIndex = index
-		fs.populateImageLayerToSociMapping(index)
+		fs.indexMu.Lock()
+		fs.discoveredIndices[key] = dgst.String()
+		fs.indexMu.Unlock()
+		return dgst.String(), nil
 	})
-	return retErr
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
 }
 
+// populateImageLayerToSociMapping records the blobs of the index by layer. indexMu must be held.
 func (fs *filesystem) populateImageLayerToSociMapping(sociIndex *soci.Index) {
 	for _, desc := range sociIndex.Blobs {
 		ociDigest := desc.Annotations[soci.IndexAnnotationImageLayerDigest]
@@ -221,6 +299,71 @@ func (fs *filesystem) populateImageLayerToSociMapping(sociIndex *soci.Index) {
 	}
 }
 
+// sociDesc returns the blob of the layer in the SOCI indices fetched so far.
+func (fs *filesystem) sociDesc(desc ocispec.Descriptor) (ocispec.Descriptor, bool) {
+	fs.indexMu.Lock()
+	defer fs.indexMu.Unlock()
+	sociDesc, ok := fs.imageLayerToSociDesc[desc.Digest.String()]
+	return sociDesc, ok
+}
+
+// isEagerLayer reports whether the SOCI index marks the layer for eager download.
+func (fs *filesystem) isEagerLayer(desc ocispec.Descriptor) bool {
+	sociDesc, ok := fs.sociDesc(desc)
+	return ok && soci.IsEagerLayer(sociDesc)
+}
+
+// newLayerFetcher returns a fetcher of the layers of the image, which stores them in the local store.
+func (fs *filesystem) newLayerFetcher(imageRef string) (*artifactFetcher, error) {
+	refspec, err := reference.Parse(imageRef)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
+	}
+	remoteStore, err := newRemoteStore(refspec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create remote store: %w", err)
+	}
+	fetcher, err := newArtifactFetcher(refspec, fs.orasStore, remoteStore, newResolver())
+	if err != nil {
+		return nil, fmt.Errorf("cannot create fetcher: %w", err)
+	}
+	return fetcher, nil
+}
+
+// fetchEagerLayer downloads a layer marked for eager download to the local store, unless it's
+// already there. A download of the layer in progress is waited for instead of being repeated,
+// so that the layer is downloaded once whether it's mounted before or after its background download.
+func (fs *filesystem) fetchEagerLayer(ctx context.Context, fetcher Fetcher, desc ocispec.Descriptor) error {
+	_, err, _ := fs.eagerLayers.Do(desc.Digest.String(), func() (interface{}, error) {
+		if fs.eagerLayerStored(ctx, desc) {
+			return nil, nil
+		}
+		rc, local, err := fetcher.Fetch(ctx, desc)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch layer: %w", err)
+		}
+		defer rc.Close()
+		if local {
+			return nil, nil
+		}
+		if err := fetcher.Store(ctx, desc, rc); err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return nil, fmt.Errorf("cannot store layer: %w", err)
+		}
+		return nil, nil
+	})
+	return err
+}
+
+// eagerLayerStored reports whether a layer marked for eager download is in the local store.
+func (fs *filesystem) eagerLayerStored(ctx context.Context, desc ocispec.Descriptor) bool {
+	exists, err := fs.orasStore.Exists(ctx, desc)
+	if err != nil {
+		log.G(ctx).WithError(err).WithField("digest", desc.Digest).Debug("cannot check local store for eager layer")
+		return false
+	}
+	return exists
+}
+
 func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels map[string]string) error {
 	imageRef, ok := labels[source.TargetRefLabel]
 	if !ok {
@@ -235,21 +378,19 @@ func (fs *filesystem) MountLocal(ctx context.Context, mountpoint string, labels
 	}
 	// download the target layer
 	s := src[0]
-	archive := NewLayerArchive()
-	refspec, err := reference.Parse(imageRef)
-	if err != nil {
-		return fmt.Errorf("cannot parse image ref (%s): %w", imageRef, err)
-	}
-	remoteStore, err := newRemoteStore(refspec)
+	desc := s.Target
+	fetcher, err := fs.newLayerFetcher(imageRef)
 	if err != nil {
-		return fmt.Errorf("cannot create remote store: %w", err)
+		return err
 	}
-	fetcher, err := newArtifactFetcher(refspec, fs.orasStore, remoteStore, newResolver())
-	if err != nil {
-		return fmt.Errorf("cannot create fetcher: %w", err)
+	if fs.isEagerLayer(desc) {
+		// the layer may already be downloading in background
+		if err := fs.fetchEagerLayer(ctx, fetcher, desc); err != nil {
+			log.G(ctx).WithError(err).WithField("digest", desc.Digest).Warn("failed to download eager layer")
+		}
 	}
+	archive := NewLayerArchive()
 	unpacker := NewLayerUnpacker(fetcher, archive)
-	desc := s.Target
 	err = unpacker.Unpack(ctx, desc, mountpoint)
 	if err != nil {
 		return fmt.Errorf("cannot unpack the layer: %w", err)
@@ -269,8 +410,8 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	defer fs.backgroundTaskManager.DonePrioritizedTask()
 	ctx = log.WithLogger(ctx, log.G(ctx).WithField("mountpoint", mountpoint))
 
-	sociIndexDigest, ok := labels[source.TargetSociIndexDigestLabel]
-	if !ok {
+	sociIndexDigest := labels[source.TargetSociIndexDigestLabel]
+	if sociIndexDigest == "" && fs.indexDiscovery.Disable {
 		return fmt.Errorf("unable to get soci index digest from labels")
 	}
 	imageRef, ok := labels[source.TargetRefLabel]
@@ -278,7 +419,8 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		return fmt.Errorf("unable to get image ref from labels")
 	}
 
-	err := fs.fetchSociArtifacts(ctx, imageRef, sociIndexDigest)
+	// Without an index, the layer isn't mounted and the snapshotter falls back to pulling it.
+	err := fs.fetchSociArtifacts(ctx, imageRef, sociIndexDigest, labels[source.TargetImgManifestDigestLabel])
 	if err != nil {
 		return fmt.Errorf("unable to fetch SOCI artifacts: %w", err)
 	}
@@ -291,6 +433,18 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 		return fmt.Errorf("source must be passed")
 	}
 
+	// Start downloading the layers marked for eager download, which are mounted with MountLocal,
+	// in parallel with the lazily loaded layers.
+	preResolve := src[0] // TODO: should we pre-resolve blobs in other sources as well?
+	for _, desc := range preResolve.Manifest.Layers {
+		if fs.isEagerLayer(desc) {
+			fs.backgroundFetchEagerLayer(ctx, imageRef, desc)
+		}
+	}
+	if fs.isEagerLayer(preResolve.Target) {
+		return fmt.Errorf("layer %s is marked for eager download in the SOCI index", preResolve.Target.Digest)
+	}
+
 	// Resolve the target layer
 	var (
 		resultChan = make(chan layer.Layer)
@@ -299,10 +453,7 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	go func() {
 		rErr := fmt.Errorf("failed to resolve target")
 		for _, s := range src {
-			sociDesc := ocispec.Descriptor{}
-			if desc, ok := fs.imageLayerToSociDesc[s.Target.Digest.String()]; ok {
-				sociDesc = desc
-			}
+			sociDesc, _ := fs.sociDesc(s.Target)
 
 			l, err := fs.resolver.Resolve(ctx, s.Hosts, s.Name, s.Target, sociDesc)
 			if err == nil {
@@ -316,16 +467,15 @@ func (fs *filesystem) Mount(ctx context.Context, mountpoint string, labels map[s
 	}()
 
 	// Also resolve and cache other layers in parallel
-	preResolve := src[0] // TODO: should we pre-resolve blobs in other sources as well?
 	for _, desc := range neighboringLayers(preResolve.Manifest, preResolve.Target) {
 		desc := desc
+		if fs.isEagerLayer(desc) {
+			continue
+		}
 		go func() {
 			// Avoids to get canceled by client.
 			ctx := log.WithLogger(context.Background(), log.G(ctx).WithField("mountpoint", mountpoint))
-			sociDesc := ocispec.Descriptor{}
-			if descriptor, ok := fs.imageLayerToSociDesc[desc.Digest.String()]; ok {
-				sociDesc = descriptor
-			}
+			sociDesc, _ := fs.sociDesc(desc)
 			l, err := fs.resolver.Resolve(ctx, preResolve.Hosts, preResolve.Name, desc, sociDesc)
 			if err != nil {
 				log.G(ctx).WithError(err).Debug("failed to pre-resolve")
@@ -487,15 +637,38 @@ func (fs *filesystem) Unmount(ctx context.Context, mountpoint string) error {
 }
 
 func (fs *filesystem) backgroundFetch(ctx context.Context, l layer.Layer, start time.Time) {
-	// Fetch whole layer aggressively in background.
-	if !fs.noBackgroundFetch {
-		go func() {
+	go func() {
+		// Fetch the spans the SOCI index marks as priority before the rest of the layer.
+		l.Prefetch()
+		// Fetch whole layer aggressively in background.
+		if !fs.noBackgroundFetch {
 			if err := l.BackgroundFetch(); err == nil {
 				// write log record for the latency between mount start and last on demand fetch
 				commonmetrics.LogLatencyForLastOnDemandFetch(ctx, l.Info().Digest, start, l.Info().ReadTime)
 			}
-		}()
-	}
+		}
+	}()
+}
+
+// backgroundFetchEagerLayer downloads a layer marked for eager download in background, unless
+// it's already in the local store. The download yields to the prioritized tasks, like the
+// background fetches of the lazily loaded layers.
+func (fs *filesystem) backgroundFetchEagerLayer(ctx context.Context, imageRef string, desc ocispec.Descriptor) {
+	ctx = log.WithLogger(ctx, log.G(ctx).WithField("digest", desc.Digest))
+	if fs.eagerLayerStored(ctx, desc) {
+		return
+	}
+	logger := log.G(ctx)
+	go fs.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
+		ctx = log.WithLogger(ctx, logger)
+		fetcher, err := fs.newLayerFetcher(imageRef)
+		if err == nil {
+			err = fs.fetchEagerLayer(ctx, fetcher, desc)
+		}
+		if err != nil {
+			logger.WithError(err).Debug("failed to download eager layer in background")
+		}
+	}, eagerLayerFetchTimeout)
 }
 
 // neighboringLayers returns layer descriptors except the `target` layer in the specified manifest.
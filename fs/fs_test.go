@@ -39,6 +39,7 @@
 package fs
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"testing"
@@ -47,12 +48,14 @@ import (
 	"github.com/awslabs/soci-snapshotter/fs/layer"
 	"github.com/awslabs/soci-snapshotter/fs/remote"
 	"github.com/awslabs/soci-snapshotter/fs/source"
+	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/task"
 	"github.com/containerd/containerd/reference"
 	"github.com/containerd/containerd/remotes/docker"
 	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	digest "github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
 )
 
 func TestCheck(t *testing.T) {
@@ -86,6 +89,7 @@ func (l *breakableLayer) RootNode(uint32) (fusefs.InodeEmbedder, error)       {
 func (l *breakableLayer) Verify(tocDigest digest.Digest) error                { return nil }
 func (l *breakableLayer) SkipVerify()                                         {}
 func (l *breakableLayer) ReadAt([]byte, int64, ...remote.Option) (int, error) { return 0, nil }
+func (l *breakableLayer) Prefetch() error                                     { return fmt.Errorf("fail") }
 func (l *breakableLayer) BackgroundFetch() error                              { return fmt.Errorf("fail") }
 func (l *breakableLayer) Check() error {
 	if !l.success {
@@ -100,3 +104,124 @@ func (l *breakableLayer) Refresh(ctx context.Context, hosts source.RegistryHosts
 	return nil
 }
 func (l *breakableLayer) Done() {}
+
+func TestIsEagerLayer(t *testing.T) {
+	eager := digest.FromString("eager")
+	lazy := digest.FromString("lazy")
+	fs := &filesystem{
+		imageLayerToSociDesc: map[string]ocispec.Descriptor{
+			eager.String(): {Annotations: map[string]string{soci.IndexAnnotationEagerLayer: "true"}},
+			lazy.String():  {Annotations: map[string]string{soci.IndexAnnotationImageLayerDigest: lazy.String()}},
+		},
+	}
+	testCases := []struct {
+		name  string
+		layer digest.Digest
+		want  bool
+	}{
+		{name: "eager layer", layer: eager, want: true},
+		{name: "lazy layer", layer: lazy, want: false},
+		{name: "layer not in index", layer: digest.FromString("other"), want: false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := fs.isEagerLayer(ocispec.Descriptor{Digest: tc.layer}); got != tc.want {
+				t.Fatalf("unexpected result; expected = %v, got = %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestFetchSociArtifactsRetriesAfterFailure(t *testing.T) {
+	index := &soci.Index{}
+	indexDigest := digest.FromString("index").String()
+	fs := &filesystem{
+		indices:              map[string]*soci.Index{indexDigest: index},
+		imageLayerToSociDesc: make(map[string]ocispec.Descriptor),
+	}
+	imageRef := "example.com/test:latest"
+	if err := fs.fetchSociArtifacts(context.Background(), imageRef, "invalid", ""); err == nil {
+		t.Fatalf("expected an error when fetching an invalid index")
+	}
+	// the failure of the first index doesn't prevent other mounts
+	if err := fs.fetchSociArtifacts(context.Background(), imageRef, indexDigest, ""); err != nil {
+		t.Fatalf("failed to fetch index after a failure: %v", err)
+	}
+}
+
+func TestDiscoverIndexDigest(t *testing.T) {
+	manifest1 := digest.FromString("manifest1").String()
+	manifest2 := digest.FromString("manifest2").String()
+	index1 := digest.FromString("index1").String()
+	index2 := digest.FromString("index2").String()
+	refspec, err := reference.Parse("example.com/test:latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs := &filesystem{
+		discoveredIndices: map[string]string{
+			refspec.Locator + "@" + manifest1: index1,
+			refspec.Locator + "@" + manifest2: index2,
+		},
+	}
+	testCases := []struct {
+		manifest string
+		want     string
+	}{
+		{manifest: manifest1, want: index1},
+		{manifest: manifest2, want: index2},
+	}
+	for _, tc := range testCases {
+		got, err := fs.discoverIndexDigest(context.Background(), refspec, tc.manifest)
+		if err != nil {
+			t.Fatalf("failed to discover index of %s: %v", tc.manifest, err)
+		}
+		if got != tc.want {
+			t.Fatalf("unexpected index of %s; expected = %s, got = %s", tc.manifest, tc.want, got)
+		}
+	}
+
+	if _, err := fs.discoverIndexDigest(context.Background(), refspec, "invalid"); err == nil {
+		t.Fatalf("expected an error when discovering the index of an invalid manifest")
+	}
+	if len(fs.discoveredIndices) != 2 {
+		t.Fatalf("failed discovery must not be remembered: %v", fs.discoveredIndices)
+	}
+}
+
+func TestFetchEagerLayer(t *testing.T) {
+	fs := &filesystem{orasStore: memory.New()}
+	fetcher := newFakeFetcher(false, false, false)
+	desc := ocispec.Descriptor{Digest: digest.FromString("eager")}
+	for i := 0; i < 2; i++ {
+		if err := fs.fetchEagerLayer(context.Background(), fetcher, desc); err != nil {
+			t.Fatalf("failed to fetch eager layer: %v", err)
+		}
+	}
+	if fetcher.fetchCount != 2 {
+		t.Fatalf("fetch must have been called twice, but was called %d times", fetcher.fetchCount)
+	}
+	// the second fetch finds the layer in the local store
+	if fetcher.storeCount != 1 {
+		t.Fatalf("store must have been called once, but was called %d times", fetcher.storeCount)
+	}
+
+	failing := newFakeFetcher(false, true, false)
+	if err := fs.fetchEagerLayer(context.Background(), failing, desc); err == nil {
+		t.Fatalf("expected an error when the layer can't be stored")
+	}
+
+	// a layer in the local store isn't fetched again
+	content := []byte("stored")
+	stored := ocispec.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))}
+	if err := fs.orasStore.Push(context.Background(), stored, bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	fetcher = newFakeFetcher(false, false, false)
+	if err := fs.fetchEagerLayer(context.Background(), fetcher, stored); err != nil {
+		t.Fatalf("failed to fetch stored eager layer: %v", err)
+	}
+	if fetcher.fetchCount != 0 {
+		t.Fatalf("stored layer must not be fetched, but fetch was called %d times", fetcher.fetchCount)
+	}
+}
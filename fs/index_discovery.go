@@ -0,0 +1,157 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/log"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/reference"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// maxManifestIndexSize is the maximum size of the image index read to find the image manifest.
+const maxManifestIndexSize = 4 << 20
+
+// ErrNoSociIndex is returned when no SOCI index refers to the image manifest.
+var ErrNoSociIndex = errors.New("no SOCI index found")
+
+// discoverSociIndex finds the SOCI index of the image manifest with the given digest among the
+// manifests referring to it, through the referrers API or the referrers tag schema of the
+// repository of the image. If manifestDigest is empty, the image manifest of the default platform
+// is resolved from the image reference. Returns ErrNoSociIndex if no index refers to the manifest.
+func discoverSociIndex(ctx context.Context, refspec reference.Spec, manifestDigest string, buildToolPreference []string) (digest.Digest, error) {
+	var (
+		dgst digest.Digest
+		err  error
+	)
+	if manifestDigest != "" {
+		dgst, err = digest.Parse(manifestDigest)
+		if err != nil {
+			return "", fmt.Errorf("invalid image manifest digest %s: %w", manifestDigest, err)
+		}
+	} else {
+		dgst, err = resolveManifestDigest(ctx, newResolver(), refspec, platforms.Default())
+		if err != nil {
+			return "", err
+		}
+	}
+
+	repo, err := newRemoteStore(refspec)
+	if err != nil {
+		return "", fmt.Errorf("cannot create remote store: %w", err)
+	}
+	referrers, err := soci.ListReferrers(ctx, repo, dgst)
+	if err != nil {
+		return "", fmt.Errorf("cannot list referrers of image manifest %v: %w", dgst, err)
+	}
+	index, ok := selectSociIndex(referrers, buildToolPreference)
+	if !ok {
+		return "", fmt.Errorf("%w for image manifest %v", ErrNoSociIndex, dgst)
+	}
+	log.G(ctx).WithField("image manifest", dgst).WithField("digest", index.Digest).Infof("discovered SOCI index")
+	return index.Digest, nil
+}
+
+// selectSociIndex returns the SOCI index to use among the referrers of an image manifest.
+// The indices are ranked by the position of their build tool in buildToolPreference, indices
+// of unlisted tools coming last. Between indices of the same rank, the first one is returned.
+func selectSociIndex(referrers []soci.Referrer, buildToolPreference []string) (soci.Referrer, bool) {
+	rank := func(r soci.Referrer) int {
+		tool := r.Annotations[soci.IndexAnnotationBuildToolIdentifier]
+		for i, t := range buildToolPreference {
+			if t == tool {
+				return i
+			}
+		}
+		return len(buildToolPreference)
+	}
+	var (
+		selected soci.Referrer
+		found    bool
+	)
+	for _, r := range referrers {
+		if r.ArtifactType != soci.SociIndexArtifactType {
+			continue
+		}
+		if !found || rank(r) < rank(selected) {
+			selected = r
+			found = true
+		}
+	}
+	return selected, found
+}
+
+// resolveManifestDigest resolves the image reference to the digest of its image manifest.
+// If the reference points to an image index, the manifest of the best platform matching
+// platform is chosen.
+func resolveManifestDigest(ctx context.Context, resolver remotes.Resolver, refspec reference.Spec, platform platforms.MatchComparer) (digest.Digest, error) {
+	name, desc, err := resolver.Resolve(ctx, refspec.String())
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve image %s: %w", refspec, err)
+	}
+	switch desc.MediaType {
+	case images.MediaTypeDockerSchema2ManifestList, ocispec.MediaTypeImageIndex:
+	default:
+		return desc.Digest, nil
+	}
+
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return "", fmt.Errorf("cannot fetch image index %v: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, maxManifestIndexSize))
+	if err != nil {
+		return "", err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(b, &index); err != nil {
+		return "", fmt.Errorf("cannot decode image index %v: %w", desc.Digest, err)
+	}
+	return selectPlatformManifest(index.Manifests, platform)
+}
+
+// selectPlatformManifest returns the digest of the manifest of the best platform matching platform.
+func selectPlatformManifest(manifests []ocispec.Descriptor, platform platforms.MatchComparer) (digest.Digest, error) {
+	var selected *ocispec.Descriptor
+	for i, m := range manifests {
+		if m.Platform == nil || !platform.Match(*m.Platform) {
+			continue
+		}
+		if selected == nil || platform.Less(*m.Platform, *selected.Platform) {
+			selected = &manifests[i]
+		}
+	}
+	if selected == nil {
+		return "", fmt.Errorf("%w: no image manifest matches the platform", ErrNoSociIndex)
+	}
+	return selected.Digest, nil
+}
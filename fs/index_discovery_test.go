@@ -0,0 +1,118 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestSelectSociIndex(t *testing.T) {
+	newReferrer := func(name, artifactType, tool string) soci.Referrer {
+		r := soci.Referrer{
+			MediaType:    soci.OCIImageManifestMediaType,
+			Digest:       digest.FromString(name),
+			ArtifactType: artifactType,
+		}
+		if tool != "" {
+			r.Annotations = map[string]string{soci.IndexAnnotationBuildToolIdentifier: tool}
+		}
+		return r
+	}
+	signature := newReferrer("signature", soci.SociSignatureArtifactType, "")
+	toolA := newReferrer("tool a", soci.SociIndexArtifactType, "tool-a")
+	toolB := newReferrer("tool b", soci.SociIndexArtifactType, "tool-b")
+	noTool := newReferrer("no tool", soci.SociIndexArtifactType, "")
+
+	testCases := []struct {
+		name       string
+		referrers  []soci.Referrer
+		preference []string
+		want       *soci.Referrer
+	}{
+		{
+			name: "no referrers",
+		},
+		{
+			name:      "no SOCI index",
+			referrers: []soci.Referrer{signature},
+		},
+		{
+			name:      "first index without preference",
+			referrers: []soci.Referrer{signature, toolB, toolA},
+			want:      &toolB,
+		},
+		{
+			name:       "preferred build tool",
+			referrers:  []soci.Referrer{toolA, noTool, toolB},
+			preference: []string{"tool-b", "tool-a"},
+			want:       &toolB,
+		},
+		{
+			name:       "unlisted build tool",
+			referrers:  []soci.Referrer{noTool, toolA},
+			preference: []string{"tool-b"},
+			want:       &noTool,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := selectSociIndex(tc.referrers, tc.preference)
+			if tc.want == nil {
+				if ok {
+					t.Fatalf("expected no index, got %v", got.Digest)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("expected index %v, got none", tc.want.Digest)
+			}
+			if got.Digest != tc.want.Digest {
+				t.Fatalf("unexpected index; expected = %v, got = %v", tc.want.Digest, got.Digest)
+			}
+		})
+	}
+}
+
+func TestSelectPlatformManifest(t *testing.T) {
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ocispec.Platform{OS: "linux", Architecture: "arm64"}
+	manifests := []ocispec.Descriptor{
+		{Digest: digest.FromString("no platform")},
+		{Digest: digest.FromString("amd64"), Platform: &amd64},
+		{Digest: digest.FromString("arm64"), Platform: &arm64},
+	}
+
+	dgst, err := selectPlatformManifest(manifests, platforms.Only(arm64))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if dgst != digest.FromString("arm64") {
+		t.Fatalf("unexpected manifest; expected = %v, got = %v", digest.FromString("arm64"), dgst)
+	}
+
+	_, err = selectPlatformManifest(manifests, platforms.Only(ocispec.Platform{OS: "windows", Architecture: "amd64"}))
+	if !errors.Is(err, ErrNoSociIndex) {
+		t.Fatalf("expected ErrNoSociIndex, got %v", err)
+	}
+}
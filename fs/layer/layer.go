@@ -102,6 +102,10 @@ type Layer interface {
 	// ReadAt reads this layer.
 	ReadAt([]byte, int64, ...remote.Option) (int, error)
 
+	// Prefetch fetches the spans which the SOCI index marks to be fetched first
+	// to the cache. Nop if the index doesn't mark any span of this layer.
+	Prefetch() error
+
 	// BackgroundFetch fetches the entire layer contents to the cache.
 	// Fetching contents is done as a background task.
 	BackgroundFetch() error
@@ -333,7 +337,11 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 	}
 	log.G(ctx).Debugf("[Resolver.Resolve]Initialized metadata store for layer sha=%v", desc.Digest)
 
-	spanManager := spanmanager.New(ztoc, sr, spanCache, cache.Direct())
+	spanManager, err := spanmanager.New(ztoc, sr, spanCache, cache.Direct())
+	if err != nil {
+		meta.Close()
+		return nil, errors.Wrap(err, "failed to create span manager")
+	}
 	vr, err := reader.NewReader(meta, desc.Digest, spanManager)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to read layer")
@@ -341,6 +349,14 @@ func (r *Resolver) Resolve(ctx context.Context, hosts source.RegistryHosts, refs
 
 	pr := newPrefetcherReader(r, blobR, desc.Digest)
 	prefetcher := newPrefetcher(pr, spanManager)
+	if hint, ok := sociDesc.Annotations[soci.IndexAnnotationPrefetchSpans]; ok {
+		spans, err := soci.ParsePrefetchSpans(hint, ztoc.MaxSpanId)
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("ignoring prefetch spans of layer %s", desc.Digest)
+		} else {
+			prefetcher.withPrioritySpans(newPriorityPrefetcherReader(blobR), spans)
+		}
+	}
 
 	// Combine layer information together and cache it.
 	l := newLayer(r, desc, blobR, vr, prefetcher)
@@ -426,6 +442,7 @@ type layer struct {
 	closed   bool
 	closedMu sync.Mutex
 
+	prefetchOnce        sync.Once
 	backgroundFetchOnce sync.Once
 }
 
@@ -474,6 +491,26 @@ func (l *layer) SkipVerify() {
 	l.r = l.verifiableReader.SkipVerify()
 }
 
+func (l *layer) Prefetch() (err error) {
+	l.prefetchOnce.Do(func() {
+		if len(l.prefetcher.prioritySpans) == 0 {
+			return
+		}
+		ctx := context.Background()
+		if l.isClosed() {
+			err = fmt.Errorf("layer is already closed")
+			return
+		}
+		err = l.prefetcher.prefetchPriority()
+		if err != nil {
+			log.G(ctx).WithError(err).Warnf("failed to prefetch priority spans of layer=%v", l.desc.Digest)
+			return
+		}
+		log.G(ctx).WithField("spans", len(l.prefetcher.prioritySpans)).Debug("completed to prefetch priority spans")
+	})
+	return
+}
+
 func (l *layer) BackgroundFetch() (err error) {
 	l.backgroundFetchOnce.Do(func() {
 		ctx := context.Background()
@@ -500,6 +537,14 @@ func (l *layerRef) Done() {
 	l.done()
 }
 
+// newPriorityPrefetcherReader returns a reader of the layer for prefetching the priority
+// spans. Unlike background fetch, they are fetched right away.
+func newPriorityPrefetcherReader(blob *blobRef) *io.SectionReader {
+	return io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (int, error) {
+		return blob.ReadAt(p, offset, remote.WithCacheOpts(cache.Direct()))
+	}), 0, blob.Size())
+}
+
 func newPrefetcherReader(resolver *Resolver, blob *blobRef, digest digest.Digest) *io.SectionReader {
 	r := io.NewSectionReader(readerAtFunc(func(p []byte, offset int64) (retN int, retErr error) {
 		resolver.backgroundTaskManager.InvokeBackgroundTask(func(ctx context.Context) {
@@ -27,6 +27,9 @@ import (
 type prefetcher struct {
 	r           *io.SectionReader // reader for prefetching the layer
 	spanManager *spanmanager.SpanManager
+
+	priorityR     *io.SectionReader // reader for prefetching the priority spans
+	prioritySpans []soci.SpanId     // spans to fetch before the rest of the layer, in order
 }
 
 func newPrefetcher(r *io.SectionReader, spanManager *spanmanager.SpanManager) *prefetcher {
@@ -37,6 +40,23 @@ func newPrefetcher(r *io.SectionReader, spanManager *spanmanager.SpanManager) *p
 	return &p
 }
 
+// withPrioritySpans sets the spans to fetch with prefetchPriority, reading them from r.
+func (p *prefetcher) withPrioritySpans(r *io.SectionReader, spans []soci.SpanId) *prefetcher {
+	p.priorityR = r
+	p.prioritySpans = spans
+	return p
+}
+
+// prefetchPriority fetches the priority spans of the layer, in order.
+func (p *prefetcher) prefetchPriority() error {
+	for _, spanID := range p.prioritySpans {
+		if err := p.spanManager.ResolveSpan(spanID, p.priorityR); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (p *prefetcher) prefetch() error {
 	var spanID soci.SpanId
 	for {
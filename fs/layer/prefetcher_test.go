@@ -19,6 +19,7 @@ package layer
 import (
 	"compress/gzip"
 	"math/rand"
+	"strconv"
 	"testing"
 
 	"github.com/awslabs/soci-snapshotter/cache"
@@ -45,7 +46,10 @@ func TestPrefetcher(t *testing.T) {
 
 	spanCache := cache.NewMemoryCache()
 	defer spanCache.Close()
-	spanManager := spanmanager.New(ztoc, r, spanCache)
+	spanManager, err := spanmanager.New(ztoc, r, spanCache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 	prefetcher := newPrefetcher(r, spanManager)
 
 	err = prefetcher.prefetch()
@@ -54,6 +58,41 @@ func TestPrefetcher(t *testing.T) {
 	}
 }
 
+func TestPrefetcherPrioritySpans(t *testing.T) {
+	spanSize := 65536 // 64 KiB
+	tarEntries := []testutil.TarEntry{
+		testutil.File("file1.txt", string(genRandomByteData(300000))),
+		testutil.File("file2.txt", string(genRandomByteData(100000))),
+	}
+	ztoc, r, err := soci.BuildZtocReader(tarEntries, gzip.BestCompression, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	if ztoc.MaxSpanId < 3 {
+		t.Fatalf("expected at least 4 spans, got %d", ztoc.MaxSpanId+1)
+	}
+
+	spanCache := cache.NewMemoryCache()
+	defer spanCache.Close()
+	spanManager, err := spanmanager.New(ztoc, r, spanCache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+	prioritySpans := []soci.SpanId{ztoc.MaxSpanId, 1}
+	prefetcher := newPrefetcher(r, spanManager).withPrioritySpans(r, prioritySpans)
+
+	if err := prefetcher.prefetchPriority(); err != nil {
+		t.Fatalf("priority prefetch failed: %v", err)
+	}
+	for id := soci.SpanId(0); id <= ztoc.MaxSpanId; id++ {
+		_, err := spanCache.Get(strconv.Itoa(int(id)))
+		cached := err == nil
+		if wantCached := id == 1 || id == ztoc.MaxSpanId; cached != wantCached {
+			t.Fatalf("unexpected cache state of span %d; expected cached = %v", id, wantCached)
+		}
+	}
+}
+
 func genRandomByteData(size int) []byte {
 	b := make([]byte, size)
 	rand.Read(b)
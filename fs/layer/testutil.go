@@ -176,7 +176,11 @@ func makeNodeReader(t *testing.T, contents []byte, spanSize int64, factory metad
 	if err != nil {
 		t.Fatalf("failed to create reader: %v", err)
 	}
-	spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+	spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+	if err != nil {
+		mr.Close()
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 	vr, err := reader.NewReader(mr, digest.FromString(""), spanManager)
 	if err != nil {
 		mr.Close()
@@ -329,7 +333,10 @@ func testExistenceWithOpaque(t *testing.T, factory metadata.Store, opaque Overla
 					t.Fatalf("failed to create reader: %v", err)
 				}
 				defer mr.Close()
-				spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+				spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+				if err != nil {
+					t.Fatalf("failed to create span manager: %v", err)
+				}
 				vr, err := reader.NewReader(mr, digest.FromString(""), spanManager)
 				if err != nil {
 					t.Fatalf("failed to make new reader: %v", err)
@@ -55,6 +55,10 @@ import (
 	"github.com/pkg/errors"
 )
 
+// ErrFileDigestMismatch is returned when the contents of a file don't match the digest
+// recorded in the ztoc.
+var ErrFileDigestMismatch = errors.New("file digest mismatch")
+
 type Reader interface {
 	OpenFile(id uint32) (io.ReaderAt, error)
 	Metadata() metadata.Reader
@@ -127,10 +131,11 @@ func (vr *VerifiableReader) isClosed() bool {
 // to use for verifying file or chunk contained in this stargz blob.
 func NewReader(r metadata.Reader, layerSha digest.Digest, spanManager *spanmanager.SpanManager) (*VerifiableReader, error) {
 	vr := &reader{
-		spanManager: spanManager,
-		r:           r,
-		layerSha:    layerSha,
-		verifier:    digestVerifier,
+		spanManager:   spanManager,
+		r:             r,
+		layerSha:      layerSha,
+		verifier:      digestVerifier,
+		fileVerifiers: make(map[uint32]*fileVerifier),
 	}
 	return &VerifiableReader{r: vr, verifier: digestVerifier}, nil
 }
@@ -148,6 +153,9 @@ type reader struct {
 
 	verify   bool
 	verifier func(uint32, string) (digest.Verifier, error)
+
+	fileVerifiers   map[uint32]*fileVerifier
+	fileVerifiersMu sync.Mutex
 }
 
 func (gr *reader) Metadata() metadata.Reader {
@@ -176,13 +184,46 @@ func (gr *reader) OpenFile(id uint32) (io.ReaderAt, error) {
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to open file %d", id)
 	}
+	fv, err := gr.fileVerifier(id, fr)
+	if err != nil {
+		return nil, err
+	}
 	return &file{
 		id: id,
 		fr: fr,
 		gr: gr,
+		fv: fv,
 	}, nil
 }
 
+// fileVerifier returns the verifier of the contents of the file, or nil if the
+// ztoc doesn't record the digest of the file.
+func (gr *reader) fileVerifier(id uint32, fr metadata.File) (*fileVerifier, error) {
+	dgst := fr.GetDigest()
+	if dgst == "" {
+		return nil, nil
+	}
+	gr.fileVerifiersMu.Lock()
+	defer gr.fileVerifiersMu.Unlock()
+	if fv, ok := gr.fileVerifiers[id]; ok {
+		return fv, nil
+	}
+	fv := &fileVerifier{
+		id:      id,
+		digest:  dgst,
+		size:    fr.GetUncompressedFileSize(),
+		newHash: gr.verifier,
+	}
+	if fv.size == 0 {
+		// empty files are never read, so verify them right away.
+		if err := fv.write(0, nil); err != nil {
+			return nil, err
+		}
+	}
+	gr.fileVerifiers[id] = fv
+	return fv, nil
+}
+
 func (gr *reader) Close() (retErr error) {
 	gr.closedMu.Lock()
 	defer gr.closedMu.Unlock()
@@ -207,6 +248,7 @@ type file struct {
 	id uint32
 	fr metadata.File
 	gr *reader
+	fv *fileVerifier
 }
 
 // ReadAt reads the file when the file is requested by the container
@@ -219,11 +261,34 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	if expectedSize > soci.FileSize(len(p)) {
 		expectedSize = soci.FileSize(len(p))
 	}
-	fileOffsetStart := sf.fr.GetUncompressedOffset() + soci.FileSize(offset)
-	fileOffsetEnd := fileOffsetStart + expectedSize
+	var err error
+	if sparseMap := sf.fr.GetSparseMap(); len(sparseMap) > 0 {
+		// only the data fragments of sparse files are in the layer; holes are zeros.
+		err = soci.ReadSparse(p[:expectedSize], soci.FileSize(offset), sparseMap, sf.readData)
+	} else {
+		err = sf.readData(p[:expectedSize], soci.FileSize(offset))
+	}
+	if err != nil {
+		return 0, err
+	}
+	n := int(expectedSize)
+	if sf.fv != nil {
+		if err := sf.fv.write(soci.FileSize(offset), p[:n]); err != nil {
+			return 0, err
+		}
+	}
+	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, int64(n)) // measure the number of on demand bytes served
+
+	return n, nil
+}
+
+// readData reads the data of the file in the layer at offset into p.
+func (sf *file) readData(p []byte, offset soci.FileSize) error {
+	fileOffsetStart := sf.fr.GetUncompressedOffset() + offset
+	fileOffsetEnd := fileOffsetStart + soci.FileSize(len(p))
 	r, err := sf.gr.spanManager.GetContents(fileOffsetStart, fileOffsetEnd)
 	if err != nil {
-		return 0, errors.Wrap(err, "failed to read the file")
+		return errors.Wrap(err, "failed to read the file")
 	}
 
 	commonmetrics.IncOperationCount(commonmetrics.OnDemandRemoteRegistryFetchCount, sf.gr.layerSha) // increment the number of on demand file fetches from remote registry
@@ -231,15 +296,65 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 
 	contents, err := io.ReadAll(r)
 	if err != nil && err != io.EOF {
-		return 0, err
+		return err
 	}
 	n := copy(p, contents)
-	if soci.FileSize(n) != expectedSize {
-		return 0, fmt.Errorf("unexpected copied data size for on-demand fetch. read = %d, expected = %d", n, expectedSize)
+	if n != len(p) {
+		return fmt.Errorf("unexpected copied data size for on-demand fetch. read = %d, expected = %d", n, len(p))
 	}
-	commonmetrics.AddBytesCount(commonmetrics.OnDemandBytesServed, sf.gr.layerSha, int64(n)) // measure the number of on demand bytes served
+	return nil
+}
 
-	return n, nil
+// fileVerifier verifies the contents of a file against its digest the first time
+// the whole file is read. The contents are hashed while they are read sequentially
+// from the start of the file; reads which skip ahead are not hashed, and hashing
+// starts over the next time the file is read from the start.
+type fileVerifier struct {
+	id      uint32
+	digest  digest.Digest
+	size    soci.FileSize
+	newHash func(uint32, string) (digest.Verifier, error)
+
+	mu       sync.Mutex
+	verifier digest.Verifier
+	next     soci.FileSize // offset of the next byte to hash
+	done     bool
+	err      error
+}
+
+// write hashes the contents p read at offset. Once the end of the file is hashed, it
+// returns an error if the contents don't match the digest of the file; the same error
+// is returned for any later read of the file.
+func (fv *fileVerifier) write(offset soci.FileSize, p []byte) error {
+	fv.mu.Lock()
+	defer fv.mu.Unlock()
+	if fv.done {
+		return fv.err
+	}
+	if offset == 0 {
+		v, err := fv.newHash(fv.id, fv.digest.String())
+		if err != nil {
+			fv.done, fv.err = true, fmt.Errorf("cannot verify file %d: %w", fv.id, err)
+			return fv.err
+		}
+		fv.verifier, fv.next = v, 0
+	}
+	if fv.verifier == nil || offset > fv.next || offset+soci.FileSize(len(p)) <= fv.next {
+		return nil
+	}
+	if _, err := fv.verifier.Write(p[fv.next-offset:]); err != nil {
+		return err
+	}
+	fv.next = offset + soci.FileSize(len(p))
+	if fv.next < fv.size {
+		return nil
+	}
+	fv.done = true
+	if !fv.verifier.Verified() {
+		fv.err = fmt.Errorf("contents of file %d don't match digest %v: %w", fv.id, fv.digest, ErrFileDigestMismatch)
+	}
+	fv.verifier = nil
+	return fv.err
 }
 
 type CacheOption func(*cacheOptions)
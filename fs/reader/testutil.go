@@ -41,6 +41,7 @@ package reader
 import (
 	"bytes"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -65,7 +66,9 @@ var spanSizeCond = [3]int64{64, 128, 256}
 
 func TestSuiteReader(t *testing.T, store metadata.Store) {
 	testFileReadAt(t, store)
+	testSparseFileReadAt(t, store)
 	testFailReader(t, store)
+	testFileDigest(t, store)
 }
 
 func testFileReadAt(t *testing.T, factory metadata.Store) {
@@ -141,11 +144,47 @@ func testFileReadAt(t *testing.T, factory metadata.Store) {
 	}
 }
 
+func testSparseFileReadAt(t *testing.T, factory metadata.Store) {
+	const size = 300
+	fragments := []testutil.SparseFragment{
+		{Offset: 10, Data: "0123456789"},
+		{Offset: 100, Data: strings.Repeat("abcdefghij", 8)},
+		{Offset: 250, Data: "ABCDEFGHIJ"},
+	}
+	contents := testutil.SparseContents(size, fragments...)
+	for _, spanSize := range spanSizeCond {
+		for _, readSize := range []int{1, 7, 64, size + 10} {
+			t.Run(fmt.Sprintf("reading_sparse_file_size_%d_spansize_%d", readSize, spanSize), func(t *testing.T) {
+				f, closeFn := makeFileFromEntry(t, testutil.SparseFile("test", size, testutil.SparsePAX1x0, fragments...), factory, spanSize)
+				defer closeFn()
+				for offset := 0; offset < size; offset += 3 {
+					wantN := readSize
+					if remain := size - offset; remain < wantN {
+						wantN = remain
+					}
+					respData := make([]byte, readSize)
+					n, err := f.ReadAt(respData, int64(offset))
+					if err != nil {
+						t.Fatalf("failed to read off=%d, size=%d: %v", offset, readSize, err)
+					}
+					if !bytes.Equal(contents[offset:offset+wantN], respData[:n]) {
+						t.Fatalf("off=%d; read data{size=%d,data=%q}; want (size=%d,data=%q)",
+							offset, n, respData[:n], wantN, contents[offset:offset+wantN])
+					}
+				}
+			})
+		}
+	}
+}
+
 func makeFile(t *testing.T, contents []byte, factory metadata.Store, spanSize int64) (*file, func() error) {
+	return makeFileFromEntry(t, testutil.File("test", string(contents)), factory, spanSize)
+}
+
+// makeFileFromEntry opens the file of a layer holding a single tar entry named "test".
+func makeFileFromEntry(t *testing.T, entry testutil.TarEntry, factory metadata.Store, spanSize int64) (*file, func() error) {
 	testName := "test"
-	tarEntry := []testutil.TarEntry{
-		testutil.File(testName, string(contents)),
-	}
+	tarEntry := []testutil.TarEntry{entry}
 	ztoc, sr, err := soci.BuildZtocReader(tarEntry, gzip.DefaultCompression, spanSize)
 	if err != nil {
 		t.Fatalf("failed to build sample ztoc: %v", err)
@@ -155,7 +194,11 @@ func makeFile(t *testing.T, contents []byte, factory metadata.Store, spanSize in
 	if err != nil {
 		t.Fatalf("failed to create reader: %v", err)
 	}
-	spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+	spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+	if err != nil {
+		mr.Close()
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 	vr, err := NewReader(mr, digest.FromString(""), spanManager)
 	if err != nil {
 		mr.Close()
@@ -211,7 +254,11 @@ func testFailReader(t *testing.T, factory metadata.Store) {
 			if !found {
 				t.Fatalf("free ID not found")
 			}
-			spanManager := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+			spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+			if err != nil {
+				mr.Close()
+				t.Fatalf("failed to create span manager: %v", err)
+			}
 			vr, err := NewReader(mr, digest.FromString(""), spanManager)
 			if err != nil {
 				mr.Close()
@@ -243,3 +290,91 @@ func testFailReader(t *testing.T, factory metadata.Store) {
 		})
 	}
 }
+
+func testFileDigest(t *testing.T, factory metadata.Store) {
+	testFileName := "test"
+	tarEntry := []testutil.TarEntry{
+		testutil.File(testFileName, sampleData1),
+	}
+	tests := []struct {
+		name      string
+		digest    digest.Digest
+		offsets   []int64
+		expectErr bool
+	}{
+		{
+			name:    "matching digest",
+			digest:  digest.FromString(sampleData1),
+			offsets: []int64{0, sampleChunkSize, 2 * sampleChunkSize, lastChunkOffset1},
+		},
+		{
+			name:      "mismatching digest",
+			digest:    digest.FromString("dummy"),
+			offsets:   []int64{0, sampleChunkSize, 2 * sampleChunkSize, lastChunkOffset1},
+			expectErr: true,
+		},
+		{
+			name:    "mismatching digest, file not read sequentially",
+			digest:  digest.FromString("dummy"),
+			offsets: []int64{0, 2 * sampleChunkSize, lastChunkOffset1},
+		},
+		{
+			name:      "mismatching digest, file read again from the start",
+			digest:    digest.FromString("dummy"),
+			offsets:   []int64{lastChunkOffset1, 0, sampleChunkSize, 2 * sampleChunkSize, lastChunkOffset1},
+			expectErr: true,
+		},
+		{
+			name:    "no digest",
+			offsets: []int64{0, sampleChunkSize, 2 * sampleChunkSize, lastChunkOffset1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ztoc, sr, err := soci.BuildZtocReader(tarEntry, gzip.DefaultCompression, spanSizeCond[0])
+			if err != nil {
+				t.Fatalf("failed to build sample ztoc: %v", err)
+			}
+			for i := range ztoc.Metadata {
+				if ztoc.Metadata[i].Name == testFileName {
+					ztoc.Metadata[i].Digest = tt.digest
+				}
+			}
+			mr, err := factory(sr, ztoc)
+			if err != nil {
+				t.Fatalf("failed to prepare metadata reader")
+			}
+			defer mr.Close()
+			spanManager, err := spanmanager.New(ztoc, sr, cache.NewMemoryCache())
+			if err != nil {
+				t.Fatalf("failed to create span manager: %v", err)
+			}
+			vr, err := NewReader(mr, digest.FromString(""), spanManager)
+			if err != nil {
+				t.Fatalf("failed to make new reader: %v", err)
+			}
+			tid, _, err := mr.GetChild(mr.RootID(), testFileName)
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", testFileName, err)
+			}
+			fr, err := vr.GetReader().OpenFile(tid)
+			if err != nil {
+				t.Fatalf("failed to open file: %v", err)
+			}
+
+			var lastErr error
+			for _, off := range tt.offsets {
+				p := make([]byte, sampleChunkSize)
+				if _, err := fr.ReadAt(p, off); err != nil {
+					lastErr = err
+				}
+			}
+			if tt.expectErr && !errors.Is(lastErr, ErrFileDigestMismatch) {
+				t.Fatalf("expected ErrFileDigestMismatch, got %v", lastErr)
+			}
+			if !tt.expectErr && lastErr != nil {
+				t.Fatalf("unexpected error: %v", lastErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"fmt"
+	"io"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content"
+)
+
+// signaturePolicy is the signature policy of a registry and the keys it trusts.
+type signaturePolicy struct {
+	policy string
+	keys   []crypto.PublicKey
+}
+
+// signatureVerifier verifies the signatures of SOCI indices according to
+// the policy of the registry the image is pulled from.
+type signatureVerifier struct {
+	defaultPolicy signaturePolicy
+	registries    map[string]signaturePolicy
+}
+
+func newSignatureVerifier(cfg config.SignatureConfig) (*signatureVerifier, error) {
+	defaultPolicy, err := newSignaturePolicy(cfg.Policy, cfg.PublicKeys, nil)
+	if err != nil {
+		return nil, err
+	}
+	v := &signatureVerifier{
+		defaultPolicy: defaultPolicy,
+		registries:    make(map[string]signaturePolicy),
+	}
+	for host, rcfg := range cfg.Registries {
+		policy := rcfg.Policy
+		if policy == "" {
+			policy = defaultPolicy.policy
+		}
+		p, err := newSignaturePolicy(policy, rcfg.PublicKeys, defaultPolicy.keys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature config of registry %s: %w", host, err)
+		}
+		v.registries[host] = p
+	}
+	return v, nil
+}
+
+func newSignaturePolicy(policy string, keyPaths []string, defaultKeys []crypto.PublicKey) (signaturePolicy, error) {
+	switch policy {
+	case "":
+		policy = config.SignaturePolicyOff
+	case config.SignaturePolicyOff, config.SignaturePolicyWarn, config.SignaturePolicyEnforce:
+	default:
+		return signaturePolicy{}, fmt.Errorf("unknown signature policy %q", policy)
+	}
+	keys := append([]crypto.PublicKey{}, defaultKeys...)
+	for _, path := range keyPaths {
+		key, err := soci.LoadPublicKey(path)
+		if err != nil {
+			return signaturePolicy{}, fmt.Errorf("cannot load public key: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	if policy == config.SignaturePolicyEnforce && len(keys) == 0 {
+		return signaturePolicy{}, fmt.Errorf("signature policy %q requires at least one public key", policy)
+	}
+	return signaturePolicy{policy: policy, keys: keys}, nil
+}
+
+func (v *signatureVerifier) policyFor(host string) signaturePolicy {
+	if p, ok := v.registries[host]; ok {
+		return p
+	}
+	return v.defaultPolicy
+}
+
+// verify verifies the signature of the SOCI index with digest indexDigest.
+// Depending on the policy of the registry of the image, a missing or invalid signature is
+// either returned as an error or only logged.
+func (v *signatureVerifier) verify(ctx context.Context, fetcher *artifactFetcher, indexDigest digest.Digest) error {
+	if v == nil {
+		return nil
+	}
+	p := v.policyFor(fetcher.refspec.Hostname())
+	if p.policy == config.SignaturePolicyOff {
+		return nil
+	}
+
+	err := verifySignature(ctx, fetcher, indexDigest, p.keys)
+	if err == nil {
+		log.G(ctx).WithField("digest", indexDigest).Debugf("verified soci index signature")
+		return nil
+	}
+	if p.policy == config.SignaturePolicyWarn {
+		log.G(ctx).WithError(err).WithField("digest", indexDigest).Warnf("cannot verify soci index signature")
+		return nil
+	}
+	return err
+}
+
+func verifySignature(ctx context.Context, fetcher *artifactFetcher, indexDigest digest.Digest, keys []crypto.PublicKey) error {
+	sigDesc, err := resolveSignature(ctx, fetcher, indexDigest)
+	if err != nil {
+		return err
+	}
+	manifest, err := fetchAll(ctx, fetcher, sigDesc)
+	if err != nil {
+		return fmt.Errorf("cannot fetch soci index signature: %w", err)
+	}
+	sig, err := soci.NewIndexFromReader(bytes.NewReader(manifest))
+	if err != nil {
+		return fmt.Errorf("cannot deserialize soci index signature: %w", err)
+	}
+	if len(sig.Blobs) != 1 {
+		return fmt.Errorf("%w: signature must have exactly one payload", soci.ErrInvalidSignature)
+	}
+	payload, err := fetchAll(ctx, fetcher, sig.Blobs[0])
+	if err != nil {
+		return fmt.Errorf("cannot fetch soci index signature payload: %w", err)
+	}
+	return soci.VerifyIndexSignature(indexDigest, sig, payload, keys)
+}
+
+// resolveSignature finds the signature manifest of the index by its tag, first in
+// the local store and then in the repository of the image.
+func resolveSignature(ctx context.Context, fetcher *artifactFetcher, indexDigest digest.Digest) (ocispec.Descriptor, error) {
+	tag := soci.SignatureTag(indexDigest)
+	if resolver, ok := fetcher.localStore.(content.Resolver); ok {
+		if desc, err := resolver.Resolve(ctx, tag); err == nil {
+			return desc, nil
+		}
+	}
+	ref := fmt.Sprintf("%s:%s", fetcher.refspec.Locator, tag)
+	_, desc, err := fetcher.resolver.Resolve(ctx, ref)
+	if errdefs.IsNotFound(err) {
+		return desc, fmt.Errorf("%w: %s", soci.ErrSignatureNotFound, ref)
+	} else if err != nil {
+		return desc, fmt.Errorf("unable to resolve ref (%s): %w", ref, err)
+	}
+	return desc, nil
+}
+
+func fetchAll(ctx context.Context, fetcher *artifactFetcher, desc ocispec.Descriptor) ([]byte, error) {
+	rc, _, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	b, err := io.ReadAll(io.LimitReader(rc, desc.Size))
+	if err != nil {
+		return nil, err
+	}
+	if digest.FromBytes(b) != desc.Digest {
+		return nil, fmt.Errorf("content of %v doesn't match its digest", desc.Digest)
+	}
+	return b, nil
+}
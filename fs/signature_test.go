@@ -0,0 +1,232 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/fs/config"
+	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/reference"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestSignatureVerifier(t *testing.T) {
+	dir := t.TempDir()
+	trustedKey := writeTestPublicKey(t, dir, "trusted.pub")
+	writeTestPublicKey(t, dir, "untrusted.pub")
+	trustedPath := filepath.Join(dir, "trusted.pub")
+	untrustedPath := filepath.Join(dir, "untrusted.pub")
+
+	testCases := []struct {
+		name      string
+		cfg       config.SignatureConfig
+		signed    bool
+		expectErr bool
+	}{
+		{
+			name:   "off",
+			cfg:    config.SignatureConfig{},
+			signed: false,
+		},
+		{
+			name:   "enforce, signed",
+			cfg:    config.SignatureConfig{Policy: config.SignaturePolicyEnforce, PublicKeys: []string{trustedPath}},
+			signed: true,
+		},
+		{
+			name:      "enforce, unsigned",
+			cfg:       config.SignatureConfig{Policy: config.SignaturePolicyEnforce, PublicKeys: []string{trustedPath}},
+			signed:    false,
+			expectErr: true,
+		},
+		{
+			name:      "enforce, signed with an untrusted key",
+			cfg:       config.SignatureConfig{Policy: config.SignaturePolicyEnforce, PublicKeys: []string{untrustedPath}},
+			signed:    true,
+			expectErr: true,
+		},
+		{
+			name:   "warn, unsigned",
+			cfg:    config.SignatureConfig{Policy: config.SignaturePolicyWarn, PublicKeys: []string{trustedPath}},
+			signed: false,
+		},
+		{
+			name: "enforce, registry off",
+			cfg: config.SignatureConfig{
+				Policy:     config.SignaturePolicyEnforce,
+				PublicKeys: []string{trustedPath},
+				Registries: map[string]config.RegistrySignatureConfig{
+					"dummy.host": {Policy: config.SignaturePolicyOff},
+				},
+			},
+			signed: false,
+		},
+		{
+			name: "off, registry enforce with its own key",
+			cfg: config.SignatureConfig{
+				PublicKeys: []string{untrustedPath},
+				Registries: map[string]config.RegistrySignatureConfig{
+					"dummy.host": {Policy: config.SignaturePolicyEnforce, PublicKeys: []string{trustedPath}},
+				},
+			},
+			signed: true,
+		},
+		{
+			name: "off, other registry enforce",
+			cfg: config.SignatureConfig{
+				Registries: map[string]config.RegistrySignatureConfig{
+					"other.host": {Policy: config.SignaturePolicyEnforce, PublicKeys: []string{trustedPath}},
+				},
+			},
+			signed: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			verifier, err := newSignatureVerifier(tc.cfg)
+			if err != nil {
+				t.Fatalf("cannot create signature verifier: %v", err)
+			}
+			refspec, err := reference.Parse(imageRef)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := memory.New()
+			fetcher, err := newArtifactFetcher(refspec, store, newFakeRemoteStore(nil), &notFoundResolver{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			indexDesc := writeTestIndex(t, store)
+			if tc.signed {
+				if _, err := soci.SignIndex(ctx, store, indexDesc, trustedKey); err != nil {
+					t.Fatalf("cannot sign index: %v", err)
+				}
+			}
+
+			err = verifier.verify(ctx, fetcher, indexDesc.Digest)
+			if tc.expectErr && err == nil {
+				t.Fatalf("expected an error")
+			}
+			if !tc.expectErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tc.signed && tc.expectErr && !errors.Is(err, soci.ErrSignatureNotFound) {
+				t.Fatalf("expected ErrSignatureNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestSignatureVerifierConfig(t *testing.T) {
+	testCases := []struct {
+		name string
+		cfg  config.SignatureConfig
+	}{
+		{
+			name: "unknown policy",
+			cfg:  config.SignatureConfig{Policy: "strict"},
+		},
+		{
+			name: "enforce without keys",
+			cfg:  config.SignatureConfig{Policy: config.SignaturePolicyEnforce},
+		},
+		{
+			name: "registry enforce without keys",
+			cfg: config.SignatureConfig{
+				Registries: map[string]config.RegistrySignatureConfig{
+					"dummy.host": {Policy: config.SignaturePolicyEnforce},
+				},
+			},
+		},
+		{
+			name: "missing key",
+			cfg:  config.SignatureConfig{Policy: config.SignaturePolicyWarn, PublicKeys: []string{"/does/not/exist.pub"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := newSignatureVerifier(tc.cfg); err == nil {
+				t.Fatalf("expected an error")
+			}
+		})
+	}
+}
+
+// writeTestPublicKey generates a key and writes its public key to dir/name.
+func writeTestPublicKey(t *testing.T, dir, name string) crypto.Signer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func writeTestIndex(t *testing.T, store *memory.Store) ocispec.Descriptor {
+	subject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("image manifest"),
+		Size:      14,
+	}
+	manifest, err := json.Marshal(soci.NewIndex(nil, &subject, nil, soci.ManifestORAS))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: soci.ORASManifestMediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	if err := store.Push(context.Background(), desc, bytes.NewReader(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+type notFoundResolver struct {
+	fakeResolver
+}
+
+func (f *notFoundResolver) Resolve(_ context.Context, ref string) (string, ocispec.Descriptor, error) {
+	return "", ocispec.Descriptor{}, errdefs.ErrNotFound
+}
@@ -16,13 +16,6 @@
 
 package spanmanager
 
-// #cgo CFLAGS: -I${SRCDIR}/../../c/
-// #cgo LDFLAGS: -L${SRCDIR}/../../out -lindexer -lz
-// #include "indexer.h"
-// #include <stdlib.h>
-// #include <stdio.h>
-import "C"
-
 import (
 	"bytes"
 	"context"
@@ -33,7 +26,6 @@ import (
 	"strconv"
 	"sync"
 	"sync/atomic"
-	"unsafe"
 
 	"github.com/awslabs/soci-snapshotter/cache"
 	"github.com/awslabs/soci-snapshotter/soci"
@@ -101,7 +93,7 @@ func (s *span) validateStateTransition(newState spanState) error {
 type SpanManager struct {
 	cache    cache.BlobCache
 	cacheOpt []cache.Option
-	index    *C.struct_gzip_index
+	zinfo    soci.Zinfo
 	r        *io.SectionReader // reader for contents of the spans managed by SpanManager
 	spans    []*span
 	ztoc     *soci.Ztoc
@@ -120,13 +112,16 @@ type spanInfo struct {
 	spanIndexInBuf []soci.FileSize
 }
 
-func New(ztoc *soci.Ztoc, r *io.SectionReader, cache cache.BlobCache, cacheOpt ...cache.Option) *SpanManager {
-	index := C.blob_to_index(unsafe.Pointer(&ztoc.IndexByteData[0]))
+func New(ztoc *soci.Ztoc, r *io.SectionReader, cache cache.BlobCache, cacheOpt ...cache.Option) (*SpanManager, error) {
+	zinfo, err := soci.NewZinfoFromZtoc(ztoc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create zinfo from ztoc: %w", err)
+	}
 	spans := make([]*span, ztoc.MaxSpanId+1)
 	m := &SpanManager{
 		cache:    cache,
 		cacheOpt: cacheOpt,
-		index:    index,
+		zinfo:    zinfo,
 		r:        r,
 		spans:    spans,
 		ztoc:     ztoc,
@@ -136,30 +131,18 @@ func New(ztoc *soci.Ztoc, r *io.SectionReader, cache cache.BlobCache, cacheOpt .
 		m.Close()
 	})
 
-	return m
+	return m, nil
 }
 
 func (m *SpanManager) buildAllSpans() {
-	m.spans[0] = &span{
-		id:                0,
-		startCompOffset:   soci.FileSize(C.get_comp_off(m.index, C.int(0))),
-		endCompOffset:     m.getEndCompressedOffset(0),
-		startUncompOffset: soci.FileSize(C.get_ucomp_off(m.index, C.int(0))),
-		endUncompOffset:   m.getEndUncompressedOffset(0),
-	}
-	m.spans[0].state.Store(unrequested)
 	var i soci.SpanId
-	for i = 1; i <= m.ztoc.MaxSpanId; i++ {
-		startCompOffset := m.spans[i-1].endCompOffset
-		if C.has_bits(m.index, C.int(i)) != 0 {
-			startCompOffset -= 1
-		}
+	for i = 0; i <= m.ztoc.MaxSpanId; i++ {
 		s := span{
 			id:                i,
-			startCompOffset:   startCompOffset,
-			endCompOffset:     m.getEndCompressedOffset(i),
-			startUncompOffset: m.spans[i-1].endUncompOffset,
-			endUncompOffset:   m.getEndUncompressedOffset(i),
+			startCompOffset:   m.zinfo.StartCompressedOffset(i),
+			endCompOffset:     m.zinfo.EndCompressedOffset(i, m.ztoc.CompressedFileSize),
+			startUncompOffset: m.zinfo.StartUncompressedOffset(i),
+			endUncompOffset:   m.zinfo.EndUncompressedOffset(i, m.ztoc.UncompressedFileSize),
 		}
 		m.spans[i] = &s
 		m.spans[i].state.Store(unrequested)
@@ -225,8 +208,8 @@ func (m *SpanManager) GetContents(offsetStart, offsetEnd soci.FileSize) (io.Read
 
 // getSpanInfo returns spanInfo from the offsets of the requested file
 func (m *SpanManager) getSpanInfo(offsetStart, offsetEnd soci.FileSize) *spanInfo {
-	spanStart := soci.SpanId(C.pt_index_from_ucmp_offset(m.index, C.long(offsetStart)))
-	spanEnd := soci.SpanId(C.pt_index_from_ucmp_offset(m.index, C.long(offsetEnd)))
+	spanStart := m.zinfo.UncompressedOffsetToSpanID(offsetStart)
+	spanEnd := m.zinfo.UncompressedOffsetToSpanID(offsetEnd)
 	numSpans := spanEnd - spanStart + 1
 	start := make([]soci.FileSize, numSpans)
 	end := make([]soci.FileSize, numSpans)
@@ -387,18 +370,18 @@ func (m *SpanManager) fetchSpan(buf []byte, spanId soci.SpanId, r *io.SectionRea
 
 func (m *SpanManager) uncompressSpan(s *span, compressedBuf []byte) ([]byte, error) {
 	uncompSize := s.endUncompOffset - s.startUncompOffset
-	bytes := make([]byte, uncompSize)
 
 	// Theoretically, a span can be empty. If that happens, just return an empty buffer.
 	if uncompSize == 0 {
-		return bytes, nil
+		return []byte{}, nil
 	}
 
-	ret := C.extract_data_from_buffer(unsafe.Pointer(&compressedBuf[0]), C.off_t(len(compressedBuf)), m.index, C.off_t(s.startUncompOffset), unsafe.Pointer(&bytes[0]), C.off_t(uncompSize), C.int(s.id))
-	if ret <= 0 {
-		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
+	// The span of an uncompressed layer is its uncompressed content.
+	if m.isUncompressedLayer() {
+		return compressedBuf, nil
 	}
-	return bytes, nil
+
+	return m.zinfo.ExtractDataFromBuffer(compressedBuf, uncompSize, s.startUncompOffset, s.id)
 }
 
 func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader, isPrefetch bool) ([]byte, error) {
@@ -419,7 +402,9 @@ func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader,
 	}
 
 	id := strconv.Itoa(int(spanId))
-	if isPrefetch {
+	// The spans of uncompressed layers don't need to be uncompressed,
+	// so they are always cached in Uncompressed state.
+	if isPrefetch && !m.isUncompressedLayer() {
 		m.addSpanToCache(id, compressedBuf, m.cacheOpt...)
 		if err != nil {
 			return nil, err
@@ -442,27 +427,12 @@ func (m *SpanManager) fetchAndCacheSpan(spanId soci.SpanId, r *io.SectionReader,
 	}
 }
 
-func (m *SpanManager) getEndCompressedOffset(spanId soci.SpanId) soci.FileSize {
-	var end soci.FileSize
-	if spanId == m.ztoc.MaxSpanId {
-		end = m.ztoc.CompressedFileSize
-	} else {
-		end = soci.FileSize(C.get_comp_off(m.index, C.int(1+int(spanId))))
-	}
-	return end
-}
-
-func (m *SpanManager) getEndUncompressedOffset(spanId soci.SpanId) soci.FileSize {
-	var end soci.FileSize
-	if spanId == m.ztoc.MaxSpanId {
-		end = m.ztoc.UncompressedFileSize
-	} else {
-		end = soci.FileSize(C.get_ucomp_off(m.index, C.int(1+int(spanId))))
-	}
-	return end
+// isUncompressedLayer returns true if the spans of the layer are stored without compression.
+func (m *SpanManager) isUncompressedLayer() bool {
+	return m.ztoc.CompressionAlgorithm == soci.CompressionUncompressed
 }
 
 func (m *SpanManager) Close() {
-	C.free_index(m.index)
+	m.zinfo.Close()
 	m.cache.Close()
 }
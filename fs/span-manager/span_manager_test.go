@@ -92,7 +92,10 @@ func TestSpanManager(t *testing.T) {
 
 			cache := cache.NewMemoryCache()
 			defer cache.Close()
-			m := New(ztoc, r, cache)
+			m, err := New(ztoc, r, cache)
+			if err != nil {
+				return
+			}
 
 			// Test GetContent
 			fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, fileName)
@@ -122,6 +125,120 @@ func TestSpanManager(t *testing.T) {
 	}
 }
 
+func TestSpanManagerZstd(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	testCases := []struct {
+		name      string
+		frameSize int
+		numFiles  int
+	}{
+		{
+			name:      "single frame",
+			frameSize: 0,
+			numFiles:  10,
+		},
+		{
+			name:      "frames smaller than spans",
+			frameSize: 16384,
+			numFiles:  10,
+		},
+		{
+			name:      "frames larger than spans",
+			frameSize: 200000,
+			numFiles:  10,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tarEntries []testutil.TarEntry
+			contents := make(map[string][]byte)
+			for i := 0; i < tc.numFiles; i++ {
+				name := fmt.Sprintf("file-%d", i)
+				contents[name] = genRandomByteData(spanSize/2 + soci.FileSize(rand.Intn(int(spanSize))))
+				tarEntries = append(tarEntries, testutil.File(name, string(contents[name])))
+			}
+
+			ztoc, r, err := soci.BuildZstdZtocReader(tarEntries, tc.frameSize, int64(spanSize))
+			if err != nil {
+				t.Fatalf("failed to create ztoc: %v", err)
+			}
+			if tc.frameSize > 0 && ztoc.MaxSpanId == 0 {
+				t.Fatalf("expected a multi-frame layer to have more than one span")
+			}
+
+			cache := cache.NewMemoryCache()
+			defer cache.Close()
+			m, err := New(ztoc, r, cache)
+			if err != nil {
+				t.Fatalf("failed to create span manager: %v", err)
+			}
+
+			for name, content := range contents {
+				fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, name)
+				if err != nil {
+					t.Fatalf("failed to get contents of %s: %v", name, err)
+				}
+				if !bytes.Equal(content, fileContentFromSpans) {
+					t.Fatalf("file contents of %s are not the same as span contents", name)
+				}
+			}
+
+			var i soci.SpanId
+			for i = 0; i <= ztoc.MaxSpanId; i++ {
+				if err := m.ResolveSpan(i, r); err != nil {
+					t.Fatalf("error resolving span %d. error: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestSpanManagerUncompressed(t *testing.T) {
+	var spanSize soci.FileSize = 65536 // 64 KiB
+	var tarEntries []testutil.TarEntry
+	contents := make(map[string][]byte)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		contents[name] = genRandomByteData(spanSize/2 + soci.FileSize(rand.Intn(int(spanSize))))
+		tarEntries = append(tarEntries, testutil.File(name, string(contents[name])))
+	}
+	ztoc, r, err := soci.BuildTarZtocReader(tarEntries, int64(spanSize))
+	if err != nil {
+		t.Fatalf("failed to create ztoc: %v", err)
+	}
+	spanCache := cache.NewMemoryCache()
+	defer spanCache.Close()
+	m, err := New(ztoc, r, spanCache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+
+	for name, content := range contents {
+		fileContentFromSpans, err := getFileContentFromSpans(m, ztoc, name)
+		if err != nil {
+			t.Fatalf("failed to get contents of %s: %v", name, err)
+		}
+		if !bytes.Equal(content, fileContentFromSpans) {
+			t.Fatalf("file contents of %s are not the same as span contents", name)
+		}
+	}
+
+	// prefetched spans don't need to be uncompressed
+	prefetchCache := cache.NewMemoryCache()
+	defer prefetchCache.Close()
+	m, err = New(ztoc, r, prefetchCache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
+	if err := m.ResolveSpan(ztoc.MaxSpanId, r); err != nil {
+		t.Fatalf("error resolving span %d: %v", ztoc.MaxSpanId, err)
+	}
+	if state := m.spans[ztoc.MaxSpanId].state.Load().(spanState); state != uncompressed {
+		t.Fatalf("prefetched span of an uncompressed layer should be in Uncompressed state")
+	}
+}
+
 func TestSpanManagerCache(t *testing.T) {
 	var spanSize soci.FileSize = 65536 // 64 KiB
 	content := genRandomByteData(spanSize)
@@ -134,7 +251,10 @@ func TestSpanManagerCache(t *testing.T) {
 	}
 	cache := cache.NewMemoryCache()
 	defer cache.Close()
-	m := New(ztoc, r, cache)
+	m, err := New(ztoc, r, cache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 	spanID := 0
 	err = m.ResolveSpan(soci.SpanId(spanID), r)
 	if err != nil {
@@ -189,7 +309,10 @@ func TestStateTransition(t *testing.T) {
 	}
 	cache := cache.NewMemoryCache()
 	defer cache.Close()
-	m := New(ztoc, r, cache)
+	m, err := New(ztoc, r, cache)
+	if err != nil {
+		t.Fatalf("failed to create span manager: %v", err)
+	}
 
 	// check initial span states
 	for i := uint32(0); i <= uint32(ztoc.MaxSpanId); i++ {
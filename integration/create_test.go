@@ -108,8 +108,8 @@ func TestSociCreateSparseIndex(t *testing.T) {
 			}
 
 			blobs := index.Blobs
-			if len(blobs) != len(includedLayers) {
-				t.Fatalf("unexpected blob count; expected=%v, got=%v", len(includedLayers), len(blobs))
+			if len(blobs) != len(imageManifest.Layers) {
+				t.Fatalf("unexpected blob count; expected=%v, got=%v", len(imageManifest.Layers), len(blobs))
 			}
 
 			for _, blob := range blobs {
@@ -118,7 +118,11 @@ func TestSociCreateSparseIndex(t *testing.T) {
 				blobDigest := digest.FromBytes(blobContent)
 				layerDigest := blob.Annotations[soci.IndexAnnotationImageLayerDigest]
 
-				if _, ok := includedLayers[layerDigest]; !ok {
+				_, included := includedLayers[layerDigest]
+				if soci.IsEagerLayer(blob) == included {
+					if included {
+						t.Fatalf("layer %v is marked for eager download but should have a ztoc", layerDigest)
+					}
 					t.Fatalf("found ztoc for layer %v in index but should not have built ztoc for it", layerDigest)
 				}
 
@@ -17,9 +17,16 @@
 package integration
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/awslabs/soci-snapshotter/soci"
 	shell "github.com/awslabs/soci-snapshotter/util/dockershell"
 	"github.com/awslabs/soci-snapshotter/util/testutil"
 	"github.com/opencontainers/go-digest"
@@ -100,6 +107,57 @@ level = "debug"
 	}
 }
 
+func TestSociArtifactsPushSigned(t *testing.T) {
+	var (
+		registryHost  = "registry-" + xid.New().String() + ".test"
+		registryUser  = "dummyuser"
+		registryPass  = "dummypass"
+		registryCreds = func() string { return registryUser + ":" + registryPass }
+		signKeyPath   = "/tmp/soci-sign-key.pem"
+	)
+
+	sh, _, done := newShellWithRegistry(t, registryHost, registryUser, registryPass)
+	defer done()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate signing key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal signing key: %v", err)
+	}
+	if err := testutil.WriteFileContents(sh, signKeyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("failed to write %v: %v", signKeyPath, err)
+	}
+
+	dockerhub := func(name string) imageInfo {
+		return imageInfo{dockerLibrary + name, "", false}
+	}
+	mirror := func(name string) imageInfo {
+		return imageInfo{registryHost + "/" + name, registryUser + ":" + registryPass, false}
+	}
+
+	rebootContainerd(t, sh, "", "")
+
+	imageName := ubuntuImage
+	copyImage(sh, dockerhub(imageName), mirror(imageName))
+	indexDigest, err := digest.Parse(optimizeImage(sh, mirror(imageName)))
+	if err != nil {
+		t.Fatalf("unexpected index digest: %v", err)
+	}
+	output := string(sh.O("soci", "push", "--user", registryCreds(), "--sign-key", signKeyPath, mirror(imageName).ref))
+
+	// the index is signed in the local store, and its signature is pushed along with it
+	layout := string(sh.O("cat", "/var/lib/soci-snapshotter-grpc/content/index.json"))
+	if !strings.Contains(layout, soci.SignatureTag(indexDigest)) {
+		t.Fatalf("signature of index %v isn't tagged in the local store", indexDigest)
+	}
+	if !strings.Contains(output, fmt.Sprintf("of soci index %v", indexDigest)) {
+		t.Fatalf("signature of index %v wasn't pushed: %s", indexDigest, output)
+	}
+}
+
 func getSociLocalStoreContentDigest(sh *shell.Shell) digest.Digest {
 	content := sh.O("ls", "/var/lib/soci-snapshotter-grpc/content/blobs/sha256")
 	return digest.FromBytes(content)
@@ -40,6 +40,7 @@ import (
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/soci"
 	"github.com/awslabs/soci-snapshotter/util/dbutil"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	bolt "go.etcd.io/bbolt"
 )
@@ -73,6 +74,7 @@ import (
 //         - spanStart : <varint>           : the first span for the data.
 //         - spanEnd : <varint>             : the last span for the data.
 //         - firstSpanHasBits : <varint>    : flag for if there is partial uncompressed data that is stored in the previous byte.
+//         - digest : <string>              : the digest of the contents of a regular file, if recorded in the ztoc.
 
 var (
 	bucketKeyFilesystems = []byte("filesystems")
@@ -100,6 +102,8 @@ var (
 	bucketKeySpanStart          = []byte("spanStart")
 	bucketKeySpanEnd            = []byte("spanEnd")
 	bucketKeyFirstSpanHasBits   = []byte("firstSpanHasBits")
+	bucketKeyDigest             = []byte("digest")
+	bucketKeySparseMap          = []byte("sparseMap")
 )
 
 type childEntry struct {
@@ -113,6 +117,8 @@ type metadataEntry struct {
 	SpanStart          soci.SpanId
 	SpanEnd            soci.SpanId
 	FirstSpanHasBits   string
+	Digest             digest.Digest
+	SparseMap          []soci.SparseEntry
 }
 
 func getNodes(tx *bolt.Tx, fsID string) (*bolt.Bucket, error) {
@@ -369,9 +375,47 @@ func writeMetadataEntry(md *bolt.Bucket, m *metadataEntry) error {
 	if err := md.Put(bucketKeyFirstSpanHasBits, []byte(m.FirstSpanHasBits)); err != nil {
 		return errors.Wrapf(err, "failed to set SpanEnd value %s", m.FirstSpanHasBits)
 	}
+	if m.Digest != "" {
+		if err := md.Put(bucketKeyDigest, []byte(m.Digest)); err != nil {
+			return errors.Wrapf(err, "failed to set Digest value %s", m.Digest)
+		}
+	}
+	if len(m.SparseMap) > 0 {
+		if err := md.Put(bucketKeySparseMap, encodeSparseMap(m.SparseMap)); err != nil {
+			return errors.Wrapf(err, "failed to set SparseMap value")
+		}
+	}
 	return nil
 }
 
+// encodeSparseMap encodes the offsets and sizes of the fragments of a sparse map as varints.
+func encodeSparseMap(sparseMap []soci.SparseEntry) []byte {
+	b := make([]byte, len(sparseMap)*2*binary.MaxVarintLen64)
+	n := 0
+	for _, e := range sparseMap {
+		n += binary.PutUvarint(b[n:], uint64(e.Offset))
+		n += binary.PutUvarint(b[n:], uint64(e.Size))
+	}
+	return b[:n]
+}
+
+func decodeSparseMap(b []byte) ([]soci.SparseEntry, error) {
+	var sparseMap []soci.SparseEntry
+	for len(b) > 0 {
+		offset, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid sparse map")
+		}
+		size, m := binary.Uvarint(b[n:])
+		if m <= 0 {
+			return nil, fmt.Errorf("invalid sparse map")
+		}
+		sparseMap = append(sparseMap, soci.SparseEntry{Offset: soci.FileSize(offset), Size: soci.FileSize(size)})
+		b = b[n+m:]
+	}
+	return sparseMap, nil
+}
+
 func putFileSize(b *bolt.Bucket, k []byte, v soci.FileSize) error {
 	return putInt(b, k, int64(v))
 }
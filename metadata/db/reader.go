@@ -49,6 +49,7 @@ import (
 
 	"github.com/awslabs/soci-snapshotter/metadata"
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	"github.com/rs/xid"
 	bolt "go.etcd.io/bbolt"
@@ -259,6 +260,8 @@ func (r *reader) initNodes(ztoc *soci.Ztoc) error {
 				md[id].SpanStart = ent.SpanStart
 				md[id].SpanEnd = ent.SpanEnd
 				md[id].FirstSpanHasBits = strconv.FormatBool(ent.FirstSpanHasBits)
+				md[id].Digest = ent.Digest
+				md[id].SparseMap = ent.SparseMap
 			}
 		}
 		return nil
@@ -508,6 +511,8 @@ func (r *reader) ForeachChild(id uint32, f func(name string, id uint32, mode os.
 func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 	var size int64
 	var uncompressedOffset soci.FileSize
+	var dgst digest.Digest
+	var sparseMap []soci.SparseEntry
 
 	if err := r.view(func(tx *bolt.Tx) error {
 		nodes, err := getNodes(tx, r.fsID)
@@ -529,12 +534,16 @@ func (r *reader) OpenFile(id uint32) (metadata.File, error) {
 		}
 		if md, err := getMetadataBucketByID(metadataEntries, id); err == nil {
 			uncompressedOffset = getUncompressedOffset(md)
+			dgst = digest.Digest(md.Get(bucketKeyDigest))
+			if sparseMap, err = decodeSparseMap(md.Get(bucketKeySparseMap)); err != nil {
+				return errors.Wrapf(err, "failed to get sparse map of %d", id)
+			}
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	return &file{uncompressedOffset, soci.FileSize(size)}, nil
+	return &file{uncompressedOffset, soci.FileSize(size), dgst, sparseMap}, nil
 }
 
 func getUncompressedOffset(md *bolt.Bucket) soci.FileSize {
@@ -545,6 +554,8 @@ func getUncompressedOffset(md *bolt.Bucket) soci.FileSize {
 type file struct {
 	uncompressedOffset soci.FileSize
 	uncompressedSize   soci.FileSize
+	digest             digest.Digest
+	sparseMap          []soci.SparseEntry
 }
 
 func (fr *file) GetUncompressedFileSize() soci.FileSize {
@@ -555,8 +566,16 @@ func (fr *file) GetUncompressedOffset() soci.FileSize {
 	return fr.uncompressedOffset
 }
 
+func (fr *file) GetDigest() digest.Digest {
+	return fr.digest
+}
+
+func (fr *file) GetSparseMap() []soci.SparseEntry {
+	return fr.sparseMap
+}
+
 func attrFromZtocEntry(src *soci.FileMetadata, dst *metadata.Attr) *metadata.Attr {
-	dst.Size = int64(src.UncompressedSize)
+	dst.Size = int64(src.Size())
 	dst.ModTime = src.ModTime
 	dst.LinkName = src.Linkname
 	dst.Mode = soci.GetFileMode(src)
@@ -38,6 +38,7 @@ import (
 	"time"
 
 	"github.com/awslabs/soci-snapshotter/soci"
+	"github.com/opencontainers/go-digest"
 )
 
 // Attr reprensents the attributes of a node.
@@ -92,6 +93,12 @@ type Reader interface {
 type File interface {
 	GetUncompressedFileSize() soci.FileSize
 	GetUncompressedOffset() soci.FileSize
+	// GetDigest returns the digest of the contents of the file, or an empty digest
+	// if the ztoc doesn't record it.
+	GetDigest() digest.Digest
+	// GetSparseMap returns the data fragments of a sparse file, or nil if the file isn't
+	// sparse. See soci.FileMetadata.
+	GetSparseMap() []soci.SparseEntry
 }
 
 type Options struct {
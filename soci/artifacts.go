@@ -40,6 +40,8 @@ import (
 //         - platform: <string>         : the platform for the index
 //         - location: <string>         : the location of the artifact
 //         - type: <string>             : the type of the artifact (can be either "soci_index" or "soci_layer")
+//         - media_type: <string>       : the media type of the artifact
+//         - span_size: <varint>        : the span size the ztoc was built with (soci_layer only)
 
 // ArtifactsDB is a store for SOCI artifact metadata
 type ArtifactsDb struct {
@@ -58,6 +60,7 @@ var (
 	bucketKeyLocation       = []byte("location")
 	bucketKeyType           = []byte("type")
 	bucketKeyMediaType      = []byte("media_type")
+	bucketKeySpanSize       = []byte("span_size")
 
 	artifactsDbName = "artifacts.db"
 	// ArtifactEntryTypeIndex indicates that an ArtifactEntry is a SOCI index artifact
@@ -89,6 +92,9 @@ type ArtifactEntry struct {
 	Type ArtifactEntryType
 	// Media Type of the stored artifact
 	MediaType string
+	// SpanSize is the span size a SOCI layer artifact was built with.
+	// It is 0 for SOCI index artifacts and for entries written before it was recorded.
+	SpanSize int64
 }
 
 func getIndexArtifactEntries(indexDigest string) ([]ArtifactEntry, error) {
@@ -153,6 +159,30 @@ func (db *ArtifactsDb) getIndexArtifactEntries(indexDigest string) ([]ArtifactEn
 
 }
 
+// getLayerArtifactEntries returns the entries of the SOCI layer artifacts (ztocs) built for the layer.
+func (db *ArtifactsDb) getLayerArtifactEntries(layerDigest string) ([]ArtifactEntry, error) {
+	artifactEntries := []ArtifactEntry{}
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		if ae.Type == ArtifactEntryTypeLayer && ae.OriginalDigest == layerDigest {
+			artifactEntries = append(artifactEntries, *ae)
+		}
+		return nil
+	})
+	return artifactEntries, err
+}
+
+// getAllIndexArtifactEntries returns the entries of all SOCI index artifacts.
+func (db *ArtifactsDb) getAllIndexArtifactEntries() ([]ArtifactEntry, error) {
+	artifactEntries := []ArtifactEntry{}
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		if ae.Type == ArtifactEntryTypeIndex {
+			artifactEntries = append(artifactEntries, *ae)
+		}
+		return nil
+	})
+	return artifactEntries, err
+}
+
 // Walk applys a function to all ArtifactEntries in the ArtifactsDB
 func (db *ArtifactsDb) Walk(f func(*ArtifactEntry) error) error {
 	err := db.db.View(func(tx *bolt.Tx) error {
@@ -217,6 +247,20 @@ func (db *ArtifactsDb) WriteArtifactEntry(entry *ArtifactEntry) error {
 	return err
 }
 
+// RemoveArtifactEntryByDigest removes the ArtifactEntry with the given digest from the ArtifactsDB.
+func (db *ArtifactsDb) RemoveArtifactEntryByDigest(digest string) error {
+	return db.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := getArtifactsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if bucket.Bucket([]byte(digest)) == nil {
+			return fmt.Errorf("couldn't remove artifact for %s, %w", digest, errdefs.ErrNotFound)
+		}
+		return bucket.DeleteBucket([]byte(digest))
+	})
+}
+
 func getArtifactsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
 	artifacts := tx.Bucket(bucketKeySociArtifacts)
 	if artifacts == nil {
@@ -249,6 +293,13 @@ func loadArtifact(artifactBkt *bolt.Bucket, digest string) (*ArtifactEntry, erro
 	ae.ImageDigest = string(artifactBkt.Get(bucketKeyImageDigest))
 	ae.Platform = string(artifactBkt.Get(bucketKeyPlatform))
 	ae.MediaType = string(artifactBkt.Get(bucketKeyMediaType))
+	if encodedSpanSize := artifactBkt.Get(bucketKeySpanSize); encodedSpanSize != nil {
+		spanSize, err := dbutil.DecodeInt(encodedSpanSize)
+		if err != nil {
+			return nil, err
+		}
+		ae.SpanSize = spanSize
+	}
 	return &ae, nil
 }
 
@@ -266,6 +317,10 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 	if err != nil {
 		return err
 	}
+	spanSizeInBytes, err := dbutil.EncodeInt(ae.SpanSize)
+	if err != nil {
+		return err
+	}
 
 	updates := []struct {
 		key []byte
@@ -278,6 +333,7 @@ func putArtifactEntry(artifacts *bolt.Bucket, ae *ArtifactEntry) error {
 		{bucketKeyPlatform, []byte(ae.Platform)},
 		{bucketKeyType, []byte(ae.Type)},
 		{bucketKeyMediaType, []byte(ae.MediaType)},
+		{bucketKeySpanSize, spanSizeInBytes},
 	}
 
 	for _, update := range updates {
@@ -0,0 +1,297 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/images/converter"
+	"github.com/containerd/containerd/labels"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// convertedGzipHeader is the header of the gzip member of a converted layer: no flags,
+// no modification time, and an unknown OS, like the header written by compress/gzip.
+var convertedGzipHeader = []byte{gzipID1, gzipID2, 8, 0, 0, 0, 0, 0, 0, 255}
+
+// ConvertLayerFunc returns a layer convert function for containerd's image converter, which
+// recompresses the gzip layers of an image with ConvertGzipLayer. The ztoc of each new layer is
+// written to store and recorded in the artifacts db, so that BuildSociIndex reuses it when it's
+// called with the same options. Layers which aren't compressed with gzip, or which are too small
+// to get a ztoc, are left as is.
+func ConvertLayerFunc(spanSize int64, store orascontent.Storage, opts ...BuildOption) (converter.ConvertFunc, error) {
+	var cfg buildConfig
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	return func(ctx context.Context, cs content.Store, desc ocispec.Descriptor) (*ocispec.Descriptor, error) {
+		if !images.IsLayerType(desc.MediaType) || skipBuildingZtoc(desc, &cfg) {
+			return nil, nil
+		}
+		compression, err := images.DiffCompression(ctx, desc.MediaType)
+		if err != nil {
+			return nil, fmt.Errorf("could not determine layer compression: %w", err)
+		}
+		if compression == "unknown" {
+			compression, err = detectCompression(ctx, cs, desc)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if compression != CompressionGzip {
+			return nil, nil
+		}
+		newDesc, ztoc, err := convertLayer(ctx, cs, desc, spanSize, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("cannot convert layer %s: %w", desc.Digest, err)
+		}
+
+		ztocReader, ztocDesc, err := NewZtocReader(ztoc)
+		if err != nil {
+			return nil, err
+		}
+		err = store.Push(ctx, ztocDesc, ztocReader)
+		if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+			return nil, fmt.Errorf("cannot push ztoc to local store: %w", err)
+		}
+		if !cfg.noArtifactsDB {
+			entry := &ArtifactEntry{
+				Size:           ztocDesc.Size,
+				Digest:         ztocDesc.Digest.String(),
+				OriginalDigest: newDesc.Digest.String(),
+				Type:           ArtifactEntryTypeLayer,
+				Location:       newDesc.Digest.String(),
+				SpanSize:       spanSize,
+			}
+			if err := writeArtifactEntry(entry); err != nil {
+				return nil, err
+			}
+		}
+		return newDesc, nil
+	}, nil
+}
+
+// convertLayer writes the layer converted by ConvertGzipLayer to cs. The new layer is labeled
+// with the digest of its uncompressed data, which is the same as the one of the original layer.
+func convertLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, spanSize int64, cfg *buildConfig) (*ocispec.Descriptor, *Ztoc, error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ra.Close()
+	w, err := content.OpenWriter(ctx, cs, content.WithRef("soci-convert-"+desc.Digest.String()))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer w.Close()
+
+	digester := digest.Canonical.Digester()
+	ztoc, uncompressed, err := convertGzipLayer(io.NewSectionReader(ra, 0, desc.Size), io.MultiWriter(w, digester.Hash()), spanSize, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	newDesc := ocispec.Descriptor{
+		MediaType: desc.MediaType,
+		Digest:    digester.Digest(),
+		Size:      int64(ztoc.CompressedFileSize),
+	}
+	info := content.Info{
+		Digest: newDesc.Digest,
+		Labels: map[string]string{labels.LabelUncompressed: uncompressed.String()},
+	}
+	if err := w.Commit(ctx, newDesc.Size, newDesc.Digest, content.WithLabels(info.Labels)); err != nil {
+		if !errdefs.IsAlreadyExists(err) {
+			return nil, nil, err
+		}
+		if _, err := cs.Update(ctx, info, "labels."+labels.LabelUncompressed); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &newDesc, ztoc, nil
+}
+
+// ConvertGzipLayer recompresses the gzip-compressed tar read from r as a single gzip member
+// written to w, with a full flush at the start of every span of spanSize bytes of uncompressed
+// data. No compressed data refers to the data before a full flush, so each span can be
+// decompressed on its own, and the checkpoints of the ztoc of the new layer, which is returned,
+// don't need any window. The spans of the ztoc are fixed, regardless of the span placement of
+// the options. The new layer is still a regular gzip stream with the same uncompressed data.
+func ConvertGzipLayer(r io.Reader, w io.Writer, spanSize int64, opts ...BuildOption) (*Ztoc, error) {
+	var cfg buildConfig
+	for _, o := range opts {
+		if err := o(&cfg); err != nil {
+			return nil, err
+		}
+	}
+	ztoc, _, err := convertGzipLayer(r, w, spanSize, &cfg)
+	return ztoc, err
+}
+
+// convertGzipLayer converts a gzip layer as described by ConvertGzipLayer, and also returns
+// the digest of its uncompressed data.
+func convertGzipLayer(r io.Reader, w io.Writer, spanSize int64, cfg *buildConfig) (*Ztoc, digest.Digest, error) {
+	if spanSize <= 0 {
+		return nil, "", fmt.Errorf("invalid span size %d", spanSize)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot read gzip layer: %w", err)
+	}
+	defer zr.Close()
+
+	spans := &spanDigester{}
+	out := &countingWriter{w: io.MultiWriter(w, spans)}
+	if _, err := out.Write(convertedGzipHeader); err != nil {
+		return nil, "", err
+	}
+	fw, err := newSpanFlushWriter(out, spans, FileSize(spanSize))
+	if err != nil {
+		return nil, "", err
+	}
+	uncompressed := digest.Canonical.Digester()
+	pt := &positionTrackerReader{r: io.TeeReader(zr, io.MultiWriter(fw, uncompressed.Hash()))}
+	fm, err := getFileMetadata(pt, cfg.fileDigests)
+	if err != nil {
+		return nil, "", err
+	}
+	// recompress the rest of the layer, e.g. the padding after the end of the tar
+	if _, err := io.Copy(io.Discard, pt); err != nil {
+		return nil, "", err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, "", err
+	}
+
+	zinfo, err := newGzipZinfoFromCheckpoints(fw.checkpoints, FileSize(spanSize))
+	if err != nil {
+		return nil, "", err
+	}
+	defer zinfo.Close()
+	ztoc, err := newZtoc(zinfo, fm, spans.digests(), out.n, pt.CurrentPos(), CompressionGzip, "", cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	return ztoc, uncompressed.Digest(), nil
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n FileSize
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += FileSize(n)
+	return n, err
+}
+
+// spanFlushWriter compresses the data written to it as a raw deflate stream, followed by
+// the gzip trailer once closed. At the start of every span, the deflate stream is flushed
+// to a byte boundary and compression starts over with an empty dictionary, which is a full
+// flush: the start of the span is a checkpoint without a window.
+type spanFlushWriter struct {
+	zw          *flate.Writer
+	out         *countingWriter
+	spans       *spanDigester
+	crc         hash.Hash32
+	span        FileSize
+	written     FileSize // uncompressed data written so far
+	next        FileSize // uncompressed offset of the start of the next span
+	checkpoints []tocCheckpoint
+}
+
+func newSpanFlushWriter(out *countingWriter, spans *spanDigester, span FileSize) (*spanFlushWriter, error) {
+	zw, err := flate.NewWriter(out, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	w := &spanFlushWriter{
+		zw:    zw,
+		out:   out,
+		spans: spans,
+		crc:   crc32.NewIEEE(),
+		span:  span,
+	}
+	if err := w.startSpan(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *spanFlushWriter) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if w.written == w.next {
+			if err := w.zw.Flush(); err != nil {
+				return n, err
+			}
+			w.zw.Reset(w.out)
+			if err := w.startSpan(); err != nil {
+				return n, err
+			}
+		}
+		chunk := p
+		if remaining := w.next - w.written; FileSize(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+		if _, err := w.zw.Write(chunk); err != nil {
+			return n, err
+		}
+		w.crc.Write(chunk)
+		w.written += FileSize(len(chunk))
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// startSpan records a checkpoint at the current position, which must be at a byte boundary
+// of the deflate stream with no reference to the data before it.
+func (w *spanFlushWriter) startSpan() error {
+	w.checkpoints = append(w.checkpoints, tocCheckpoint{in: w.out.n, out: w.written})
+	w.next = w.written + w.span
+	return w.spans.startSpan(w.out.n)
+}
+
+// Close ends the deflate stream and writes the gzip trailer.
+func (w *spanFlushWriter) Close() error {
+	if err := w.zw.Close(); err != nil {
+		return err
+	}
+	trailer := make([]byte, gzipTrailerSize)
+	binary.LittleEndian.PutUint32(trailer[0:4], w.crc.Sum32())
+	binary.LittleEndian.PutUint32(trailer[4:8], uint32(w.written))
+	_, err := w.out.Write(trailer)
+	return err
+}
@@ -0,0 +1,265 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/labels"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+func TestConvertGzipLayer(t *testing.T) {
+	contents := map[string]string{
+		"large":  string(genRandomByteData(300000)),
+		"medium": string(genRandomByteData(70000)),
+		"small":  "small",
+		"empty":  "",
+	}
+	ents := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("large", contents["large"]),
+		testutil.File("small", contents["small"]),
+		testutil.File("medium", contents["medium"]),
+		testutil.File("empty", contents["empty"]),
+		testutil.Symlink("link", "large"),
+	}
+	tarData, err := io.ReadAll(testutil.BuildTar(ents))
+	if err != nil {
+		t.Fatalf("cannot build tar: %v", err)
+	}
+	var layer bytes.Buffer
+	zw := gzip.NewWriter(&layer)
+	zw.Write(tarData)
+	zw.Close()
+
+	for _, spanSize := range []int64{65536, 100000} {
+		t.Run(fmt.Sprintf("span_%d", spanSize), func(t *testing.T) {
+			var converted bytes.Buffer
+			ztoc, err := ConvertGzipLayer(bytes.NewReader(layer.Bytes()), &converted, spanSize, WithFileDigests())
+			if err != nil {
+				t.Fatalf("cannot convert layer: %v", err)
+			}
+
+			// the converted layer is a single gzip member with the same tar
+			br := bytes.NewReader(converted.Bytes())
+			zr, err := gzip.NewReader(br)
+			if err != nil {
+				t.Fatalf("converted layer isn't gzip: %v", err)
+			}
+			zr.Multistream(false)
+			decompressed, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("cannot decompress converted layer: %v", err)
+			}
+			if !bytes.Equal(decompressed, tarData) {
+				t.Fatalf("converted layer doesn't have the same tar")
+			}
+			if br.Len() != 0 {
+				t.Fatalf("converted layer has more than one gzip member")
+			}
+			if ztoc.CompressedFileSize != FileSize(converted.Len()) || ztoc.UncompressedFileSize != FileSize(len(tarData)) {
+				t.Fatalf("unexpected sizes in ztoc; compressed = %d, uncompressed = %d", ztoc.CompressedFileSize, ztoc.UncompressedFileSize)
+			}
+
+			index, err := unmarshalGzipIndex(ztoc.IndexByteData)
+			if err != nil {
+				t.Fatalf("cannot read checkpoints: %v", err)
+			}
+			if int(index.have) != int(ztoc.MaxSpanId)+1 {
+				t.Fatalf("unexpected number of checkpoints; expected = %d, got = %d", ztoc.MaxSpanId+1, index.have)
+			}
+			for i, p := range index.list {
+				if p.bits != 0 || len(p.window) != 0 {
+					t.Fatalf("checkpoint %d has a window", i)
+				}
+				if p.out != int64(i)*spanSize {
+					t.Fatalf("unexpected uncompressed offset of checkpoint %d; expected = %d, got = %d", i, int64(i)*spanSize, p.out)
+				}
+				// each span decompresses on its own
+				end := int64(len(tarData))
+				if i+1 < len(index.list) {
+					end = index.list[i+1].out
+				}
+				span := make([]byte, end-p.out)
+				if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(converted.Bytes()[p.in:])), span); err != nil {
+					t.Fatalf("cannot decompress span %d on its own: %v", i, err)
+				}
+				if !bytes.Equal(span, tarData[p.out:end]) {
+					t.Fatalf("unexpected data of span %d", i)
+				}
+			}
+
+			sr := io.NewSectionReader(bytes.NewReader(converted.Bytes()), 0, int64(converted.Len()))
+			discrepancies, err := VerifyZtoc(ztoc, sr)
+			if err != nil {
+				t.Fatalf("cannot verify ztoc: %v", err)
+			}
+			if len(discrepancies) != 0 {
+				t.Fatalf("unexpected discrepancies: %v", discrepancies)
+			}
+			for _, m := range ztoc.Metadata {
+				want, ok := contents[m.Name]
+				if !ok {
+					continue
+				}
+				if m.Digest != digest.FromString(want) {
+					t.Fatalf("unexpected digest of %s", m.Name)
+				}
+				extracted, err := ExtractFile(sr, &FileExtractConfig{
+					UncompressedSize:     m.UncompressedSize,
+					UncompressedOffset:   m.UncompressedOffset,
+					SpanStart:            m.SpanStart,
+					SpanEnd:              m.SpanEnd,
+					FirstSpanHasBits:     m.FirstSpanHasBits,
+					IndexByteData:        ztoc.IndexByteData,
+					CompressedFileSize:   ztoc.CompressedFileSize,
+					MaxSpanId:            ztoc.MaxSpanId,
+					CompressionAlgorithm: ztoc.CompressionAlgorithm,
+				})
+				if err != nil {
+					t.Fatalf("cannot extract %s: %v", m.Name, err)
+				}
+				if string(extracted) != want {
+					t.Fatalf("unexpected contents of %s", m.Name)
+				}
+			}
+		})
+	}
+}
+
+// memoryLabelStore keeps the labels of a local content store in memory.
+type memoryLabelStore map[digest.Digest]map[string]string
+
+func (s memoryLabelStore) Get(dgst digest.Digest) (map[string]string, error) {
+	return s[dgst], nil
+}
+
+func (s memoryLabelStore) Set(dgst digest.Digest, labels map[string]string) error {
+	s[dgst] = labels
+	return nil
+}
+
+func (s memoryLabelStore) Update(dgst digest.Digest, update map[string]string) (map[string]string, error) {
+	labels := s[dgst]
+	if labels == nil {
+		labels = make(map[string]string)
+	}
+	for k, v := range update {
+		if v == "" {
+			delete(labels, k)
+		} else {
+			labels[k] = v
+		}
+	}
+	s[dgst] = labels
+	return labels, nil
+}
+
+func TestConvertLayerFunc(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewLabeledStore(t.TempDir(), memoryLabelStore{})
+	if err != nil {
+		t.Fatalf("cannot create content store: %v", err)
+	}
+	store, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create ztoc store: %v", err)
+	}
+	ents := []testutil.TarEntry{
+		testutil.File("file", string(genRandomByteData(100000))),
+	}
+	tarData, err := io.ReadAll(testutil.BuildTar(ents))
+	if err != nil {
+		t.Fatalf("cannot build tar: %v", err)
+	}
+
+	testCases := []struct {
+		name      string
+		mediaType string
+		layer     io.Reader
+		converted bool
+	}{
+		{
+			name:      "gzip",
+			mediaType: ocispec.MediaTypeImageLayerGzip,
+			layer:     testutil.BuildTarGz(ents, gzip.BestCompression),
+			converted: true,
+		},
+		{
+			name:      "zstd",
+			mediaType: ocispec.MediaTypeImageLayerZstd,
+			layer:     testutil.BuildTarZstd(ents, 0),
+		},
+		{
+			name:      "uncompressed",
+			mediaType: ocispec.MediaTypeImageLayer,
+			layer:     testutil.BuildTar(ents),
+		},
+	}
+	convert, err := ConvertLayerFunc(65536, store, WithNoArtifactsDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			layer, err := io.ReadAll(tc.layer)
+			if err != nil {
+				t.Fatalf("cannot build layer: %v", err)
+			}
+			desc := ocispec.Descriptor{MediaType: tc.mediaType, Digest: digest.FromBytes(layer), Size: int64(len(layer))}
+			if err := content.WriteBlob(ctx, cs, tc.name, bytes.NewReader(layer), desc); err != nil {
+				t.Fatalf("cannot write layer: %v", err)
+			}
+
+			newDesc, err := convert(ctx, cs, desc)
+			if err != nil {
+				t.Fatalf("cannot convert layer: %v", err)
+			}
+			if !tc.converted {
+				if newDesc != nil {
+					t.Fatalf("expected the layer to be left as is, got %v", newDesc)
+				}
+				return
+			}
+			if newDesc == nil || newDesc.MediaType != desc.MediaType || newDesc.Digest == desc.Digest {
+				t.Fatalf("unexpected converted layer: %v", newDesc)
+			}
+			info, err := cs.Info(ctx, newDesc.Digest)
+			if err != nil {
+				t.Fatalf("converted layer isn't in the content store: %v", err)
+			}
+			if info.Size != newDesc.Size {
+				t.Fatalf("unexpected size of converted layer; expected = %d, got = %d", newDesc.Size, info.Size)
+			}
+			if info.Labels[labels.LabelUncompressed] != digest.FromBytes(tarData).String() {
+				t.Fatalf("unexpected uncompressed digest of converted layer: %v", info.Labels)
+			}
+		})
+	}
+}
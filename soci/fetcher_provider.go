@@ -0,0 +1,120 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NewFetcherProvider returns a content provider reading blobs through the fetcher, e.g. from a
+// registry, without storing them. Blobs are streamed: reading a blob sequentially from its start,
+// as BuildSociIndex does, fetches it once.
+func NewFetcherProvider(fetcher remotes.Fetcher) content.Provider {
+	return &fetcherProvider{fetcher: fetcher}
+}
+
+type fetcherProvider struct {
+	fetcher remotes.Fetcher
+}
+
+func (p *fetcherProvider) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	return &fetchedReaderAt{ctx: ctx, fetcher: p.fetcher, desc: desc}, nil
+}
+
+// fetchedReaderAt reads a blob from the stream returned by the fetcher, which is opened on the
+// first read. Reads at other offsets than the end of the last read seek the stream if it supports
+// it, e.g. with range requests, and otherwise skip data or fetch the blob again.
+type fetchedReaderAt struct {
+	ctx     context.Context
+	fetcher remotes.Fetcher
+	desc    ocispec.Descriptor
+	rc      io.ReadCloser
+	offset  int64
+}
+
+func (r *fetchedReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, fmt.Errorf("invalid offset %d", offset)
+	}
+	if offset >= r.desc.Size {
+		return 0, io.EOF
+	}
+	if err := r.seek(offset); err != nil {
+		return 0, err
+	}
+	n, err := io.ReadFull(r.rc, p)
+	r.offset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// seek moves the stream to offset.
+func (r *fetchedReaderAt) seek(offset int64) error {
+	if r.rc != nil && offset == r.offset {
+		return nil
+	}
+	if r.rc != nil {
+		if s, ok := r.rc.(io.Seeker); ok {
+			if _, err := s.Seek(offset, io.SeekStart); err != nil {
+				return fmt.Errorf("cannot seek blob %v: %w", r.desc.Digest, err)
+			}
+			r.offset = offset
+			return nil
+		}
+		if offset < r.offset {
+			r.rc.Close()
+			r.rc = nil
+		}
+	}
+	if r.rc == nil {
+		rc, err := r.fetcher.Fetch(r.ctx, r.desc)
+		if err != nil {
+			return fmt.Errorf("cannot fetch blob %v: %w", r.desc.Digest, err)
+		}
+		r.rc, r.offset = rc, 0
+		if offset == 0 {
+			return nil
+		}
+		if _, ok := rc.(io.Seeker); ok {
+			return r.seek(offset)
+		}
+	}
+	if _, err := io.CopyN(io.Discard, r.rc, offset-r.offset); err != nil {
+		return fmt.Errorf("cannot read blob %v: %w", r.desc.Digest, err)
+	}
+	r.offset = offset
+	return nil
+}
+
+func (r *fetchedReaderAt) Size() int64 {
+	return r.desc.Size
+}
+
+func (r *fetchedReaderAt) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	return r.rc.Close()
+}
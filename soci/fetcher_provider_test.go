@@ -0,0 +1,118 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// testFetcher serves a blob, counting the fetches.
+type testFetcher struct {
+	blob     []byte
+	seekable bool
+	fetches  int
+}
+
+func (f *testFetcher) Fetch(_ context.Context, _ ocispec.Descriptor) (io.ReadCloser, error) {
+	f.fetches++
+	r := bytes.NewReader(f.blob)
+	if f.seekable {
+		return struct {
+			io.ReadSeeker
+			io.Closer
+		}{r, io.NopCloser(nil)}, nil
+	}
+	return io.NopCloser(r), nil
+}
+
+func TestFetcherProvider(t *testing.T) {
+	blob := genRandomByteData(10000)
+	desc := ocispec.Descriptor{Digest: digest.FromBytes(blob), Size: int64(len(blob))}
+
+	testCases := []struct {
+		name     string
+		seekable bool
+		reads    [][2]int64 // offset and length of each read
+		fetches  int
+	}{
+		{
+			name:    "sequential",
+			reads:   [][2]int64{{0, 100}, {100, 5000}, {5100, 4900}},
+			fetches: 1,
+		},
+		{
+			name:    "skip_forward",
+			reads:   [][2]int64{{1000, 100}, {5000, 100}, {9000, 1000}},
+			fetches: 1,
+		},
+		{
+			name:    "backward",
+			reads:   [][2]int64{{5000, 100}, {0, 100}, {100, 100}},
+			fetches: 2,
+		},
+		{
+			name:     "seekable_backward",
+			seekable: true,
+			reads:    [][2]int64{{5000, 100}, {0, 100}, {9000, 100}},
+			fetches:  1,
+		},
+		{
+			name:    "past_end",
+			reads:   [][2]int64{{9950, 100}},
+			fetches: 1,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			fetcher := &testFetcher{blob: blob, seekable: tc.seekable}
+			ra, err := NewFetcherProvider(fetcher).ReaderAt(context.Background(), desc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ra.Close()
+			if ra.Size() != desc.Size {
+				t.Fatalf("unexpected size; expected = %d, got = %d", desc.Size, ra.Size())
+			}
+			for _, read := range tc.reads {
+				offset, length := read[0], read[1]
+				p := make([]byte, length)
+				n, err := ra.ReadAt(p, offset)
+				expected := blob[offset:]
+				if int64(len(expected)) > length {
+					expected = expected[:length]
+				}
+				if int64(len(expected)) < length && err != io.EOF {
+					t.Fatalf("expected EOF reading at %d, got %v", offset, err)
+				} else if int64(len(expected)) == length && err != nil {
+					t.Fatalf("cannot read at %d: %v", offset, err)
+				}
+				if !bytes.Equal(p[:n], expected) {
+					t.Fatalf("unexpected data at %d", offset)
+				}
+			}
+			if fetcher.fetches != tc.fetches {
+				t.Fatalf("unexpected number of fetches; expected = %d, got = %d", tc.fetches, fetcher.fetches)
+			}
+		})
+	}
+}
@@ -0,0 +1,251 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+// RemoveArtifact removes the artifact from the ArtifactsDB along with its blob in the
+// OCI layout store at contentStorePath.
+func RemoveArtifact(db *ArtifactsDb, contentStorePath string, entry *ArtifactEntry) error {
+	dgst, err := digest.Parse(entry.Digest)
+	if err != nil {
+		return fmt.Errorf("invalid digest of artifact %s: %w", entry.Digest, err)
+	}
+	if err := os.Remove(blobPath(contentStorePath, dgst)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot remove blob of artifact %s: %w", entry.Digest, err)
+	}
+	return db.RemoveArtifactEntryByDigest(entry.Digest)
+}
+
+// RemoveIndex removes the SOCI index from the ArtifactsDB along with its blob in the OCI layout
+// store at contentStorePath. The signature of the index is untagged and its blobs are removed,
+// and the index is dropped from the referrers index of its image manifest.
+func RemoveIndex(ctx context.Context, db *ArtifactsDb, contentStorePath string, entry *ArtifactEntry) error {
+	dgst, err := digest.Parse(entry.Digest)
+	if err != nil {
+		return fmt.Errorf("invalid digest of index %s: %w", entry.Digest, err)
+	}
+	store, err := oci.New(contentStorePath)
+	if err != nil {
+		return fmt.Errorf("cannot open local store: %w", err)
+	}
+	var (
+		tags  []string
+		blobs []digest.Digest
+	)
+
+	sigTag := SignatureTag(dgst)
+	sigDesc, err := store.Resolve(ctx, sigTag)
+	if err == nil {
+		sig, err := fetchIndex(ctx, store, sigDesc)
+		if err != nil {
+			return fmt.Errorf("cannot read signature of index %s: %w", entry.Digest, err)
+		}
+		tags = append(tags, sigTag)
+		blobs = append(blobs, sigDesc.Digest)
+		for _, b := range sig.Blobs {
+			blobs = append(blobs, b.Digest)
+		}
+	} else if !errors.Is(err, errdef.ErrNotFound) {
+		return fmt.Errorf("cannot resolve signature of index %s: %w", entry.Digest, err)
+	}
+
+	// the image manifest of an index is its original digest
+	if subject, err := digest.Parse(entry.OriginalDigest); err == nil {
+		referrersTag := ReferrersTag(subject)
+		referrersDesc, err := store.Resolve(ctx, referrersTag)
+		if err == nil {
+			referrers, err := FetchReferrersTagIndex(ctx, store, subject)
+			if err != nil {
+				return err
+			}
+			var remaining []Referrer
+			for _, r := range referrers {
+				if r.Digest != dgst {
+					remaining = append(remaining, r)
+				}
+			}
+			if len(remaining) != len(referrers) {
+				if len(remaining) == 0 {
+					tags = append(tags, referrersTag)
+				} else if err := tagReferrersIndex(ctx, store, subject, remaining); err != nil {
+					return err
+				}
+				blobs = append(blobs, referrersDesc.Digest)
+			}
+		} else if !errors.Is(err, errdef.ErrNotFound) {
+			return fmt.Errorf("cannot resolve referrers index of %v: %w", subject, err)
+		}
+	}
+
+	// the tags are removed after the store is done with index.json, which it rewrites on Tag
+	if err := untag(contentStorePath, tags); err != nil {
+		return fmt.Errorf("cannot untag artifacts of index %s: %w", entry.Digest, err)
+	}
+	for _, b := range append(blobs, dgst) {
+		if err := os.Remove(blobPath(contentStorePath, b)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot remove blob %s of index %s: %w", b, entry.Digest, err)
+		}
+	}
+	return db.RemoveArtifactEntryByDigest(entry.Digest)
+}
+
+// untag removes the tags from the index.json of the OCI layout store at contentStorePath.
+// The OCI layout store of oras-go can't remove tags, so the stores opened before don't see
+// the removal.
+func untag(contentStorePath string, tags []string) error {
+	if len(tags) == 0 {
+		return nil
+	}
+	removed := make(map[string]struct{})
+	for _, t := range tags {
+		removed[t] = struct{}{}
+	}
+	indexPath := filepath.Join(contentStorePath, "index.json")
+	data, err := os.ReadFile(indexPath)
+	if err != nil {
+		return err
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("cannot decode %s: %w", indexPath, err)
+	}
+	var manifests []ocispec.Descriptor
+	for _, m := range index.Manifests {
+		if _, ok := removed[m.Annotations[ocispec.AnnotationRefName]]; !ok {
+			manifests = append(manifests, m)
+		}
+	}
+	index.Manifests = manifests
+	data, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(indexPath, data, 0666)
+}
+
+// fetchIndex reads the manifest described by desc from the store.
+func fetchIndex(ctx context.Context, store orascontent.Fetcher, desc ocispec.Descriptor) (*Index, error) {
+	rc, err := store.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return NewIndexFromReader(rc)
+}
+
+// GarbageCollect removes the SOCI indices whose image is gone, according to imageExists,
+// and the ztocs that are not referenced by any of the remaining indices. The artifacts are
+// removed from the ArtifactsDB and their blobs from the OCI layout store at contentStorePath.
+// The indices are removed with RemoveIndex.
+// If dryRun is set, nothing is removed.
+// It returns the entries of the artifacts which are (or, with dryRun, would be) removed.
+func GarbageCollect(ctx context.Context, db *ArtifactsDb, contentStorePath string, imageExists func(*ArtifactEntry) (bool, error), dryRun bool) ([]*ArtifactEntry, error) {
+	var indices, ztocs []*ArtifactEntry
+	err := db.Walk(func(ae *ArtifactEntry) error {
+		switch ae.Type {
+		case ArtifactEntryTypeIndex:
+			indices = append(indices, ae)
+		case ArtifactEntryTypeLayer:
+			ztocs = append(ztocs, ae)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []*ArtifactEntry
+	referenced := make(map[string]struct{})
+	for _, ae := range indices {
+		exists, err := imageExists(ae)
+		if err != nil {
+			return removed, fmt.Errorf("cannot check image of index %s: %w", ae.Digest, err)
+		}
+		if exists {
+			blobs, err := indexBlobs(contentStorePath, ae)
+			if err == nil {
+				for _, b := range blobs {
+					referenced[b.String()] = struct{}{}
+				}
+				continue
+			}
+			// an index which can't be read can't be used either.
+			log.G(ctx).WithError(err).WithField("digest", ae.Digest).Warnf("cannot read soci index")
+		}
+		if !dryRun {
+			if err := RemoveIndex(ctx, db, contentStorePath, ae); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, ae)
+	}
+
+	for _, ae := range ztocs {
+		if _, ok := referenced[ae.Digest]; ok {
+			continue
+		}
+		if !dryRun {
+			if err := RemoveArtifact(db, contentStorePath, ae); err != nil {
+				return removed, err
+			}
+		}
+		removed = append(removed, ae)
+	}
+	return removed, nil
+}
+
+// indexBlobs returns the digests of the blobs referenced by the index.
+func indexBlobs(contentStorePath string, ae *ArtifactEntry) ([]digest.Digest, error) {
+	dgst, err := digest.Parse(ae.Digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(blobPath(contentStorePath, dgst))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	index, err := NewIndexFromReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var blobs []digest.Digest
+	for _, b := range index.Blobs {
+		blobs = append(blobs, b.Digest)
+	}
+	return blobs, nil
+}
+
+// blobPath returns the path of the blob in the OCI layout store at contentStorePath.
+func blobPath(contentStorePath string, dgst digest.Digest) string {
+	return filepath.Join(contentStorePath, "blobs", dgst.Algorithm().String(), dgst.Encoded())
+}
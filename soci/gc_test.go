@@ -0,0 +1,261 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+	"oras.land/oras-go/v2/errdef"
+)
+
+func TestGarbageCollect(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dry_run_%v", dryRun), func(t *testing.T) {
+			ctx := context.Background()
+			dir := t.TempDir()
+			store, err := oci.New(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			db, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+
+			pushBlob := func(data []byte, mediaType string) ocispec.Descriptor {
+				desc := ocispec.Descriptor{
+					MediaType: mediaType,
+					Digest:    digest.FromBytes(data),
+					Size:      int64(len(data)),
+				}
+				if err := store.Push(ctx, desc, bytes.NewReader(data)); err != nil {
+					t.Fatal(err)
+				}
+				return desc
+			}
+			writeZtoc := func(name string) ocispec.Descriptor {
+				desc := pushBlob([]byte(name), SociLayerMediaType)
+				err := db.WriteArtifactEntry(&ArtifactEntry{
+					Size:           desc.Size,
+					Digest:         desc.Digest.String(),
+					OriginalDigest: digest.FromString("layer " + name).String(),
+					Type:           ArtifactEntryTypeLayer,
+					MediaType:      SociLayerMediaType,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return desc
+			}
+			writeIndex := func(image string, ztocs ...ocispec.Descriptor) ocispec.Descriptor {
+				manifest, err := json.Marshal(NewIndex(ztocs, &ocispec.Descriptor{}, nil, ManifestORAS))
+				if err != nil {
+					t.Fatal(err)
+				}
+				desc := pushBlob(manifest, ORASManifestMediaType)
+				err = db.WriteArtifactEntry(&ArtifactEntry{
+					Size:           desc.Size,
+					Digest:         desc.Digest.String(),
+					OriginalDigest: digest.FromString("manifest " + image).String(),
+					ImageDigest:    digest.FromString(image).String(),
+					Type:           ArtifactEntryTypeIndex,
+					MediaType:      ORASManifestMediaType,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return desc
+			}
+
+			shared := writeZtoc("shared")
+			kept := writeZtoc("kept")
+			ofRemovedIndex := writeZtoc("of removed index")
+			unreferenced := writeZtoc("unreferenced")
+			keptIndex := writeIndex("kept image", shared, kept)
+			removedIndex := writeIndex("removed image", shared, ofRemovedIndex)
+
+			imageExists := func(ae *ArtifactEntry) (bool, error) {
+				return ae.ImageDigest == digest.FromString("kept image").String(), nil
+			}
+			removed, err := GarbageCollect(ctx, db, dir, imageExists, dryRun)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			var got []string
+			for _, ae := range removed {
+				got = append(got, ae.Digest)
+			}
+			want := []string{removedIndex.Digest.String(), ofRemovedIndex.Digest.String(), unreferenced.Digest.String()}
+			sort.Strings(got)
+			sort.Strings(want)
+			if len(got) != len(want) {
+				t.Fatalf("unexpected removed artifacts; expected %v, got %v", want, got)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("unexpected removed artifacts; expected %v, got %v", want, got)
+				}
+			}
+
+			wantRemoved := make(map[digest.Digest]bool)
+			for _, dgst := range want {
+				wantRemoved[digest.Digest(dgst)] = !dryRun
+			}
+			for _, desc := range []ocispec.Descriptor{keptIndex, shared, kept, removedIndex, ofRemovedIndex, unreferenced} {
+				wantExists := !wantRemoved[desc.Digest]
+				_, err := db.GetArtifactEntry(desc.Digest.String())
+				if wantExists && err != nil {
+					t.Fatalf("expected entry of %v to exist: %v", desc.Digest, err)
+				}
+				if !wantExists && !errors.Is(err, errdefs.ErrNotFound) {
+					t.Fatalf("expected entry of %v to be removed, got %v", desc.Digest, err)
+				}
+				_, err = os.Stat(blobPath(dir, desc.Digest))
+				if wantExists && err != nil {
+					t.Fatalf("expected blob of %v to exist: %v", desc.Digest, err)
+				}
+				if !wantExists && !os.IsNotExist(err) {
+					t.Fatalf("expected blob of %v to be removed, got %v", desc.Digest, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRemoveIndex(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := oci.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := ocispec.Descriptor{
+		MediaType: OCIImageManifestMediaType,
+		Digest:    digest.FromString("image manifest"),
+		Size:      14,
+	}
+	writeIndex := func(name string) ocispec.Descriptor {
+		blobs := []ocispec.Descriptor{{
+			MediaType: SociLayerMediaType,
+			Digest:    digest.FromString(name),
+			Size:      int64(len(name)),
+		}}
+		index := NewIndex(blobs, &subject, map[string]string{"name": name}, ManifestOCIImage)
+		desc, err := WriteSociIndexAsReferrer(ctx, IndexWithMetadata{Index: index}, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := SignIndex(ctx, store, *desc, key); err != nil {
+			t.Fatal(err)
+		}
+		err = db.WriteArtifactEntry(&ArtifactEntry{
+			Size:           desc.Size,
+			Digest:         desc.Digest.String(),
+			OriginalDigest: subject.Digest.String(),
+			Type:           ArtifactEntryTypeIndex,
+			MediaType:      desc.MediaType,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return *desc
+	}
+	indices := []ocispec.Descriptor{writeIndex("index 1"), writeIndex("index 2")}
+
+	for i, index := range indices {
+		store, err := oci.New(dir)
+		if err != nil {
+			t.Fatalf("cannot open store: %v", err)
+		}
+		sigDesc, err := store.Resolve(ctx, SignatureTag(index.Digest))
+		if err != nil {
+			t.Fatalf("cannot resolve signature of %v: %v", index.Digest, err)
+		}
+		sig, err := fetchIndex(ctx, store, sigDesc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ae, err := db.GetArtifactEntry(index.Digest.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := RemoveIndex(ctx, db, dir, ae); err != nil {
+			t.Fatalf("cannot remove index %v: %v", index.Digest, err)
+		}
+
+		if _, err := db.GetArtifactEntry(index.Digest.String()); !errors.Is(err, errdefs.ErrNotFound) {
+			t.Fatalf("expected entry of %v to be removed, got %v", index.Digest, err)
+		}
+		for _, dgst := range []digest.Digest{index.Digest, sigDesc.Digest, sig.Blobs[0].Digest} {
+			if _, err := os.Stat(blobPath(dir, dgst)); !os.IsNotExist(err) {
+				t.Fatalf("expected blob %v to be removed, got %v", dgst, err)
+			}
+		}
+
+		// the store opens without the removed artifacts
+		store, err = oci.New(dir)
+		if err != nil {
+			t.Fatalf("cannot open store after removing %v: %v", index.Digest, err)
+		}
+		if _, err := store.Resolve(ctx, SignatureTag(index.Digest)); !errors.Is(err, errdef.ErrNotFound) {
+			t.Fatalf("expected signature tag of %v to be removed, got %v", index.Digest, err)
+		}
+		referrers, err := FetchReferrersTagIndex(ctx, store, subject.Digest)
+		if err != nil {
+			t.Fatalf("cannot fetch referrers: %v", err)
+		}
+		remaining := indices[i+1:]
+		if len(referrers) != len(remaining) {
+			t.Fatalf("unexpected referrers after removing %v; expected %d, got %v", index.Digest, len(remaining), referrers)
+		}
+		for j, r := range referrers {
+			if r.Digest != remaining[j].Digest {
+				t.Fatalf("unexpected referrer %d; expected = %v, got = %v", j, remaining[j].Digest, r.Digest)
+			}
+		}
+		if len(remaining) > 0 {
+			if _, err := store.Resolve(ctx, SignatureTag(remaining[0].Digest)); err != nil {
+				t.Fatalf("expected signature of remaining index %v to be kept: %v", remaining[0].Digest, err)
+			}
+		} else if _, err := store.Resolve(ctx, ReferrersTag(subject.Digest)); !errors.Is(err, errdef.ErrNotFound) {
+			t.Fatalf("expected empty referrers index to be untagged, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+// #cgo CFLAGS: -I${SRCDIR}/../c/
+// #cgo LDFLAGS: -L${SRCDIR}/../out -lindexer -lz
+// #include "indexer.h"
+// #include <stdlib.h>
+// #include <stdint.h>
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"unsafe"
+)
+
+const (
+	// size of the chunks of compressed and uncompressed data processed by the C indexer at once
+	gzipBuilderChunkSize = 1 << 16
+
+	// magic number of a gzip member
+	gzipID1 = 0x1f
+	gzipID2 = 0x8b
+)
+
+// gzipZinfo is the Zinfo of a gzip-compressed layer. It wraps the gzip index
+// generated by the C indexer, which stores a checkpoint (including the 32KiB
+// window) roughly every span bytes of uncompressed data. Windows are kept
+// compressed and only expanded when data is extracted from their span.
+type gzipZinfo struct {
+	index *C.struct_gzip_index
+}
+
+func newGzipZinfo(indexByteData []byte) (*gzipZinfo, error) {
+	if len(indexByteData) == 0 {
+		return nil, fmt.Errorf("empty checkpoints")
+	}
+	index := C.blob_to_index(unsafe.Pointer(&indexByteData[0]), C.uint(len(indexByteData)))
+	if index == nil {
+		return nil, fmt.Errorf("cannot convert blob to gzip_index")
+	}
+	return newGzipZinfoFromIndex(index), nil
+}
+
+func newGzipZinfoFromIndex(index *C.struct_gzip_index) *gzipZinfo {
+	zinfo := &gzipZinfo{index: index}
+	runtime.SetFinalizer(zinfo, func(i *gzipZinfo) {
+		i.Close()
+	})
+	return zinfo
+}
+
+// newGzipZinfoFromCheckpoints returns the gzipZinfo of a layer made of several gzip members
+// whose checkpoints are all at the start of a member, where no window is needed. The index
+// is serialized in the layout of index_to_blob, which is little endian on supported platforms.
+func newGzipZinfoFromCheckpoints(checkpoints []tocCheckpoint, span FileSize) (*gzipZinfo, error) {
+	const headerSize, entrySize = 20, 21
+	buf := make([]byte, headerSize+len(checkpoints)*entrySize)
+	binary.LittleEndian.PutUint32(buf[0:4], 0) // marker of the current layout
+	binary.LittleEndian.PutUint32(buf[4:8], 1) // version of the layout
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(len(checkpoints)))
+	binary.LittleEndian.PutUint64(buf[12:20], uint64(span))
+	cur := buf[headerSize:]
+	for _, c := range checkpoints {
+		binary.LittleEndian.PutUint64(cur[0:8], uint64(c.in))
+		binary.LittleEndian.PutUint64(cur[8:16], uint64(c.out))
+		// no bits and no window
+		cur = cur[entrySize:]
+	}
+	return newGzipZinfo(buf)
+}
+
+// gzipZinfoBuilder builds a gzipZinfo with the incremental C indexer, which
+// inflates the layer to find the checkpoints.
+type gzipZinfoBuilder struct {
+	builder *C.struct_gzip_index_builder
+	r       io.Reader
+	spans   *spanDigester
+	// chooses the block ends where spans start, or nil to let the indexer start them every span bytes
+	placer spanPlacer
+	in     []byte
+	// compressed data which hasn't been consumed by the indexer yet
+	pending []byte
+	// number of checkpoints reported to spans
+	checkpoints int
+	done        bool
+}
+
+func newGzipZinfoBuilder(r io.Reader, span int64, spans *spanDigester, placer spanPlacer) (*gzipZinfoBuilder, error) {
+	var builder *C.struct_gzip_index_builder
+	ret := C.init_index_builder(C.off_t(span), &builder)
+	if ret != C.GZIP_INDEXER_OK {
+		return nil, fmt.Errorf("could not initialize gzip indexer. gzip error: %v", ret)
+	}
+	if placer != nil {
+		builder.manual = 1
+	}
+	return &gzipZinfoBuilder{
+		builder: builder,
+		r:       r,
+		spans:   spans,
+		placer:  placer,
+		in:      make([]byte, gzipBuilderChunkSize),
+	}, nil
+}
+
+func (b *gzipZinfoBuilder) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if len(p) > gzipBuilderChunkSize {
+		p = p[:gzipBuilderChunkSize]
+	}
+	for !b.done {
+		if len(b.pending) == 0 {
+			n, err := b.r.Read(b.in)
+			b.pending = b.in[:n]
+			if n == 0 {
+				if err == io.EOF {
+					return 0, io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					return 0, err
+				}
+				continue
+			}
+		}
+
+		var consumed, produced C.uint
+		ret := C.index_builder_inflate(b.builder, unsafe.Pointer(&b.pending[0]), C.uint(len(b.pending)), &consumed,
+			unsafe.Pointer(&p[0]), C.uint(len(p)), &produced)
+		b.spans.Write(b.pending[:consumed])
+		b.pending = b.pending[consumed:]
+		switch ret {
+		case C.Z_OK:
+			if b.builder.at_block_end != 0 && b.placer.startSpan(FileSize(b.builder.totout), FileSize(b.builder.last)) {
+				if ret := C.index_builder_add_point(b.builder); ret != C.GZIP_INDEXER_OK {
+					return 0, fmt.Errorf("could not add checkpoint to gzip index. gzip error: %v", ret)
+				}
+			}
+			if err := b.startSpans(); err != nil {
+				return 0, err
+			}
+		case C.Z_STREAM_END:
+			more, err := b.nextMember()
+			if err != nil {
+				return 0, err
+			}
+			if more {
+				break
+			}
+			b.done = true
+			// anything after the gzip stream is part of the last span
+			b.spans.Write(b.pending)
+			b.pending = nil
+			if _, err := io.Copy(b.spans, b.r); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("could not generate gzip index. gzip error: %v", ret)
+		}
+		if produced > 0 {
+			return int(produced), nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// nextMember reports whether another gzip member follows the one which just ended, as in
+// eStargz layers, in which case the indexer continues with it.
+func (b *gzipZinfoBuilder) nextMember() (bool, error) {
+	if len(b.pending) < 2 {
+		n := copy(b.in, b.pending)
+		m, err := io.ReadAtLeast(b.r, b.in[n:], 2-n)
+		b.pending = b.in[:n+m]
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if b.pending[0] != gzipID1 || b.pending[1] != gzipID2 {
+		return false, nil
+	}
+	if ret := C.index_builder_next_member(b.builder); ret != C.Z_OK {
+		return false, fmt.Errorf("could not continue with the next gzip member. gzip error: %v", ret)
+	}
+	return true, nil
+}
+
+// startSpans starts the spans of the checkpoints added by the indexer since the last call.
+func (b *gzipZinfoBuilder) startSpans() error {
+	index := b.builder.index
+	if index == nil {
+		return nil
+	}
+	points := unsafe.Slice(index.list, int(index.have))
+	for ; b.checkpoints < len(points); b.checkpoints++ {
+		pt := points[b.checkpoints]
+		start := FileSize(pt.in)
+		if pt.bits != 0 {
+			start--
+		}
+		if err := b.spans.startSpan(start); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *gzipZinfoBuilder) Zinfo() (Zinfo, error) {
+	var index *C.struct_gzip_index
+	ret := C.index_builder_finish(b.builder, &index)
+	if int(ret) < 0 {
+		return nil, fmt.Errorf("could not generate gzip index. gzip error: %v", ret)
+	}
+	return newGzipZinfoFromIndex(index), nil
+}
+
+func (b *gzipZinfoBuilder) Close() {
+	if b.builder != nil {
+		C.free_index_builder(b.builder)
+		b.builder = nil
+	}
+}
+
+func (i *gzipZinfo) Close() {
+	if i.index != nil {
+		C.free_index(i.index)
+		i.index = nil
+	}
+}
+
+func (i *gzipZinfo) Bytes() ([]byte, error) {
+	blobSize := C.get_blob_size(i.index)
+	bytes := make([]byte, uint64(blobSize))
+	if len(bytes) == 0 {
+		return nil, fmt.Errorf("could not allocate byte array of size %d", blobSize)
+	}
+
+	ret := C.index_to_blob(i.index, unsafe.Pointer(&bytes[0]))
+	if int(ret) <= 0 {
+		return nil, fmt.Errorf("could not serialize gzip index to byte array; gzip error: %v", ret)
+	}
+	return bytes, nil
+}
+
+func (i *gzipZinfo) MaxSpanID() SpanId {
+	return SpanId(i.index.have - 1)
+}
+
+func (i *gzipZinfo) SpanSize() FileSize {
+	return FileSize(i.index.span_size)
+}
+
+func (i *gzipZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanID SpanId) ([]byte, error) {
+	bytes := make([]byte, uncompressedSize)
+	if uncompressedSize == 0 {
+		return bytes, nil
+	}
+	if len(compressedBuf) == 0 {
+		return bytes, fmt.Errorf("empty compressed buffer")
+	}
+
+	ret := C.extract_data_from_buffer(unsafe.Pointer(&compressedBuf[0]), C.off_t(len(compressedBuf)), i.index, C.off_t(uncompressedOffset), unsafe.Pointer(&bytes[0]), C.off_t(uncompressedSize), C.int(spanID))
+	if ret <= 0 {
+		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
+	}
+	return bytes, nil
+}
+
+func (i *gzipZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncompressedOffset FileSize) ([]byte, error) {
+	bytes := make([]byte, uncompressedSize)
+	if uncompressedSize == 0 {
+		return bytes, nil
+	}
+
+	cstr := C.CString(fileName)
+	defer C.free(unsafe.Pointer(cstr))
+
+	ret := C.extract_data(cstr, i.index, C.off_t(uncompressedOffset), unsafe.Pointer(&bytes[0]), C.int(uncompressedSize))
+	if ret <= 0 {
+		return bytes, fmt.Errorf("unable to extract data; return code = %v", ret)
+	}
+	return bytes, nil
+}
+
+func (i *gzipZinfo) StartCompressedOffset(spanID SpanId) FileSize {
+	start := FileSize(C.get_comp_off(i.index, C.int(spanID)))
+	if i.HasBits(spanID) {
+		start--
+	}
+	return start
+}
+
+func (i *gzipZinfo) EndCompressedOffset(spanID SpanId, fileSize FileSize) FileSize {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return FileSize(C.get_comp_off(i.index, C.int(spanID+1)))
+}
+
+func (i *gzipZinfo) StartUncompressedOffset(spanID SpanId) FileSize {
+	return FileSize(C.get_ucomp_off(i.index, C.int(spanID)))
+}
+
+func (i *gzipZinfo) EndUncompressedOffset(spanID SpanId, fileSize FileSize) FileSize {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return FileSize(C.get_ucomp_off(i.index, C.int(spanID+1)))
+}
+
+func (i *gzipZinfo) UncompressedOffsetToSpanID(offset FileSize) SpanId {
+	return SpanId(C.pt_index_from_ucmp_offset(i.index, C.off_t(offset)))
+}
+
+func (i *gzipZinfo) HasBits(spanID SpanId) bool {
+	return C.has_bits(i.index, C.int(spanID)) != 0
+}
@@ -0,0 +1,407 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	refdocker "github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Images can be read from OCI image layouts and image tarballs without a containerd content store.
+// OCILayout and ImageTarball are content providers for BuildSociIndex.
+
+const (
+	ociLayoutFile        = "oci-layout"
+	ociIndexFile         = "index.json"
+	ociBlobsDir          = "blobs"
+	dockerManifestFile   = "manifest.json"
+	maxImageMetadataSize = 4 << 20
+
+	// annotation of the manifests of OCI image layouts with the name of the image
+	// in the containerd image store, as written by docker save and ctr export
+	containerdImageNameAnnotation = "io.containerd.image.name"
+)
+
+// namedManifest is an image manifest, or an image index, of an image layout or tarball,
+// along with the names the image is stored under.
+type namedManifest struct {
+	desc  ocispec.Descriptor
+	names []string
+}
+
+// OCILayout is an OCI image layout directory.
+type OCILayout struct {
+	root      string
+	manifests []namedManifest
+}
+
+// NewOCILayout opens the OCI image layout in the directory root.
+func NewOCILayout(root string) (*OCILayout, error) {
+	if _, err := os.Stat(filepath.Join(root, ociLayoutFile)); err != nil {
+		return nil, fmt.Errorf("%s is not an OCI image layout: %w", root, err)
+	}
+	f, err := os.Open(filepath.Join(root, ociIndexFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	manifests, err := readOCIIndexManifests(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read image index of %s: %w", root, err)
+	}
+	return &OCILayout{root: root, manifests: manifests}, nil
+}
+
+// ReaderAt returns a reader for the blob of the layout described by desc.
+func (l *OCILayout) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if err := desc.Digest.Validate(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(l.root, ociBlobsDir, desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("blob %v: %w", desc.Digest, errdefs.ErrNotFound)
+		}
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.Size() != desc.Size {
+		f.Close()
+		return nil, fmt.Errorf("blob %v is %d bytes, expected %d", desc.Digest, fi.Size(), desc.Size)
+	}
+	return sectionReaderAt{io.NewSectionReader(f, 0, desc.Size), f}, nil
+}
+
+// Resolve returns the image of the layout with the given reference, which is either its name
+// or the digest of its manifest. If ref is empty, the layout must hold a single image.
+func (l *OCILayout) Resolve(ctx context.Context, ref string) (images.Image, error) {
+	return resolveNamedManifest(l.manifests, ref)
+}
+
+// ImageTarball is a tarball of images, either an OCI image layout archive, as written by
+// docker save from Docker 25 on and by ctr export, or a tarball written by earlier versions
+// of docker save. The images of the latter are described by Docker image manifests built
+// from its manifest.json, whose layers are the uncompressed layer tarballs.
+type ImageTarball struct {
+	f         *os.File
+	members   map[string]tarMember
+	blobs     map[digest.Digest]tarMember
+	manifests []namedManifest
+	// manifests and configs which aren't members of the tarball, built for docker save tarballs
+	generated map[digest.Digest][]byte
+}
+
+// tarMember is the contents of a regular file of a tarball.
+type tarMember struct {
+	offset, size int64
+}
+
+// dockerSaveManifest is an image of the manifest.json of docker save tarballs.
+type dockerSaveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// OpenImageTarball opens the image tarball at path, which must be uncompressed.
+func OpenImageTarball(path string) (*ImageTarball, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &ImageTarball{
+		f:         f,
+		members:   make(map[string]tarMember),
+		blobs:     make(map[digest.Digest]tarMember),
+		generated: make(map[digest.Digest][]byte),
+	}
+	if err := t.init(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("cannot read image tarball %s: %w", path, err)
+	}
+	return t, nil
+}
+
+func (t *ImageTarball) init() error {
+	if err := t.readMembers(); err != nil {
+		return err
+	}
+	if _, ok := t.members[ociIndexFile]; ok {
+		return t.initOCILayout()
+	}
+	if _, ok := t.members[dockerManifestFile]; ok {
+		return t.initDockerSave()
+	}
+	return fmt.Errorf("neither %s nor %s found", ociIndexFile, dockerManifestFile)
+}
+
+// readMembers records the offsets of the regular files of the tarball. Links are
+// recorded as the files they link to.
+func (t *ImageTarball) readMembers() error {
+	tr := tar.NewReader(t.f)
+	links := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			// archive/tar reads the tarball up to the contents of the file
+			offset, err := t.f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			t.members[name] = tarMember{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), hdr.Linkname)
+		case tar.TypeLink:
+			links[name] = path.Clean(hdr.Linkname)
+		}
+	}
+	for name, target := range links {
+		// links to links aren't followed
+		if m, ok := t.members[target]; ok {
+			t.members[name] = m
+		}
+	}
+	return nil
+}
+
+func (t *ImageTarball) initOCILayout() error {
+	data, err := t.readMember(ociIndexFile)
+	if err != nil {
+		return err
+	}
+	if t.manifests, err = readOCIIndexManifests(bytes.NewReader(data)); err != nil {
+		return err
+	}
+	for name, m := range t.members {
+		dir, encoded := path.Split(name)
+		alg := path.Base(dir)
+		if path.Dir(path.Clean(dir)) != ociBlobsDir {
+			continue
+		}
+		if dgst := digest.NewDigestFromEncoded(digest.Algorithm(alg), encoded); dgst.Validate() == nil {
+			t.blobs[dgst] = m
+		}
+	}
+	return nil
+}
+
+func (t *ImageTarball) initDockerSave() error {
+	data, err := t.readMember(dockerManifestFile)
+	if err != nil {
+		return err
+	}
+	var saved []dockerSaveManifest
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("cannot decode %s: %w", dockerManifestFile, err)
+	}
+	for _, s := range saved {
+		config, err := t.readMember(s.Config)
+		if err != nil {
+			return err
+		}
+		manifest := ocispec.Manifest{
+			MediaType: images.MediaTypeDockerSchema2Manifest,
+			Config: ocispec.Descriptor{
+				MediaType: images.MediaTypeDockerSchema2Config,
+				Digest:    digest.FromBytes(config),
+				Size:      int64(len(config)),
+			},
+		}
+		manifest.SchemaVersion = 2
+		t.generated[manifest.Config.Digest] = config
+		for _, name := range s.Layers {
+			desc, err := t.addLayer(name)
+			if err != nil {
+				return err
+			}
+			manifest.Layers = append(manifest.Layers, desc)
+		}
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return err
+		}
+		desc := ocispec.Descriptor{
+			MediaType: manifest.MediaType,
+			Digest:    digest.FromBytes(data),
+			Size:      int64(len(data)),
+		}
+		t.generated[desc.Digest] = data
+		t.manifests = append(t.manifests, namedManifest{desc: desc, names: s.RepoTags})
+	}
+	return nil
+}
+
+// addLayer adds the layer tarball to the blobs of a docker save tarball, which
+// requires reading it to compute its digest.
+func (t *ImageTarball) addLayer(name string) (ocispec.Descriptor, error) {
+	m, ok := t.members[path.Clean(name)]
+	if !ok {
+		return ocispec.Descriptor{}, fmt.Errorf("layer %s: %w", name, errdefs.ErrNotFound)
+	}
+	digester := digest.Canonical.Digester()
+	if _, err := io.Copy(digester.Hash(), io.NewSectionReader(t.f, m.offset, m.size)); err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("cannot read layer %s: %w", name, err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: images.MediaTypeDockerSchema2Layer,
+		Digest:    digester.Digest(),
+		Size:      m.size,
+	}
+	t.blobs[desc.Digest] = m
+	return desc, nil
+}
+
+// readMember reads a small file of the tarball, e.g. a manifest.
+func (t *ImageTarball) readMember(name string) ([]byte, error) {
+	m, ok := t.members[path.Clean(name)]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, errdefs.ErrNotFound)
+	}
+	if m.size > maxImageMetadataSize {
+		return nil, fmt.Errorf("%s is too large: %d bytes", name, m.size)
+	}
+	data := make([]byte, m.size)
+	if _, err := t.f.ReadAt(data, m.offset); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// ReaderAt returns a reader for the blob of the tarball described by desc.
+func (t *ImageTarball) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	if data, ok := t.generated[desc.Digest]; ok {
+		return sectionReaderAt{io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), nil}, nil
+	}
+	m, ok := t.blobs[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("blob %v: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	if m.size != desc.Size {
+		return nil, fmt.Errorf("blob %v is %d bytes, expected %d", desc.Digest, m.size, desc.Size)
+	}
+	return sectionReaderAt{io.NewSectionReader(t.f, m.offset, m.size), nil}, nil
+}
+
+// Resolve returns the image of the tarball with the given reference, which is either its name
+// or the digest of its manifest. If ref is empty, the tarball must hold a single image.
+func (t *ImageTarball) Resolve(ctx context.Context, ref string) (images.Image, error) {
+	return resolveNamedManifest(t.manifests, ref)
+}
+
+// Close closes the tarball.
+func (t *ImageTarball) Close() error {
+	return t.f.Close()
+}
+
+// sectionReaderAt is a content.ReaderAt reading a section of a file, which
+// closes the file when it's closed, if set.
+type sectionReaderAt struct {
+	*io.SectionReader
+	f io.Closer
+}
+
+func (r sectionReaderAt) Close() error {
+	if r.f == nil {
+		return nil
+	}
+	return r.f.Close()
+}
+
+// readOCIIndexManifests reads the manifests of the index.json of an OCI image layout.
+func readOCIIndexManifests(r io.Reader) ([]namedManifest, error) {
+	var index ocispec.Index
+	if err := json.NewDecoder(io.LimitReader(r, maxImageMetadataSize)).Decode(&index); err != nil {
+		return nil, err
+	}
+	var manifests []namedManifest
+	for _, desc := range index.Manifests {
+		if !images.IsManifestType(desc.MediaType) && !images.IsIndexType(desc.MediaType) {
+			continue
+		}
+		m := namedManifest{desc: desc}
+		for _, k := range []string{containerdImageNameAnnotation, ocispec.AnnotationRefName} {
+			if name := desc.Annotations[k]; name != "" {
+				m.names = append(m.names, name)
+			}
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, nil
+}
+
+// resolveNamedManifest returns the image of the manifest named ref, or whose digest is ref.
+// Names are compared as normalized docker references when they're valid references, so that
+// e.g. "alpine:3" matches "docker.io/library/alpine:3".
+func resolveNamedManifest(manifests []namedManifest, ref string) (images.Image, error) {
+	if ref == "" {
+		if len(manifests) != 1 {
+			return images.Image{}, fmt.Errorf("found %d images, the image reference needs to be specified", len(manifests))
+		}
+		m := manifests[0]
+		name := m.desc.Digest.String()
+		if len(m.names) > 0 {
+			name = m.names[0]
+		}
+		return images.Image{Name: name, Target: m.desc}, nil
+	}
+	normalized := normalizeImageName(ref)
+	for _, m := range manifests {
+		if m.desc.Digest.String() == ref {
+			return images.Image{Name: ref, Target: m.desc}, nil
+		}
+		for _, name := range m.names {
+			if name == ref || normalizeImageName(name) == normalized {
+				return images.Image{Name: ref, Target: m.desc}, nil
+			}
+		}
+	}
+	return images.Image{}, fmt.Errorf("image %s: %w", ref, errdefs.ErrNotFound)
+}
+
+// normalizeImageName returns the normalized docker reference of an image name, or the name
+// itself if it isn't a valid reference, e.g. a bare tag of an OCI image layout.
+func normalizeImageName(name string) string {
+	if ref, err := refdocker.ParseDockerRef(name); err == nil {
+		return ref.String()
+	}
+	return name
+}
@@ -0,0 +1,311 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// testImageBlobs returns the layers and the config of a test image, and the manifest referring to them.
+func testImageBlobs(t *testing.T, layerMediaType string, compress bool) (manifest []byte, blobs map[digest.Digest][]byte) {
+	blobs = make(map[digest.Digest][]byte)
+	m := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+	}
+	for _, ents := range [][]testutil.TarEntry{
+		{testutil.File("file1", string(genRandomByteData(100000)))},
+		{testutil.Dir("dir/"), testutil.File("dir/file2", string(genRandomByteData(200000)))},
+	} {
+		var r io.Reader
+		if compress {
+			r = testutil.BuildTarGz(ents, gzip.DefaultCompression)
+		} else {
+			r = testutil.BuildTar(ents)
+		}
+		layer, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blobs[digest.FromBytes(layer)] = layer
+		m.Layers = append(m.Layers, ocispec.Descriptor{MediaType: layerMediaType, Digest: digest.FromBytes(layer), Size: int64(len(layer))})
+	}
+	config := []byte(`{"architecture":"amd64","os":"linux","rootfs":{"type":"layers"}}`)
+	blobs[digest.FromBytes(config)] = config
+	m.Config = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manifest, blobs
+}
+
+// writeTestOCILayout writes a layout holding the test image named "test:v1" to dir,
+// and returns the descriptor of its manifest.
+func writeTestOCILayout(t *testing.T, dir string) ocispec.Descriptor {
+	manifest, blobs := testImageBlobs(t, ocispec.MediaTypeImageLayerGzip, true)
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+		Annotations: map[string]string{
+			containerdImageNameAnnotation: "docker.io/library/test:v1",
+			ocispec.AnnotationRefName:     "v1",
+		},
+	}
+	blobs[desc.Digest] = manifest
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{desc},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		ociLayoutFile: []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		ociIndexFile:  index,
+	}
+	for dgst, blob := range blobs {
+		files[filepath.Join(ociBlobsDir, dgst.Algorithm().String(), dgst.Encoded())] = blob
+	}
+	for name, data := range files {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return desc
+}
+
+// writeTestTarball writes a tarball of the files to path. Names of links are mapped to their targets.
+func writeTestTarball(t *testing.T, path string, files map[string][]byte, links map[string]string) {
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := tar.NewWriter(f)
+	for name, data := range files {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: int64(len(data)), Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0644}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBuildSociIndexFromOCILayout(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	manifestDesc := writeTestOCILayout(t, dir)
+
+	layout, err := NewOCILayout(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{"", "v1", "docker.io/library/test:v1", "test:v1", manifestDesc.Digest.String()} {
+		img, err := layout.Resolve(ctx, ref)
+		if err != nil {
+			t.Fatalf("cannot resolve %q: %v", ref, err)
+		}
+		if img.Target.Digest != manifestDesc.Digest {
+			t.Fatalf("unexpected manifest of %q: %v", ref, img.Target.Digest)
+		}
+	}
+	if _, err := layout.Resolve(ctx, "test:v2"); err == nil {
+		t.Fatalf("expected an error resolving a missing image")
+	}
+
+	img, err := layout.Resolve(ctx, "v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := oci.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := BuildSociIndex(ctx, layout, img, 65536, store, WithNoArtifactsDB(), WithManifestType(ManifestOCIImage))
+	if err != nil {
+		t.Fatalf("cannot build soci index: %v", err)
+	}
+	if index.Index.refers().Digest != manifestDesc.Digest {
+		t.Fatalf("unexpected subject of the index; expected = %v, got = %v", manifestDesc.Digest, index.Index.refers().Digest)
+	}
+	if len(index.Index.Blobs) != 2 {
+		t.Fatalf("unexpected number of ztocs; expected = 2, got = %d", len(index.Index.Blobs))
+	}
+	for _, blob := range index.Index.Blobs {
+		if _, err := os.Stat(filepath.Join(dir, ociBlobsDir, blob.Digest.Algorithm().String(), blob.Digest.Encoded())); err != nil {
+			t.Fatalf("ztoc %v not written to the layout: %v", blob.Digest, err)
+		}
+	}
+
+	desc, err := WriteSociIndexAsReferrer(ctx, *index, store)
+	if err != nil {
+		t.Fatalf("cannot write soci index: %v", err)
+	}
+	// reopen the layout to read its index.json again
+	store, err = oci.New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	referrers, err := FetchReferrersTagIndex(ctx, store, manifestDesc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referrers) != 1 || referrers[0].Digest != desc.Digest || referrers[0].ArtifactType != SociIndexArtifactType {
+		t.Fatalf("unexpected referrers of the image manifest: %v", referrers)
+	}
+}
+
+func TestBuildSociIndexFromImageTarball(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("oci_layout_archive", func(t *testing.T) {
+		dir := t.TempDir()
+		manifestDesc := writeTestOCILayout(t, dir)
+		files := make(map[string][]byte)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, path)
+			files[filepath.ToSlash(rel)] = data
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tarball := filepath.Join(t.TempDir(), "image.tar")
+		writeTestTarball(t, tarball, files, nil)
+
+		testBuildSociIndexFromTarball(ctx, t, tarball, "test:v1", manifestDesc.Digest, ocispec.MediaTypeImageLayerGzip)
+	})
+
+	t.Run("docker_save", func(t *testing.T) {
+		manifest, blobs := testImageBlobs(t, images.MediaTypeDockerSchema2Layer, false)
+		var m ocispec.Manifest
+		if err := json.Unmarshal(manifest, &m); err != nil {
+			t.Fatal(err)
+		}
+		files := map[string][]byte{
+			m.Config.Digest.Encoded() + ".json": blobs[m.Config.Digest],
+			"layer1/layer.tar":                  blobs[m.Layers[0].Digest],
+			"layer2/layer.tar":                  blobs[m.Layers[1].Digest],
+		}
+		saved, err := json.Marshal([]dockerSaveManifest{{
+			Config:   m.Config.Digest.Encoded() + ".json",
+			RepoTags: []string{"test:v1"},
+			// docker save links layers shared with other images
+			Layers: []string{"layer1/layer.tar", "layer2/layer.tar", "layer3/layer.tar"},
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[dockerManifestFile] = saved
+		tarball := filepath.Join(t.TempDir(), "image.tar")
+		writeTestTarball(t, tarball, files, map[string]string{"layer3/layer.tar": "../layer1/layer.tar"})
+
+		// the manifest of the image is built from the manifest.json of the tarball
+		expected := ocispec.Manifest{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: images.MediaTypeDockerSchema2Manifest,
+			Config: ocispec.Descriptor{
+				MediaType: images.MediaTypeDockerSchema2Config,
+				Digest:    m.Config.Digest,
+				Size:      m.Config.Size,
+			},
+			Layers: []ocispec.Descriptor{m.Layers[0], m.Layers[1], m.Layers[0]},
+		}
+		expectedManifest, err := json.Marshal(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testBuildSociIndexFromTarball(ctx, t, tarball, "docker.io/library/test:v1", digest.FromBytes(expectedManifest), images.MediaTypeDockerSchema2Layer)
+	})
+}
+
+func testBuildSociIndexFromTarball(ctx context.Context, t *testing.T, path, ref string, manifestDigest digest.Digest, layerMediaType string) {
+	tarball, err := OpenImageTarball(path)
+	if err != nil {
+		t.Fatalf("cannot open image tarball: %v", err)
+	}
+	defer tarball.Close()
+	img, err := tarball.Resolve(ctx, ref)
+	if err != nil {
+		t.Fatalf("cannot resolve %s: %v", ref, err)
+	}
+	if img.Target.Digest != manifestDigest {
+		t.Fatalf("unexpected manifest; expected = %v, got = %v", manifestDigest, img.Target.Digest)
+	}
+	manifest, err := images.Manifest(ctx, tarball, img.Target, nil)
+	if err != nil {
+		t.Fatalf("cannot read manifest: %v", err)
+	}
+
+	store, err := oci.New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := BuildSociIndex(ctx, tarball, img, 65536, store, WithNoArtifactsDB())
+	if err != nil {
+		t.Fatalf("cannot build soci index: %v", err)
+	}
+	if len(index.Index.Blobs) != len(manifest.Layers) {
+		t.Fatalf("unexpected number of ztocs; expected = %d, got = %d", len(manifest.Layers), len(index.Index.Blobs))
+	}
+	for i, blob := range index.Index.Blobs {
+		if blob.Annotations[IndexAnnotationImageLayerDigest] != manifest.Layers[i].Digest.String() {
+			t.Fatalf("unexpected layer of ztoc %d: %s", i, blob.Annotations[IndexAnnotationImageLayerDigest])
+		}
+		if blob.Annotations[IndexAnnotationImageLayerMediaType] != layerMediaType {
+			t.Fatalf("unexpected media type of layer %d: %s", i, blob.Annotations[IndexAnnotationImageLayerMediaType])
+		}
+		if exists, err := store.Exists(ctx, blob); err != nil || !exists {
+			t.Fatalf("ztoc %v not written to the store: %v", blob.Digest, err)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// whiteoutPrefix is the prefix of the name of the entries of a layer removing
+	// the file of the same name, without the prefix, from the lower layers.
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaqueDir is the name of the entry of a layer hiding the contents of
+	// its directory in the lower layers.
+	whiteoutOpaqueDir = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// Kinds of FileChange.
+const (
+	FileAdded   = "added"
+	FileRemoved = "removed"
+	FileChanged = "changed"
+)
+
+// LayerZtoc is a layer of an image with its ztoc, which is nil if the layer has none.
+type LayerZtoc struct {
+	Layer digest.Digest
+	Ztoc  *Ztoc
+}
+
+// ImageFile is a file of the merged view of the layers of an image, as recorded in
+// the ztoc of the topmost layer holding it.
+type ImageFile struct {
+	Path     string            `json:"path"`
+	Type     string            `json:"type"`
+	Size     int64             `json:"size"`
+	Mode     int64             `json:"mode"`
+	ModTime  time.Time         `json:"mtime"`
+	UID      int               `json:"uid"`
+	GID      int               `json:"gid"`
+	Linkname string            `json:"linkname,omitempty"`
+	Xattrs   map[string]string `json:"xattrs,omitempty"`
+	Digest   digest.Digest     `json:"digest,omitempty"`
+	Layer    digest.Digest     `json:"layer"`
+}
+
+// FileChange is a difference between the files of two images. Old is nil for added
+// files, New is nil for removed files, and Fields lists the attributes of changed files
+// which differ.
+type FileChange struct {
+	Kind   string     `json:"kind"`
+	Path   string     `json:"path"`
+	Fields []string   `json:"fields,omitempty"`
+	Old    *ImageFile `json:"old,omitempty"`
+	New    *ImageFile `json:"new,omitempty"`
+}
+
+func (c FileChange) String() string {
+	if c.Kind != FileChanged {
+		return fmt.Sprintf("%s %s", c.Kind, c.Path)
+	}
+	changes := make([]string, 0, len(c.Fields))
+	for _, f := range c.Fields {
+		switch f {
+		case "size":
+			changes = append(changes, fmt.Sprintf("size %d -> %d", c.Old.Size, c.New.Size))
+		case "mode":
+			changes = append(changes, fmt.Sprintf("mode %o -> %o", c.Old.Mode, c.New.Mode))
+		case "mtime":
+			changes = append(changes, fmt.Sprintf("mtime %s -> %s", c.Old.ModTime.UTC().Format(time.RFC3339), c.New.ModTime.UTC().Format(time.RFC3339)))
+		case "uid":
+			changes = append(changes, fmt.Sprintf("uid %d -> %d", c.Old.UID, c.New.UID))
+		case "gid":
+			changes = append(changes, fmt.Sprintf("gid %d -> %d", c.Old.GID, c.New.GID))
+		case "type":
+			changes = append(changes, fmt.Sprintf("type %s -> %s", c.Old.Type, c.New.Type))
+		case "linkname":
+			changes = append(changes, fmt.Sprintf("link %s -> %s", c.Old.Linkname, c.New.Linkname))
+		default:
+			changes = append(changes, f)
+		}
+	}
+	return fmt.Sprintf("%s %s: %s", c.Kind, c.Path, strings.Join(changes, ", "))
+}
+
+// MergeLayerFiles returns the files of the overlay view of the layers, ordered from the
+// lowest one, by their absolute path. Like overlayfs, the whiteouts of a layer remove files
+// of the lower layers, and a file which isn't a directory hides the contents of a directory
+// of the same path in the lower layers. Layers without a ztoc are skipped: their files are
+// unknown without downloading them.
+func MergeLayerFiles(layers []LayerZtoc) map[string]ImageFile {
+	files := make(map[string]ImageFile)
+	for _, l := range layers {
+		if l.Ztoc != nil {
+			mergeLayer(files, l.Layer, l.Ztoc)
+		}
+	}
+	return files
+}
+
+func mergeLayer(files map[string]ImageFile, layer digest.Digest, ztoc *Ztoc) {
+	var (
+		removed = make(map[string]bool) // paths removed from the lower layers with their contents
+		opaque  = make(map[string]bool) // directories whose contents in the lower layers are hidden
+		added   []ImageFile
+	)
+	for _, m := range ztoc.Metadata {
+		p := path.Join("/", m.Name)
+		dir, base := path.Split(p)
+		switch {
+		case base == whiteoutOpaqueDir:
+			opaque[path.Clean(dir)] = true
+		case strings.HasPrefix(base, whiteoutPrefix):
+			removed[path.Join(dir, base[len(whiteoutPrefix):])] = true
+		default:
+			if m.Type != "dir" {
+				removed[p] = true
+			}
+			added = append(added, newImageFile(p, layer, m))
+		}
+	}
+	if len(removed) > 0 || len(opaque) > 0 {
+		for p := range files {
+			if isHidden(p, removed, opaque) {
+				delete(files, p)
+			}
+		}
+	}
+	for _, f := range added {
+		files[f.Path] = f
+	}
+}
+
+// isHidden reports whether the file at p is removed, or is in a removed or opaque directory.
+func isHidden(p string, removed, opaque map[string]bool) bool {
+	if removed[p] {
+		return true
+	}
+	for p != "/" {
+		p = path.Dir(p)
+		if removed[p] || opaque[p] {
+			return true
+		}
+	}
+	return false
+}
+
+func newImageFile(p string, layer digest.Digest, m FileMetadata) ImageFile {
+	return ImageFile{
+		Path:     p,
+		Type:     m.Type,
+		Size:     int64(m.Size()),
+		Mode:     m.Mode,
+		ModTime:  m.ModTime,
+		UID:      m.UID,
+		GID:      m.GID,
+		Linkname: m.Linkname,
+		Xattrs:   m.Xattrs,
+		Digest:   m.Digest,
+		Layer:    layer,
+	}
+}
+
+// DiffImageFiles returns the files added, removed and changed from the files of the image a
+// to the ones of the image b, as returned by MergeLayerFiles, sorted by path. The contents of
+// files are only compared if both ztocs recorded their digest.
+func DiffImageFiles(a, b map[string]ImageFile) []FileChange {
+	var changes []FileChange
+	for p, before := range a {
+		before := before
+		after, ok := b[p]
+		if !ok {
+			changes = append(changes, FileChange{Kind: FileRemoved, Path: p, Old: &before})
+			continue
+		}
+		if fields := changedFields(before, after); len(fields) > 0 {
+			changes = append(changes, FileChange{Kind: FileChanged, Path: p, Fields: fields, Old: &before, New: &after})
+		}
+	}
+	for p, after := range b {
+		after := after
+		if _, ok := a[p]; !ok {
+			changes = append(changes, FileChange{Kind: FileAdded, Path: p, New: &after})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes
+}
+
+func changedFields(before, after ImageFile) []string {
+	var fields []string
+	if before.Type != after.Type {
+		fields = append(fields, "type")
+	}
+	if before.Size != after.Size {
+		fields = append(fields, "size")
+	}
+	if before.Mode != after.Mode {
+		fields = append(fields, "mode")
+	}
+	if !before.ModTime.Equal(after.ModTime) {
+		fields = append(fields, "mtime")
+	}
+	if before.UID != after.UID {
+		fields = append(fields, "uid")
+	}
+	if before.GID != after.GID {
+		fields = append(fields, "gid")
+	}
+	if before.Linkname != after.Linkname {
+		fields = append(fields, "linkname")
+	}
+	if (len(before.Xattrs) > 0 || len(after.Xattrs) > 0) && !reflect.DeepEqual(before.Xattrs, after.Xattrs) {
+		fields = append(fields, "xattrs")
+	}
+	if before.Digest != "" && after.Digest != "" && before.Digest != after.Digest {
+		fields = append(fields, "digest")
+	}
+	return fields
+}
@@ -0,0 +1,230 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func testLayerZtoc(name string, files ...FileMetadata) LayerZtoc {
+	ztoc := &Ztoc{}
+	ztoc.Metadata = files
+	return LayerZtoc{Layer: digest.FromString(name), Ztoc: ztoc}
+}
+
+func TestMergeLayerFiles(t *testing.T) {
+	dir := func(name string) FileMetadata { return FileMetadata{Name: name, Type: "dir", Mode: 0755} }
+	reg := func(name string) FileMetadata { return FileMetadata{Name: name, Type: "reg", Mode: 0644} }
+
+	testCases := []struct {
+		name     string
+		layers   []LayerZtoc
+		expected []string
+	}{
+		{
+			name: "upper_layer_adds_files",
+			layers: []LayerZtoc{
+				testLayerZtoc("l1", dir("./"), dir("./etc/"), reg("./etc/hosts")),
+				testLayerZtoc("l2", dir("etc/"), reg("etc/passwd")),
+			},
+			expected: []string{"/", "/etc", "/etc/hosts", "/etc/passwd"},
+		},
+		{
+			name: "whiteout_removes_file",
+			layers: []LayerZtoc{
+				testLayerZtoc("l1", dir("etc/"), reg("etc/hosts"), reg("etc/passwd")),
+				testLayerZtoc("l2", dir("etc/"), reg("etc/.wh.hosts")),
+			},
+			expected: []string{"/etc", "/etc/passwd"},
+		},
+		{
+			name: "whiteout_removes_directory_contents",
+			layers: []LayerZtoc{
+				testLayerZtoc("l1", dir("var/"), dir("var/cache/"), dir("var/cache/apt/"), reg("var/cache/apt/pkgcache.bin"), reg("var/cachefile")),
+				testLayerZtoc("l2", reg("var/.wh.cache")),
+			},
+			expected: []string{"/var", "/var/cachefile"},
+		},
+		{
+			name: "opaque_directory_hides_lower_contents",
+			layers: []LayerZtoc{
+				testLayerZtoc("l1", dir("opt/"), reg("opt/a"), dir("opt/b/"), reg("opt/b/c")),
+				testLayerZtoc("l2", dir("opt/"), reg("opt/.wh..wh..opq"), reg("opt/d")),
+			},
+			expected: []string{"/opt", "/opt/d"},
+		},
+		{
+			name: "whiteout_only_applies_to_lower_layers",
+			layers: []LayerZtoc{
+				testLayerZtoc("l1", reg("a")),
+				testLayerZtoc("l2", reg(".wh.a"), reg("a")),
+			},
+			expected: []string{"/a"},
+		},
+		{
+			name: "file_replaces_directory",
+			layers: []LayerZtoc{
+				testLayerZtoc("l1", dir("lib/"), reg("lib/x")),
+				testLayerZtoc("l2", FileMetadata{Name: "lib", Type: "symlink", Linkname: "usr/lib"}),
+			},
+			expected: []string{"/lib"},
+		},
+		{
+			name: "layer_without_ztoc_is_skipped",
+			layers: []LayerZtoc{
+				testLayerZtoc("l1", reg("a")),
+				{Layer: digest.FromString("l2")},
+			},
+			expected: []string{"/a"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			files := MergeLayerFiles(tc.layers)
+			var paths []string
+			for p, f := range files {
+				if p != f.Path {
+					t.Fatalf("file %s has path %s", p, f.Path)
+				}
+				paths = append(paths, p)
+			}
+			sort.Strings(paths)
+			if !reflect.DeepEqual(paths, tc.expected) {
+				t.Fatalf("unexpected files; expected = %v, got = %v", tc.expected, paths)
+			}
+		})
+	}
+}
+
+func TestMergeLayerFilesTopmostLayer(t *testing.T) {
+	files := MergeLayerFiles([]LayerZtoc{
+		testLayerZtoc("l1", FileMetadata{Name: "a", Type: "reg", UncompressedSize: 1}),
+		testLayerZtoc("l2", FileMetadata{Name: "a", Type: "reg", UncompressedSize: 2}),
+	})
+	if f := files["/a"]; f.Size != 2 || f.Layer != digest.FromString("l2") {
+		t.Fatalf("expected the file of the topmost layer, got %+v", f)
+	}
+}
+
+func TestMergeLayerFilesSparseFile(t *testing.T) {
+	// the data stored in the layer of a sparse file is smaller than the file itself
+	sparse := func(name string, stored FileSize) LayerZtoc {
+		return testLayerZtoc(name, FileMetadata{
+			Name:             "sparse",
+			Type:             "reg",
+			UncompressedSize: stored,
+			SparseMap:        []SparseEntry{{Offset: 0, Size: stored}, {Offset: 1 << 20, Size: 0}},
+		})
+	}
+	a := MergeLayerFiles([]LayerZtoc{sparse("l1", 4096)})
+	if f := a["/sparse"]; f.Size != 1<<20 {
+		t.Fatalf("unexpected size of sparse file; expected = %d, got = %d", 1<<20, f.Size)
+	}
+	// the same file stored with more data isn't a size change
+	b := MergeLayerFiles([]LayerZtoc{sparse("l2", 8192)})
+	if changes := DiffImageFiles(a, b); len(changes) != 0 {
+		t.Fatalf("unexpected changes of sparse file: %v", changes)
+	}
+}
+
+func TestDiffImageFiles(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	file := func(p string, opts ...func(*ImageFile)) ImageFile {
+		f := ImageFile{Path: p, Type: "reg", Size: 10, Mode: 0644, ModTime: mtime}
+		for _, o := range opts {
+			o(&f)
+		}
+		return f
+	}
+	files := func(fs ...ImageFile) map[string]ImageFile {
+		m := make(map[string]ImageFile)
+		for _, f := range fs {
+			m[f.Path] = f
+		}
+		return m
+	}
+
+	testCases := []struct {
+		name     string
+		a, b     map[string]ImageFile
+		expected []string
+	}{
+		{
+			name:     "identical",
+			a:        files(file("/a"), file("/b")),
+			b:        files(file("/a"), file("/b")),
+			expected: nil,
+		},
+		{
+			name:     "added_and_removed",
+			a:        files(file("/a"), file("/b")),
+			b:        files(file("/b"), file("/c")),
+			expected: []string{"removed /a", "added /c"},
+		},
+		{
+			name: "changed_attributes",
+			a:    files(file("/a"), file("/b"), file("/c")),
+			b: files(
+				file("/a", func(f *ImageFile) { f.Size = 20; f.Mode = 0755 }),
+				file("/b", func(f *ImageFile) { f.ModTime = mtime.Add(time.Hour); f.UID = 1000; f.GID = 1000 }),
+				file("/c", func(f *ImageFile) { f.Xattrs = map[string]string{"user.a": "b"} }),
+			),
+			expected: []string{
+				"changed /a: size 10 -> 20, mode 644 -> 755",
+				"changed /b: mtime 2020-09-13T12:26:40Z -> 2020-09-13T13:26:40Z, uid 0 -> 1000, gid 0 -> 1000",
+				"changed /c: xattrs",
+			},
+		},
+		{
+			name:     "empty_and_missing_xattrs_are_equal",
+			a:        files(file("/a", func(f *ImageFile) { f.Xattrs = map[string]string{} })),
+			b:        files(file("/a")),
+			expected: nil,
+		},
+		{
+			name:     "digests_compared_when_both_recorded",
+			a:        files(file("/a", func(f *ImageFile) { f.Digest = digest.FromString("a") }), file("/b", func(f *ImageFile) { f.Digest = digest.FromString("b") })),
+			b:        files(file("/a", func(f *ImageFile) { f.Digest = digest.FromString("c") }), file("/b")),
+			expected: []string{"changed /a: digest"},
+		},
+		{
+			name:     "type_change",
+			a:        files(file("/a")),
+			b:        files(file("/a", func(f *ImageFile) { f.Type = "symlink"; f.Size = 0; f.Linkname = "b" })),
+			expected: []string{"changed /a: type reg -> symlink, size 10 -> 0, link  -> b"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var got []string
+			for _, c := range DiffImageFiles(tc.a, tc.b) {
+				got = append(got, fmt.Sprint(c))
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("unexpected changes; expected = %q, got = %q", tc.expected, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// LayerReport describes how a layer of an image is loaded with a SOCI index.
+// The ztoc fields are empty for layers without a ztoc, which are downloaded as a whole.
+type LayerReport struct {
+	Layer     digest.Digest `json:"layer"`
+	MediaType string        `json:"mediaType"`
+	Size      int64         `json:"size"`
+	Ztoc      digest.Digest `json:"ztoc,omitempty"`
+	ZtocSize  int64         `json:"ztocSize,omitempty"`
+	Spans     int           `json:"spans,omitempty"`
+	// SpanSize is the span size the ztoc was built with, as recorded in the artifacts db.
+	// It is 0 if it wasn't recorded.
+	SpanSize int64 `json:"spanSize,omitempty"`
+	Files    int   `json:"files,omitempty"`
+	// ZtocRatio is the size of the ztoc divided by the size of the layer.
+	ZtocRatio float64 `json:"ztocRatio,omitempty"`
+}
+
+// LazilyLoaded reports whether the layer has a ztoc, and is lazily loaded.
+func (r LayerReport) LazilyLoaded() bool {
+	return r.Ztoc != ""
+}
+
+// InspectIndex reports how each layer of the image manifest is loaded with the SOCI index.
+// The ztocs of the index are read from store, and the span sizes they were built with from db.
+// Layers which are eager in the index, or missing from it, have no ztoc.
+func InspectIndex(ctx context.Context, manifest ocispec.Manifest, index *Index, store orascontent.Storage, db *ArtifactsDb) ([]LayerReport, error) {
+	blobs := make(map[string]ocispec.Descriptor)
+	for _, blob := range index.Blobs {
+		if !IsEagerLayer(blob) {
+			blobs[blob.Annotations[IndexAnnotationImageLayerDigest]] = blob
+		}
+	}
+
+	reports := make([]LayerReport, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		report := LayerReport{
+			Layer:     layer.Digest,
+			MediaType: layer.MediaType,
+			Size:      layer.Size,
+		}
+		blob, ok := blobs[layer.Digest.String()]
+		if !ok {
+			reports = append(reports, report)
+			continue
+		}
+		ztoc, err := fetchZtoc(ctx, store, blob)
+		if err != nil {
+			return nil, err
+		}
+		report.Ztoc = blob.Digest
+		report.ZtocSize = blob.Size
+		report.Spans = int(ztoc.MaxSpanId) + 1
+		report.Files = len(ztoc.Metadata)
+		if layer.Size > 0 {
+			report.ZtocRatio = float64(blob.Size) / float64(layer.Size)
+		}
+		entry, err := db.GetArtifactEntry(blob.Digest.String())
+		switch {
+		case err == nil:
+			report.SpanSize = entry.SpanSize
+		case !errdefs.IsNotFound(err):
+			return nil, fmt.Errorf("cannot get artifact entry of ztoc %v: %w", blob.Digest, err)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+func fetchZtoc(ctx context.Context, store orascontent.Storage, desc ocispec.Descriptor) (*Ztoc, error) {
+	rc, err := store.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch ztoc %v: %w", desc.Digest, err)
+	}
+	defer rc.Close()
+	ztoc, err := GetZtoc(rc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read ztoc %v: %w", desc.Digest, err)
+	}
+	return ztoc, nil
+}
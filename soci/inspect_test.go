@@ -0,0 +1,115 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"compress/gzip"
+	"context"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestInspectIndex(t *testing.T) {
+	const spanSize = 65536
+	ctx := context.Background()
+	db, err := newTestableDb()
+	if err != nil {
+		t.Fatalf("can't create a test db")
+	}
+	store := memory.New()
+
+	ents := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(genRandomByteData(200000))),
+		testutil.File("dir/file2", string(genRandomByteData(100000))),
+	}
+	ztoc, sr, err := BuildZtocReader(ents, gzip.BestCompression, spanSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ztocReader, ztocDesc, err := NewZtocReader(ztoc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ztocDesc.MediaType = SociLayerMediaType
+	if err := store.Push(ctx, ztocDesc, ztocReader); err != nil {
+		t.Fatal(err)
+	}
+
+	lazyLayer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("lazy"), Size: sr.Size()}
+	eagerLayer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("eager"), Size: 100}
+	missingLayer := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageLayerGzip, Digest: digest.FromString("missing"), Size: 200}
+	blob := ztocDesc
+	blob.Annotations = map[string]string{
+		IndexAnnotationImageLayerMediaType: lazyLayer.MediaType,
+		IndexAnnotationImageLayerDigest:    lazyLayer.Digest.String(),
+	}
+	index := &Index{Blobs: []ocispec.Descriptor{blob, *eagerLayerDescriptor(eagerLayer)}}
+	manifest := ocispec.Manifest{Layers: []ocispec.Descriptor{lazyLayer, eagerLayer, missingLayer}}
+
+	for _, recorded := range []bool{false, true} {
+		if recorded {
+			err := db.WriteArtifactEntry(&ArtifactEntry{
+				Size:           ztocDesc.Size,
+				Digest:         ztocDesc.Digest.String(),
+				OriginalDigest: lazyLayer.Digest.String(),
+				Type:           ArtifactEntryTypeLayer,
+				MediaType:      SociLayerMediaType,
+				SpanSize:       spanSize,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		reports, err := InspectIndex(ctx, manifest, index, store, db)
+		if err != nil {
+			t.Fatalf("cannot inspect index: %v", err)
+		}
+		if len(reports) != 3 {
+			t.Fatalf("expected a report per layer, got %d", len(reports))
+		}
+
+		lazy := reports[0]
+		if !lazy.LazilyLoaded() || lazy.Layer != lazyLayer.Digest || lazy.Ztoc != ztocDesc.Digest || lazy.ZtocSize != ztocDesc.Size {
+			t.Fatalf("unexpected report of lazily loaded layer: %+v", lazy)
+		}
+		if lazy.Spans != int(ztoc.MaxSpanId)+1 || lazy.Files != len(ents) || lazy.Size != sr.Size() {
+			t.Fatalf("unexpected ztoc stats of lazily loaded layer: %+v", lazy)
+		}
+		if lazy.ZtocRatio != float64(ztocDesc.Size)/float64(sr.Size()) {
+			t.Fatalf("unexpected ztoc ratio; expected = %f, got = %f", float64(ztocDesc.Size)/float64(sr.Size()), lazy.ZtocRatio)
+		}
+		expectedSpanSize := int64(0)
+		if recorded {
+			expectedSpanSize = spanSize
+		}
+		if lazy.SpanSize != expectedSpanSize {
+			t.Fatalf("unexpected span size; expected = %d, got = %d", expectedSpanSize, lazy.SpanSize)
+		}
+
+		for i, layer := range []ocispec.Descriptor{eagerLayer, missingLayer} {
+			r := reports[i+1]
+			if r.LazilyLoaded() || r.Layer != layer.Digest || r.Size != layer.Size || r.Spans != 0 || r.Files != 0 {
+				t.Fatalf("unexpected report of layer %s: %+v", layer.Digest, r)
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// PrefetchSpans returns the spans of the layer holding the contents of the files, in the order
+// of the files. Files which aren't regular files of the layer are ignored.
+// The files are paths in the image filesystem, e.g. /usr/bin/bash.
+func PrefetchSpans(ztoc *Ztoc, files []string) []SpanId {
+	if ztoc == nil || len(files) == 0 {
+		return nil
+	}
+	byName := make(map[string]*FileMetadata)
+	for i, m := range ztoc.Metadata {
+		if m.Type == "reg" && m.UncompressedSize > 0 {
+			// a later entry of the same file replaces the earlier ones
+			byName[cleanEntryName(m.Name)] = &ztoc.Metadata[i]
+		}
+	}
+
+	var spans []SpanId
+	seen := make(map[SpanId]struct{})
+	for _, f := range files {
+		m, ok := byName[cleanEntryName(f)]
+		if !ok {
+			continue
+		}
+		for id := m.SpanStart; id <= m.SpanEnd; id++ {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				spans = append(spans, id)
+			}
+		}
+	}
+	return spans
+}
+
+// FormatPrefetchSpans formats the span ids as the value of IndexAnnotationPrefetchSpans:
+// a comma separated list of span ids, where consecutive ids are written as a range,
+// e.g. "4-7,0,12".
+func FormatPrefetchSpans(spans []SpanId) string {
+	var b strings.Builder
+	for i := 0; i < len(spans); {
+		j := i
+		for j+1 < len(spans) && spans[j+1] == spans[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		if j == i {
+			fmt.Fprintf(&b, "%d", spans[i])
+		} else {
+			fmt.Fprintf(&b, "%d-%d", spans[i], spans[j])
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// ParsePrefetchSpans parses the value of IndexAnnotationPrefetchSpans of a layer whose last
+// span is maxSpanID. It returns an error if any span is out of the layer.
+func ParsePrefetchSpans(s string, maxSpanID SpanId) ([]SpanId, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var spans []SpanId
+	for _, r := range strings.Split(s, ",") {
+		bounds := strings.SplitN(r, "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefetch span %q: %w", r, err)
+		}
+		end := start
+		if len(bounds) == 2 {
+			if end, err = strconv.ParseUint(bounds[1], 10, 31); err != nil {
+				return nil, fmt.Errorf("invalid prefetch span %q: %w", r, err)
+			}
+			if end < start {
+				return nil, fmt.Errorf("invalid prefetch span range %q", r)
+			}
+		}
+		if end > uint64(maxSpanID) {
+			return nil, fmt.Errorf("prefetch span %q exceeds the last span %d", r, maxSpanID)
+		}
+		for id := start; id <= end; id++ {
+			spans = append(spans, SpanId(id))
+		}
+	}
+	return spans, nil
+}
+
+// cleanEntryName returns the name of a tar entry or of a file in the image
+// as a path relative to the root of the image filesystem.
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,132 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"compress/gzip"
+	"reflect"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+)
+
+func TestPrefetchSpans(t *testing.T) {
+	ents := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(genRandomByteData(200000))),
+		testutil.File("dir/file2", string(genRandomByteData(100000))),
+		testutil.File("empty", ""),
+		testutil.Symlink("link", "dir/file1"),
+	}
+	ztoc, _, err := BuildZtocReader(ents, gzip.BestCompression, 65536)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	spansOf := func(name string) []SpanId {
+		m, err := GetMetadataEntry(ztoc, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var spans []SpanId
+		for id := m.SpanStart; id <= m.SpanEnd; id++ {
+			spans = append(spans, id)
+		}
+		return spans
+	}
+	file1, file2 := spansOf("dir/file1"), spansOf("dir/file2")
+
+	// the spans shared by file1 and file2 are only listed once
+	both := append([]SpanId{}, file2...)
+	for _, id := range file1 {
+		if id < file2[0] {
+			both = append(both, id)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		files    []string
+		expected []SpanId
+	}{
+		{
+			name:     "absolute path",
+			files:    []string{"/dir/file1"},
+			expected: file1,
+		},
+		{
+			name:     "files in order",
+			files:    []string{"dir/file2", "./dir/file1"},
+			expected: both,
+		},
+		{
+			name:  "not regular files or not in the layer",
+			files: []string{"/dir", "/empty", "/link", "/other"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			spans := PrefetchSpans(ztoc, tc.files)
+			if !reflect.DeepEqual(spans, tc.expected) {
+				t.Fatalf("unexpected spans; expected %v, got %v", tc.expected, spans)
+			}
+		})
+	}
+}
+
+func TestFormatPrefetchSpans(t *testing.T) {
+	testCases := []struct {
+		spans     []SpanId
+		formatted string
+	}{
+		{
+			formatted: "",
+		},
+		{
+			spans:     []SpanId{3},
+			formatted: "3",
+		},
+		{
+			spans:     []SpanId{4, 5, 6, 7, 0, 12, 2, 3},
+			formatted: "4-7,0,12,2-3",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.formatted, func(t *testing.T) {
+			formatted := FormatPrefetchSpans(tc.spans)
+			if formatted != tc.formatted {
+				t.Fatalf("unexpected formatted spans; expected %q, got %q", tc.formatted, formatted)
+			}
+			spans, err := ParsePrefetchSpans(formatted, 12)
+			if err != nil {
+				t.Fatalf("can't parse %q: %v", formatted, err)
+			}
+			if !reflect.DeepEqual(spans, tc.spans) {
+				t.Fatalf("unexpected parsed spans; expected %v, got %v", tc.spans, spans)
+			}
+		})
+	}
+}
+
+func TestParseInvalidPrefetchSpans(t *testing.T) {
+	for _, s := range []string{"a", "1,", "-1", "3-1", "1-a", "13", "0-13"} {
+		t.Run(s, func(t *testing.T) {
+			if _, err := ParsePrefetchSpans(s, 12); err == nil {
+				t.Fatalf("expected an error parsing %q", s)
+			}
+		})
+	}
+}
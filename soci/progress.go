@@ -0,0 +1,95 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"io"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// progressInterval is the number of bytes of a layer processed between two progress reports.
+const progressInterval = 1 << 20
+
+// LayerState is the state of a layer while BuildSociIndex builds its ztoc.
+type LayerState string
+
+const (
+	// LayerStateWaiting is the state of a layer waiting for a build slot, see WithConcurrency.
+	LayerStateWaiting LayerState = "waiting"
+	// LayerStateBuilding is the state of a layer whose ztoc is being built.
+	LayerStateBuilding LayerState = "building"
+	// LayerStateBuilt is the state of a layer whose ztoc was built.
+	LayerStateBuilt LayerState = "built"
+	// LayerStateReused is the state of a layer whose existing ztoc was reused.
+	LayerStateReused LayerState = "reused"
+	// LayerStateSkipped is the state of a layer without ztoc, marked for eager download.
+	LayerStateSkipped LayerState = "skipped"
+	// LayerStateFailed is the state of a layer whose ztoc couldn't be built.
+	LayerStateFailed LayerState = "failed"
+)
+
+// LayerProgress is the progress of the build of the ztoc of a layer.
+type LayerProgress struct {
+	// Layer is the descriptor of the layer.
+	Layer ocispec.Descriptor
+	State LayerState
+	// BytesProcessed is the number of bytes of the layer blob read so far.
+	BytesProcessed int64
+	// Ztoc is the descriptor of the ztoc of a built or reused layer.
+	Ztoc *ocispec.Descriptor
+	// Err is the error of a failed layer.
+	Err error
+}
+
+// ProgressReporter receives the progress of the layers while BuildSociIndex builds their ztocs.
+// Each layer is reported as waiting first, then while it's being built, at least every MiB read,
+// and last in one of the final states. Layers are built concurrently, so ReportLayerProgress
+// must be safe for concurrent use.
+type ProgressReporter interface {
+	ReportLayerProgress(LayerProgress)
+}
+
+// reportProgress reports the progress of a layer to the configured reporter, if any.
+func (c *buildConfig) reportProgress(p LayerProgress) {
+	if c != nil && c.progress != nil {
+		c.progress.ReportLayerProgress(p)
+	}
+}
+
+// progressReaderAt reports the bytes of a layer read through it as processed.
+// It's meant for the reads of a single builder, which doesn't read concurrently.
+type progressReaderAt struct {
+	io.ReaderAt
+	layer     ocispec.Descriptor
+	cfg       *buildConfig
+	processed int64
+	reported  int64
+}
+
+func (r *progressReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := r.ReaderAt.ReadAt(p, offset)
+	// bytes read again, e.g. by the second pass of SpanPlacementFileBoundary, aren't counted twice
+	if end := offset + int64(n); end > r.processed {
+		r.processed = end
+	}
+	if r.processed-r.reported >= progressInterval {
+		r.reported = r.processed
+		r.cfg.reportProgress(LayerProgress{Layer: r.layer, State: LayerStateBuilding, BytesProcessed: r.processed})
+	}
+	return n, err
+}
@@ -0,0 +1,131 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"oras.land/oras-go/v2/content/oci"
+)
+
+// recordingReporter records the progress reports of each layer and the maximum
+// number of layers being built at once.
+type recordingReporter struct {
+	mu        sync.Mutex
+	reports   map[digest.Digest][]LayerProgress
+	building  int
+	maxActive int
+}
+
+func (r *recordingReporter) ReportLayerProgress(p LayerProgress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reports := r.reports[p.Layer.Digest]
+	switch {
+	case len(reports) == 0:
+	case p.State == LayerStateBuilding && reports[len(reports)-1].State == LayerStateWaiting:
+		r.building++
+		if r.building > r.maxActive {
+			r.maxActive = r.building
+		}
+	case p.State != LayerStateBuilding && reports[len(reports)-1].State == LayerStateBuilding:
+		r.building--
+	}
+	r.reports[p.Layer.Digest] = append(reports, p)
+}
+
+func TestBuildSociIndexProgress(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		name          string
+		concurrency   int
+		minLayerSize  int64
+		maxActive     int
+		expectedState LayerState
+	}{
+		{
+			name:          "sequential",
+			concurrency:   1,
+			maxActive:     1,
+			expectedState: LayerStateBuilt,
+		},
+		{
+			name:          "unbounded",
+			maxActive:     2,
+			expectedState: LayerStateBuilt,
+		},
+		{
+			name:          "eager",
+			concurrency:   1,
+			minLayerSize:  1 << 30,
+			maxActive:     1,
+			expectedState: LayerStateSkipped,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			writeTestOCILayout(t, dir)
+			layout, err := NewOCILayout(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := layout.Resolve(ctx, "v1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			store, err := oci.New(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			reporter := &recordingReporter{reports: make(map[digest.Digest][]LayerProgress)}
+			_, err = BuildSociIndex(ctx, layout, img, 65536, store, WithNoArtifactsDB(),
+				WithMinLayerSize(tc.minLayerSize), WithConcurrency(tc.concurrency), WithProgress(reporter))
+			if err != nil {
+				t.Fatalf("cannot build soci index: %v", err)
+			}
+
+			if len(reporter.reports) != 2 {
+				t.Fatalf("unexpected number of reported layers; expected = 2, got = %d", len(reporter.reports))
+			}
+			if reporter.maxActive > tc.maxActive {
+				t.Fatalf("too many layers built at once; expected at most %d, got %d", tc.maxActive, reporter.maxActive)
+			}
+			for dgst, reports := range reporter.reports {
+				if reports[0].State != LayerStateWaiting {
+					t.Fatalf("layer %v not reported as waiting first: %v", dgst, reports[0].State)
+				}
+				last := reports[len(reports)-1]
+				if last.State != tc.expectedState {
+					t.Fatalf("unexpected final state of layer %v; expected = %v, got = %v", dgst, tc.expectedState, last.State)
+				}
+				if tc.expectedState == LayerStateBuilt && (last.BytesProcessed != last.Layer.Size || last.Ztoc == nil) {
+					t.Fatalf("unexpected final progress of layer %v: %+v", dgst, last)
+				}
+			}
+		})
+	}
+}
+
+func TestWithConcurrencyInvalid(t *testing.T) {
+	if err := WithConcurrency(-1)(&buildConfig{}); err == nil {
+		t.Fatalf("expected an error for a negative concurrency")
+	}
+}
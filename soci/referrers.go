@@ -0,0 +1,210 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oraslib "oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+// OCIImageIndexMediaType is the media type of OCI image indices, which is also
+// the media type of the referrers index of the referrers tag schema.
+const OCIImageIndexMediaType = "application/vnd.oci.image.index.v1+json"
+
+// Referrer describes a manifest referring to another manifest, as listed
+// in the referrers index of that manifest.
+type Referrer struct {
+	MediaType    string            `json:"mediaType"`
+	Digest       digest.Digest     `json:"digest"`
+	Size         int64             `json:"size"`
+	ArtifactType string            `json:"artifactType,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// Descriptor returns the descriptor of the referring manifest.
+func (r Referrer) Descriptor() ocispec.Descriptor {
+	return ocispec.Descriptor{
+		MediaType:   r.MediaType,
+		Digest:      r.Digest,
+		Size:        r.Size,
+		Annotations: r.Annotations,
+	}
+}
+
+// referrersIndex is the image index listing the manifests referring to a manifest,
+// as returned by the referrers API and as tagged in the referrers tag schema.
+type referrersIndex struct {
+	SchemaVersion int        `json:"schemaVersion"`
+	MediaType     string     `json:"mediaType"`
+	Manifests     []Referrer `json:"manifests"`
+}
+
+// ReferrersTag returns the tag of the referrers index of the manifest with the given digest
+// in the referrers tag schema, e.g. "sha256-<hex>". The tag schema is used instead of the
+// referrers API with registries which don't support it.
+func ReferrersTag(d digest.Digest) string {
+	return fmt.Sprintf("%s-%s", d.Algorithm(), d.Encoded())
+}
+
+// maxReferrersIndexSize is the maximum size of the referrers index read from the referrers API.
+const maxReferrersIndexSize = 4 << 20
+
+// ReferrersAPISupported reports whether the registry of the repository supports the
+// referrers API, by listing the referrers of the manifest with the given digest.
+func ReferrersAPISupported(ctx context.Context, repo *remote.Repository, subject digest.Digest) (bool, error) {
+	_, supported, err := fetchReferrersAPI(ctx, repo, subject)
+	return supported, err
+}
+
+// ListReferrers returns the manifests referring to the manifest with the given digest in the
+// repository, as listed by the referrers API or, if the registry doesn't support it, by the
+// referrers index of the referrers tag schema.
+func ListReferrers(ctx context.Context, repo *remote.Repository, subject digest.Digest) ([]Referrer, error) {
+	referrers, supported, err := fetchReferrersAPI(ctx, repo, subject)
+	if err != nil {
+		return nil, err
+	}
+	if supported {
+		return referrers, nil
+	}
+	return FetchReferrersTagIndex(ctx, repo, subject)
+}
+
+// fetchReferrersAPI lists the referrers of the manifest with the given digest through the
+// referrers API. It reports whether the registry supports the API.
+func fetchReferrersAPI(ctx context.Context, repo *remote.Repository, subject digest.Digest) ([]Referrer, bool, error) {
+	scheme := "https"
+	if repo.PlainHTTP {
+		scheme = "http"
+	}
+	url := fmt.Sprintf("%s://%s/v2/%s/referrers/%s", scheme, repo.Reference.Registry, repo.Reference.Repository, subject)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Accept", OCIImageIndexMediaType)
+	client := repo.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("unexpected status listing referrers of %v: %s", subject, resp.Status)
+	}
+	var index referrersIndex
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReferrersIndexSize)).Decode(&index); err != nil {
+		return nil, true, fmt.Errorf("cannot decode referrers of %v: %w", subject, err)
+	}
+	return index.Manifests, true, nil
+}
+
+// AddReferrer adds the manifest of the index, described by desc, to the referrers index of its
+// subject in the referrers tag schema of the target, so that the index can be discovered from
+// its subject in registries which don't support the referrers API.
+func AddReferrer(ctx context.Context, target oraslib.Target, desc ocispec.Descriptor, index *Index) error {
+	subject := index.refers()
+	if subject == nil {
+		return errors.New("cannot add referrer: the manifest has no subject")
+	}
+	referrers, err := FetchReferrersTagIndex(ctx, target, subject.Digest)
+	if err != nil {
+		return err
+	}
+	for _, r := range referrers {
+		if r.Digest == desc.Digest {
+			return nil
+		}
+	}
+	referrers = append(referrers, Referrer{
+		MediaType:    desc.MediaType,
+		Digest:       desc.Digest,
+		Size:         desc.Size,
+		ArtifactType: index.ArtifactType,
+		Annotations:  index.Annotations,
+	})
+	return tagReferrersIndex(ctx, target, subject.Digest, referrers)
+}
+
+// tagReferrersIndex writes the referrers index of subject listing referrers to the target,
+// and tags it in the referrers tag schema.
+func tagReferrersIndex(ctx context.Context, target oraslib.Target, subject digest.Digest, referrers []Referrer) error {
+	data, err := json.Marshal(referrersIndex{
+		SchemaVersion: 2,
+		MediaType:     OCIImageIndexMediaType,
+		Manifests:     referrers,
+	})
+	if err != nil {
+		return err
+	}
+	indexDesc := ocispec.Descriptor{
+		MediaType: OCIImageIndexMediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if err := pushIfNotExists(ctx, target, indexDesc, data); err != nil {
+		return fmt.Errorf("cannot write referrers index of %v: %w", subject, err)
+	}
+	if err := target.Tag(ctx, indexDesc, ReferrersTag(subject)); err != nil {
+		return fmt.Errorf("cannot tag referrers index of %v: %w", subject, err)
+	}
+	return nil
+}
+
+// FetchReferrersTagIndex returns the manifests referring to the manifest with the given digest,
+// as listed by the referrers index tagged in the referrers tag schema of the target.
+// It returns no referrers if the target has no referrers index for the manifest.
+func FetchReferrersTagIndex(ctx context.Context, target oraslib.Target, subject digest.Digest) ([]Referrer, error) {
+	desc, err := target.Resolve(ctx, ReferrersTag(subject))
+	if errors.Is(err, errdef.ErrNotFound) || errdefs.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("cannot resolve referrers index of %v: %w", subject, err)
+	}
+	rc, err := target.Fetch(ctx, desc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch referrers index of %v: %w", subject, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, desc.Size))
+	if err != nil {
+		return nil, err
+	}
+	var index referrersIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("cannot decode referrers index of %v: %w", subject, err)
+	}
+	return index.Manifests, nil
+}
@@ -0,0 +1,181 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+	"oras.land/oras-go/v2/registry/remote"
+)
+
+func TestReferrersTag(t *testing.T) {
+	d := digest.FromString("image manifest")
+	if got, want := ReferrersTag(d), "sha256-"+d.Encoded(); got != want {
+		t.Fatalf("unexpected referrers tag; expected = %s, got = %s", want, got)
+	}
+}
+
+func TestAddReferrer(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	subject := ocispec.Descriptor{
+		MediaType: OCIImageManifestMediaType,
+		Digest:    digest.FromString("image manifest"),
+		Size:      14,
+	}
+
+	referrers, err := FetchReferrersTagIndex(ctx, store, subject.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(referrers) != 0 {
+		t.Fatalf("expected no referrers, got %v", referrers)
+	}
+
+	newReferrer := func(name string) (ocispec.Descriptor, *Index) {
+		blobs := []ocispec.Descriptor{{
+			MediaType: SociLayerMediaType,
+			Digest:    digest.FromString(name),
+			Size:      int64(len(name)),
+		}}
+		index := NewIndex(blobs, &subject, map[string]string{"name": name}, ManifestOCIImage)
+		manifest, err := json.Marshal(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ocispec.Descriptor{
+			MediaType: OCIImageManifestMediaType,
+			Digest:    digest.FromBytes(manifest),
+			Size:      int64(len(manifest)),
+		}, index
+	}
+	desc1, index1 := newReferrer("index 1")
+	desc2, index2 := newReferrer("index 2")
+
+	for _, add := range []struct {
+		desc  ocispec.Descriptor
+		index *Index
+	}{{desc1, index1}, {desc1, index1}, {desc2, index2}} {
+		if err := AddReferrer(ctx, store, add.desc, add.index); err != nil {
+			t.Fatalf("cannot add referrer: %v", err)
+		}
+	}
+
+	referrers, err = FetchReferrersTagIndex(ctx, store, subject.Digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(referrers) != 2 {
+		t.Fatalf("unexpected number of referrers; expected = 2, got = %d", len(referrers))
+	}
+	for i, want := range []ocispec.Descriptor{desc1, desc2} {
+		got := referrers[i]
+		if got.Digest != want.Digest || got.MediaType != want.MediaType || got.Size != want.Size {
+			t.Fatalf("unexpected referrer %d; expected = %v, got = %v", i, want, got)
+		}
+		if got.ArtifactType != SociIndexArtifactType {
+			t.Fatalf("unexpected artifact type of referrer %d; expected = %s, got = %s", i, SociIndexArtifactType, got.ArtifactType)
+		}
+	}
+
+	if err := AddReferrer(ctx, store, desc1, NewIndex(nil, nil, nil, ManifestOCIImage)); err == nil {
+		t.Fatalf("expected an error adding a referrer without subject")
+	}
+}
+
+func TestListReferrers(t *testing.T) {
+	subject := digest.FromString("image manifest")
+	index := referrersIndex{
+		SchemaVersion: 2,
+		MediaType:     OCIImageIndexMediaType,
+		Manifests: []Referrer{{
+			MediaType:    OCIImageManifestMediaType,
+			Digest:       digest.FromString("index"),
+			Size:         5,
+			ArtifactType: SociIndexArtifactType,
+		}},
+	}
+
+	testCases := []struct {
+		name          string
+		apiSupported  bool
+		wantReferrers int
+	}{
+		{
+			name:          "referrers API",
+			apiSupported:  true,
+			wantReferrers: 1,
+		},
+		{
+			name:          "referrers tag schema without referrers index",
+			apiSupported:  false,
+			wantReferrers: 0,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.apiSupported && r.URL.Path == "/v2/repo/referrers/"+subject.String() {
+					w.Header().Set("Content-Type", OCIImageIndexMediaType)
+					json.NewEncoder(w).Encode(index)
+					return
+				}
+				http.NotFound(w, r)
+			}))
+			defer server.Close()
+			u, err := url.Parse(server.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo, err := remote.NewRepository(u.Host + "/repo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo.PlainHTTP = true
+
+			ctx := context.Background()
+			supported, err := ReferrersAPISupported(ctx, repo, subject)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if supported != tc.apiSupported {
+				t.Fatalf("unexpected support of the referrers API; expected = %v, got = %v", tc.apiSupported, supported)
+			}
+			referrers, err := ListReferrers(ctx, repo, subject)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(referrers) != tc.wantReferrers {
+				t.Fatalf("unexpected number of referrers; expected = %d, got = %v", tc.wantReferrers, referrers)
+			}
+			for i, r := range referrers {
+				if r.Digest != index.Manifests[i].Digest || r.ArtifactType != SociIndexArtifactType {
+					t.Fatalf("unexpected referrer %d: %v", i, r)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,294 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oraslib "oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/errdef"
+)
+
+const (
+	// artifactType of the signature of a SOCI index
+	SociSignatureArtifactType = "application/vnd.amazon.soci.signature.v1+json"
+	// mediaType of the signed payload of a SOCI index signature
+	SociSignaturePayloadMediaType = "application/vnd.amazon.soci.signature.payload.v1+json"
+	// SignatureAnnotationSignature is the annotation of the payload descriptor
+	// containing the base64 encoded signature of the payload
+	SignatureAnnotationSignature = "com.amazon.soci.signature"
+)
+
+var (
+	// ErrSignatureNotFound is returned when a SOCI index has no signature
+	ErrSignatureNotFound = errors.New("soci index signature not found")
+	// ErrInvalidSignature is returned when the signature of a SOCI index can't be
+	// verified with any of the trusted public keys
+	ErrInvalidSignature = errors.New("invalid soci index signature")
+)
+
+// signaturePayload is the content signed by the signature of a SOCI index.
+type signaturePayload struct {
+	// Index is the digest of the SOCI index manifest.
+	Index digest.Digest `json:"index"`
+	// Image is the digest of the image manifest the index refers to.
+	Image digest.Digest `json:"image"`
+}
+
+// SignatureTag returns the tag of the signature of the SOCI index with the given digest,
+// e.g. "sha256-<hex>.sig". The tag allows finding the signature of an index in registries
+// and stores which don't support listing the artifacts referring to a manifest.
+func SignatureTag(indexDigest digest.Digest) string {
+	return ReferrersTag(indexDigest) + ".sig"
+}
+
+// LoadPrivateKey reads a PEM encoded ECDSA, RSA or Ed25519 private key from a file.
+func LoadPrivateKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key type %q in %s", block.Type, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse private key %s: %w", path, err)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key in %s", path)
+	}
+	return signer, nil
+}
+
+// LoadPublicKey reads a PEM encoded ECDSA, RSA or Ed25519 public key from a file.
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unsupported public key type %q in %s", block.Type, path)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key %s: %w", path, err)
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key in %s", path)
+}
+
+// SignSociIndex signs the SOCI index of indexWithMetadata, which must already be written to the store.
+// See SignIndex.
+func SignSociIndex(ctx context.Context, store oraslib.Target, indexWithMetadata IndexWithMetadata, key crypto.Signer) (*ocispec.Descriptor, error) {
+	manifest, err := json.Marshal(indexWithMetadata.Index)
+	if err != nil {
+		return nil, err
+	}
+	return SignIndex(ctx, store, ocispec.Descriptor{
+		MediaType: indexWithMetadata.Index.MediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}, key)
+}
+
+// SignIndex signs the SOCI index manifest described by indexDesc with key.
+//
+// The signature is written to the store as an artifact manifest referring to the index,
+// with the signed payload as its only blob and the signature in the annotations of the
+// payload. The signature manifest is tagged with SignatureTag, replacing any previous
+// signature of the index.
+func SignIndex(ctx context.Context, store oraslib.Target, indexDesc ocispec.Descriptor, key crypto.Signer) (*ocispec.Descriptor, error) {
+	rc, err := store.Fetch(ctx, indexDesc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch soci index %v: %w", indexDesc.Digest, err)
+	}
+	index, err := NewIndexFromReader(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	refers := index.refers()
+	if refers == nil {
+		return nil, errors.New("cannot sign soci index: the Refers field is nil")
+	}
+
+	payload, err := json.Marshal(signaturePayload{
+		Index: indexDesc.Digest,
+		Image: refers.Digest,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signPayload(key, payload)
+	if err != nil {
+		return nil, fmt.Errorf("cannot sign soci index %v: %w", indexDesc.Digest, err)
+	}
+
+	payloadDesc := ocispec.Descriptor{
+		MediaType: SociSignaturePayloadMediaType,
+		Digest:    digest.FromBytes(payload),
+		Size:      int64(len(payload)),
+		Annotations: map[string]string{
+			SignatureAnnotationSignature: base64.StdEncoding.EncodeToString(signature),
+		},
+	}
+	if err := pushIfNotExists(ctx, store, payloadDesc, payload); err != nil {
+		return nil, fmt.Errorf("cannot write signature payload: %w", err)
+	}
+
+	subject := ocispec.Descriptor{
+		MediaType: indexDesc.MediaType,
+		Digest:    indexDesc.Digest,
+		Size:      indexDesc.Size,
+	}
+	sig := &Index{
+		MediaType:    index.MediaType,
+		ArtifactType: SociSignatureArtifactType,
+		Blobs:        []ocispec.Descriptor{payloadDesc},
+	}
+	if index.MediaType == OCIArtifactManifestMediaType {
+		sig.Refers = &subject
+	} else {
+		sig.Subject = &subject
+	}
+	manifest, err := json.Marshal(sig)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeIndexConfig(ctx, store, sig); err != nil {
+		return nil, err
+	}
+	sigDesc := ocispec.Descriptor{
+		MediaType: sig.MediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	if err := pushIfNotExists(ctx, store, sigDesc, manifest); err != nil {
+		return nil, fmt.Errorf("cannot write signature manifest: %w", err)
+	}
+	if err := store.Tag(ctx, sigDesc, SignatureTag(indexDesc.Digest)); err != nil {
+		return nil, fmt.Errorf("cannot tag signature manifest: %w", err)
+	}
+
+	log.G(ctx).WithField("digest", sigDesc.Digest.String()).Debugf("soci index signature has been written")
+	return &sigDesc, nil
+}
+
+// VerifyIndexSignature checks that sig is a signature of the SOCI index with digest indexDigest
+// made with the private key of one of keys. payload is the content of the only blob of sig.
+func VerifyIndexSignature(indexDigest digest.Digest, sig *Index, payload []byte, keys []crypto.PublicKey) error {
+	if sig.ArtifactType != SociSignatureArtifactType {
+		return fmt.Errorf("%w: unexpected artifact type %q", ErrInvalidSignature, sig.ArtifactType)
+	}
+	if refers := sig.refers(); refers == nil || refers.Digest != indexDigest {
+		return fmt.Errorf("%w: signature doesn't refer to soci index %v", ErrInvalidSignature, indexDigest)
+	}
+	if len(sig.Blobs) != 1 || sig.Blobs[0].MediaType != SociSignaturePayloadMediaType {
+		return fmt.Errorf("%w: signature must have exactly one payload", ErrInvalidSignature)
+	}
+	payloadDesc := sig.Blobs[0]
+	if payloadDesc.Digest != digest.FromBytes(payload) {
+		return fmt.Errorf("%w: payload doesn't match digest %v", ErrInvalidSignature, payloadDesc.Digest)
+	}
+	signature, err := base64.StdEncoding.DecodeString(payloadDesc.Annotations[SignatureAnnotationSignature])
+	if err != nil || len(signature) == 0 {
+		return fmt.Errorf("%w: missing or malformed signature annotation", ErrInvalidSignature)
+	}
+
+	var p signaturePayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return fmt.Errorf("%w: cannot decode payload: %v", ErrInvalidSignature, err)
+	}
+	if p.Index != indexDigest {
+		return fmt.Errorf("%w: payload is for soci index %v", ErrInvalidSignature, p.Index)
+	}
+
+	for _, key := range keys {
+		if verifyPayload(key, payload, signature) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no trusted key matches the signature of soci index %v", ErrInvalidSignature, indexDigest)
+}
+
+func signPayload(key crypto.Signer, payload []byte) ([]byte, error) {
+	if _, ok := key.Public().(ed25519.PublicKey); ok {
+		return key.Sign(rand.Reader, payload, crypto.Hash(0))
+	}
+	h := sha256.Sum256(payload)
+	return key.Sign(rand.Reader, h[:], crypto.SHA256)
+}
+
+func verifyPayload(key crypto.PublicKey, payload, signature []byte) bool {
+	h := sha256.Sum256(payload)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(k, h[:], signature)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], signature) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, payload, signature)
+	}
+	return false
+}
+
+func pushIfNotExists(ctx context.Context, store oraslib.Target, desc ocispec.Descriptor, data []byte) error {
+	err := store.Push(ctx, desc, bytes.NewReader(data))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return err
+	}
+	return nil
+}
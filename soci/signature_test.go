@@ -0,0 +1,236 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	oraslib "oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestSignIndex(t *testing.T) {
+	testCases := []struct {
+		name         string
+		newKey       func() (crypto.Signer, error)
+		manifestType ManifestType
+	}{
+		{
+			name: "ecdsa key, ORAS manifest",
+			newKey: func() (crypto.Signer, error) {
+				return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			},
+			manifestType: ManifestORAS,
+		},
+		{
+			name: "rsa key, OCI artifact manifest",
+			newKey: func() (crypto.Signer, error) {
+				return rsa.GenerateKey(rand.Reader, 2048)
+			},
+			manifestType: ManifestOCIArtifact,
+		},
+		{
+			name: "ed25519 key, ORAS manifest",
+			newKey: func() (crypto.Signer, error) {
+				_, key, err := ed25519.GenerateKey(rand.Reader)
+				return key, err
+			},
+			manifestType: ManifestORAS,
+		},
+		{
+			name: "ecdsa key, OCI image manifest",
+			newKey: func() (crypto.Signer, error) {
+				return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			},
+			manifestType: ManifestOCIImage,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := memory.New()
+			key, err := tc.newKey()
+			if err != nil {
+				t.Fatal(err)
+			}
+			otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			indexDesc := writeTestIndex(t, store, tc.manifestType)
+			sigDesc, err := SignIndex(ctx, store, indexDesc, key)
+			if err != nil {
+				t.Fatalf("cannot sign index: %v", err)
+			}
+
+			tagged, err := store.Resolve(ctx, SignatureTag(indexDesc.Digest))
+			if err != nil {
+				t.Fatalf("cannot resolve signature tag: %v", err)
+			}
+			if tagged.Digest != sigDesc.Digest {
+				t.Fatalf("unexpected tagged signature; expected = %v, got = %v", sigDesc.Digest, tagged.Digest)
+			}
+
+			sig, payload := readTestSignature(t, store, *sigDesc)
+			if err := VerifyIndexSignature(indexDesc.Digest, sig, payload, []crypto.PublicKey{otherKey.Public(), key.Public()}); err != nil {
+				t.Fatalf("cannot verify signature: %v", err)
+			}
+
+			if err := VerifyIndexSignature(indexDesc.Digest, sig, payload, []crypto.PublicKey{otherKey.Public()}); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("expected ErrInvalidSignature for an untrusted key, got %v", err)
+			}
+
+			otherIndex := digest.FromString("other index")
+			if err := VerifyIndexSignature(otherIndex, sig, payload, []crypto.PublicKey{key.Public()}); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("expected ErrInvalidSignature for another index, got %v", err)
+			}
+
+			tampered := bytes.Replace(payload, []byte(indexDesc.Digest.Encoded()), []byte(otherIndex.Encoded()), 1)
+			if err := VerifyIndexSignature(indexDesc.Digest, sig, tampered, []crypto.PublicKey{key.Public()}); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("expected ErrInvalidSignature for a tampered payload, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadKeys(t *testing.T) {
+	dir := t.TempDir()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath, publicPath := writeTestKeys(t, dir, key)
+
+	signer, err := LoadPrivateKey(privatePath)
+	if err != nil {
+		t.Fatalf("cannot load private key: %v", err)
+	}
+	if !key.Equal(signer) {
+		t.Fatalf("loaded private key doesn't match")
+	}
+	pub, err := LoadPublicKey(publicPath)
+	if err != nil {
+		t.Fatalf("cannot load public key: %v", err)
+	}
+	if !key.PublicKey.Equal(pub) {
+		t.Fatalf("loaded public key doesn't match")
+	}
+
+	if _, err := LoadPublicKey(privatePath); err == nil {
+		t.Fatalf("expected an error when loading a private key as a public key")
+	}
+	if _, err := LoadPrivateKey(publicPath); err == nil {
+		t.Fatalf("expected an error when loading a public key as a private key")
+	}
+}
+
+func writeTestIndex(t *testing.T, store oraslib.Target, manifestType ManifestType) ocispec.Descriptor {
+	subject := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("image manifest"),
+		Size:      14,
+	}
+	blobs := []ocispec.Descriptor{{
+		MediaType: SociLayerMediaType,
+		Digest:    digest.FromString("ztoc"),
+		Size:      4,
+	}}
+	manifest, err := json.Marshal(NewIndex(blobs, &subject, nil, manifestType))
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ORASManifestMediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	switch manifestType {
+	case ManifestOCIArtifact:
+		desc.MediaType = OCIArtifactManifestMediaType
+	case ManifestOCIImage:
+		desc.MediaType = OCIImageManifestMediaType
+	}
+	if err := store.Push(context.Background(), desc, bytes.NewReader(manifest)); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+func readTestSignature(t *testing.T, store oraslib.Target, sigDesc ocispec.Descriptor) (*Index, []byte) {
+	ctx := context.Background()
+	rc, err := store.Fetch(ctx, sigDesc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	sig, err := NewIndexFromReader(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig.Blobs) != 1 {
+		t.Fatalf("unexpected number of signature blobs: %d", len(sig.Blobs))
+	}
+	payloadReader, err := store.Fetch(ctx, sig.Blobs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer payloadReader.Close()
+	payload, err := io.ReadAll(payloadReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sig, payload
+}
+
+func writeTestKeys(t *testing.T, dir string, key crypto.Signer) (string, string) {
+	private, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	privatePath := filepath.Join(dir, "key.pem")
+	publicPath := filepath.Join(dir, "key.pub")
+	if err := os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: private}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return privatePath, publicPath
+}
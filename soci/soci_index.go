@@ -22,7 +22,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"os"
 
 	"github.com/containerd/containerd/content"
 	"github.com/containerd/containerd/images"
@@ -32,6 +31,8 @@ import (
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+	oraslib "oras.land/oras-go/v2"
 	orascontent "oras.land/oras-go/v2/content"
 	"oras.land/oras-go/v2/errdef"
 )
@@ -49,10 +50,19 @@ const (
 	IndexAnnotationBuildToolIdentifier = "com.amazon.soci.build-tool-identifier"
 	// index annotation for build tool version
 	IndexAnnotationBuildToolVersion = "com.amazon.soci.build-tool-version"
+	// index annotation for the spans of a layer to prefetch first, see FormatPrefetchSpans
+	IndexAnnotationPrefetchSpans = "com.amazon.soci.prefetch-spans"
+	// index annotation for layers without ztoc, which the snapshotter downloads and unpacks
+	// itself when the image is mounted, see IsEagerLayer
+	IndexAnnotationEagerLayer = "com.amazon.soci.eager"
 	// media type for OCI Artifact manifest
 	OCIArtifactManifestMediaType = "application/vnd.oci.artifact.manifest.v1+json"
 	// media type for ORAS manifest
 	ORASManifestMediaType = "application/vnd.cncf.oras.artifact.manifest.v1+json"
+	// media type for OCI image manifest
+	OCIImageManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	// media type of the empty config of OCI image manifests of artifacts
+	OCIEmptyConfigMediaType = "application/vnd.oci.empty.v1+json"
 )
 
 type ManifestType int
@@ -60,13 +70,25 @@ type ManifestType int
 const (
 	ManifestOCIArtifact ManifestType = iota
 	ManifestORAS
+	// ManifestOCIImage is an OCI 1.1 image manifest with an artifact type and a subject.
+	ManifestOCIImage
 )
 
 var (
 	errNotLayerType = errors.New("not a layer mediaType")
+
+	// emptyConfig is the content of the config of OCI image manifests of artifacts
+	emptyConfig = []byte("{}")
+	// emptyConfigDesc is the descriptor of emptyConfig
+	emptyConfigDesc = ocispec.Descriptor{
+		MediaType: OCIEmptyConfigMediaType,
+		Digest:    digest.FromBytes(emptyConfig),
+		Size:      int64(len(emptyConfig)),
+	}
 )
 
-// Index represents an ORAS/OCI Artifact Manifest
+// Index represents an ORAS/OCI Artifact Manifest, or an OCI image manifest.
+// In OCI image manifests, the blobs are the layers of the manifest.
 type Index struct {
 	// The media type of the manifest
 	MediaType string `json:"mediaType"`
@@ -91,9 +113,66 @@ type Index struct {
 	Annotations map[string]string `json:"annotations,omitempty"`
 }
 
+// ociImageManifest is the serialized form of an Index written as an OCI image manifest.
+type ociImageManifest struct {
+	SchemaVersion int                  `json:"schemaVersion"`
+	MediaType     string               `json:"mediaType"`
+	ArtifactType  string               `json:"artifactType,omitempty"`
+	Config        ocispec.Descriptor   `json:"config"`
+	Layers        []ocispec.Descriptor `json:"layers"`
+	Subject       *ocispec.Descriptor  `json:"subject,omitempty"`
+	Annotations   map[string]string    `json:"annotations,omitempty"`
+}
+
+// MarshalJSON writes OCI image manifests with the blobs as layers, and other
+// manifests as they are.
+func (i Index) MarshalJSON() ([]byte, error) {
+	type index Index
+	if i.MediaType != OCIImageManifestMediaType {
+		return json.Marshal(index(i))
+	}
+	layers := i.Blobs
+	if len(layers) == 0 {
+		// an image manifest without layers has the empty descriptor as its only layer
+		layers = []ocispec.Descriptor{emptyConfigDesc}
+	}
+	return json.Marshal(ociImageManifest{
+		SchemaVersion: 2,
+		MediaType:     i.MediaType,
+		ArtifactType:  i.ArtifactType,
+		Config:        emptyConfigDesc,
+		Layers:        layers,
+		Subject:       i.Subject,
+		Annotations:   i.Annotations,
+	})
+}
+
+// UnmarshalJSON reads the layers of OCI image manifests as the blobs of the index.
+func (i *Index) UnmarshalJSON(data []byte) error {
+	type index Index
+	var v struct {
+		index
+		Layers []ocispec.Descriptor `json:"layers,omitempty"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*i = Index(v.index)
+	if i.MediaType == OCIImageManifestMediaType {
+		i.Blobs = nil
+		for _, l := range v.Layers {
+			// skip the empty descriptor of manifests without layers, but not eager layers
+			if l.MediaType != OCIEmptyConfigMediaType || IsEagerLayer(l) {
+				i.Blobs = append(i.Blobs, l)
+			}
+		}
+	}
+	return nil
+}
+
 func (i *Index) refers() *ocispec.Descriptor {
 	switch i.MediaType {
-	case ORASManifestMediaType:
+	case ORASManifestMediaType, OCIImageManifestMediaType:
 		return i.Subject
 	case OCIArtifactManifestMediaType:
 		return i.Refers
@@ -109,44 +188,91 @@ type IndexWithMetadata struct {
 
 type IndexDescriptorInfo struct {
 	ocispec.Descriptor
+	// Platform is the platform of the image manifest the index was built for
+	Platform ocispec.Platform
 }
 
-func GetIndexDescriptorCollection(ctx context.Context, cs content.Store, img images.Image) ([]IndexDescriptorInfo, error) {
+// GetIndexDescriptorCollection returns the descriptors of the SOCI indices built for the image
+// manifests matching ps. If ps is empty, the default platform is used.
+func GetIndexDescriptorCollection(ctx context.Context, cs content.Store, img images.Image, ps []ocispec.Platform) ([]IndexDescriptorInfo, error) {
 	descriptors := []IndexDescriptorInfo{}
-	platform := platforms.Default()
-	indexDesc, err := GetImageManifestDescriptor(ctx, cs, img, platform)
-	if err != nil {
-		return descriptors, err
+	if len(ps) == 0 {
+		ps = []ocispec.Platform{platforms.DefaultSpec()}
 	}
 
-	entries, err := getIndexArtifactEntries(indexDesc.Digest.String())
-	if err != nil {
-		return descriptors, err
-	}
+	for _, platform := range ps {
+		indexDesc, err := GetImageManifestDescriptor(ctx, cs, img, platforms.Only(platform))
+		if err != nil {
+			return descriptors, err
+		}
 
-	for _, entry := range entries {
-		dgst, err := digest.Parse(entry.Digest)
+		entries, err := getIndexArtifactEntries(indexDesc.Digest.String())
 		if err != nil {
-			continue
+			return descriptors, err
 		}
-		desc := ocispec.Descriptor{
-			MediaType: entry.MediaType,
-			Digest:    dgst,
-			Size:      entry.Size,
+
+		for _, entry := range entries {
+			dgst, err := digest.Parse(entry.Digest)
+			if err != nil {
+				continue
+			}
+			desc := ocispec.Descriptor{
+				MediaType: entry.MediaType,
+				Digest:    dgst,
+				Size:      entry.Size,
+			}
+			descriptors = append(descriptors, IndexDescriptorInfo{
+				Descriptor: desc,
+				Platform:   platform,
+			})
 		}
-		descriptors = append(descriptors, IndexDescriptorInfo{
-			Descriptor: desc,
-		})
 	}
 
 	return descriptors, nil
 }
 
+// GetImagePlatforms returns the platforms of the image manifests of an image.
+// Manifests which don't describe a runnable image (e.g. attestation manifests
+// with the "unknown/unknown" platform) are ignored.
+func GetImagePlatforms(ctx context.Context, cs content.Provider, img images.Image) ([]ocispec.Platform, error) {
+	ps, err := images.Platforms(ctx, cs, img.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []ocispec.Platform
+	seen := make(map[string]struct{})
+	for _, p := range ps {
+		if p.OS == "unknown" || p.Architecture == "unknown" {
+			continue
+		}
+		p = platforms.Normalize(p)
+		key := platforms.Format(p)
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		result = append(result, p)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no platforms found for image %s", img.Name)
+	}
+	return result, nil
+}
+
 type buildConfig struct {
 	minLayerSize        int64
 	buildToolIdentifier string
 	buildToolVersion    string
 	manifestType        ManifestType
+	platform            ocispec.Platform
+	noZtocReuse         bool
+	fileDigests         bool
+	prefetchFiles       []string
+	spanPlacement       SpanPlacement
+	noArtifactsDB       bool
+	concurrency         int
+	progress            ProgressReporter
 }
 
 type BuildOption func(c *buildConfig) error
@@ -179,33 +305,140 @@ func WithManifestType(val ManifestType) BuildOption {
 	}
 }
 
-func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spanSize int64, store orascontent.Storage, opts ...BuildOption) (*Index, error) {
-	var config buildConfig
+// WithPlatform sets the platform of the image manifest to build the SOCI index for.
+// If not set, the default platform is used.
+func WithPlatform(platform ocispec.Platform) BuildOption {
+	return func(c *buildConfig) error {
+		c.platform = platform
+		return nil
+	}
+}
+
+// WithPrefetchFiles sets the files to fetch first when the image is lazily loaded, in order
+// of priority. The spans of the files are recorded in the annotations of the ztoc descriptors.
+func WithPrefetchFiles(files []string) BuildOption {
+	return func(c *buildConfig) error {
+		c.prefetchFiles = files
+		return nil
+	}
+}
+
+// WithFileDigests records the digest of the contents of each regular file in the ztocs,
+// which allows verifying the contents of whole files when they are read.
+func WithFileDigests() BuildOption {
+	return func(c *buildConfig) error {
+		c.fileDigests = true
+		return nil
+	}
+}
+
+// WithSpanPlacement sets the strategy used to choose where the spans of the ztocs start.
+// The default is SpanPlacementFixed.
+func WithSpanPlacement(placement SpanPlacement) BuildOption {
+	return func(c *buildConfig) error {
+		if _, err := ParseSpanPlacement(string(placement)); err != nil {
+			return err
+		}
+		c.spanPlacement = placement
+		return nil
+	}
+}
+
+// WithNoZtocReuse makes BuildSociIndex build the ztocs of all layers, even when
+// ztocs built with the same parameters already exist.
+func WithNoZtocReuse() BuildOption {
+	return func(c *buildConfig) error {
+		c.noZtocReuse = true
+		return nil
+	}
+}
+
+// WithNoArtifactsDB makes BuildSociIndex neither record the ztocs in the artifacts DB nor
+// reuse the ztocs recorded there, for indices which aren't written to the local SOCI store.
+func WithNoArtifactsDB() BuildOption {
+	return func(c *buildConfig) error {
+		c.noArtifactsDB = true
+		return nil
+	}
+}
+
+// WithConcurrency limits the number of layers BuildSociIndex builds ztocs for concurrently.
+// By default, or if n is 0, the ztocs of all layers are built concurrently.
+func WithConcurrency(n int) BuildOption {
+	return func(c *buildConfig) error {
+		if n < 0 {
+			return fmt.Errorf("invalid concurrency %d", n)
+		}
+		c.concurrency = n
+		return nil
+	}
+}
+
+// WithProgress makes BuildSociIndex report the progress of each layer to the reporter.
+func WithProgress(reporter ProgressReporter) BuildOption {
+	return func(c *buildConfig) error {
+		c.progress = reporter
+		return nil
+	}
+}
+
+// BuildSociIndex builds the SOCI index for the image manifest of img matching the configured platform.
+func BuildSociIndex(ctx context.Context, cs content.Provider, img images.Image, spanSize int64, store orascontent.Storage, opts ...BuildOption) (*IndexWithMetadata, error) {
+	config := buildConfig{
+		platform: platforms.DefaultSpec(),
+	}
 	for _, o := range opts {
 		if err := o(&config); err != nil {
 			return nil, err
 		}
 	}
 
-	platform := platforms.Default()
+	platform := platforms.Only(config.platform)
 	// we get manifest descriptor before calling images.Manifest, since after calling
 	// images.Manifest, images.Children will error out when reading the manifest blob (this happens on containerd side)
 	imgManifestDesc, err := GetImageManifestDescriptor(ctx, cs, img, platform)
 	if err != nil {
 		return nil, err
 	}
+	if imgManifestDesc == nil {
+		return nil, fmt.Errorf("image %s has an unsupported media type %s", img.Name, img.Target.MediaType)
+	}
+	// The matched manifest may be for a platform compatible with (but different from) the requested one,
+	// e.g. linux/386 for linux/amd64, so the index records the platform of the manifest when it's known.
+	indexPlatform := platforms.Normalize(config.platform)
+	if imgManifestDesc.Platform != nil {
+		indexPlatform = platforms.Normalize(*imgManifestDesc.Platform)
+	}
 	manifest, err := images.Manifest(ctx, cs, img.Target, platform)
 	if err != nil {
 		return nil, err
 	}
 
+	for _, l := range manifest.Layers {
+		config.reportProgress(LayerProgress{Layer: l, State: LayerStateWaiting})
+	}
+	var sem *semaphore.Weighted
+	if config.concurrency > 0 {
+		sem = semaphore.NewWeighted(int64(config.concurrency))
+	}
 	sociLayersDesc := make([]*ocispec.Descriptor, len(manifest.Layers))
 	eg, ctx := errgroup.WithContext(ctx)
 	for i, l := range manifest.Layers {
 		i, l := i, l
+		if sem != nil {
+			if err := sem.Acquire(ctx, 1); err != nil {
+				// the context is done, either because a layer failed or because it was canceled
+				eg.Go(func() error { return err })
+				break
+			}
+		}
 		eg.Go(func() error {
+			if sem != nil {
+				defer sem.Release(1)
+			}
 			desc, err := buildSociLayer(ctx, cs, l, spanSize, store, &config)
 			if err != nil {
+				config.reportProgress(LayerProgress{Layer: l, State: LayerStateFailed, Err: err})
 				return fmt.Errorf("could not build zTOC for %s: %w", l.Digest.String(), err)
 			}
 			sociLayersDesc[i] = desc
@@ -234,13 +467,20 @@ func BuildSociIndex(ctx context.Context, cs content.Store, img images.Image, spa
 		Size:        imgManifestDesc.Size,
 		Annotations: imgManifestDesc.Annotations,
 	}
-	return NewIndex(ztocsDesc, refers, annotations, config.manifestType), nil
+	return &IndexWithMetadata{
+		Index:       NewIndex(ztocsDesc, refers, annotations, config.manifestType),
+		ImageDigest: img.Target.Digest,
+		Platform:    indexPlatform,
+	}, nil
 }
 
 // Returns a new index.
 func NewIndex(blobs []ocispec.Descriptor, subject *ocispec.Descriptor, annotations map[string]string, manifestType ManifestType) *Index {
-	if manifestType == ManifestOCIArtifact {
+	switch manifestType {
+	case ManifestOCIArtifact:
 		return newOCIArtifactManifest(blobs, subject, annotations)
+	case ManifestOCIImage:
+		return newOCIImageManifest(blobs, subject, annotations)
 	}
 	return newORASManifest(blobs, subject, annotations)
 }
@@ -265,6 +505,33 @@ func newORASManifest(blobs []ocispec.Descriptor, subject *ocispec.Descriptor, an
 	}
 }
 
+func newOCIImageManifest(blobs []ocispec.Descriptor, subject *ocispec.Descriptor, annotations map[string]string) *Index {
+	return &Index{
+		Blobs:        blobs,
+		ArtifactType: SociIndexArtifactType,
+		Annotations:  annotations,
+		Subject:      subject,
+		MediaType:    OCIImageManifestMediaType,
+	}
+}
+
+// writeIndexConfig writes emptyConfig to the store if the index references it, either as its config
+// or as the blob of an eager layer. Only OCI image manifests have a config, which is always emptyConfig.
+func writeIndexConfig(ctx context.Context, store orascontent.Storage, index *Index) error {
+	referenced := index.MediaType == OCIImageManifestMediaType
+	for _, b := range index.Blobs {
+		referenced = referenced || IsEagerLayer(b)
+	}
+	if !referenced {
+		return nil
+	}
+	err := store.Push(ctx, emptyConfigDesc, bytes.NewReader(emptyConfig))
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return fmt.Errorf("cannot write config of SOCI index to local store: %w", err)
+	}
+	return nil
+}
+
 // Returns a new index from a Reader.
 func NewIndexFromReader(reader io.Reader) (*Index, error) {
 	index := new(Index)
@@ -285,100 +552,188 @@ func skipBuildingZtoc(desc ocispec.Descriptor, cfg *buildConfig) bool {
 	return false
 }
 
+// IsEagerLayer reports whether the blob of an index stands for a layer without ztoc, which is
+// downloaded and unpacked as a whole when the image is mounted instead of being lazily loaded.
+// Layers are marked for eager download when they're smaller than the minimum layer size.
+// The blob of an eager layer is the empty descriptor, annotated with the digest and media type
+// of the layer.
+func IsEagerLayer(desc ocispec.Descriptor) bool {
+	return desc.Annotations[IndexAnnotationEagerLayer] == "true"
+}
+
+// eagerLayerDescriptor returns the blob of the index marking the layer for eager download.
+func eagerLayerDescriptor(desc ocispec.Descriptor) *ocispec.Descriptor {
+	eager := emptyConfigDesc
+	eager.Annotations = map[string]string{
+		IndexAnnotationImageLayerMediaType: desc.MediaType,
+		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
+		IndexAnnotationEagerLayer:          "true",
+	}
+	return &eager
+}
+
 // buildSociLayer builds the ztoc for an image layer and returns a Descriptor for the new ztoc.
-func buildSociLayer(ctx context.Context, cs content.Store, desc ocispec.Descriptor, spanSize int64, store orascontent.Storage, cfg *buildConfig) (*ocispec.Descriptor, error) {
+// Layers for which no ztoc is built are marked for eager download instead.
+func buildSociLayer(ctx context.Context, cs content.Provider, desc ocispec.Descriptor, spanSize int64, store orascontent.Storage, cfg *buildConfig) (*ocispec.Descriptor, error) {
 	if !images.IsLayerType(desc.MediaType) {
 		return nil, errNotLayerType
 	}
 	// check if we need to skip building the zTOC
 	if skipBuildingZtoc(desc, cfg) {
-		fmt.Printf("layer %s -> ztoc skipped\n", desc.Digest)
-		return nil, nil
+		cfg.reportProgress(LayerProgress{Layer: desc, State: LayerStateSkipped})
+		return eagerLayerDescriptor(desc), nil
 	}
+	cfg.reportProgress(LayerProgress{Layer: desc, State: LayerStateBuilding})
 	compression, err := images.DiffCompression(ctx, desc.MediaType)
 	if err != nil {
 		return nil, fmt.Errorf("could not determine layer compression: %w", err)
 	}
-	if compression != "gzip" {
-		return nil, errors.New("only layers compressed with gzip are supported")
+	if compression == "unknown" {
+		// Docker layers of this media type may be compressed despite their media type
+		compression, err = detectCompression(ctx, cs, desc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch compression {
+	case CompressionGzip, CompressionZstd:
+	case "":
+		compression = CompressionUncompressed
+	default:
+		return nil, fmt.Errorf("layer %s (%s) must be uncompressed or compressed by gzip or zstd", desc.Digest, desc.MediaType)
 	}
 
-	ra, err := cs.ReaderAt(ctx, desc)
+	ztocDesc, ztoc, err := reuseZtoc(ctx, store, desc, spanSize, compression, cfg)
 	if err != nil {
 		return nil, err
 	}
-	defer ra.Close()
-	sr := io.NewSectionReader(ra, 0, desc.Size)
+	state := LayerStateReused
+	if ztocDesc == nil {
+		ztocDesc, ztoc, err = buildZtoc(ctx, cs, store, desc, spanSize, compression, cfg)
+		if err != nil {
+			return nil, err
+		}
+		state = LayerStateBuilt
+	}
 
-	tmpFile, err := os.CreateTemp("", "tmp.*")
-	if err != nil {
-		return nil, err
+	// write the artifact entry for soci layer
+	// this part is needed for local store only
+	if !cfg.noArtifactsDB {
+		entry := &ArtifactEntry{
+			Size:           ztocDesc.Size,
+			Digest:         ztocDesc.Digest.String(),
+			OriginalDigest: desc.Digest.String(),
+			Type:           ArtifactEntryTypeLayer,
+			Location:       desc.Digest.String(),
+			SpanSize:       spanSize,
+		}
+		err = writeArtifactEntry(entry)
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer os.Remove(tmpFile.Name())
-	n, err := io.Copy(tmpFile, sr)
-	if err != nil {
-		return nil, err
+
+	ztocDesc.MediaType = SociLayerMediaType
+	ztocDesc.Annotations = map[string]string{
+		IndexAnnotationImageLayerMediaType: desc.MediaType,
+		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
+	}
+	if prefetchSpans := PrefetchSpans(ztoc, cfg.prefetchFiles); len(prefetchSpans) > 0 {
+		ztocDesc.Annotations[IndexAnnotationPrefetchSpans] = FormatPrefetchSpans(prefetchSpans)
 	}
-	if n != desc.Size {
-		return nil, errors.New("the size of the temp file doesn't match that of the layer")
+	processed := int64(0)
+	if state == LayerStateBuilt {
+		processed = desc.Size
 	}
+	cfg.reportProgress(LayerProgress{Layer: desc, State: state, BytesProcessed: processed, Ztoc: ztocDesc})
+	return ztocDesc, nil
+}
 
-	ztoc, err := BuildZtoc(tmpFile.Name(), spanSize, cfg)
+// detectCompression detects the compression of the layer from its magic number.
+// It returns an empty string if the layer is uncompressed.
+func detectCompression(ctx context.Context, cs content.Provider, desc ocispec.Descriptor) (string, error) {
+	ra, err := cs.ReaderAt(ctx, desc)
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	defer ra.Close()
+	magic := make([]byte, 4)
+	n, err := ra.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("cannot read layer %s: %w", desc.Digest, err)
+	}
+	magic = magic[:n]
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return CompressionGzip, nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return CompressionZstd, nil
+	}
+	return "", nil
+}
 
-	ztocReader, ztocDesc, err := NewZtocReader(ztoc)
+// reuseZtoc returns the descriptor of an existing ztoc of the layer built with the same parameters,
+// along with the ztoc, or nil if there is none. See findReusableZtoc.
+func reuseZtoc(ctx context.Context, store orascontent.Storage, desc ocispec.Descriptor, spanSize int64, compression string, cfg *buildConfig) (*ocispec.Descriptor, *Ztoc, error) {
+	if cfg != nil && (cfg.noZtocReuse || cfg.noArtifactsDB) {
+		return nil, nil, nil
+	}
+	db, err := NewDB()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	return findReusableZtoc(ctx, db, store, desc, spanSize, compression, cfg)
+}
 
-	err = store.Push(ctx, ztocDesc, ztocReader)
-	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
-		return nil, fmt.Errorf("cannot push ztoc to local store: %w", err)
+// buildZtoc builds the ztoc of the layer and writes it to the store.
+// It returns the descriptor of the ztoc along with the ztoc.
+func buildZtoc(ctx context.Context, cs content.Provider, store orascontent.Storage, desc ocispec.Descriptor, spanSize int64, compression string, cfg *buildConfig) (*ocispec.Descriptor, *Ztoc, error) {
+	ra, err := cs.ReaderAt(ctx, desc)
+	if err != nil {
+		return nil, nil, err
 	}
+	defer ra.Close()
+	sr := io.NewSectionReader(&progressReaderAt{ReaderAt: ra, layer: desc, cfg: cfg}, 0, desc.Size)
 
-	// write the artifact entry for soci layer
-	// this part is needed for local store only
-	entry := &ArtifactEntry{
-		Size:           ztocDesc.Size,
-		Digest:         ztocDesc.Digest.String(),
-		OriginalDigest: desc.Digest.String(),
-		Type:           ArtifactEntryTypeLayer,
-		Location:       desc.Digest.String(),
-	}
-	err = writeArtifactEntry(entry)
+	ztoc, err := BuildZtoc(sr, spanSize, compression, cfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	fmt.Printf("layer %s -> ztoc %s\n", desc.Digest, ztocDesc.Digest)
+	ztocReader, ztocDesc, err := NewZtocReader(ztoc)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	ztocDesc.MediaType = SociLayerMediaType
-	ztocDesc.Annotations = map[string]string{
-		IndexAnnotationImageLayerMediaType: ocispec.MediaTypeImageLayerGzip,
-		IndexAnnotationImageLayerDigest:    desc.Digest.String(),
+	err = store.Push(ctx, ztocDesc, ztocReader)
+	if err != nil && !errors.Is(err, errdef.ErrAlreadyExists) {
+		return nil, nil, fmt.Errorf("cannot push ztoc to local store: %w", err)
 	}
-	return &ztocDesc, err
+	return &ztocDesc, ztoc, nil
 }
 
 // getImageManifestDescriptor gets the descriptor of image manifest
-func GetImageManifestDescriptor(ctx context.Context, cs content.Store, img images.Image, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
+func GetImageManifestDescriptor(ctx context.Context, cs content.Provider, img images.Image, platform platforms.MatchComparer) (*ocispec.Descriptor, error) {
 	target := img.Target
 	if images.IsIndexType(target.MediaType) {
 		manifests, err := images.Children(ctx, cs, target)
 		if err != nil {
 			return nil, err
 		}
-		for _, manifest := range manifests {
+		// pick the best match, since a platform can match several manifests (e.g. linux/amd64 matches linux/386)
+		var best *ocispec.Descriptor
+		for i, manifest := range manifests {
 			if manifest.Platform == nil {
 				return nil, errors.New("manifest should have proper platform")
 			}
-			if platform.Match(*manifest.Platform) {
-				return &manifest, nil
+			if platform.Match(*manifest.Platform) && (best == nil || platform.Less(*manifest.Platform, *best.Platform)) {
+				best = &manifests[i]
 			}
 		}
-		return nil, errors.New("image manifest not found")
+		if best == nil {
+			return nil, errors.New("image manifest not found")
+		}
+		return best, nil
 	} else if images.IsManifestType(target.MediaType) {
 		return &target, nil
 	}
@@ -396,6 +751,9 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata IndexWithMetadata, st
 	dgst := digest.FromBytes(manifest)
 	size := int64(len(manifest))
 
+	if err := writeIndexConfig(ctx, store, indexWithMetadata.Index); err != nil {
+		return err
+	}
 	err = store.Push(ctx, ocispec.Descriptor{
 		Digest: dgst,
 		Size:   size,
@@ -426,3 +784,29 @@ func WriteSociIndex(ctx context.Context, indexWithMetadata IndexWithMetadata, st
 	}
 	return writeArtifactEntry(entry)
 }
+
+// WriteSociIndexAsReferrer writes the SOCI index to the target, e.g. an OCI image layout, without
+// recording it in the artifacts DB, and adds it to the referrers of its image manifest in the
+// referrers tag schema so that it can be discovered from the image.
+func WriteSociIndexAsReferrer(ctx context.Context, indexWithMetadata IndexWithMetadata, target oraslib.Target) (*ocispec.Descriptor, error) {
+	manifest, err := json.Marshal(indexWithMetadata.Index)
+	if err != nil {
+		return nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: indexWithMetadata.Index.MediaType,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+	if err := writeIndexConfig(ctx, target, indexWithMetadata.Index); err != nil {
+		return nil, err
+	}
+	if err := pushIfNotExists(ctx, target, desc, manifest); err != nil {
+		return nil, fmt.Errorf("cannot write SOCI index: %w", err)
+	}
+	if err := AddReferrer(ctx, target, desc, indexWithMetadata.Index); err != nil {
+		return nil, err
+	}
+	log.G(ctx).WithField("digest", desc.Digest.String()).Debugf("soci index has been written as a referrer")
+	return &desc, nil
+}
@@ -20,10 +20,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
 
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/content/local"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
 	"github.com/google/go-cmp/cmp"
 	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"oras.land/oras-go/v2/content/memory"
 )
@@ -202,13 +208,16 @@ func TestBuildSociIndexWithLimits(t *testing.T) {
 			blobStore := memory.New()
 			ztoc, err := buildSociLayer(ctx, cs, desc, spanSize, blobStore, cfg)
 			if tc.ztocGenerated {
-				// we check only for build skip, which is indicated as nil value for ztoc and nil value for error
-				if ztoc == nil && err == nil {
+				// we check only for build skip, which is indicated as an eager layer and nil value for error
+				if err == nil && (ztoc == nil || IsEagerLayer(*ztoc)) {
 					t.Fatalf("%v: ztoc should've been generated; error=%v", tc.name, err)
 				}
 			} else {
-				if ztoc != nil {
-					t.Fatalf("%v: ztoc should've skipped", tc.name)
+				if err != nil {
+					t.Fatalf("%v: unexpected error: %v", tc.name, err)
+				}
+				if ztoc == nil || !IsEagerLayer(*ztoc) {
+					t.Fatalf("%v: ztoc should've skipped and the layer marked for eager download", tc.name)
 				}
 			}
 		})
@@ -257,6 +266,23 @@ func TestNewIndex(t *testing.T) {
 			},
 			manifestType: ManifestOCIArtifact,
 		},
+		{
+			name: "successfully build OCI image manifest",
+			blobs: []ocispec.Descriptor{
+				{
+					Size:   4,
+					Digest: digest.FromBytes([]byte("test")),
+				},
+			},
+			subject: ocispec.Descriptor{
+				Size:   4,
+				Digest: digest.FromBytes([]byte("test")),
+			},
+			annotations: map[string]string{
+				"foo": "bar",
+			},
+			manifestType: ManifestOCIImage,
+		},
 	}
 
 	for _, tc := range testcases {
@@ -272,16 +298,24 @@ func TestNewIndex(t *testing.T) {
 			}
 
 			mt := index.MediaType
-			if tc.manifestType == ManifestORAS {
+			switch tc.manifestType {
+			case ManifestORAS:
 				if mt != ORASManifestMediaType {
-					t.Fatalf("unexpected media type; expected = %v, got = %v", ManifestORAS, mt)
+					t.Fatalf("unexpected media type; expected = %v, got = %v", ORASManifestMediaType, mt)
 				}
 				if diff := cmp.Diff(index.Subject, &tc.subject); diff != "" {
 					t.Fatalf("the subject field is not equal; diff = %v", diff)
 				}
-			} else {
+			case ManifestOCIImage:
+				if mt != OCIImageManifestMediaType {
+					t.Fatalf("unexpected media type; expected = %v, got = %v", OCIImageManifestMediaType, mt)
+				}
+				if diff := cmp.Diff(index.Subject, &tc.subject); diff != "" {
+					t.Fatalf("the subject field is not equal; diff = %v", diff)
+				}
+			default:
 				if mt != OCIArtifactManifestMediaType {
-					t.Fatalf("unexpected media type; expected = %v, got = %v", ManifestORAS, mt)
+					t.Fatalf("unexpected media type; expected = %v, got = %v", OCIArtifactManifestMediaType, mt)
 				}
 				if diff := cmp.Diff(index.Refers, &tc.subject); diff != "" {
 					t.Fatalf("the refers field is not equal; diff = %v", diff)
@@ -333,6 +367,31 @@ func TestNewIndexFromReader(t *testing.T) {
 			},
 			manifestType: ManifestOCIArtifact,
 		},
+		{
+			name: "successfully build OCI image manifest",
+			blobs: []ocispec.Descriptor{
+				{
+					Size:   4,
+					Digest: digest.FromBytes([]byte("test")),
+				},
+			},
+			subject: ocispec.Descriptor{
+				Size:   4,
+				Digest: digest.FromBytes([]byte("test")),
+			},
+			annotations: map[string]string{
+				"foo": "bar",
+			},
+			manifestType: ManifestOCIImage,
+		},
+		{
+			name: "successfully build OCI image manifest without blobs",
+			subject: ocispec.Descriptor{
+				Size:   4,
+				Digest: digest.FromBytes([]byte("test")),
+			},
+			manifestType: ManifestOCIImage,
+		},
 	}
 
 	for _, tc := range testcases {
@@ -352,3 +411,216 @@ func TestNewIndexFromReader(t *testing.T) {
 		})
 	}
 }
+
+func TestImagePlatforms(t *testing.T) {
+	ctx := context.Background()
+	cs, err := local.NewStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("cannot create content store: %v", err)
+	}
+
+	manifests := []ocispec.Descriptor{
+		{Platform: &ocispec.Platform{OS: "linux", Architecture: "386"}},
+		{Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+		{Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+		{Platform: &ocispec.Platform{OS: "unknown", Architecture: "unknown"}},
+	}
+	for i := range manifests {
+		manifests[i].MediaType = ocispec.MediaTypeImageManifest
+		manifests[i].Digest = digest.FromString(platforms.Format(*manifests[i].Platform))
+		manifests[i].Size = 100
+	}
+	idx, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: manifests,
+	})
+	if err != nil {
+		t.Fatalf("cannot marshal image index: %v", err)
+	}
+	idxDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageIndex,
+		Digest:    digest.FromBytes(idx),
+		Size:      int64(len(idx)),
+	}
+	if err := content.WriteBlob(ctx, cs, "index", bytes.NewReader(idx), idxDesc); err != nil {
+		t.Fatalf("cannot write image index: %v", err)
+	}
+	img := images.Image{Name: "test", Target: idxDesc}
+
+	ps, err := GetImagePlatforms(ctx, cs, img)
+	if err != nil {
+		t.Fatalf("cannot get image platforms: %v", err)
+	}
+	var formatted []string
+	for _, p := range ps {
+		formatted = append(formatted, platforms.Format(p))
+	}
+	expected := []string{"linux/386", "linux/amd64", "linux/arm64"}
+	if diff := cmp.Diff(expected, formatted); diff != "" {
+		t.Fatalf("unexpected platforms; diff = %v", diff)
+	}
+
+	testcases := []struct {
+		platform string
+		expected int
+	}{
+		{platform: "linux/amd64", expected: 1},
+		{platform: "linux/386", expected: 0},
+		{platform: "linux/arm64", expected: 2},
+	}
+	for _, tc := range testcases {
+		t.Run(tc.platform, func(t *testing.T) {
+			desc, err := GetImageManifestDescriptor(ctx, cs, img, platforms.Only(platforms.MustParse(tc.platform)))
+			if err != nil {
+				t.Fatalf("cannot get image manifest: %v", err)
+			}
+			if desc.Digest != manifests[tc.expected].Digest {
+				t.Fatalf("unexpected manifest for %s; expected %s, got %s", tc.platform, platforms.Format(*manifests[tc.expected].Platform), platforms.Format(*desc.Platform))
+			}
+		})
+	}
+}
+
+func TestOCIImageManifestSerialization(t *testing.T) {
+	eager := *eagerLayerDescriptor(ocispec.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+		Digest:    digest.FromBytes([]byte("layer")),
+	})
+	testcases := []struct {
+		name   string
+		blobs  []ocispec.Descriptor
+		layers []ocispec.Descriptor
+	}{
+		{
+			name: "with blobs",
+			blobs: []ocispec.Descriptor{
+				{
+					MediaType: SociLayerMediaType,
+					Size:      4,
+					Digest:    digest.FromBytes([]byte("test")),
+				},
+			},
+			layers: []ocispec.Descriptor{
+				{
+					MediaType: SociLayerMediaType,
+					Size:      4,
+					Digest:    digest.FromBytes([]byte("test")),
+				},
+			},
+		},
+		{
+			name:   "without blobs",
+			layers: []ocispec.Descriptor{emptyConfigDesc},
+		},
+		{
+			name:   "with eager layer",
+			blobs:  []ocispec.Descriptor{eager},
+			layers: []ocispec.Descriptor{eager},
+		},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			subject := ocispec.Descriptor{
+				MediaType: OCIImageManifestMediaType,
+				Size:      4,
+				Digest:    digest.FromBytes([]byte("image")),
+			}
+			jsonBytes, err := json.Marshal(NewIndex(tc.blobs, &subject, nil, ManifestOCIImage))
+			if err != nil {
+				t.Fatalf("cannot convert index to json byte data: %v", err)
+			}
+			var manifest ociImageManifest
+			if err := json.Unmarshal(jsonBytes, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if manifest.SchemaVersion != 2 {
+				t.Fatalf("unexpected schema version; expected = 2, got = %d", manifest.SchemaVersion)
+			}
+			if manifest.ArtifactType != SociIndexArtifactType {
+				t.Fatalf("unexpected artifact type; expected = %s, got = %s", SociIndexArtifactType, manifest.ArtifactType)
+			}
+			if diff := cmp.Diff(manifest.Config, emptyConfigDesc); diff != "" {
+				t.Fatalf("unexpected config; diff = %v", diff)
+			}
+			if diff := cmp.Diff(manifest.Layers, tc.layers); diff != "" {
+				t.Fatalf("unexpected layers; diff = %v", diff)
+			}
+			if diff := cmp.Diff(manifest.Subject, &subject); diff != "" {
+				t.Fatalf("unexpected subject; diff = %v", diff)
+			}
+			var fields map[string]json.RawMessage
+			if err := json.Unmarshal(jsonBytes, &fields); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := fields["blobs"]; ok {
+				t.Fatalf("unexpected blobs field in OCI image manifest")
+			}
+		})
+	}
+}
+
+func TestEagerLayerSerialization(t *testing.T) {
+	layer := ocispec.Descriptor{
+		MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
+		Size:      5,
+		Digest:    digest.FromBytes([]byte("layer")),
+	}
+	blobs := []ocispec.Descriptor{
+		{
+			MediaType: SociLayerMediaType,
+			Size:      4,
+			Digest:    digest.FromBytes([]byte("test")),
+			Annotations: map[string]string{
+				IndexAnnotationImageLayerMediaType: layer.MediaType,
+				IndexAnnotationImageLayerDigest:    digest.FromBytes([]byte("other layer")).String(),
+			},
+		},
+		*eagerLayerDescriptor(layer),
+	}
+	subject := ocispec.Descriptor{
+		MediaType: OCIImageManifestMediaType,
+		Size:      4,
+		Digest:    digest.FromBytes([]byte("image")),
+	}
+
+	for _, manifestType := range []ManifestType{ManifestORAS, ManifestOCIArtifact, ManifestOCIImage} {
+		t.Run(fmt.Sprintf("manifest_type_%d", manifestType), func(t *testing.T) {
+			jsonBytes, err := json.Marshal(NewIndex(blobs, &subject, nil, manifestType))
+			if err != nil {
+				t.Fatalf("cannot convert index to json byte data: %v", err)
+			}
+			index, err := NewIndexFromReader(bytes.NewReader(jsonBytes))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(index.Blobs, blobs); diff != "" {
+				t.Fatalf("unexpected blobs; diff = %v", diff)
+			}
+			if IsEagerLayer(index.Blobs[0]) || !IsEagerLayer(index.Blobs[1]) {
+				t.Fatalf("unexpected eager layers in %v", index.Blobs)
+			}
+			if index.Blobs[1].Annotations[IndexAnnotationImageLayerDigest] != layer.Digest.String() {
+				t.Fatalf("unexpected layer digest of eager layer; expected = %v, got = %v", layer.Digest, index.Blobs[1].Annotations[IndexAnnotationImageLayerDigest])
+			}
+		})
+	}
+}
+
+func TestWriteIndexConfigForEagerLayers(t *testing.T) {
+	ctx := context.Background()
+	store := memory.New()
+	eager := eagerLayerDescriptor(ocispec.Descriptor{MediaType: "application/vnd.oci.image.layer.v1.tar+gzip", Digest: digest.FromBytes([]byte("layer"))})
+	index := NewIndex([]ocispec.Descriptor{*eager}, &ocispec.Descriptor{}, nil, ManifestORAS)
+	if err := writeIndexConfig(ctx, store, index); err != nil {
+		t.Fatal(err)
+	}
+	exists, err := store.Exists(ctx, *eager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists {
+		t.Fatalf("expected the blob of the eager layer to be written")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// SpanPlacement is the strategy used to choose where the spans of a ztoc start.
+type SpanPlacement string
+
+const (
+	// SpanPlacementFixed starts a span at the first checkpoint found after every span bytes
+	// of uncompressed data. Ztocs built with this placement don't record it.
+	SpanPlacementFixed SpanPlacement = "fixed"
+	// SpanPlacementFileBoundary starts a span at the first checkpoint found after span bytes
+	// of uncompressed data which isn't in the middle of a small file, i.e. a regular file of
+	// at most span bytes, so that small files are in a single span. If no such checkpoint is
+	// found, the span ends after twice span bytes regardless. This is only supported by gzip
+	// and zstd layers; the spans of uncompressed layers are always fixed.
+	SpanPlacementFileBoundary SpanPlacement = "file-boundary"
+)
+
+// ParseSpanPlacement parses the name of a span placement.
+func ParseSpanPlacement(s string) (SpanPlacement, error) {
+	switch p := SpanPlacement(s); p {
+	case SpanPlacementFixed, SpanPlacementFileBoundary:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown span placement %q", s)
+	}
+}
+
+// spanPlacer decides at which of the candidate checkpoints of a layer spans start.
+// Candidate checkpoints are the ends of deflate blocks for gzip, and the starts of
+// frames for zstd.
+type spanPlacer interface {
+	// startSpan reports whether a span starts at the candidate checkpoint at the
+	// uncompressed offset, given the uncompressed offset where the current span started.
+	startSpan(offset, spanStart FileSize) bool
+}
+
+// fileExtent is the range [start, end) of the uncompressed data of a file in a layer.
+type fileExtent struct {
+	start, end FileSize
+}
+
+// fileBoundaryPlacer places spans according to SpanPlacementFileBoundary.
+type fileBoundaryPlacer struct {
+	span FileSize
+	// extents of the small files, sorted by start
+	files []fileExtent
+}
+
+// newFileBoundaryPlacer finds the small files of the layer, which needs an additional pass over it.
+func newFileBoundaryPlacer(sr *io.SectionReader, compressionAlgo string, span int64) (*fileBoundaryPlacer, error) {
+	builder, err := newZinfoBuilder(compressionAlgo, io.NewSectionReader(sr, 0, sr.Size()), span, &spanDigester{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer builder.Close()
+	fm, err := getFileMetadata(&positionTrackerReader{r: builder}, false)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find files for span placement: %w", err)
+	}
+	return newFileBoundaryPlacerFromMetadata(fm, FileSize(span)), nil
+}
+
+func newFileBoundaryPlacerFromMetadata(fm []FileMetadata, span FileSize) *fileBoundaryPlacer {
+	p := &fileBoundaryPlacer{span: span}
+	for _, m := range fm {
+		if m.Type == "reg" && m.UncompressedSize > 0 && m.UncompressedSize <= span {
+			p.files = append(p.files, fileExtent{start: m.UncompressedOffset, end: m.UncompressedOffset + m.UncompressedSize})
+		}
+	}
+	sort.Slice(p.files, func(i, j int) bool {
+		return p.files[i].start < p.files[j].start
+	})
+	return p
+}
+
+func (p *fileBoundaryPlacer) startSpan(offset, spanStart FileSize) bool {
+	size := offset - spanStart
+	if size < p.span {
+		return false
+	}
+	if size >= 2*p.span {
+		return true
+	}
+	return !p.splitsFile(offset)
+}
+
+// splitsFile reports whether a span starting at offset would split a small file.
+func (p *fileBoundaryPlacer) splitsFile(offset FileSize) bool {
+	// the last file starting before offset; files don't overlap
+	i := sort.Search(len(p.files), func(i int) bool {
+		return p.files[i].start >= offset
+	}) - 1
+	return i >= 0 && p.files[i].end > offset
+}
+
+// FileFetchStats describes the compressed data fetched to read the regular files of a
+// ztoc, which depends on the placement of its spans.
+type FileFetchStats struct {
+	// Files is the number of non-empty regular files.
+	Files int
+	// SplitFiles is the number of files whose data is in more than one span.
+	SplitFiles int
+	// FetchedBytes is the total size of the compressed data of the spans
+	// fetched to read each file once, without any cache.
+	FetchedBytes FileSize
+}
+
+// AverageFetchedBytes returns the average size of the compressed data fetched to read a file.
+func (s FileFetchStats) AverageFetchedBytes() FileSize {
+	if s.Files == 0 {
+		return 0
+	}
+	return s.FetchedBytes / FileSize(s.Files)
+}
+
+// GetFileFetchStats computes the FileFetchStats of the ztoc.
+func GetFileFetchStats(ztoc *Ztoc) (FileFetchStats, error) {
+	var stats FileFetchStats
+	zinfo, err := NewZinfoFromZtoc(ztoc)
+	if err != nil {
+		return stats, err
+	}
+	defer zinfo.Close()
+	for _, m := range ztoc.Metadata {
+		if m.Type != "reg" || m.UncompressedSize == 0 {
+			continue
+		}
+		// the end of the file is exclusive, so the last span holding its data may be before SpanEnd
+		end := zinfo.UncompressedOffsetToSpanID(m.UncompressedOffset + m.UncompressedSize - 1)
+		stats.Files++
+		if end != m.SpanStart {
+			stats.SplitFiles++
+		}
+		stats.FetchedBytes += zinfo.EndCompressedOffset(end, ztoc.CompressedFileSize) - zinfo.StartCompressedOffset(m.SpanStart)
+	}
+	return stats, nil
+}
@@ -0,0 +1,167 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+)
+
+func TestFileBoundaryPlacer(t *testing.T) {
+	fm := []FileMetadata{
+		{Type: "reg", UncompressedOffset: 1024, UncompressedSize: 100},
+		{Type: "dir", UncompressedOffset: 1536},
+		{Type: "reg", UncompressedOffset: 2048, UncompressedSize: 5000},
+		{Type: "reg", UncompressedOffset: 8192, UncompressedSize: 500},
+	}
+	p := newFileBoundaryPlacerFromMetadata(fm, 1000)
+
+	testCases := []struct {
+		offset    FileSize
+		spanStart FileSize
+		want      bool
+	}{
+		{offset: 1124, spanStart: 0, want: true},
+		{offset: 1050, spanStart: 0, want: false},
+		{offset: 800, spanStart: 0, want: false},
+		// in a file larger than the span
+		{offset: 3000, spanStart: 1100, want: true},
+		{offset: 8300, spanStart: 7000, want: false},
+		{offset: 8692, spanStart: 7000, want: true},
+		// twice the span size
+		{offset: 8300, spanStart: 6300, want: true},
+	}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("offset_%d_span_start_%d", tc.offset, tc.spanStart), func(t *testing.T) {
+			if got := p.startSpan(tc.offset, tc.spanStart); got != tc.want {
+				t.Fatalf("unexpected span start; expected = %v, got = %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestBuildZtocWithFileBoundarySpans(t *testing.T) {
+	const spanSize = 65536
+	var (
+		ents  []testutil.TarEntry
+		files = make(map[string][]byte)
+	)
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("file%d", i)
+		contents := genRandomByteData(1024 + (i*797)%2048)
+		files[name] = contents
+		ents = append(ents, testutil.File(name, string(contents)))
+	}
+
+	testCases := []struct {
+		name            string
+		compressionAlgo string
+		layer           io.Reader
+	}{
+		{
+			name:            "gzip",
+			compressionAlgo: CompressionGzip,
+			layer:           testutil.BuildTarGz(ents, gzip.DefaultCompression),
+		},
+		{
+			name:            "zstd",
+			compressionAlgo: CompressionZstd,
+			layer:           testutil.BuildTarZstd(ents, 4096),
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			layer, err := io.ReadAll(tc.layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sr := io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer)))
+
+			fixed, err := BuildZtoc(sr, spanSize, tc.compressionAlgo, &buildConfig{})
+			if err != nil {
+				t.Fatalf("cannot build ztoc with fixed spans: %v", err)
+			}
+			ztoc, err := BuildZtoc(sr, spanSize, tc.compressionAlgo, &buildConfig{spanPlacement: SpanPlacementFileBoundary})
+			if err != nil {
+				t.Fatalf("cannot build ztoc with file boundary spans: %v", err)
+			}
+			if ztoc.SpanPlacement != string(SpanPlacementFileBoundary) {
+				t.Fatalf("unexpected span placement; expected = %s, got = %q", SpanPlacementFileBoundary, ztoc.SpanPlacement)
+			}
+
+			fixedStats, err := GetFileFetchStats(fixed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := GetFileFetchStats(ztoc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fixedStats.SplitFiles == 0 {
+				t.Fatalf("expected files split across fixed spans")
+			}
+			if stats.SplitFiles >= fixedStats.SplitFiles {
+				t.Fatalf("expected fewer split files than with fixed spans (%d), got %d", fixedStats.SplitFiles, stats.SplitFiles)
+			}
+
+			zinfo, err := NewZinfoFromZtoc(ztoc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zinfo.Close()
+			for i := SpanId(0); i < ztoc.MaxSpanId; i++ {
+				size := zinfo.EndUncompressedOffset(i, ztoc.UncompressedFileSize) - zinfo.StartUncompressedOffset(i)
+				if size < spanSize {
+					t.Fatalf("span %d is shorter than the span size: %d bytes", i, size)
+				}
+			}
+
+			discrepancies, err := VerifyZtoc(ztoc, sr)
+			if err != nil {
+				t.Fatalf("cannot verify ztoc: %v", err)
+			}
+			if len(discrepancies) != 0 {
+				t.Fatalf("unexpected discrepancies: %v", discrepancies)
+			}
+			for _, m := range ztoc.Metadata {
+				extracted, err := ExtractFile(sr, &FileExtractConfig{
+					UncompressedSize:     m.UncompressedSize,
+					UncompressedOffset:   m.UncompressedOffset,
+					SpanStart:            m.SpanStart,
+					SpanEnd:              m.SpanEnd,
+					FirstSpanHasBits:     m.FirstSpanHasBits,
+					IndexByteData:        ztoc.IndexByteData,
+					CompressedFileSize:   ztoc.CompressedFileSize,
+					MaxSpanId:            ztoc.MaxSpanId,
+					CompressionAlgorithm: ztoc.CompressionAlgorithm,
+				})
+				if err != nil {
+					t.Fatalf("cannot extract %s: %v", m.Name, err)
+				}
+				if !bytes.Equal(extracted, files[m.Name]) {
+					t.Fatalf("unexpected contents of %s", m.Name)
+				}
+			}
+		})
+	}
+}
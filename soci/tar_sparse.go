@@ -0,0 +1,355 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// archive/tar reads the sparse maps of GNU sparse files to synthesize their holes, but doesn't
+// expose them, so they're parsed again from the raw headers of the entries.
+
+const (
+	tarBlockSize = 512
+
+	paxGNUSparse      = "GNU.sparse."
+	paxGNUSparseMap   = "GNU.sparse.map"
+	paxGNUSparseMajor = "GNU.sparse.major"
+	paxGNUSparseMinor = "GNU.sparse.minor"
+
+	// offsets of the fields of tar header blocks
+	tarHeaderSize     = 124
+	tarHeaderTypeflag = 156
+	// offsets of the sparse map in old GNU headers, which holds 4 entries,
+	// and in their extension blocks, which hold 21 entries
+	gnuHeaderSparse         = 386
+	gnuHeaderIsExtended     = 482
+	gnuExtensionIsExtended  = 504
+	gnuHeaderSparseEntries  = 4
+	gnuExtensionEntries     = 21
+	gnuSparseEntrySize      = 24
+	gnuSparseEntryFieldSize = 12
+)
+
+var errInvalidSparseMap = errors.New("invalid sparse map")
+
+// tarBlockAlign rounds n up to a multiple of the tar block size.
+func tarBlockAlign(n FileSize) FileSize {
+	return (n + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
+
+// headerRecorder records the bytes of a tar read from a given offset, so that the raw
+// headers of an entry can be parsed after archive/tar has read them.
+type headerRecorder struct {
+	pt        *positionTrackerReader
+	recording bool
+	from      FileSize
+	raw       []byte
+}
+
+func (r *headerRecorder) Read(p []byte) (int, error) {
+	pos := r.pt.CurrentPos()
+	n, err := r.pt.Read(p)
+	if r.recording && pos+FileSize(n) > r.from {
+		start := FileSize(0)
+		if r.from > pos {
+			start = r.from - pos
+		}
+		r.raw = append(r.raw, p[start:n]...)
+	}
+	return n, err
+}
+
+// start starts recording the bytes from offset from, which must be at or after the
+// current position, dropping the bytes recorded so far.
+func (r *headerRecorder) start(from FileSize) {
+	r.recording, r.from, r.raw = true, from, r.raw[:0]
+}
+
+// stop stops recording and returns the recorded bytes, which are only valid
+// until recording starts again.
+func (r *headerRecorder) stop() []byte {
+	r.recording = false
+	return r.raw
+}
+
+// readSparseMap returns the sparse map of the file of the tar header, or nil if it isn't a
+// GNU sparse file. raw holds the tar from the first header block of the entry to the start
+// of its data. The sparse map is normalized to end at the end of the file.
+func readSparseMap(hdr *tar.Header, raw []byte) ([]SparseEntry, error) {
+	var (
+		sparseMap []SparseEntry
+		err       error
+	)
+	major, minor := hdr.PAXRecords[paxGNUSparseMajor], hdr.PAXRecords[paxGNUSparseMinor]
+	switch {
+	case hdr.Typeflag == tar.TypeGNUSparse:
+		sparseMap, err = readOldGNUSparseMap(raw)
+	case major == "1" && minor == "0":
+		sparseMap, err = readGNUSparseMap1x0(raw)
+	case major == "0" && (minor == "0" || minor == "1"),
+		major == "" && minor == "" && hdr.PAXRecords[paxGNUSparseMap] != "":
+		// archive/tar merges the offset and size records of 0.0 into a map as in 0.1.
+		// Like archive/tar, which is used to unpack layers, files of 0.0 and 0.1 without
+		// fragments are read as regular files.
+		sparseMap, err = parseGNUSparseMap0x1(hdr.PAXRecords[paxGNUSparseMap])
+	default:
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return normalizeSparseMap(sparseMap, FileSize(hdr.Size))
+}
+
+// normalizeSparseMap validates the sparse map of a file of the given size, drops its empty
+// fragments, and appends an empty fragment at the end of the file if it ends with a hole.
+func normalizeSparseMap(sparseMap []SparseEntry, size FileSize) ([]SparseEntry, error) {
+	normalized := make([]SparseEntry, 0, len(sparseMap)+1)
+	var end FileSize
+	for _, e := range sparseMap {
+		if e.Offset < end || e.Size < 0 || e.Offset+e.Size < e.Offset || e.Offset+e.Size > size {
+			return nil, fmt.Errorf("%w: fragment of %d bytes at offset %d in a file of %d bytes", errInvalidSparseMap, e.Size, e.Offset, size)
+		}
+		if e.Size > 0 {
+			normalized = append(normalized, e)
+			end = e.Offset + e.Size
+		}
+	}
+	if end < size || len(normalized) == 0 {
+		normalized = append(normalized, SparseEntry{Offset: size})
+	}
+	return normalized, nil
+}
+
+// readOldGNUSparseMap reads the sparse map of a file with the old GNU sparse headers
+// from its last header block and the extension blocks after it.
+func readOldGNUSparseMap(raw []byte) ([]SparseEntry, error) {
+	off, err := lastTarHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	blk := raw[off : off+tarBlockSize]
+	sparseMap, err := appendGNUSparseEntries(nil, blk[gnuHeaderSparse:], gnuHeaderSparseEntries)
+	if err != nil {
+		return nil, err
+	}
+	for extended := blk[gnuHeaderIsExtended] != 0; extended; extended = blk[gnuExtensionIsExtended] != 0 {
+		off += tarBlockSize
+		if off+tarBlockSize > len(raw) {
+			return nil, fmt.Errorf("%w: truncated extension block", errInvalidSparseMap)
+		}
+		blk = raw[off : off+tarBlockSize]
+		if sparseMap, err = appendGNUSparseEntries(sparseMap, blk, gnuExtensionEntries); err != nil {
+			return nil, err
+		}
+	}
+	return sparseMap, nil
+}
+
+// appendGNUSparseEntries appends the sparse entries of b, which holds up to n entries.
+// The first entry with an empty offset ends the entries.
+func appendGNUSparseEntries(sparseMap []SparseEntry, b []byte, n int) ([]SparseEntry, error) {
+	for i := 0; i < n; i++ {
+		e := b[i*gnuSparseEntrySize : (i+1)*gnuSparseEntrySize]
+		if e[0] == 0 {
+			break
+		}
+		offset, err := parseTarNumeric(e[:gnuSparseEntryFieldSize])
+		if err != nil {
+			return nil, err
+		}
+		size, err := parseTarNumeric(e[gnuSparseEntryFieldSize:])
+		if err != nil {
+			return nil, err
+		}
+		sparseMap = append(sparseMap, SparseEntry{Offset: FileSize(offset), Size: FileSize(size)})
+	}
+	return sparseMap, nil
+}
+
+// readGNUSparseMap1x0 reads the sparse map of a file with PAX sparse headers of version 1.0,
+// which is at the start of the data of the entry, after its last header block.
+func readGNUSparseMap1x0(raw []byte) ([]SparseEntry, error) {
+	off, err := lastTarHeader(raw)
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Split(string(raw[off+tarBlockSize:]), "\n")
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: missing number of entries", errInvalidSparseMap)
+	}
+	n, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || n < 0 || 2*n+1 > int64(len(fields)) {
+		return nil, fmt.Errorf("%w: invalid number of entries %q", errInvalidSparseMap, fields[0])
+	}
+	return parseSparseEntries(fields[1 : 2*n+1])
+}
+
+// parseGNUSparseMap0x1 parses the sparse map of a file with PAX sparse headers of
+// version 0.1, a comma separated list of offsets and sizes.
+func parseGNUSparseMap0x1(s string) ([]SparseEntry, error) {
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Split(s, ",")
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("%w: odd number of fields", errInvalidSparseMap)
+	}
+	return parseSparseEntries(fields)
+}
+
+// parseSparseEntries parses pairs of decimal offsets and sizes.
+func parseSparseEntries(fields []string) ([]SparseEntry, error) {
+	sparseMap := make([]SparseEntry, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		offset, err := strconv.ParseInt(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSparseMap, err)
+		}
+		size, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidSparseMap, err)
+		}
+		sparseMap = append(sparseMap, SparseEntry{Offset: FileSize(offset), Size: FileSize(size)})
+	}
+	return sparseMap, nil
+}
+
+// lastTarHeader returns the offset in raw of the last header block of an entry,
+// skipping its PAX and GNU long name headers.
+func lastTarHeader(raw []byte) (int, error) {
+	off := 0
+	for {
+		if off+tarBlockSize > len(raw) {
+			return 0, fmt.Errorf("%w: truncated tar header", errInvalidSparseMap)
+		}
+		blk := raw[off : off+tarBlockSize]
+		switch blk[tarHeaderTypeflag] {
+		case tar.TypeXHeader, tar.TypeGNULongName, tar.TypeGNULongLink:
+			size, err := parseTarNumeric(blk[tarHeaderSize : tarHeaderSize+12])
+			if err != nil {
+				return 0, err
+			}
+			off += tarBlockSize + int(tarBlockAlign(FileSize(size)))
+		default:
+			return off, nil
+		}
+	}
+}
+
+// parseTarNumeric parses a numeric field of a tar header, which is either octal or,
+// if the high bit of its first byte is set, a base-256 big-endian number.
+func parseTarNumeric(b []byte) (int64, error) {
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		var v int64
+		for i, c := range b {
+			if i == 0 {
+				c &= 0x7f
+			}
+			if v > math.MaxInt64>>8 {
+				return 0, fmt.Errorf("%w: numeric field overflows", errInvalidSparseMap)
+			}
+			v = v<<8 | int64(c)
+		}
+		return v, nil
+	}
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseInt(s, 8, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("%w: invalid numeric field %q", errInvalidSparseMap, s)
+	}
+	return v, nil
+}
+
+// withoutSparseRecords returns the PAX records other than the GNU sparse ones, which
+// describe the encoding of the file in the tar and are replaced by the sparse map.
+func withoutSparseRecords(records map[string]string) map[string]string {
+	var filtered map[string]string
+	for k, v := range records {
+		if strings.HasPrefix(k, paxGNUSparse) {
+			continue
+		}
+		if filtered == nil {
+			filtered = make(map[string]string)
+		}
+		filtered[k] = v
+	}
+	return filtered
+}
+
+// sparseDataSize returns the size of the data of a sparse file, i.e. the total size of its fragments.
+func sparseDataSize(sparseMap []SparseEntry) FileSize {
+	var size FileSize
+	for _, e := range sparseMap {
+		size += e.Size
+	}
+	return size
+}
+
+// ReadSparse reads the contents of a sparse file at offset into p, synthesizing its holes.
+// readData reads the data of the file, i.e. the concatenation of the fragments of sparseMap,
+// at the given offset of the data. p must not extend beyond the end of the file.
+func ReadSparse(p []byte, offset FileSize, sparseMap []SparseEntry, readData func(p []byte, offset FileSize) error) error {
+	end := offset + FileSize(len(p))
+	for i := range p {
+		p[i] = 0
+	}
+	var dataOffset FileSize // offset of the fragment in the data of the file
+	for _, e := range sparseMap {
+		if e.Offset >= end {
+			break
+		}
+		start, fragmentEnd := e.Offset, e.Offset+e.Size
+		if start < offset {
+			start = offset
+		}
+		if fragmentEnd > end {
+			fragmentEnd = end
+		}
+		if start < fragmentEnd {
+			if err := readData(p[start-offset:fragmentEnd-offset], dataOffset+start-e.Offset); err != nil {
+				return err
+			}
+		}
+		dataOffset += e.Size
+	}
+	return nil
+}
+
+// ExpandSparse returns the contents of a sparse file from its data, the concatenation of
+// the fragments of its sparse map.
+func ExpandSparse(data []byte, sparseMap []SparseEntry) ([]byte, error) {
+	if FileSize(len(data)) != sparseDataSize(sparseMap) {
+		return nil, fmt.Errorf("sparse file has %d bytes of data, its sparse map expects %d", len(data), sparseDataSize(sparseMap))
+	}
+	m := FileMetadata{SparseMap: sparseMap}
+	contents := make([]byte, m.Size())
+	err := ReadSparse(contents, 0, sparseMap, func(p []byte, offset FileSize) error {
+		copy(p, data[offset:])
+		return nil
+	})
+	return contents, err
+}
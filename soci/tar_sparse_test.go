@@ -0,0 +1,279 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+)
+
+// gnuSymlink is a symlink entry written in the GNU format, which stores
+// a long target in a GNU long link header.
+type gnuSymlink struct {
+	name, target string
+}
+
+func (e gnuSymlink) AppendTar(tw *tar.Writer, opts testutil.BuildTarOptions) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     opts.Prefix + e.name,
+		Linkname: e.target,
+		Mode:     0644,
+		Format:   tar.FormatGNU,
+	})
+}
+
+func TestBuildZtocWithSparseFiles(t *testing.T) {
+	// more fragments than fit in the header and the first extension block of the old GNU format
+	var fragments []testutil.SparseFragment
+	for i := 0; i < 30; i++ {
+		fragments = append(fragments, testutil.SparseFragment{Offset: int64(i)*10000 + 500, Data: string(genRandomByteData(100 + i))})
+	}
+	longName := "dir/" + strings.Repeat("a", 150)
+
+	formats := []struct {
+		name   string
+		format testutil.SparseFormat
+	}{
+		{name: "gnu", format: testutil.SparseGNU},
+		{name: "pax_0.0", format: testutil.SparsePAX0x0},
+		{name: "pax_0.1", format: testutil.SparsePAX0x1},
+		{name: "pax_1.0", format: testutil.SparsePAX1x0},
+	}
+	for _, f := range formats {
+		type sparseFile struct {
+			size      int64
+			fragments []testutil.SparseFragment
+			sparseMap []SparseEntry
+		}
+		sparseFiles := map[string]sparseFile{
+			"data_at_end": {
+				size:      3000,
+				fragments: []testutil.SparseFragment{{Offset: 2000, Data: string(genRandomByteData(1000))}},
+				sparseMap: []SparseEntry{{Offset: 2000, Size: 1000}},
+			},
+			"hole": {
+				size:      4096,
+				sparseMap: []SparseEntry{{Offset: 4096}},
+			},
+		}
+		var sparseMap []SparseEntry
+		for _, frag := range fragments {
+			sparseMap = append(sparseMap, SparseEntry{Offset: FileSize(frag.Offset), Size: FileSize(len(frag.Data))})
+		}
+		sparseMap = append(sparseMap, SparseEntry{Offset: 400000})
+		sparseFiles["sparse"] = sparseFile{size: 400000, fragments: fragments, sparseMap: sparseMap}
+		if f.format == testutil.SparsePAX0x0 || f.format == testutil.SparsePAX0x1 {
+			// without version records, files without fragments aren't recognized as sparse
+			delete(sparseFiles, "hole")
+		}
+
+		files := map[string][]byte{
+			"after":                           []byte("data after the sparse files"),
+			longName:                          []byte("long name"),
+			"dir/" + strings.Repeat("b", 150): []byte("GNU long name"),
+		}
+		ents := []testutil.TarEntry{testutil.Dir("dir/")}
+		for _, name := range []string{"sparse", "data_at_end", "hole"} {
+			sf, ok := sparseFiles[name]
+			if !ok {
+				continue
+			}
+			ents = append(ents, testutil.SparseFile(name, sf.size, f.format, sf.fragments...))
+			files[name] = testutil.SparseContents(sf.size, sf.fragments...)
+		}
+		ents = append(ents,
+			testutil.File("after", string(files["after"])),
+			testutil.File(longName, string(files[longName])),
+			testutil.File("dir/"+strings.Repeat("b", 150), string(files["dir/"+strings.Repeat("b", 150)]), testutil.WithFileFormat(tar.FormatGNU)),
+			gnuSymlink{name: "dir/" + strings.Repeat("c", 150), target: longName},
+		)
+
+		for _, algo := range []string{CompressionGzip, CompressionZstd} {
+			t.Run(fmt.Sprintf("%s_%s", f.name, algo), func(t *testing.T) {
+				var layer io.Reader
+				if algo == CompressionGzip {
+					layer = testutil.BuildTarGz(ents, gzip.DefaultCompression)
+				} else {
+					layer = testutil.BuildTarZstd(ents, 0)
+				}
+				b, err := io.ReadAll(layer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sr := io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+				ztoc, err := BuildZtoc(sr, 65536, algo, &buildConfig{})
+				if err != nil {
+					t.Fatalf("cannot build ztoc: %v", err)
+				}
+
+				discrepancies, err := VerifyZtoc(ztoc, sr)
+				if err != nil {
+					t.Fatalf("cannot verify ztoc: %v", err)
+				}
+				if len(discrepancies) != 0 {
+					t.Fatalf("unexpected discrepancies: %v", discrepancies)
+				}
+
+				seen := make(map[string]bool)
+				for _, m := range ztoc.Metadata {
+					seen[m.Name] = true
+					if m.Type == "symlink" {
+						if m.Linkname != longName {
+							t.Fatalf("unexpected link name of %s: %s", m.Name, m.Linkname)
+						}
+						continue
+					}
+					if m.Type != "reg" {
+						continue
+					}
+					if _, ok := m.Xattrs[paxGNUSparseMap]; ok {
+						t.Fatalf("unexpected sparse records in the xattrs of %s: %v", m.Name, m.Xattrs)
+					}
+					sf, sparse := sparseFiles[m.Name]
+					if sparse && !reflect.DeepEqual(m.SparseMap, sf.sparseMap) {
+						t.Fatalf("unexpected sparse map of %s; expected = %v, got = %v", m.Name, sf.sparseMap, m.SparseMap)
+					}
+					if !sparse && m.SparseMap != nil {
+						t.Fatalf("unexpected sparse map of %s: %v", m.Name, m.SparseMap)
+					}
+					if int(m.Size()) != len(files[m.Name]) {
+						t.Fatalf("unexpected size of %s; expected = %d, got = %d", m.Name, len(files[m.Name]), m.Size())
+					}
+
+					data, err := ExtractFile(sr, &FileExtractConfig{
+						UncompressedSize:     m.UncompressedSize,
+						UncompressedOffset:   m.UncompressedOffset,
+						SpanStart:            m.SpanStart,
+						SpanEnd:              m.SpanEnd,
+						FirstSpanHasBits:     m.FirstSpanHasBits,
+						IndexByteData:        ztoc.IndexByteData,
+						CompressedFileSize:   ztoc.CompressedFileSize,
+						MaxSpanId:            ztoc.MaxSpanId,
+						CompressionAlgorithm: ztoc.CompressionAlgorithm,
+					})
+					if err != nil {
+						t.Fatalf("cannot extract %s: %v", m.Name, err)
+					}
+					if sparse {
+						if data, err = ExpandSparse(data, m.SparseMap); err != nil {
+							t.Fatalf("cannot expand %s: %v", m.Name, err)
+						}
+					}
+					if !bytes.Equal(data, files[m.Name]) {
+						t.Fatalf("unexpected contents of %s", m.Name)
+					}
+				}
+				for name := range files {
+					if !seen[name] {
+						t.Fatalf("missing %s in the ztoc", name)
+					}
+				}
+				if !seen["dir/"+strings.Repeat("c", 150)] {
+					t.Fatalf("missing symlink with a long name in the ztoc")
+				}
+			})
+		}
+	}
+}
+
+func TestReadSparse(t *testing.T) {
+	data := []byte("abcdefgh")
+	sparseMap := []SparseEntry{{Offset: 2, Size: 3}, {Offset: 8, Size: 5}, {Offset: 15}}
+	contents := []byte("\x00\x00abc\x00\x00\x00defgh\x00\x00")
+
+	for offset := 0; offset < len(contents); offset++ {
+		for end := offset; end <= len(contents); end++ {
+			p := bytes.Repeat([]byte{'x'}, end-offset)
+			err := ReadSparse(p, FileSize(offset), sparseMap, func(p []byte, offset FileSize) error {
+				copy(p, data[offset:])
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(p, contents[offset:end]) {
+				t.Fatalf("unexpected contents at [%d, %d); expected = %q, got = %q", offset, end, contents[offset:end], p)
+			}
+		}
+	}
+}
+
+func TestNormalizeSparseMap(t *testing.T) {
+	testCases := []struct {
+		name      string
+		sparseMap []SparseEntry
+		size      FileSize
+		expected  []SparseEntry
+		wantErr   bool
+	}{
+		{
+			name:      "data_at_end",
+			sparseMap: []SparseEntry{{Offset: 0, Size: 10}, {Offset: 20, Size: 10}},
+			size:      30,
+			expected:  []SparseEntry{{Offset: 0, Size: 10}, {Offset: 20, Size: 10}},
+		},
+		{
+			name:      "hole_at_end",
+			sparseMap: []SparseEntry{{Offset: 10, Size: 0}, {Offset: 20, Size: 5}},
+			size:      30,
+			expected:  []SparseEntry{{Offset: 20, Size: 5}, {Offset: 30}},
+		},
+		{
+			name:     "empty",
+			size:     0,
+			expected: []SparseEntry{{Offset: 0}},
+		},
+		{
+			name:      "overlapping",
+			sparseMap: []SparseEntry{{Offset: 0, Size: 10}, {Offset: 5, Size: 10}},
+			size:      30,
+			wantErr:   true,
+		},
+		{
+			name:      "beyond_end",
+			sparseMap: []SparseEntry{{Offset: 25, Size: 10}},
+			size:      30,
+			wantErr:   true,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := normalizeSparseMap(tc.sparseMap, tc.size)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got sparse map %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Fatalf("unexpected sparse map; expected = %v, got = %v", tc.expected, got)
+			}
+		})
+	}
+}
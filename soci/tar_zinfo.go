@@ -0,0 +1,192 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// size of the serialized tarZinfo: span size (8 bytes) and file size (8 bytes)
+const tarZinfoSize = 16
+
+// tarZinfo is the Zinfo of an uncompressed layer.
+//
+// Offsets in the tar are offsets in the layer, so a span is simply the range
+// [spanID*spanSize, (spanID+1)*spanSize) of the layer and no checkpoints need
+// to be stored.
+type tarZinfo struct {
+	spanSize FileSize
+	fileSize FileSize
+}
+
+// newTarZinfo deserializes a tarZinfo. The buffer is little endian: the
+// span size (8 bytes) followed by the size of the layer (8 bytes).
+func newTarZinfo(indexByteData []byte) (*tarZinfo, error) {
+	if len(indexByteData) != tarZinfoSize {
+		return nil, fmt.Errorf("invalid tar zinfo size: %d bytes", len(indexByteData))
+	}
+	spanSize := FileSize(binary.LittleEndian.Uint64(indexByteData[0:8]))
+	if spanSize <= 0 {
+		return nil, fmt.Errorf("invalid span size %d", spanSize)
+	}
+	return &tarZinfo{
+		spanSize: spanSize,
+		fileSize: FileSize(binary.LittleEndian.Uint64(indexByteData[8:16])),
+	}, nil
+}
+
+// tarZinfoBuilder builds a tarZinfo. Spans start every span bytes, so the data
+// is passed through as is.
+type tarZinfoBuilder struct {
+	r        io.Reader
+	spans    *spanDigester
+	spanSize FileSize
+	read     FileSize
+	// number of spans started
+	numSpans FileSize
+}
+
+func newTarZinfoBuilder(r io.Reader, span int64, spans *spanDigester) (*tarZinfoBuilder, error) {
+	// there is always at least one span, even if the layer is empty
+	if err := spans.startSpan(0); err != nil {
+		return nil, err
+	}
+	return &tarZinfoBuilder{
+		r:        r,
+		spans:    spans,
+		spanSize: FileSize(span),
+		numSpans: 1,
+	}, nil
+}
+
+func (b *tarZinfoBuilder) Read(p []byte) (int, error) {
+	// don't read past the end of a span, so that the data is digested with the right span
+	end := b.numSpans * b.spanSize
+	if b.read == end {
+		end += b.spanSize
+	}
+	if FileSize(len(p)) > end-b.read {
+		p = p[:end-b.read]
+	}
+	n, err := b.r.Read(p)
+	if n > 0 && b.read == b.numSpans*b.spanSize {
+		if serr := b.spans.startSpan(b.read); serr != nil {
+			return 0, serr
+		}
+		b.numSpans++
+	}
+	b.spans.Write(p[:n])
+	b.read += FileSize(n)
+	return n, err
+}
+
+func (b *tarZinfoBuilder) Zinfo() (Zinfo, error) {
+	return &tarZinfo{
+		spanSize: b.spanSize,
+		fileSize: b.read,
+	}, nil
+}
+
+func (b *tarZinfoBuilder) Close() {}
+
+func (i *tarZinfo) Close() {}
+
+func (i *tarZinfo) Bytes() ([]byte, error) {
+	buf := make([]byte, tarZinfoSize)
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(i.spanSize))
+	binary.LittleEndian.PutUint64(buf[8:16], uint64(i.fileSize))
+	return buf, nil
+}
+
+func (i *tarZinfo) MaxSpanID() SpanId {
+	if i.fileSize == 0 {
+		return 0
+	}
+	return SpanId((i.fileSize - 1) / i.spanSize)
+}
+
+func (i *tarZinfo) SpanSize() FileSize {
+	return i.spanSize
+}
+
+func (i *tarZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanID SpanId) ([]byte, error) {
+	start := uncompressedOffset - i.StartUncompressedOffset(spanID)
+	if start < 0 || start+uncompressedSize > FileSize(len(compressedBuf)) {
+		return nil, fmt.Errorf("range [%d, %d) is not in the buffer of span %d", uncompressedOffset, uncompressedOffset+uncompressedSize, spanID)
+	}
+	bytes := make([]byte, uncompressedSize)
+	copy(bytes, compressedBuf[start:start+uncompressedSize])
+	return bytes, nil
+}
+
+func (i *tarZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncompressedOffset FileSize) ([]byte, error) {
+	bytes := make([]byte, uncompressedSize)
+	if uncompressedSize == 0 {
+		return bytes, nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for reading: %w", err)
+	}
+	defer f.Close()
+
+	n, err := f.ReadAt(bytes, int64(uncompressedOffset))
+	if err != nil && err != io.EOF {
+		return bytes, err
+	}
+	if FileSize(n) != uncompressedSize {
+		return bytes, fmt.Errorf("unexpected data size. read = %d, expected = %d", n, uncompressedSize)
+	}
+	return bytes, nil
+}
+
+func (i *tarZinfo) StartCompressedOffset(spanID SpanId) FileSize {
+	return i.StartUncompressedOffset(spanID)
+}
+
+func (i *tarZinfo) EndCompressedOffset(spanID SpanId, fileSize FileSize) FileSize {
+	return i.EndUncompressedOffset(spanID, fileSize)
+}
+
+func (i *tarZinfo) StartUncompressedOffset(spanID SpanId) FileSize {
+	return FileSize(spanID) * i.spanSize
+}
+
+func (i *tarZinfo) EndUncompressedOffset(spanID SpanId, fileSize FileSize) FileSize {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return FileSize(spanID+1) * i.spanSize
+}
+
+func (i *tarZinfo) UncompressedOffsetToSpanID(offset FileSize) SpanId {
+	if offset < 0 {
+		return 0
+	}
+	id := SpanId(offset / i.spanSize)
+	if id > i.MaxSpanID() {
+		return i.MaxSpanID()
+	}
+	return id
+}
+
+func (i *tarZinfo) HasBits(spanID SpanId) bool {
+	return false
+}
@@ -64,8 +64,11 @@ func parseDigest(digestString string) digest.Digest {
 	return dgst
 }
 
-func unmarshalGzipIndex(blob byte) (*gzipIndex, error) {
-	var index *C.struct_gzip_index = C.blob_to_index(unsafe.Pointer(&blob))
+func unmarshalGzipIndex(blob []byte) (*gzipIndex, error) {
+	if len(blob) == 0 {
+		return nil, fmt.Errorf("empty blob")
+	}
+	var index *C.struct_gzip_index = C.blob_to_index(unsafe.Pointer(&blob[0]), C.uint(len(blob)))
 
 	if index == nil {
 		return nil, fmt.Errorf("cannot convert blob to gzip_index")
@@ -77,12 +80,16 @@ func unmarshalGzipIndex(blob byte) (*gzipIndex, error) {
 	lst := unsafe.Slice(index.list, int(index.have))
 	for i := 0; i < int(index.have); i++ {
 		indexPoint := lst[i]
-		window := C.GoBytes(unsafe.Pointer(&indexPoint.window[0]), windowSize)
+		window := make([]byte, windowSize)
+		ret := C.get_window(index, C.int(i), unsafe.Pointer(&window[0]))
+		if ret < 0 {
+			return nil, fmt.Errorf("cannot expand window %d; zlib error: %v", i, ret)
+		}
 		listEntry := gzipIndexPoint{
 			out:    int64(indexPoint.out),
 			in:     int64(indexPoint.in),
 			bits:   int8(indexPoint.bits),
-			window: window,
+			window: window[:ret],
 		}
 		list = append(list, listEntry)
 	}
@@ -213,29 +220,52 @@ func tempTarGz(inputDir string, targzName string) (*string, error) {
 func BuildZtocReader(ents []testutil.TarEntry, compressionLevel int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
 	// build tar gz file
 	tarReader := testutil.BuildTarGz(ents, compressionLevel, opts...)
+	return buildZtocReader(tarReader, CompressionGzip, spanSize)
+}
 
-	// build ztoc
-	tarFile, err := os.CreateTemp("", "tmp.*")
-	if err != nil {
-		return nil, nil, fmt.Errorf("failed to create temp file: %v", err)
-	}
-	defer os.Remove(tarFile.Name())
-	tarBuf := new(bytes.Buffer)
-	w := io.MultiWriter(tarFile, tarBuf)
-	_, err = io.Copy(w, tarReader)
+// BuildZstdZtocReader creates the tar zstd file for tar entries, compressing every
+// frameSize bytes of the tar as a separate zstd frame.
+// It returns ztoc and io.SectionReader of the file.
+func BuildZstdZtocReader(ents []testutil.TarEntry, frameSize int, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+	tarReader := testutil.BuildTarZstd(ents, frameSize, opts...)
+	return buildZtocReader(tarReader, CompressionZstd, spanSize)
+}
+
+// BuildTarZtocReader creates the uncompressed tar file for tar entries.
+// It returns ztoc and io.SectionReader of the file.
+func BuildTarZtocReader(ents []testutil.TarEntry, spanSize int64, opts ...testutil.BuildTarOption) (*Ztoc, *io.SectionReader, error) {
+	tarReader := testutil.BuildTar(ents, opts...)
+	return buildZtocReader(tarReader, CompressionUncompressed, spanSize)
+}
+
+func buildZtocReader(tarReader io.Reader, compressionAlgo string, spanSize int64) (*Ztoc, *io.SectionReader, error) {
+	tarData, err := io.ReadAll(tarReader)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to write tar file: %v", err)
+		return nil, nil, fmt.Errorf("failed to read tar: %v", err)
 	}
-	tarData := tarBuf.Bytes()
 	sr := io.NewSectionReader(bytes.NewReader(tarData), 0, int64(len(tarData)))
 	cfg := &buildConfig{}
-	ztoc, err := BuildZtoc(tarFile.Name(), spanSize, cfg)
+	ztoc, err := BuildZtoc(sr, spanSize, compressionAlgo, cfg)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to build sample ztoc: %v", err)
 	}
 	return ztoc, sr, nil
 }
 
+// buildZtocFromFile builds the ztoc of a compressed tar file.
+func buildZtocFromFile(file string, spanSize int64, compressionAlgo string, cfg *buildConfig) (*Ztoc, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return BuildZtoc(io.NewSectionReader(f, 0, st.Size()), spanSize, compressionAlgo, cfg)
+}
+
 func GenerateTempTestingDir(dirMaker TempDirMaker) (string, error) {
 	tempDir := dirMaker.TempDir()
 	err := createRandFile(tempDir+"/smallfile", 1, 100)
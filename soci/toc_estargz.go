@@ -0,0 +1,586 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// estargzFooterSize is the size of the footer of an eStargz layer, an empty gzip
+	// member whose extra field holds the offset of the TOC.
+	estargzFooterSize = 51
+	// estargzTOCName is the name of the tar entry holding the TOC of an eStargz layer.
+	estargzTOCName = "stargz.index.json"
+	// gzipTrailerSize is the size of the trailer of a gzip member: the CRC32 and the
+	// size of the uncompressed data modulo 2^32.
+	gzipTrailerSize = 8
+	// maxHeaderSearchSteps bounds the search for the formats of the tar headers of
+	// an eStargz layer, beyond the number of headers.
+	maxHeaderSearchSteps = 1 << 16
+	// paxSchilyXattr is the prefix of the PAX records of extended attributes.
+	paxSchilyXattr = "SCHILY.xattr."
+)
+
+// estargzTOC is the TOC of an eStargz layer, stored as JSON in the last entry of the tar.
+type estargzTOC struct {
+	Version int            `json:"version"`
+	Entries []estargzEntry `json:"entries"`
+}
+
+// estargzEntry is an entry of the TOC of an eStargz layer. Regular files have an
+// entry for their first chunk, followed by an entry of type chunk for each other chunk.
+// Each chunk starts a new gzip member, at Offset in the layer.
+type estargzEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	InnerOffset int64             `json:"innerOffset,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+}
+
+// gzipMember is a gzip member of an eStargz layer.
+type gzipMember struct {
+	start      FileSize // offset of the member in the layer
+	headerSize FileSize
+	out        FileSize // offset of its uncompressed data
+	size       FileSize // size of its uncompressed data
+	end        FileSize // offset of the next member in the layer
+	// whether the contents of a file start in the member
+	contents bool
+	// uncompressed data of a member without the contents of any file, or nil
+	data []byte
+}
+
+// readEStargzLayout reads the layout of an eStargz layer. The offset of each gzip member is
+// known from the TOC, and the size of its uncompressed data from its trailer. The members
+// without the contents of any file, i.e. the first one and the one of the TOC, are decompressed.
+// The other tar headers are at the end of the members of the contents of the previous file,
+// so they are encoded again from the TOC. The headers of the entries between two files fill the
+// space left between the contents of the files, which gives the format of each header. If
+// several formats fill it, the member holding the headers is decompressed to read them.
+func readEStargzLayout(sr *io.SectionReader) (*tocLayout, error) {
+	size := FileSize(sr.Size())
+	if size < estargzFooterSize {
+		return nil, errNoTOC
+	}
+	footerStart := size - estargzFooterSize
+	footer := make([]byte, estargzFooterSize)
+	if _, err := sr.ReadAt(footer, int64(footerStart)); err != nil {
+		return nil, fmt.Errorf("cannot read layer footer: %w", err)
+	}
+	tocOffset, ok := parseEStargzFooter(footer)
+	if !ok || tocOffset < 0 || tocOffset >= footerStart {
+		return nil, errNoTOC
+	}
+
+	tocData, err := decodeGzipMember(sr, tocOffset, footerStart)
+	if err != nil {
+		return nil, err
+	}
+	tocPos := &positionTrackerReader{r: bytes.NewReader(tocData)}
+	tr := tar.NewReader(tocPos)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != estargzTOCName {
+		return nil, fmt.Errorf("%w: no %s in the last gzip member", errNoTOC, estargzTOCName)
+	}
+	tocContentsOffset := tocPos.CurrentPos()
+	tocJSON, err := io.ReadAll(tr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read %s: %v", errNoTOC, estargzTOCName, err)
+	}
+	var toc estargzTOC
+	if err := json.Unmarshal(tocJSON, &toc); err != nil {
+		return nil, fmt.Errorf("%w: cannot parse %s: %v", errNoTOC, estargzTOCName, err)
+	}
+
+	members, err := readGzipMembers(sr, &toc, tocOffset, footerStart)
+	if err != nil {
+		return nil, err
+	}
+	tocMember := members[tocOffset]
+	tocMember.data = tocData
+	if tocMember.size != FileSize(len(tocData)) {
+		return nil, fmt.Errorf("%w: unexpected size of the gzip member of the TOC", errNoTOC)
+	}
+
+	layout := newTOCLayout()
+	layout.uncompressedSize = members[footerStart].out
+	starts := make([]FileSize, 0, len(members))
+	for start := range members {
+		starts = append(starts, start)
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, start := range starts {
+		m := members[start]
+		if start == footerStart {
+			continue
+		}
+		if err := layout.addCheckpoint(m.start+m.headerSize, m.out); err != nil {
+			return nil, err
+		}
+		if m.data == nil && !m.contents {
+			// a member without the contents of any file, e.g. the first one, holds tar headers only
+			if m.data, err = decodeGzipMember(sr, start, m.end); err != nil {
+				return nil, err
+			}
+			if FileSize(len(m.data)) != m.size {
+				return nil, fmt.Errorf("%w: unexpected size of the gzip member at offset %d", errNoTOC, start)
+			}
+		}
+	}
+
+	if err := placeEStargzEntries(layout, sr, &toc, members, tocMember); err != nil {
+		return nil, err
+	}
+	if err := layout.addFile(tocMember.out+tocContentsOffset, estargzTOCName, digest.FromBytes(tocJSON).String()); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+// placeEStargzEntries places the tar headers of the entries of the TOC, and the known pieces
+// of the uncompressed data, in the layout.
+func placeEStargzEntries(layout *tocLayout, sr *io.SectionReader, toc *estargzTOC, members map[FileSize]*gzipMember, tocMember *gzipMember) error {
+	// the user and group names are only recorded when they change for an id, so like the
+	// eStargz reader, an entry without a name takes the last name recorded for its id
+	unames := make(map[int]string)
+	gnames := make(map[int]string)
+
+	var pending []*estargzEntry // entries whose headers are before the contents of the next file
+	var pos FileSize            // end of the contents of the last file
+	var file *estargzEntry      // last regular file with contents
+	var fileStart FileSize      // offset of the contents of the last file
+	// the members holding tar headers only, which are decompressed
+	decoded := []*gzipMember{members[0], tocMember}
+	for i := range toc.Entries {
+		e := &toc.Entries[i]
+		if e.Type == "chunk" {
+			if file == nil || e.Name != file.Name {
+				return fmt.Errorf("%w: chunk of %s doesn't follow its file", errNoTOC, e.Name)
+			}
+			if start, ok := contentsOffset(members, e); !ok || start != fileStart+FileSize(e.ChunkOffset) {
+				return fmt.Errorf("%w: chunk of %s at offset %d isn't at the start of a gzip member", errNoTOC, e.Name, e.Offset)
+			}
+			continue
+		}
+		if e.Uname != "" {
+			unames[e.UID] = e.Uname
+		} else {
+			e.Uname = unames[e.UID]
+		}
+		if e.Gname != "" {
+			gnames[e.GID] = e.Gname
+		} else {
+			e.Gname = gnames[e.GID]
+		}
+		pending = append(pending, e)
+		if e.Type != "reg" || e.Size == 0 {
+			continue
+		}
+
+		start, ok := contentsOffset(members, e)
+		if !ok {
+			return fmt.Errorf("%w: contents of %s at offset %d aren't at the start of a gzip member", errNoTOC, e.Name, e.Offset)
+		}
+		if err := placeTarHeaders(layout, sr, members, decoded, pending, pos, start); err != nil {
+			return err
+		}
+		if err := layout.addFile(start, e.Name, e.Digest); err != nil {
+			return err
+		}
+		pending = nil
+		file, fileStart = e, start
+		pos = tarBlockAlign(start + FileSize(e.Size))
+	}
+	if err := placeTarHeaders(layout, sr, members, decoded, pending, pos, tocMember.out); err != nil {
+		return err
+	}
+	return layout.addPiece(tocMember.out, tocMember.data)
+}
+
+// placeTarHeaders places the headers of entries, which fill the uncompressed data in [from, to).
+// If the headers are in a decompressed member, its data is used as is. Otherwise the headers are
+// encoded again from the TOC, in the only combination of formats which fills the space. If several
+// combinations fill it, the member holding the headers is decompressed to read them.
+func placeTarHeaders(layout *tocLayout, sr *io.SectionReader, members map[FileSize]*gzipMember, decoded []*gzipMember, entries []*estargzEntry, from, to FileSize) error {
+	if to < from {
+		return fmt.Errorf("%w: contents of files overlap at offset %d", errNoTOC, to)
+	}
+	if from == to && len(entries) == 0 {
+		return nil
+	}
+	for _, m := range decoded {
+		if m.data != nil && m.out <= from && to <= m.out+m.size {
+			if len(layout.pieces) == 0 || layout.pieces[len(layout.pieces)-1].offset != m.out {
+				return layout.addPiece(m.out, m.data)
+			}
+			return nil
+		}
+	}
+
+	encodings := make([][][]byte, len(entries))
+	for i, e := range entries {
+		var err error
+		if encodings[i], err = e.headerEncodings(); err != nil {
+			return err
+		}
+	}
+	choice, n := chooseEncodings(encodings, to-from)
+	switch {
+	case n == 0:
+		return fmt.Errorf("%w: cannot infer the tar headers at offset %d", errNoTOC, from)
+	case n > 1:
+		return placeDecodedHeaders(layout, sr, members, from, to)
+	}
+	pos := from
+	for i, j := range choice {
+		if err := layout.addPiece(pos, encodings[i][j]); err != nil {
+			return err
+		}
+		pos += FileSize(len(encodings[i][j]))
+	}
+	return nil
+}
+
+// chooseEncodings returns a choice of an encoding for each header whose sizes add up to size,
+// and the number of such choices: 0, 1, or 2 if there are more than one or too many to search.
+func chooseEncodings(encodings [][][]byte, size FileSize) ([]int, int) {
+	n := len(encodings)
+	// bounds of the size of the headers from each header to the last one, to prune the search
+	minRest := make([]FileSize, n+1)
+	maxRest := make([]FileSize, n+1)
+	for i := n - 1; i >= 0; i-- {
+		lo, hi := FileSize(len(encodings[i][0])), FileSize(len(encodings[i][0]))
+		for _, enc := range encodings[i][1:] {
+			if l := FileSize(len(enc)); l < lo {
+				lo = l
+			} else if l > hi {
+				hi = l
+			}
+		}
+		minRest[i] = minRest[i+1] + lo
+		maxRest[i] = maxRest[i+1] + hi
+	}
+
+	var solution []int
+	solutions, steps := 0, 0
+	choice := make([]int, n)
+	var search func(i int, remaining FileSize)
+	search = func(i int, remaining FileSize) {
+		steps++
+		if solutions > 1 || steps > n+maxHeaderSearchSteps {
+			return
+		}
+		if i == n {
+			solutions++
+			solution = append([]int(nil), choice...)
+			return
+		}
+		if remaining < minRest[i] || remaining > maxRest[i] {
+			return
+		}
+		for j, enc := range encodings[i] {
+			choice[i] = j
+			search(i+1, remaining-FileSize(len(enc)))
+		}
+	}
+	search(0, size)
+	if steps > n+maxHeaderSearchSteps {
+		return nil, 2
+	}
+	return solution, solutions
+}
+
+// placeDecodedHeaders places the tar headers in [from, to), read by decompressing the gzip
+// member holding them, i.e. the member of the end of the contents of the previous file.
+func placeDecodedHeaders(layout *tocLayout, sr *io.SectionReader, members map[FileSize]*gzipMember, from, to FileSize) error {
+	for _, m := range members {
+		if m.out > from || to > m.out+m.size || from == m.out+m.size {
+			continue
+		}
+		data, err := decodeGzipMember(sr, m.start, m.end)
+		if err != nil {
+			return err
+		}
+		if FileSize(len(data)) != m.size {
+			return fmt.Errorf("%w: unexpected size of the gzip member at offset %d", errNoTOC, m.start)
+		}
+		return layout.addPiece(from, data[from-m.out:to-m.out])
+	}
+	return fmt.Errorf("%w: tar headers at offset %d aren't in a gzip member", errNoTOC, from)
+}
+
+// tarHeaderFormats are the formats in which a header may have been written. A header which
+// can't be written in the USTAR format may have been written either in the PAX or GNU format,
+// and a header written in the PAX format may have extended records, e.g. for a long name,
+// even if it could be written in the USTAR format.
+var tarHeaderFormats = []tar.Format{tar.FormatUnknown, tar.FormatPAX, tar.FormatGNU}
+
+// headerEncodings returns the encodings of the tar header of the entry. Encodings of the same
+// size are only kept if they are read differently, e.g. a GNU long name and a PAX header with a
+// path record, which is recorded in the xattrs of the ztoc; the headers are then ambiguous.
+func (e *estargzEntry) headerEncodings() ([][]byte, error) {
+	hdr, err := e.header()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		encodings [][]byte
+		records   []map[string]string
+	)
+	for _, format := range tarHeaderFormats {
+		hdr.Format = format
+		var buf bytes.Buffer
+		if err := tar.NewWriter(&buf).WriteHeader(hdr); err != nil {
+			continue
+		}
+		read, err := tar.NewReader(bytes.NewReader(buf.Bytes())).Next()
+		if err != nil {
+			continue
+		}
+		known := false
+		for i, enc := range encodings {
+			known = known || len(enc) == buf.Len() && samePAXRecords(records[i], read.PAXRecords)
+		}
+		if !known {
+			encodings = append(encodings, buf.Bytes())
+			records = append(records, read.PAXRecords)
+		}
+	}
+	if len(encodings) == 0 {
+		return nil, fmt.Errorf("%w: cannot encode the tar header of %s", errNoTOC, e.Name)
+	}
+	return encodings, nil
+}
+
+func samePAXRecords(a, b map[string]string) bool {
+	return len(a) == 0 && len(b) == 0 || reflect.DeepEqual(a, b)
+}
+
+// header returns the tar header of the entry, as written by the eStargz writer.
+func (e *estargzEntry) header() (*tar.Header, error) {
+	hdr := &tar.Header{
+		Name:     e.Name,
+		Linkname: e.LinkName,
+		Mode:     e.Mode,
+		Uid:      e.UID,
+		Gid:      e.GID,
+		Uname:    e.Uname,
+		Gname:    e.Gname,
+		// the modification time is only recorded if it isn't the epoch
+		ModTime:  time.Unix(0, 0),
+		Devmajor: int64(e.DevMajor),
+		Devminor: int64(e.DevMinor),
+	}
+	if e.ModTime != "" {
+		modTime, err := time.Parse(time.RFC3339, e.ModTime)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid modification time of %s: %v", errNoTOC, e.Name, err)
+		}
+		hdr.ModTime = modTime
+	}
+	switch e.Type {
+	case "reg":
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.Size
+	case "dir":
+		hdr.Typeflag = tar.TypeDir
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+	case "hardlink":
+		hdr.Typeflag = tar.TypeLink
+	case "char":
+		hdr.Typeflag = tar.TypeChar
+	case "block":
+		hdr.Typeflag = tar.TypeBlock
+	case "fifo":
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("%w: unsupported type %q of %s", errNoTOC, e.Type, e.Name)
+	}
+	for name, value := range e.Xattrs {
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxSchilyXattr+name] = string(value)
+	}
+	return hdr, nil
+}
+
+// contentsOffset returns the uncompressed offset of the contents of the chunk of a file.
+func contentsOffset(members map[FileSize]*gzipMember, e *estargzEntry) (FileSize, bool) {
+	m, ok := members[FileSize(e.Offset)]
+	if !ok || e.InnerOffset < 0 || FileSize(e.InnerOffset) >= m.size {
+		return 0, false
+	}
+	return m.out + FileSize(e.InnerOffset), true
+}
+
+// readGzipMembers reads the header and the trailer of the gzip members of an eStargz layer,
+// keyed by offset. The members start at the start of the layer, at each chunk of the files,
+// at the TOC and at the footer.
+func readGzipMembers(sr *io.SectionReader, toc *estargzTOC, tocOffset, footerStart FileSize) (map[FileSize]*gzipMember, error) {
+	starts := []FileSize{0, tocOffset, footerStart}
+	contents := make(map[FileSize]bool)
+	for _, e := range toc.Entries {
+		if e.Type == "chunk" || (e.Type == "reg" && e.Size > 0) {
+			if e.Offset < 0 || FileSize(e.Offset) >= tocOffset {
+				return nil, fmt.Errorf("%w: invalid offset %d of %s", errNoTOC, e.Offset, e.Name)
+			}
+			starts = append(starts, FileSize(e.Offset))
+			contents[FileSize(e.Offset)] = true
+		}
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	unique := starts[:1]
+	for _, start := range starts[1:] {
+		if start != unique[len(unique)-1] {
+			unique = append(unique, start)
+		}
+	}
+	starts = unique
+
+	members := make(map[FileSize]*gzipMember)
+	var out FileSize
+	trailer := make([]byte, gzipTrailerSize)
+	for i, start := range starts {
+		end := FileSize(sr.Size())
+		if i+1 < len(starts) {
+			end = starts[i+1]
+		}
+		headerSize, err := gzipHeaderSize(io.NewSectionReader(sr, int64(start), int64(end-start)))
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid gzip member at offset %d: %v", errNoTOC, start, err)
+		}
+		if end-start < headerSize+gzipTrailerSize {
+			return nil, fmt.Errorf("%w: gzip member at offset %d is too short", errNoTOC, start)
+		}
+		if _, err := sr.ReadAt(trailer, int64(end-gzipTrailerSize)); err != nil {
+			return nil, fmt.Errorf("cannot read gzip trailer at offset %d: %w", end-gzipTrailerSize, err)
+		}
+		size := FileSize(binary.LittleEndian.Uint32(trailer[4:8]))
+		members[start] = &gzipMember{start: start, headerSize: headerSize, out: out, size: size, end: end, contents: contents[start]}
+		out += size
+	}
+	return members, nil
+}
+
+// parseEStargzFooter returns the offset of the TOC recorded in the footer of an eStargz layer.
+// The extra field of the footer is "SG", the size of the subfield, and the offset of the TOC
+// as 16 hexadecimal digits followed by "STARGZ".
+func parseEStargzFooter(footer []byte) (FileSize, bool) {
+	zr, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return 0, false
+	}
+	extra := zr.Header.Extra
+	const subfieldSize = 16 + len("STARGZ")
+	if len(extra) != 4+subfieldSize || extra[0] != 'S' || extra[1] != 'G' ||
+		int(binary.LittleEndian.Uint16(extra[2:4])) != subfieldSize || string(extra[20:]) != "STARGZ" {
+		return 0, false
+	}
+	offset, err := strconv.ParseInt(string(extra[4:20]), 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return FileSize(offset), true
+}
+
+// decodeGzipMember decompresses the gzip member in [start, end) of the layer.
+func decodeGzipMember(sr *io.SectionReader, start, end FileSize) ([]byte, error) {
+	zr, err := gzip.NewReader(io.NewSectionReader(sr, int64(start), int64(end-start)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid gzip member at offset %d: %v", errNoTOC, start, err)
+	}
+	zr.Multistream(false)
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decompress gzip member at offset %d: %v", errNoTOC, start, err)
+	}
+	return data, nil
+}
+
+// gzipHeaderSize returns the size of the header of the gzip member read from r, see RFC 1952.
+func gzipHeaderSize(r io.Reader) (FileSize, error) {
+	const (
+		flagHCRC    = 1 << 1
+		flagExtra   = 1 << 2
+		flagName    = 1 << 3
+		flagComment = 1 << 4
+	)
+	br := bufio.NewReader(r)
+	hdr := make([]byte, 10)
+	if _, err := io.ReadFull(br, hdr); err != nil {
+		return 0, err
+	}
+	if hdr[0] != gzipID1 || hdr[1] != gzipID2 || hdr[2] != 8 {
+		return 0, gzip.ErrHeader
+	}
+	size := FileSize(len(hdr))
+	flags := hdr[3]
+	if flags&flagExtra != 0 {
+		xlen := make([]byte, 2)
+		if _, err := io.ReadFull(br, xlen); err != nil {
+			return 0, err
+		}
+		n, err := br.Discard(int(binary.LittleEndian.Uint16(xlen)))
+		if err != nil {
+			return 0, err
+		}
+		size += FileSize(len(xlen) + n)
+	}
+	for _, flag := range []byte{flagName, flagComment} {
+		if flags&flag != 0 {
+			s, err := br.ReadBytes(0)
+			if err != nil {
+				return 0, err
+			}
+			size += FileSize(len(s))
+		}
+	}
+	if flags&flagHCRC != 0 {
+		size += 2
+	}
+	return size, nil
+}
@@ -0,0 +1,205 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// zstdChunkedFooterMagic ends the footer of a zstd:chunked layer.
+	zstdChunkedFooterMagic = "GnUlInUx"
+	// zstdSkippableFrameHeaderSize is the size of the magic number and the frame size
+	// of a skippable frame.
+	zstdSkippableFrameHeaderSize = 8
+)
+
+// zstdChunkedFooterSizes are the sizes of the data of the footer of a zstd:chunked layer,
+// without and with the offset of the tar-split data.
+var zstdChunkedFooterSizes = []FileSize{40, 64}
+
+// zstdChunkedManifest is the TOC of a zstd:chunked layer, stored in a skippable frame
+// after the tar.
+type zstdChunkedManifest struct {
+	Version int                `json:"version"`
+	Entries []zstdChunkedEntry `json:"entries"`
+}
+
+// zstdChunkedEntry is an entry of the TOC of a zstd:chunked layer. The contents of a regular file
+// are in the zstd frames in [Offset, EndOffset), and each entry of type chunk following it is
+// a chunk of its contents starting a new frame. The tar headers are in the other frames.
+type zstdChunkedEntry struct {
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	Offset      int64  `json:"offset,omitempty"`
+	EndOffset   int64  `json:"endOffset,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+}
+
+// zstdChunkedRegion is the compressed contents of a regular file of a zstd:chunked layer.
+type zstdChunkedRegion struct {
+	file   *zstdChunkedEntry
+	chunks []*zstdChunkedEntry
+	end    FileSize
+}
+
+// readZstdChunkedLayout reads the layout of a zstd:chunked layer. The contents of the files are
+// in their own frames, whose offsets are in the TOC, so only the frames of the tar headers
+// between them are decompressed.
+func readZstdChunkedLayout(sr *io.SectionReader) (*tocLayout, error) {
+	size := FileSize(sr.Size())
+	manifestOffset, manifestSize, tocEnd, ok := readZstdChunkedFooter(sr)
+	if !ok || manifestOffset+manifestSize > size {
+		return nil, errNoTOC
+	}
+	compressed := make([]byte, manifestSize)
+	if _, err := sr.ReadAt(compressed, int64(manifestOffset)); err != nil {
+		return nil, fmt.Errorf("cannot read zstd:chunked manifest: %w", err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	defer dec.Close()
+	manifestJSON, err := dec.DecodeAll(compressed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot decompress zstd:chunked manifest: %v", errNoTOC, err)
+	}
+	var manifest zstdChunkedManifest
+	if err := json.Unmarshal(manifestJSON, &manifest); err != nil {
+		return nil, fmt.Errorf("%w: cannot parse zstd:chunked manifest: %v", errNoTOC, err)
+	}
+
+	var regions []*zstdChunkedRegion
+	for i := range manifest.Entries {
+		e := &manifest.Entries[i]
+		switch {
+		case e.Type == "chunk":
+			if len(regions) == 0 || regions[len(regions)-1].file.Name != e.Name {
+				return nil, fmt.Errorf("%w: chunk of %s doesn't follow its file", errNoTOC, e.Name)
+			}
+			r := regions[len(regions)-1]
+			r.chunks = append(r.chunks, e)
+			if FileSize(e.EndOffset) > r.end {
+				r.end = FileSize(e.EndOffset)
+			}
+		case e.Type == "reg" && e.Size > 0 && e.EndOffset > e.Offset:
+			regions = append(regions, &zstdChunkedRegion{file: e, end: FileSize(e.EndOffset)})
+		}
+	}
+
+	layout := newTOCLayout()
+	if err := layout.addCheckpoint(0, 0); err != nil {
+		return nil, err
+	}
+	var in, out FileSize
+	// addHeaders decompresses the frames of the tar headers in [in, end)
+	addHeaders := func(end FileSize) error {
+		if end < in {
+			return fmt.Errorf("%w: contents of files overlap at offset %d", errNoTOC, end)
+		}
+		if end == in {
+			return nil
+		}
+		compressed := make([]byte, end-in)
+		if _, err := sr.ReadAt(compressed, int64(in)); err != nil {
+			return fmt.Errorf("cannot read layer: %w", err)
+		}
+		data, err := dec.DecodeAll(compressed, nil)
+		if err != nil {
+			return fmt.Errorf("%w: cannot decompress zstd frames at offset %d: %v", errNoTOC, in, err)
+		}
+		if in > 0 {
+			if err := layout.addCheckpoint(in, out); err != nil {
+				return err
+			}
+		}
+		if err := layout.addPiece(out, data); err != nil {
+			return err
+		}
+		in, out = end, out+FileSize(len(data))
+		return nil
+	}
+	for _, r := range regions {
+		start := FileSize(r.file.Offset)
+		if err := addHeaders(start); err != nil {
+			return nil, err
+		}
+		if err := layout.addCheckpoint(start, out); err != nil {
+			return nil, err
+		}
+		for _, c := range r.chunks {
+			if c.ChunkOffset <= 0 || c.ChunkOffset >= r.file.Size {
+				continue
+			}
+			if err := layout.addCheckpoint(FileSize(c.Offset), out+FileSize(c.ChunkOffset)); err != nil {
+				return nil, err
+			}
+		}
+		if err := layout.addFile(out, r.file.Name, r.file.Digest); err != nil {
+			return nil, err
+		}
+		in, out = r.end, out+FileSize(r.file.Size)
+	}
+	if err := addHeaders(tocEnd); err != nil {
+		return nil, err
+	}
+	layout.uncompressedSize = out
+	return layout, nil
+}
+
+// readZstdChunkedFooter reads the footer of a zstd:chunked layer, a skippable frame at the end
+// of the layer. It returns the offset and size of the compressed manifest, and the end of the
+// tar, i.e. the start of the first skippable frame after it.
+func readZstdChunkedFooter(sr *io.SectionReader) (manifestOffset, manifestSize, tocEnd FileSize, ok bool) {
+	size := FileSize(sr.Size())
+	for _, n := range zstdChunkedFooterSizes {
+		if size < n+zstdSkippableFrameHeaderSize {
+			continue
+		}
+		frame := make([]byte, n+zstdSkippableFrameHeaderSize)
+		if _, err := sr.ReadAt(frame, int64(size)-int64(len(frame))); err != nil {
+			return 0, 0, 0, false
+		}
+		if binary.LittleEndian.Uint32(frame[0:4]) != zstdSkippableFrameMagic ||
+			FileSize(binary.LittleEndian.Uint32(frame[4:8])) != n ||
+			string(frame[len(frame)-len(zstdChunkedFooterMagic):]) != zstdChunkedFooterMagic {
+			continue
+		}
+		data := frame[zstdSkippableFrameHeaderSize:]
+		manifestOffset = FileSize(binary.LittleEndian.Uint64(data[0:8]))
+		manifestSize = FileSize(binary.LittleEndian.Uint64(data[8:16]))
+		tocEnd = manifestOffset
+		if n == 64 {
+			if tarSplitOffset := FileSize(binary.LittleEndian.Uint64(data[32:40])); tarSplitOffset > 0 && tarSplitOffset < tocEnd {
+				tocEnd = tarSplitOffset
+			}
+		}
+		if tocEnd < zstdSkippableFrameHeaderSize {
+			return 0, 0, 0, false
+		}
+		return manifestOffset, manifestSize, tocEnd - zstdSkippableFrameHeaderSize, true
+	}
+	return 0, 0, 0, false
+}
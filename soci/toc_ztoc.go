@@ -0,0 +1,291 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// errNoTOC is returned when the ztoc of a layer can't be derived from a table of contents,
+// either because the layer has none or because it doesn't describe the layer exactly.
+// The ztoc is then built by decompressing the layer.
+var errNoTOC = errors.New("layer has no usable table of contents")
+
+// tocLayout is the layout of the uncompressed data of a layer, derived from the table of
+// contents of an eStargz or zstd:chunked layer without decompressing the contents of its files.
+type tocLayout struct {
+	// pieces of the uncompressed data known without decompressing the contents of
+	// the files, i.e. the tar headers, sorted by offset. The rest of the uncompressed
+	// data is the contents of files, which are read as zeros.
+	pieces           []tocPiece
+	uncompressedSize FileSize
+	// candidate checkpoints, at the start of gzip members or zstd frames, sorted by offset.
+	// The first one is where the first span starts.
+	checkpoints []tocCheckpoint
+	// cleaned names of the regular files whose contents are described by the TOC,
+	// keyed by the uncompressed offset of their contents
+	files map[FileSize]string
+	// digests of the contents of the files, keyed by the uncompressed offset of their contents
+	digests map[FileSize]digest.Digest
+}
+
+// tocPiece is a known piece of the uncompressed data of a layer.
+type tocPiece struct {
+	offset FileSize
+	data   []byte
+}
+
+// tocCheckpoint is the start of a gzip member or zstd frame, from which decompression can
+// start without a window.
+type tocCheckpoint struct {
+	in  FileSize // offset of the compressed data of the member or frame, after the gzip header
+	out FileSize // corresponding offset in the uncompressed data
+}
+
+func newTOCLayout() *tocLayout {
+	return &tocLayout{
+		files:   make(map[FileSize]string),
+		digests: make(map[FileSize]digest.Digest),
+	}
+}
+
+// addPiece adds a piece of uncompressed data, which must start after the previous pieces.
+func (l *tocLayout) addPiece(offset FileSize, data []byte) error {
+	if n := len(l.pieces); n > 0 {
+		last := l.pieces[n-1]
+		if offset < last.offset+FileSize(len(last.data)) {
+			return fmt.Errorf("%w: data at offset %d overlaps data at offset %d", errNoTOC, offset, last.offset)
+		}
+	}
+	if len(data) > 0 {
+		l.pieces = append(l.pieces, tocPiece{offset: offset, data: data})
+	}
+	return nil
+}
+
+// addCheckpoint adds a candidate checkpoint, which must be after the previous ones.
+func (l *tocLayout) addCheckpoint(in, out FileSize) error {
+	if n := len(l.checkpoints); n > 0 {
+		last := l.checkpoints[n-1]
+		if in <= last.in || out < last.out {
+			return fmt.Errorf("%w: checkpoint at offset %d is before checkpoint at offset %d", errNoTOC, in, last.in)
+		}
+	}
+	l.checkpoints = append(l.checkpoints, tocCheckpoint{in: in, out: out})
+	return nil
+}
+
+// addFile records the contents of a regular file described by the TOC. The digest is
+// optional, but the ztoc can only have file digests if the TOC has all of them.
+func (l *tocLayout) addFile(offset FileSize, name string, dgst string) error {
+	l.files[offset] = cleanEntryName(name)
+	if dgst == "" {
+		return nil
+	}
+	d, err := digest.Parse(dgst)
+	if err != nil {
+		return fmt.Errorf("%w: invalid digest of %s: %v", errNoTOC, name, err)
+	}
+	l.digests[offset] = d
+	return nil
+}
+
+// reader returns a reader of the uncompressed data of the layer, where the contents
+// of the files are zeros.
+func (l *tocLayout) reader() io.Reader {
+	return &tocLayoutReader{layout: l}
+}
+
+// tocLayoutReader reads the uncompressed data of a tocLayout.
+type tocLayoutReader struct {
+	layout *tocLayout
+	pos    FileSize
+	next   int // index of the first piece which doesn't end before pos
+}
+
+func (r *tocLayoutReader) Read(p []byte) (int, error) {
+	l := r.layout
+	if r.pos >= l.uncompressedSize {
+		return 0, io.EOF
+	}
+	if remaining := l.uncompressedSize - r.pos; FileSize(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	for r.next < len(l.pieces) && l.pieces[r.next].offset+FileSize(len(l.pieces[r.next].data)) <= r.pos {
+		r.next++
+	}
+	var n int
+	if r.next < len(l.pieces) && l.pieces[r.next].offset <= r.pos {
+		piece := l.pieces[r.next]
+		n = copy(p, piece.data[r.pos-piece.offset:])
+	} else {
+		// contents of files, up to the next piece
+		end := l.uncompressedSize
+		if r.next < len(l.pieces) {
+			end = l.pieces[r.next].offset
+		}
+		if FileSize(len(p)) > end-r.pos {
+			p = p[:end-r.pos]
+		}
+		for i := range p {
+			p[i] = 0
+		}
+		n = len(p)
+	}
+	r.pos += FileSize(n)
+	return n, nil
+}
+
+// buildZtocFromTOC builds the ztoc of an eStargz or zstd:chunked layer from the table of
+// contents in the layer, instead of decompressing it. The tar headers are read from the
+// TOC, or decompressed when they aren't mixed with the contents of files, and the gzip
+// members or zstd frames where the contents of files start are the checkpoints, which
+// don't need any window. The compressed data is still read once to compute the span digests.
+//
+// It returns errNoTOC if the layer has no TOC or if the TOC doesn't describe the layer exactly,
+// in which case the ztoc must be built by decompressing the layer.
+func buildZtocFromTOC(sr *io.SectionReader, span int64, compressionAlgo string, cfg *buildConfig) (*Ztoc, error) {
+	if span <= 0 {
+		return nil, fmt.Errorf("invalid span size %d", span)
+	}
+	var layout *tocLayout
+	var err error
+	switch compressionAlgo {
+	case CompressionGzip:
+		layout, err = readEStargzLayout(sr)
+	case CompressionZstd:
+		layout, err = readZstdChunkedLayout(sr)
+	default:
+		return nil, errNoTOC
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pt := &positionTrackerReader{r: layout.reader()}
+	fm, err := getFileMetadata(pt, false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errNoTOC, err)
+	}
+	if err := layout.checkFiles(fm, cfg.fileDigests); err != nil {
+		return nil, err
+	}
+
+	spanPlacement := recordedSpanPlacement(cfg, compressionAlgo)
+	var placer spanPlacer
+	if spanPlacement == string(SpanPlacementFileBoundary) {
+		placer = newFileBoundaryPlacerFromMetadata(fm, FileSize(span))
+	}
+	checkpoints := layout.spanCheckpoints(FileSize(span), placer)
+
+	digests, err := tocSpanDigests(sr, checkpoints)
+	if err != nil {
+		return nil, err
+	}
+
+	var zinfo Zinfo
+	switch compressionAlgo {
+	case CompressionGzip:
+		zinfo, err = newGzipZinfoFromCheckpoints(checkpoints, FileSize(span))
+		if err != nil {
+			return nil, err
+		}
+	case CompressionZstd:
+		zinfo = newZstdZinfoFromCheckpoints(checkpoints, FileSize(span))
+	}
+	defer zinfo.Close()
+
+	return newZtoc(zinfo, fm, digests, FileSize(sr.Size()), layout.uncompressedSize, compressionAlgo, spanPlacement, cfg)
+}
+
+// checkFiles checks that the files read from the tar headers are where the TOC says their
+// contents are, and fills in their digests if needed.
+func (l *tocLayout) checkFiles(fm []FileMetadata, fileDigests bool) error {
+	found := 0
+	for i := range fm {
+		m := &fm[i]
+		if m.Type != "reg" {
+			continue
+		}
+		if name, ok := l.files[m.UncompressedOffset]; ok && m.UncompressedSize > 0 {
+			if name != cleanEntryName(m.Name) {
+				return fmt.Errorf("%w: contents at offset %d are %s in the TOC, not %s", errNoTOC, m.UncompressedOffset, name, m.Name)
+			}
+			found++
+		}
+		if !fileDigests {
+			continue
+		}
+		if m.UncompressedSize == 0 {
+			m.Digest = digest.FromBytes(nil)
+			continue
+		}
+		d, ok := l.digests[m.UncompressedOffset]
+		if !ok {
+			return fmt.Errorf("%w: TOC has no digest of %s", errNoTOC, m.Name)
+		}
+		m.Digest = d
+	}
+	if found != len(l.files) {
+		return fmt.Errorf("%w: found %d of the %d files of the TOC", errNoTOC, found, len(l.files))
+	}
+	return nil
+}
+
+// spanCheckpoints returns the candidate checkpoints where spans start. If placer is nil,
+// spans start every span bytes; otherwise placer chooses the checkpoints.
+func (l *tocLayout) spanCheckpoints(span FileSize, placer spanPlacer) []tocCheckpoint {
+	checkpoints := []tocCheckpoint{l.checkpoints[0]}
+	for _, c := range l.checkpoints[1:] {
+		if c.out >= l.uncompressedSize {
+			// no span after the end of the uncompressed data
+			break
+		}
+		last := checkpoints[len(checkpoints)-1].out
+		start := c.out-last >= span
+		if placer != nil {
+			start = placer.startSpan(c.out, last)
+		}
+		if start {
+			checkpoints = append(checkpoints, c)
+		}
+	}
+	return checkpoints
+}
+
+// tocSpanDigests computes the digests of the spans starting at the checkpoints. The data
+// before the first checkpoint, i.e. the header of the first gzip member, is in no span.
+func tocSpanDigests(sr *io.SectionReader, checkpoints []tocCheckpoint) ([]digest.Digest, error) {
+	spans := &spanDigester{}
+	r := io.NewSectionReader(sr, 0, sr.Size())
+	for _, c := range checkpoints {
+		if _, err := io.CopyN(spans, r, int64(c.in-spans.written)); err != nil {
+			return nil, fmt.Errorf("cannot read layer: %w", err)
+		}
+		if err := spans.startSpan(c.in); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := io.Copy(spans, r); err != nil {
+		return nil, fmt.Errorf("cannot read layer: %w", err)
+	}
+	return spans.digests(), nil
+}
@@ -0,0 +1,239 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+// tarHeaderEntry is a tar entry without contents written from a raw header, e.g. to set
+// the names of the owner.
+type tarHeaderEntry tar.Header
+
+func (e tarHeaderEntry) AppendTar(tw *tar.Writer, opts testutil.BuildTarOptions) error {
+	hdr := tar.Header(e)
+	return tw.WriteHeader(&hdr)
+}
+
+func TestBuildZtocFromTOC(t *testing.T) {
+	longName := "dir/" + strings.Repeat("long", 30)
+	contents := map[string]string{
+		"dir/small":   "hello",
+		"dir/xattrs":  "with xattrs",
+		"empty":       "",
+		"large":       string(genRandomByteData(200000)),
+		longName:      "long name",
+		"after-large": string(genRandomByteData(1000)),
+	}
+	modTime := time.Date(2023, 3, 4, 5, 6, 7, 0, time.UTC)
+	ents := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/small", contents["dir/small"], testutil.WithFileModTime(modTime)),
+		testutil.File("dir/xattrs", contents["dir/xattrs"], testutil.WithFileXattrs(map[string]string{"user.foo": "bar"})),
+		testutil.File("empty", contents["empty"], testutil.WithFileOwner(1000, 1000)),
+		testutil.File("large", contents["large"]),
+		// a GNU long name has the size of a PAX path record, which is read as an xattr
+		tarHeaderEntry{Typeflag: tar.TypeDir, Name: longName + "-gnu/", Mode: 0755, Format: tar.FormatGNU},
+		testutil.File(longName, contents[longName]),
+		testutil.Symlink("symlink", "large"),
+		tarHeaderEntry{Typeflag: tar.TypeLink, Name: "hardlink", Linkname: "large"},
+		tarHeaderEntry{Typeflag: tar.TypeDir, Name: "owned/", Mode: 0755, Uid: 1000, Gid: 1000, Uname: "user", Gname: "group"},
+		tarHeaderEntry{Typeflag: tar.TypeDir, Name: "owned/again/", Mode: 0755, Uid: 1000, Gid: 1000, Uname: "user", Gname: "group"},
+		testutil.File("after-large", contents["after-large"]),
+	}
+
+	formats := []struct {
+		name            string
+		compressionAlgo string
+		build           func([]testutil.TarEntry, int64, ...testutil.BuildTarOption) (io.Reader, error)
+	}{
+		{name: "estargz", compressionAlgo: CompressionGzip, build: testutil.BuildEStargz},
+		{name: "zstd_chunked", compressionAlgo: CompressionZstd, build: testutil.BuildZstdChunked},
+	}
+	for _, f := range formats {
+		for _, placement := range []SpanPlacement{SpanPlacementFixed, SpanPlacementFileBoundary} {
+			t.Run(fmt.Sprintf("%s_%s", f.name, placement), func(t *testing.T) {
+				r, err := f.build(ents, 65536)
+				if err != nil {
+					t.Fatalf("cannot build layer: %v", err)
+				}
+				layer, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatalf("cannot read layer: %v", err)
+				}
+				sr := io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer)))
+				var cfg buildConfig
+				if err := WithFileDigests()(&cfg); err != nil {
+					t.Fatal(err)
+				}
+				if err := WithSpanPlacement(placement)(&cfg); err != nil {
+					t.Fatal(err)
+				}
+
+				ztoc, err := buildZtocFromTOC(sr, 65536, f.compressionAlgo, &cfg)
+				if err != nil {
+					t.Fatalf("cannot build ztoc from TOC: %v", err)
+				}
+				expected, err := buildZtocByDecompression(sr, 65536, f.compressionAlgo, &cfg)
+				if err != nil {
+					t.Fatalf("cannot build ztoc by decompression: %v", err)
+				}
+				if ztoc.UncompressedFileSize != expected.UncompressedFileSize {
+					t.Fatalf("unexpected uncompressed size; expected = %d, got = %d", expected.UncompressedFileSize, ztoc.UncompressedFileSize)
+				}
+				if len(ztoc.Metadata) != len(expected.Metadata) {
+					t.Fatalf("unexpected number of files; expected = %d, got = %d", len(expected.Metadata), len(ztoc.Metadata))
+				}
+				for i, m := range ztoc.Metadata {
+					want := expected.Metadata[i]
+					// the spans depend on the checkpoints
+					m.SpanStart, m.SpanEnd, m.FirstSpanHasBits = want.SpanStart, want.SpanEnd, want.FirstSpanHasBits
+					if !reflect.DeepEqual(m, want) {
+						t.Fatalf("unexpected metadata of %s; expected = %+v, got = %+v", want.Name, want, m)
+					}
+				}
+				if ztoc.MaxSpanId < 3 {
+					t.Fatalf("expected the chunks of the large file to start spans, got %d spans", ztoc.MaxSpanId+1)
+				}
+
+				discrepancies, err := VerifyZtoc(ztoc, sr)
+				if err != nil {
+					t.Fatalf("cannot verify ztoc: %v", err)
+				}
+				if len(discrepancies) != 0 {
+					t.Fatalf("unexpected discrepancies: %v", discrepancies)
+				}
+
+				for _, m := range ztoc.Metadata {
+					want, ok := contents[m.Name]
+					if !ok || m.Type != "reg" {
+						continue
+					}
+					if m.Digest != digest.FromString(want) {
+						t.Fatalf("unexpected digest of %s; expected = %v, got = %v", m.Name, digest.FromString(want), m.Digest)
+					}
+					extracted, err := ExtractFile(sr, &FileExtractConfig{
+						UncompressedSize:     m.UncompressedSize,
+						UncompressedOffset:   m.UncompressedOffset,
+						SpanStart:            m.SpanStart,
+						SpanEnd:              m.SpanEnd,
+						FirstSpanHasBits:     m.FirstSpanHasBits,
+						IndexByteData:        ztoc.IndexByteData,
+						CompressedFileSize:   ztoc.CompressedFileSize,
+						MaxSpanId:            ztoc.MaxSpanId,
+						CompressionAlgorithm: ztoc.CompressionAlgorithm,
+					})
+					if err != nil {
+						t.Fatalf("cannot extract %s: %v", m.Name, err)
+					}
+					if string(extracted) != want {
+						t.Fatalf("unexpected contents of %s", m.Name)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestBuildZtocFromTOCNoTOC(t *testing.T) {
+	ents := []testutil.TarEntry{
+		testutil.File("file", string(genRandomByteData(1000))),
+	}
+	testCases := []struct {
+		name            string
+		compressionAlgo string
+		layer           io.Reader
+	}{
+		{
+			name:            "gzip",
+			compressionAlgo: CompressionGzip,
+			layer:           testutil.BuildTarGz(ents, gzip.DefaultCompression),
+		},
+		{
+			name:            "zstd",
+			compressionAlgo: CompressionZstd,
+			layer:           testutil.BuildTarZstd(ents, 0),
+		},
+		{
+			name:            "uncompressed",
+			compressionAlgo: CompressionUncompressed,
+			layer:           testutil.BuildTar(ents),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			layer, err := io.ReadAll(tc.layer)
+			if err != nil {
+				t.Fatalf("cannot read layer: %v", err)
+			}
+			sr := io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer)))
+			if _, err := buildZtocFromTOC(sr, 65536, tc.compressionAlgo, &buildConfig{}); !errors.Is(err, errNoTOC) {
+				t.Fatalf("expected errNoTOC, got %v", err)
+			}
+			// the ztoc is still built by decompressing the layer
+			if _, err := BuildZtoc(sr, 65536, tc.compressionAlgo, &buildConfig{}); err != nil {
+				t.Fatalf("cannot build ztoc: %v", err)
+			}
+		})
+	}
+}
+
+// TestBuildZtocFromTOCFallback checks that the ztoc of an eStargz layer whose tar headers
+// can't be derived from the TOC, here because the TOC rounds the modification time which
+// the PAX header records exactly, is built by decompressing the layer.
+func TestBuildZtocFromTOCFallback(t *testing.T) {
+	modTime := time.Date(2023, 3, 4, 5, 6, 7, 500, time.UTC)
+	ents := []testutil.TarEntry{
+		testutil.File("file", string(genRandomByteData(1000))),
+		testutil.File("pax", string(genRandomByteData(1000)), testutil.WithFileModTime(modTime), testutil.WithFileFormat(tar.FormatPAX)),
+	}
+	r, err := testutil.BuildEStargz(ents, 65536)
+	if err != nil {
+		t.Fatalf("cannot build layer: %v", err)
+	}
+	layer, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("cannot read layer: %v", err)
+	}
+	sr := io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer)))
+	if _, err := buildZtocFromTOC(sr, 65536, CompressionGzip, &buildConfig{}); !errors.Is(err, errNoTOC) {
+		t.Fatalf("expected errNoTOC, got %v", err)
+	}
+	ztoc, err := BuildZtoc(sr, 65536, CompressionGzip, &buildConfig{})
+	if err != nil {
+		t.Fatalf("cannot build ztoc: %v", err)
+	}
+	discrepancies, err := VerifyZtoc(ztoc, sr)
+	if err != nil {
+		t.Fatalf("cannot verify ztoc: %v", err)
+	}
+	if len(discrepancies) != 0 {
+		t.Fatalf("unexpected discrepancies: %v", discrepancies)
+	}
+}
@@ -0,0 +1,124 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	// CompressionGzip is the compression algorithm of gzip-compressed layers
+	CompressionGzip = "gzip"
+	// CompressionZstd is the compression algorithm of zstd-compressed layers
+	CompressionZstd = "zstd"
+	// CompressionUncompressed is the compression algorithm of uncompressed layers
+	CompressionUncompressed = "uncompressed"
+)
+
+// Zinfo is the interface for dealing with a compressed layer as a list of
+// independently decompressible spans. Each implementation knows how to find
+// the span boundaries (checkpoints) of one compression algorithm and how to
+// decompress the data of a span without reading the preceding spans.
+//
+// Compressed offsets describe half-open ranges, i.e. the compressed data of
+// a span is [StartCompressedOffset, EndCompressedOffset).
+type Zinfo interface {
+	// ExtractDataFromBuffer extracts the uncompressed data at uncompressedOffset
+	// from compressedBuf. compressedBuf must contain the compressed data of one or
+	// more consecutive spans, starting at StartCompressedOffset(spanID).
+	ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanID SpanId) ([]byte, error)
+	// ExtractDataFromFile extracts the uncompressed data at uncompressedOffset from a compressed file.
+	ExtractDataFromFile(fileName string, uncompressedSize, uncompressedOffset FileSize) ([]byte, error)
+	// Bytes returns the serialized Zinfo, as stored in `Ztoc.IndexByteData`.
+	Bytes() ([]byte, error)
+	// MaxSpanID returns the id of the last span.
+	MaxSpanID() SpanId
+	// SpanSize returns the span size the Zinfo was built with.
+	SpanSize() FileSize
+	// StartCompressedOffset returns the offset of the first compressed byte needed to decompress the span.
+	StartCompressedOffset(spanID SpanId) FileSize
+	// EndCompressedOffset returns the offset right after the last compressed byte of the span.
+	// fileSize is the size of the compressed file, which is the end of the last span.
+	EndCompressedOffset(spanID SpanId, fileSize FileSize) FileSize
+	// StartUncompressedOffset returns the uncompressed offset where the span starts.
+	StartUncompressedOffset(spanID SpanId) FileSize
+	// EndUncompressedOffset returns the uncompressed offset where the span ends.
+	// fileSize is the size of the uncompressed data, which is the end of the last span.
+	EndUncompressedOffset(spanID SpanId, fileSize FileSize) FileSize
+	// UncompressedOffsetToSpanID returns the id of the span containing the uncompressed offset.
+	UncompressedOffsetToSpanID(offset FileSize) SpanId
+	// HasBits reports whether the span starts in the middle of a compressed byte.
+	// If so, StartCompressedOffset includes that partial byte.
+	HasBits(spanID SpanId) bool
+	// Close releases the resources held by the Zinfo.
+	Close()
+}
+
+// NewZinfo deserializes the Zinfo of a ztoc built for the given compression algorithm.
+// An empty compression algorithm is treated as gzip, since ztocs built before
+// zstd support was added do not record the algorithm.
+func NewZinfo(compressionAlgo string, indexByteData []byte) (Zinfo, error) {
+	switch compressionAlgo {
+	case CompressionGzip, "":
+		return newGzipZinfo(indexByteData)
+	case CompressionZstd:
+		return newZstdZinfo(indexByteData)
+	case CompressionUncompressed:
+		return newTarZinfo(indexByteData)
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", compressionAlgo)
+	}
+}
+
+// NewZinfoFromZtoc deserializes the Zinfo stored in the ztoc.
+func NewZinfoFromZtoc(ztoc *Ztoc) (Zinfo, error) {
+	return NewZinfo(ztoc.CompressionAlgorithm, ztoc.IndexByteData)
+}
+
+// zinfoBuilder builds a Zinfo in a single pass over a compressed layer.
+// Reading from a zinfoBuilder returns the uncompressed data of the layer,
+// while the compressed data is read from the underlying reader as needed.
+type zinfoBuilder interface {
+	io.Reader
+	// Zinfo returns the Zinfo of the layer. It must only be called once
+	// Read returned io.EOF.
+	Zinfo() (Zinfo, error)
+	// Close releases the resources held by the builder.
+	Close()
+}
+
+// newZinfoBuilder returns a zinfoBuilder reading the compressed data from r, which must
+// start at the beginning of the layer. The compressed data is written to spans as it is
+// consumed, and the spans are started as their checkpoints are found. If placer is nil,
+// spans start every span bytes; otherwise placer chooses the checkpoints where spans start,
+// except for uncompressed layers whose spans are always fixed.
+func newZinfoBuilder(compressionAlgo string, r io.Reader, span int64, spans *spanDigester, placer spanPlacer) (zinfoBuilder, error) {
+	if span <= 0 {
+		return nil, fmt.Errorf("invalid span size %d", span)
+	}
+	switch compressionAlgo {
+	case CompressionGzip:
+		return newGzipZinfoBuilder(r, span, spans, placer)
+	case CompressionZstd:
+		return newZstdZinfoBuilder(r, span, spans, placer)
+	case CompressionUncompressed:
+		return newTarZinfoBuilder(r, span, spans)
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %q", compressionAlgo)
+	}
+}
@@ -0,0 +1,433 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	zstdFrameMagic             = 0xFD2FB528
+	zstdSkippableFrameMagic    = 0x184D2A50
+	zstdSkippableFrameMagicMax = 0x184D2A5F
+	zstdBlockHeaderSize        = 3
+	zstdChecksumSize           = 4
+
+	// size of the serialized zstdZinfo header: number of checkpoints (4 bytes) and span size (8 bytes)
+	zstdZinfoHeaderSize = 12
+	// size of a serialized checkpoint: compressed offset (8 bytes) and uncompressed offset (8 bytes)
+	zstdCheckpointSize = 16
+)
+
+var errInvalidZstdFrame = errors.New("invalid zstd frame")
+
+// zstdCheckpoint is the start of a zstd frame from which decompression can begin.
+type zstdCheckpoint struct {
+	in  FileSize // offset of the frame in the compressed file
+	out FileSize // corresponding offset in the uncompressed data
+}
+
+// zstdZinfo is the Zinfo of a zstd-compressed layer.
+//
+// zstd frames are independent of each other, so every frame boundary is a
+// valid checkpoint and no decompression window needs to be stored. A span
+// starts at the first frame starting at least span bytes (uncompressed) after
+// the start of the previous span, unless the ztoc was built with another
+// SpanPlacement. Layers compressed as a single frame produce a
+// single span; layers in the seekable zstd format (or any other multi-frame
+// layout) get one checkpoint every few frames.
+type zstdZinfo struct {
+	checkpoints []zstdCheckpoint
+	spanSize    FileSize
+}
+
+// newZstdZinfo deserializes a zstdZinfo. The buffer is tightly packed and little endian:
+// the number of checkpoints (4 bytes) and the span size (8 bytes), followed by
+// the compressed offset (8 bytes) and uncompressed offset (8 bytes) of each checkpoint.
+func newZstdZinfo(indexByteData []byte) (*zstdZinfo, error) {
+	if len(indexByteData) < zstdZinfoHeaderSize {
+		return nil, fmt.Errorf("zstd checkpoints are too short: %d bytes", len(indexByteData))
+	}
+	numCheckpoints := binary.LittleEndian.Uint32(indexByteData[0:4])
+	spanSize := FileSize(binary.LittleEndian.Uint64(indexByteData[4:12]))
+	if numCheckpoints == 0 || uint64(len(indexByteData)) != zstdZinfoHeaderSize+uint64(numCheckpoints)*zstdCheckpointSize {
+		return nil, fmt.Errorf("invalid zstd checkpoints; checkpoints = %d, size = %d", numCheckpoints, len(indexByteData))
+	}
+
+	checkpoints := make([]zstdCheckpoint, numCheckpoints)
+	cur := indexByteData[zstdZinfoHeaderSize:]
+	for i := range checkpoints {
+		checkpoints[i].in = FileSize(binary.LittleEndian.Uint64(cur[0:8]))
+		checkpoints[i].out = FileSize(binary.LittleEndian.Uint64(cur[8:16]))
+		cur = cur[zstdCheckpointSize:]
+	}
+	return &zstdZinfo{
+		checkpoints: checkpoints,
+		spanSize:    spanSize,
+	}, nil
+}
+
+// newZstdZinfoFromCheckpoints returns the zstdZinfo of a layer whose checkpoints are known
+// without decompressing it.
+func newZstdZinfoFromCheckpoints(checkpoints []tocCheckpoint, span FileSize) *zstdZinfo {
+	zinfo := &zstdZinfo{spanSize: span}
+	for _, c := range checkpoints {
+		zinfo.checkpoints = append(zinfo.checkpoints, zstdCheckpoint{in: c.in, out: c.out})
+	}
+	return zinfo
+}
+
+// zstdZinfoBuilder builds a zstdZinfo. It decompresses the layer frame by frame
+// and places a checkpoint at the start of a frame whenever at least span bytes
+// have been decompressed since the previous checkpoint.
+type zstdZinfoBuilder struct {
+	r           *bufio.Reader
+	spans       *spanDigester
+	spanSize    FileSize
+	placer      spanPlacer // nil to start spans every spanSize bytes
+	dec         *zstd.Decoder
+	frame       *zstdFrameReader // nil between frames
+	checkpoints []zstdCheckpoint
+	in          FileSize // offset of the current frame in the compressed data
+	out         FileSize // uncompressed bytes produced so far
+}
+
+func newZstdZinfoBuilder(r io.Reader, span int64, spans *spanDigester, placer spanPlacer) (*zstdZinfoBuilder, error) {
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create zstd reader: %w", err)
+	}
+	if err := spans.startSpan(0); err != nil {
+		dec.Close()
+		return nil, err
+	}
+	return &zstdZinfoBuilder{
+		r:           bufio.NewReader(r),
+		spans:       spans,
+		spanSize:    FileSize(span),
+		placer:      placer,
+		dec:         dec,
+		checkpoints: []zstdCheckpoint{{in: 0, out: 0}},
+	}, nil
+}
+
+func (b *zstdZinfoBuilder) Read(p []byte) (int, error) {
+	for {
+		if b.frame == nil {
+			ok, err := b.nextFrame()
+			if err != nil {
+				return 0, err
+			}
+			if !ok {
+				return 0, io.EOF
+			}
+		}
+		n, err := b.dec.Read(p)
+		b.out += FileSize(n)
+		if err == io.EOF {
+			if !b.frame.done() {
+				return n, fmt.Errorf("zstd frame at offset %d was not fully decompressed: %w", b.in, errInvalidZstdFrame)
+			}
+			b.in += b.frame.read
+			b.frame = nil
+			err = nil
+		}
+		if err != nil {
+			return n, fmt.Errorf("cannot decompress zstd frame at offset %d: %w", b.in, err)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// nextFrame starts decompressing the next frame, skipping skippable frames.
+// It returns false at the end of the compressed data.
+func (b *zstdZinfoBuilder) nextFrame() (bool, error) {
+	for {
+		// magic number (4 bytes) followed by either the frame header descriptor or
+		// the size of a skippable frame (4 bytes)
+		hdr, err := b.r.Peek(8)
+		if len(hdr) == 0 && err == io.EOF {
+			return false, nil
+		}
+		if len(hdr) < 8 {
+			return false, fmt.Errorf("cannot read zstd frame at offset %d: %w", b.in, io.ErrUnexpectedEOF)
+		}
+		magic := binary.LittleEndian.Uint32(hdr[0:4])
+		if magic >= zstdSkippableFrameMagic && magic <= zstdSkippableFrameMagicMax {
+			size := 8 + int64(binary.LittleEndian.Uint32(hdr[4:8]))
+			n, err := io.CopyN(b.spans, b.r, size)
+			b.in += FileSize(n)
+			if err != nil {
+				return false, fmt.Errorf("cannot read skippable zstd frame at offset %d: %w", b.in, err)
+			}
+			continue
+		}
+		if magic != zstdFrameMagic {
+			return false, fmt.Errorf("cannot read zstd frame at offset %d: unexpected magic number %#x: %w", b.in, magic, errInvalidZstdFrame)
+		}
+
+		if b.in != 0 && b.startSpan() {
+			b.checkpoints = append(b.checkpoints, zstdCheckpoint{in: b.in, out: b.out})
+			if err := b.spans.startSpan(b.in); err != nil {
+				return false, err
+			}
+		}
+		b.frame = &zstdFrameReader{
+			r:         b.r,
+			w:         b.spans,
+			remaining: zstdFrameHeaderSize(hdr[4]),
+			checksum:  hdr[4]&(1<<2) != 0,
+		}
+		if err := b.dec.Reset(b.frame); err != nil {
+			return false, fmt.Errorf("cannot reset zstd reader: %w", err)
+		}
+		return true, nil
+	}
+}
+
+// startSpan reports whether a span starts at the current frame.
+func (b *zstdZinfoBuilder) startSpan() bool {
+	last := b.checkpoints[len(b.checkpoints)-1].out
+	if b.placer != nil {
+		return b.placer.startSpan(b.out, last)
+	}
+	return b.out-last >= b.spanSize
+}
+
+func (b *zstdZinfoBuilder) Zinfo() (Zinfo, error) {
+	return &zstdZinfo{
+		checkpoints: b.checkpoints,
+		spanSize:    b.spanSize,
+	}, nil
+}
+
+func (b *zstdZinfoBuilder) Close() {
+	b.dec.Close()
+}
+
+// zstdFrameReader reads a single zstd frame, as described in RFC 8878, and returns
+// io.EOF at its end. The data read is also written to w.
+type zstdFrameReader struct {
+	r *bufio.Reader
+	w io.Writer
+	// number of bytes which can be read before the next block header
+	remaining FileSize
+	read      FileSize
+	last      bool // whether the header of the last block has been read
+	checksum  bool
+}
+
+// zstdFrameHeaderSize returns the size of the header of a frame, including its magic number,
+// given its frame header descriptor.
+func zstdFrameHeaderSize(descriptor byte) FileSize {
+	fcsFlag := descriptor >> 6
+	singleSegment := descriptor&(1<<5) != 0
+	dictIDFlag := descriptor & 3
+
+	size := FileSize(5)
+	if !singleSegment {
+		size++ // window descriptor
+	}
+	size += [4]FileSize{0, 1, 2, 4}[dictIDFlag]
+	switch fcsFlag {
+	case 0:
+		if singleSegment {
+			size++
+		}
+	case 1:
+		size += 2
+	case 2:
+		size += 4
+	case 3:
+		size += 8
+	}
+	return size
+}
+
+func (f *zstdFrameReader) Read(p []byte) (int, error) {
+	if f.remaining == 0 {
+		if f.last {
+			return 0, io.EOF
+		}
+		blockHdr, err := f.r.Peek(zstdBlockHeaderSize)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		bh := uint32(blockHdr[0]) | uint32(blockHdr[1])<<8 | uint32(blockHdr[2])<<16
+		f.last = bh&1 != 0
+		blockType := (bh >> 1) & 3
+		blockSize := FileSize(bh >> 3)
+		f.remaining = zstdBlockHeaderSize
+		switch blockType {
+		case 0, 2: // raw and compressed blocks
+			f.remaining += blockSize
+		case 1: // RLE block
+			f.remaining++
+		default:
+			return 0, fmt.Errorf("reserved block type: %w", errInvalidZstdFrame)
+		}
+		if f.last && f.checksum {
+			f.remaining += zstdChecksumSize
+		}
+	}
+
+	if FileSize(len(p)) > f.remaining {
+		p = p[:f.remaining]
+	}
+	n, err := f.r.Read(p)
+	if _, werr := f.w.Write(p[:n]); werr != nil {
+		return 0, werr
+	}
+	f.remaining -= FileSize(n)
+	f.read += FileSize(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// done reports whether the whole frame has been read.
+func (f *zstdFrameReader) done() bool {
+	return f.last && f.remaining == 0
+}
+
+func (i *zstdZinfo) Close() {}
+
+func (i *zstdZinfo) Bytes() ([]byte, error) {
+	buf := make([]byte, zstdZinfoHeaderSize+len(i.checkpoints)*zstdCheckpointSize)
+	binary.LittleEndian.PutUint32(buf[0:4], uint32(len(i.checkpoints)))
+	binary.LittleEndian.PutUint64(buf[4:12], uint64(i.spanSize))
+	cur := buf[zstdZinfoHeaderSize:]
+	for _, c := range i.checkpoints {
+		binary.LittleEndian.PutUint64(cur[0:8], uint64(c.in))
+		binary.LittleEndian.PutUint64(cur[8:16], uint64(c.out))
+		cur = cur[zstdCheckpointSize:]
+	}
+	return buf, nil
+}
+
+func (i *zstdZinfo) MaxSpanID() SpanId {
+	return SpanId(len(i.checkpoints) - 1)
+}
+
+func (i *zstdZinfo) SpanSize() FileSize {
+	return i.spanSize
+}
+
+func (i *zstdZinfo) ExtractDataFromBuffer(compressedBuf []byte, uncompressedSize, uncompressedOffset FileSize, spanID SpanId) ([]byte, error) {
+	return i.extract(bytes.NewReader(compressedBuf), uncompressedSize, uncompressedOffset, spanID)
+}
+
+func (i *zstdZinfo) ExtractDataFromFile(fileName string, uncompressedSize, uncompressedOffset FileSize) ([]byte, error) {
+	if uncompressedSize == 0 {
+		return []byte{}, nil
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("could not open file for reading: %w", err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	spanID := i.UncompressedOffsetToSpanID(uncompressedOffset)
+	start := int64(i.StartCompressedOffset(spanID))
+	return i.extract(io.NewSectionReader(f, start, st.Size()-start), uncompressedSize, uncompressedOffset, spanID)
+}
+
+// extract decompresses r, which must start at the checkpoint of spanID, and
+// returns the uncompressedSize bytes at uncompressedOffset.
+func (i *zstdZinfo) extract(r io.Reader, uncompressedSize, uncompressedOffset FileSize, spanID SpanId) ([]byte, error) {
+	bytes := make([]byte, uncompressedSize)
+	if uncompressedSize == 0 {
+		return bytes, nil
+	}
+	if spanID < 0 || spanID > i.MaxSpanID() {
+		return bytes, fmt.Errorf("invalid span id %d; max span id = %d", spanID, i.MaxSpanID())
+	}
+	skip := uncompressedOffset - i.checkpoints[spanID].out
+	if skip < 0 {
+		return bytes, fmt.Errorf("uncompressed offset %d is before the start of span %d", uncompressedOffset, spanID)
+	}
+
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return bytes, fmt.Errorf("cannot create zstd reader: %w", err)
+	}
+	defer dec.Close()
+
+	if _, err := io.CopyN(io.Discard, dec, int64(skip)); err != nil {
+		return bytes, fmt.Errorf("error extracting data; cannot skip to offset %d: %w", uncompressedOffset, err)
+	}
+	if _, err := io.ReadFull(dec, bytes); err != nil {
+		return bytes, fmt.Errorf("error extracting data: %w", err)
+	}
+	return bytes, nil
+}
+
+func (i *zstdZinfo) StartCompressedOffset(spanID SpanId) FileSize {
+	return i.checkpoints[spanID].in
+}
+
+func (i *zstdZinfo) EndCompressedOffset(spanID SpanId, fileSize FileSize) FileSize {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].in
+}
+
+func (i *zstdZinfo) StartUncompressedOffset(spanID SpanId) FileSize {
+	return i.checkpoints[spanID].out
+}
+
+func (i *zstdZinfo) EndUncompressedOffset(spanID SpanId, fileSize FileSize) FileSize {
+	if spanID == i.MaxSpanID() {
+		return fileSize
+	}
+	return i.checkpoints[spanID+1].out
+}
+
+func (i *zstdZinfo) UncompressedOffsetToSpanID(offset FileSize) SpanId {
+	// index of the first checkpoint after offset; the span containing offset is the one before it
+	idx := sort.Search(len(i.checkpoints), func(j int) bool {
+		return i.checkpoints[j].out > offset
+	})
+	if idx == 0 {
+		return 0
+	}
+	return SpanId(idx - 1)
+}
+
+func (i *zstdZinfo) HasBits(spanID SpanId) bool {
+	return false
+}
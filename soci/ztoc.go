@@ -16,17 +16,11 @@
 
 package soci
 
-// #include "indexer.h"
-// #include <stdlib.h>
-// #include <stdio.h>
-import "C"
-
 import (
 	"context"
 	"fmt"
 	"io"
 	"time"
-	"unsafe"
 
 	"github.com/opencontainers/go-digest"
 	"golang.org/x/sync/errgroup"
@@ -58,11 +52,40 @@ type FileMetadata struct {
 	Devminor int64     // Minor device number (valid for TypeChar or TypeBlock)
 
 	Xattrs map[string]string
+
+	// Digest is the digest of the contents of a regular file. It's only recorded
+	// if the ztoc was built with file digests, and is empty otherwise.
+	Digest digest.Digest
+
+	// SparseMap lists the data fragments of a sparse file in order, and is empty for
+	// other files. The data of a sparse file in the layer, at UncompressedOffset, is the
+	// concatenation of its fragments, and UncompressedSize is the size of that data.
+	// The rest of the file is holes. The last fragment ends at the end of the file, and
+	// is empty if the file ends with a hole.
+	SparseMap []SparseEntry
+}
+
+// SparseEntry is a fragment of data of a sparse file, of Size bytes at Offset in the file.
+type SparseEntry struct {
+	Offset FileSize
+	Size   FileSize
+}
+
+// Size returns the size of the file, which is larger than the size of its data in the
+// layer if it's a sparse file.
+func (m *FileMetadata) Size() FileSize {
+	if len(m.SparseMap) == 0 {
+		return m.UncompressedSize
+	}
+	last := m.SparseMap[len(m.SparseMap)-1]
+	return last.Offset + last.Size
 }
 
 type Ztoc struct {
-	Version             string
-	BuildToolIdentifier string
+	Version              string
+	BuildToolIdentifier  string
+	CompressionAlgorithm string // Compression algorithm of the layer; empty for gzip layers in ztocs built before zstd was supported
+	SpanPlacement        string // Placement of the spans; empty for fixed spans
 
 	Metadata []FileMetadata
 
@@ -78,14 +101,15 @@ type ztocInfo struct {
 }
 
 type FileExtractConfig struct {
-	UncompressedSize   FileSize
-	UncompressedOffset FileSize
-	SpanStart          SpanId
-	SpanEnd            SpanId
-	FirstSpanHasBits   bool
-	IndexByteData      []byte
-	CompressedFileSize FileSize
-	MaxSpanId          SpanId
+	UncompressedSize     FileSize
+	UncompressedOffset   FileSize
+	SpanStart            SpanId
+	SpanEnd              SpanId
+	FirstSpanHasBits     bool
+	IndexByteData        []byte
+	CompressedFileSize   FileSize
+	MaxSpanId            SpanId
+	CompressionAlgorithm string
 }
 
 type MetadataEntry struct {
@@ -94,6 +118,7 @@ type MetadataEntry struct {
 	SpanStart          SpanId
 	SpanEnd            SpanId
 	FirstSpanHasBits   bool
+	SparseMap          []SparseEntry
 }
 
 func ExtractFile(r *io.SectionReader, config *FileExtractConfig) ([]byte, error) {
@@ -102,53 +127,54 @@ func ExtractFile(r *io.SectionReader, config *FileExtractConfig) ([]byte, error)
 		return bytes, nil
 	}
 
-	numSpans := config.SpanEnd - config.SpanStart + 1
-
-	index := C.blob_to_index(unsafe.Pointer(&config.IndexByteData[0]))
+	// The file contents of an uncompressed layer are at the same offsets in the layer,
+	// so they can be read directly.
+	if config.CompressionAlgorithm == CompressionUncompressed {
+		n, err := r.ReadAt(bytes, int64(config.UncompressedOffset))
+		if err != nil && err != io.EOF {
+			return bytes, err
+		}
+		if FileSize(n) != config.UncompressedSize {
+			return bytes, fmt.Errorf("unexpected data size. read = %d, expected = %d", n, config.UncompressedSize)
+		}
+		return bytes, nil
+	}
 
-	if index == nil {
-		return bytes, fmt.Errorf("cannot convert blob to gzip_index")
+	zinfo, err := NewZinfo(config.CompressionAlgorithm, config.IndexByteData)
+	if err != nil {
+		return bytes, err
 	}
-	defer C.free_index(index)
-	var bufSize FileSize
+	defer zinfo.Close()
+
+	numSpans := config.SpanEnd - config.SpanStart + 1
 	starts := make([]FileSize, numSpans)
 	ends := make([]FileSize, numSpans)
 
 	var i SpanId
 	for i = 0; i < numSpans; i++ {
-		starts[i] = FileSize(C.get_comp_off(index, C.int(i+config.SpanStart)))
-		if i+config.SpanStart == config.MaxSpanId {
-			ends[i] = config.CompressedFileSize - 1
+		if i == 0 {
+			starts[i] = zinfo.StartCompressedOffset(config.SpanStart)
 		} else {
-			ends[i] = FileSize(C.get_comp_off(index, C.int(i+1+config.SpanStart)))
+			starts[i] = ends[i-1]
 		}
-		bufSize += (ends[i] - starts[i] + 1)
+		ends[i] = zinfo.EndCompressedOffset(i+config.SpanStart, config.CompressedFileSize)
 	}
 
 	start := starts[0]
+	buf := make([]byte, ends[numSpans-1]-start)
 	// Fetch all span data in parallel
-	if config.FirstSpanHasBits {
-		bufSize += 1
-		start -= 1
-	}
-
-	buf := make([]byte, bufSize)
 	eg, _ := errgroup.WithContext(context.Background())
-
 	for i = 0; i < numSpans; i++ {
 		j := i
 		eg.Go(func() error {
 			rangeStart := starts[j]
 			rangeEnd := ends[j]
-			if j == 0 && config.FirstSpanHasBits {
-				rangeStart -= 1
-			}
-			n, err := r.ReadAt(buf[rangeStart-start:rangeEnd-start+1], int64(rangeStart)) // need to convert rangeStart to int64 to use in ReadAt
-			if err != nil {
+			n, err := r.ReadAt(buf[rangeStart-start:rangeEnd-start], int64(rangeStart)) // need to convert rangeStart to int64 to use in ReadAt
+			if err != nil && err != io.EOF {
 				return err
 			}
 
-			bytesToFetch := rangeEnd - rangeStart + 1
+			bytesToFetch := rangeEnd - rangeStart
 			if n != int(bytesToFetch) {
 				return fmt.Errorf("unexpected data size. read = %d, expected = %d", n, bytesToFetch)
 			}
@@ -159,12 +185,7 @@ func ExtractFile(r *io.SectionReader, config *FileExtractConfig) ([]byte, error)
 		return bytes, err
 	}
 
-	ret := C.extract_data_from_buffer(unsafe.Pointer(&buf[0]), C.off_t(len(buf)), index, C.off_t(config.UncompressedOffset), unsafe.Pointer(&bytes[0]), C.off_t(config.UncompressedSize), C.int(config.SpanStart))
-	if ret <= 0 {
-		return bytes, fmt.Errorf("error extracting data; return code: %v", ret)
-	}
-
-	return bytes, nil
+	return zinfo.ExtractDataFromBuffer(buf, config.UncompressedSize, config.UncompressedOffset, config.SpanStart)
 }
 
 func GetMetadataEntry(ztoc *Ztoc, text string) (*MetadataEntry, error) {
@@ -179,6 +200,7 @@ func GetMetadataEntry(ztoc *Ztoc, text string) (*MetadataEntry, error) {
 				SpanStart:          v.SpanStart,
 				SpanEnd:            v.SpanEnd,
 				FirstSpanHasBits:   v.FirstSpanHasBits,
+				SparseMap:          v.SparseMap,
 			}, nil
 		}
 	}
@@ -192,26 +214,24 @@ func ExtractFromTarGz(gz string, ztoc *Ztoc, text string) (string, error) {
 		return "", err
 	}
 
-	if entry.UncompressedSize == 0 {
-		return "", nil
-	}
-
-	cstr := C.CString(gz)
-	defer C.free(unsafe.Pointer(cstr))
-
-	index := C.blob_to_index(unsafe.Pointer(&ztoc.IndexByteData[0]))
+	var bytes []byte
+	if entry.UncompressedSize != 0 {
+		zinfo, err := NewZinfoFromZtoc(ztoc)
+		if err != nil {
+			return "", err
+		}
+		defer zinfo.Close()
 
-	if index == nil {
-		return "", fmt.Errorf("cannot convert blob to gzip_index")
+		bytes, err = zinfo.ExtractDataFromFile(gz, entry.UncompressedSize, entry.UncompressedOffset)
+		if err != nil {
+			return "", err
+		}
 	}
-
-	defer C.free_index(index)
-
-	bytes := make([]byte, entry.UncompressedSize)
-	ret := C.extract_data(cstr, index, C.off_t(entry.UncompressedOffset), unsafe.Pointer(&bytes[0]), C.int(entry.UncompressedSize))
-
-	if ret <= 0 {
-		return "", fmt.Errorf("unable to extract data; return code = %v", ret)
+	if len(entry.SparseMap) > 0 {
+		bytes, err = ExpandSparse(bytes, entry.SparseMap)
+		if err != nil {
+			return "", err
+		}
 	}
 
 	return string(bytes), nil
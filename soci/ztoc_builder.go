@@ -16,220 +16,232 @@
 
 package soci
 
-// #cgo CFLAGS: -I${SRCDIR}/../c/
-// #cgo LDFLAGS: -L${SRCDIR}/../out -lindexer -lz
-// #include "indexer.h"
-// #include <stdlib.h>
-// #include <stdint.h>
-import "C"
-
 import (
 	"archive/tar"
 	"bytes"
-	"compress/gzip"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
-	"os"
-	"unsafe"
 
 	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
-func BuildZtoc(gzipFile string, span int64, cfg *buildConfig) (*Ztoc, error) {
-	if gzipFile == "" {
-		return nil, fmt.Errorf("need to provide gzip file")
+// BuildZtoc builds the ztoc of a compressed tar. compressionAlgo is the
+// compression algorithm of the tar, i.e. `CompressionGzip`, `CompressionZstd`
+// or `CompressionUncompressed`.
+//
+// The ztoc of an eStargz or zstd:chunked layer is derived from the table of contents
+// in the layer, which only takes reading the compressed data once, see buildZtocFromTOC.
+// Other layers, or layers whose table of contents doesn't match the layer, are decompressed.
+func BuildZtoc(sr *io.SectionReader, span int64, compressionAlgo string, cfg *buildConfig) (*Ztoc, error) {
+	if sr == nil {
+		return nil, fmt.Errorf("need to provide a compressed file")
+	}
+	ztoc, err := buildZtocFromTOC(sr, span, compressionAlgo, cfg)
+	if !errors.Is(err, errNoTOC) {
+		return ztoc, err
 	}
+	return buildZtocByDecompression(sr, span, compressionAlgo, cfg)
+}
 
-	index, indexData, err := getGzipIndexByteData(gzipFile, span)
+// buildZtocByDecompression builds the ztoc of a compressed tar by decompressing it.
+//
+// The ztoc is built in a single pass over sr: the checkpoints, the file metadata
+// and the span digests are all computed while the compressed data is streamed.
+// Placing the spans at file boundaries takes an additional pass to find the files.
+func buildZtocByDecompression(sr *io.SectionReader, span int64, compressionAlgo string, cfg *buildConfig) (*Ztoc, error) {
+	var placer spanPlacer
+	spanPlacement := recordedSpanPlacement(cfg, compressionAlgo)
+	if spanPlacement == string(SpanPlacementFileBoundary) {
+		p, err := newFileBoundaryPlacer(sr, compressionAlgo, span)
+		if err != nil {
+			return nil, err
+		}
+		placer = p
+	}
+
+	spans := &spanDigester{}
+	// read through a new section reader so that the offset of sr is left unchanged
+	builder, err := newZinfoBuilder(compressionAlgo, io.NewSectionReader(sr, 0, sr.Size()), span, spans, placer)
 	if err != nil {
 		return nil, err
 	}
-	defer C.free(unsafe.Pointer(index))
+	defer builder.Close()
 
-	fm, uncompressedFileSize, err := getGzipFileMetadata(gzipFile, index)
+	pt := &positionTrackerReader{r: builder}
+	fm, err := getFileMetadata(pt, cfg.fileDigests)
 	if err != nil {
 		return nil, err
 	}
+	// read the rest of the layer, e.g. the padding after the end of the tar
+	if _, err := io.Copy(io.Discard, pt); err != nil {
+		return nil, err
+	}
 
-	fs, err := getFileSize(gzipFile)
+	zinfo, err := builder.Zinfo()
 	if err != nil {
 		return nil, err
 	}
+	defer zinfo.Close()
+
+	return newZtoc(zinfo, fm, spans.digests(), FileSize(sr.Size()), pt.CurrentPos(), compressionAlgo, spanPlacement, cfg)
+}
 
-	digests, err := getPerSpanDigests(gzipFile, int64(fs), index)
+// newZtoc returns the ztoc of a layer given its zinfo, the metadata of its files,
+// whose spans are filled in, and the digests of its spans.
+func newZtoc(zinfo Zinfo, fm []FileMetadata, digests []digest.Digest, compressedSize, uncompressedSize FileSize,
+	compressionAlgo, spanPlacement string, cfg *buildConfig) (*Ztoc, error) {
+	indexData, err := zinfo.Bytes()
 	if err != nil {
 		return nil, err
 	}
 
+	for i := range fm {
+		start := fm[i].UncompressedOffset
+		end := start + fm[i].UncompressedSize
+		fm[i].SpanStart = zinfo.UncompressedOffsetToSpanID(start)
+		fm[i].SpanEnd = zinfo.UncompressedOffsetToSpanID(end)
+		fm[i].FirstSpanHasBits = zinfo.HasBits(fm[i].SpanStart)
+	}
+
+	if len(digests) != int(zinfo.MaxSpanID())+1 {
+		return nil, fmt.Errorf("unexpected number of span digests; expected %d, got %d", zinfo.MaxSpanID()+1, len(digests))
+	}
+
 	ztocInfo := ztocInfo{
 		SpanDigests: digests,
 	}
 
 	return &Ztoc{
-		Version:              "0.1",
+		Version:              ztocVersion(fm),
 		IndexByteData:        indexData,
 		Metadata:             fm,
-		CompressedFileSize:   fs,
-		UncompressedFileSize: uncompressedFileSize,
-		MaxSpanId:            SpanId(index.have) - 1,
+		CompressedFileSize:   compressedSize,
+		UncompressedFileSize: uncompressedSize,
+		MaxSpanId:            zinfo.MaxSpanID(),
 		BuildToolIdentifier:  cfg.buildToolIdentifier,
+		CompressionAlgorithm: compressionAlgo,
+		SpanPlacement:        spanPlacement,
 		ZtocInfo:             ztocInfo,
 	}, nil
 }
 
-func NewZtocReader(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
-	serializedBuf := new(bytes.Buffer)
-	enc := gob.NewEncoder(serializedBuf)
-	err := enc.Encode(*ztoc)
-	if err != nil {
-		return nil, ocispec.Descriptor{}, fmt.Errorf("cannot serialize ztoc: %w", err)
+// recordedSpanPlacement returns the span placement recorded in the ztocs built with cfg for
+// layers compressed with compressionAlgo, which is empty for fixed spans.
+func recordedSpanPlacement(cfg *buildConfig, compressionAlgo string) string {
+	if cfg.spanPlacement != SpanPlacementFileBoundary || compressionAlgo == CompressionUncompressed {
+		return ""
 	}
+	return string(cfg.spanPlacement)
+}
 
-	compressedBuf := new(bytes.Buffer)
-	zs, err := zstd.NewWriter(compressedBuf)
+// NewZtocReader serializes the ztoc with the current version of the schema in ztoc.proto
+// and returns a reader of the zstd compressed result, along with its descriptor.
+// The result only depends on the ztoc, so the same layer built with the same parameters
+// always gets a ztoc with the same digest.
+func NewZtocReader(ztoc *Ztoc) (io.Reader, ocispec.Descriptor, error) {
+	serialized := marshalZtoc(ztoc)
+
+	// The encoder settings are fixed rather than left to the defaults, which depend on the
+	// number of CPUs, and the ztoc is compressed as a single frame by a single goroutine.
+	zs, err := zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedDefault),
+		zstd.WithEncoderConcurrency(1),
+		zstd.WithEncoderCRC(true))
 	if err != nil {
 		return nil, ocispec.Descriptor{}, fmt.Errorf("cannot create zstd writer: %w", err)
 	}
-
-	if _, err := zs.Write(serializedBuf.Bytes()); err != nil {
-		return nil, ocispec.Descriptor{}, fmt.Errorf("cannot compress ztoc: %w", err)
-	}
-
+	compressedBytes := zs.EncodeAll(serialized, nil)
 	if err := zs.Close(); err != nil {
 		return nil, ocispec.Descriptor{}, err
 	}
 
-	compressedBytes := compressedBuf.Bytes()
-	dgst := digest.FromBytes(compressedBytes)
-	size := len(compressedBytes)
-	return compressedBuf, ocispec.Descriptor{
-		Digest: dgst,
-		Size:   int64(size),
+	return bytes.NewReader(compressedBytes), ocispec.Descriptor{
+		Digest: digest.FromBytes(compressedBytes),
+		Size:   int64(len(compressedBytes)),
 	}, nil
 }
 
-func getPerSpanDigests(gzipFile string, fileSize int64, index *C.struct_gzip_index) ([]digest.Digest, error) {
-	file, err := os.Open(gzipFile)
-	if err != nil {
-		return nil, fmt.Errorf("could not open file for reading: %w", err)
-	}
-	defer file.Close()
-
-	gzipPoints := unsafe.Slice(index.list, index.have)
-	var digests []digest.Digest
-
-	for i := 0; i < len(gzipPoints); i++ {
-		var (
-			startOffset = int64(gzipPoints[i].in)
-			endOffset   int64
-		)
-
-		if gzipPoints[i].bits != 0 {
-			startOffset -= 1
-		}
-
-		if i == len(gzipPoints)-1 {
-			endOffset = fileSize
-		} else {
-			endOffset = int64(gzipPoints[i+1].in)
-		}
-
-		section := io.NewSectionReader(file, startOffset, endOffset-startOffset)
-		dgst, err := digest.FromReader(section)
-		if err != nil {
-			return nil, fmt.Errorf("unable to compute digest for section; start=%d, end=%d, file=%s, size=%d", startOffset, endOffset, gzipFile, fileSize)
-		}
-		digests = append(digests, dgst)
-	}
-	return digests, nil
+// spanDigester computes the digests of the compressed data of the spans while
+// the layer is read. The compressed data is written in order, and each span
+// ends where the next one starts.
+type spanDigester struct {
+	digester digest.Digester // digester of the current span, nil before the first span
+	written  FileSize
+	last     byte // last byte written, which may be shared with the next span
+	spans    []digest.Digest
 }
 
-func getGzipIndexByteData(gzipFile string, span int64) (*C.struct_gzip_index, []byte, error) {
-	cstr := C.CString(gzipFile)
-	defer C.free(unsafe.Pointer(cstr))
-
-	var index *C.struct_gzip_index
-
-	ret := C.generate_index(cstr, C.off_t(span), &index)
-
-	if int(ret) < 0 {
-		return nil, nil, fmt.Errorf("could not generate gzip index. gzip error: %v", ret)
-	}
-
-	blobSize := C.get_blob_size(index)
-	bytes := make([]byte, uint64(blobSize))
-
-	if bytes == nil {
-		return nil, nil, fmt.Errorf("could not allocate byte array of size %d", blobSize)
+func (d *spanDigester) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
 	}
-	ret = C.index_to_blob(index, unsafe.Pointer(&bytes[0]))
-
-	if int(ret) <= 0 {
-		return nil, nil, fmt.Errorf("could not serialize gzip index to byte array; gzip error: %v", ret)
+	if d.digester != nil {
+		d.digester.Hash().Write(p)
 	}
-
-	return index, bytes, nil
+	d.written += FileSize(len(p))
+	d.last = p[len(p)-1]
+	return len(p), nil
 }
 
-func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMetadata, FileSize, error) {
-	file, err := os.Open(gzipFile)
-	if err != nil {
-		return nil, 0, fmt.Errorf("could not open file for reading: %v", err)
+// startSpan ends the current span and starts a new span at compressed offset start,
+// which must either be the offset of the next byte or, for gzip spans starting
+// in the middle of a byte, the offset of the last byte written.
+func (d *spanDigester) startSpan(start FileSize) error {
+	if d.digester != nil {
+		d.spans = append(d.spans, d.digester.Digest())
 	}
-	defer file.Close()
-
-	gzipRdr, err := gzip.NewReader(file)
-	if err != nil {
-		return nil, 0, fmt.Errorf("could not create gzip reader: %v", err)
+	d.digester = digest.Canonical.Digester()
+	switch start {
+	case d.written:
+	case d.written - 1:
+		d.digester.Hash().Write([]byte{d.last})
+	default:
+		return fmt.Errorf("cannot start span at offset %d after reading %d bytes", start, d.written)
 	}
+	return nil
+}
 
-	f, sr, uncompressedFileSize, err := getTarReader(gzipRdr)
-
-	if err != nil {
-		return nil, 0, err
+// digests ends the current span, which extends to the end of the layer,
+// and returns the digests of all spans.
+func (d *spanDigester) digests() []digest.Digest {
+	if d.digester != nil {
+		d.spans = append(d.spans, d.digester.Digest())
+		d.digester = nil
 	}
-	defer os.Remove(f.Name())
+	return d.spans
+}
 
-	pt := &positionTrackerReader{r: sr}
-	tarRdr := tar.NewReader(pt)
+// getFileMetadata reads the tar from pt and returns the metadata of its files.
+// If fileDigests is set, the digests of the contents of the regular files are computed as well.
+func getFileMetadata(pt *positionTrackerReader, fileDigests bool) ([]FileMetadata, error) {
+	rec := &headerRecorder{pt: pt}
+	tarRdr := tar.NewReader(rec)
 	var md []FileMetadata
+	var end FileSize // end of the data of the last entry
 
 	for {
+		// record the headers of the next entry, which start at the block after the data of the last entry
+		rec.start(tarBlockAlign(end))
 		hdr, err := tarRdr.Next()
+		raw := rec.stop()
 		if err != nil {
 			if err == io.EOF {
 				break
 			} else {
-				return nil, 0, fmt.Errorf("error while reading tar header: %w", err)
+				return nil, fmt.Errorf("error while reading tar header: %w", err)
 			}
 		}
 
-		start := pt.CurrentPos()
-		end := pt.CurrentPos() + FileSize(hdr.Size)
-
-		var indexStart SpanId
-		var indexEnd SpanId
-
-		ret := C.span_indices_for_file(index, C.off_t(start), C.off_t(end), unsafe.Pointer(&indexStart), unsafe.Pointer(&indexEnd))
-
-		if int(ret) <= 0 {
-			return nil, 0, fmt.Errorf("cannot get the span indices for file with start and end offset: %d, %d; gzip error: %v", start, end, ret)
-		}
-
-		var hasBits bool
-		ret = C.has_bits(index, C.int(indexStart))
-		if ret == 0 {
-			hasBits = false
-		} else {
-			hasBits = true
-		}
-
 		fileType, err := getType(hdr)
 		if err != nil {
-			return nil, 0, err
+			return nil, err
+		}
+		sparseMap, err := readSparseMap(hdr, raw)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read sparse map of %s: %w", hdr.Name, err)
 		}
 
 		metadataEntry := FileMetadata{
@@ -237,9 +249,6 @@ func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMet
 			Type:               fileType,
 			UncompressedOffset: pt.CurrentPos(),
 			UncompressedSize:   FileSize(hdr.Size),
-			SpanStart:          indexStart,
-			SpanEnd:            indexEnd,
-			FirstSpanHasBits:   hasBits,
 			Linkname:           hdr.Linkname,
 			Mode:               hdr.Mode,
 			UID:                hdr.Uid,
@@ -251,41 +260,25 @@ func getGzipFileMetadata(gzipFile string, index *C.struct_gzip_index) ([]FileMet
 			Devminor:           hdr.Devminor,
 			Xattrs:             hdr.PAXRecords,
 		}
+		if sparseMap != nil {
+			metadataEntry.UncompressedSize = sparseDataSize(sparseMap)
+			metadataEntry.SparseMap = sparseMap
+			metadataEntry.Xattrs = withoutSparseRecords(hdr.PAXRecords)
+		}
+		end = metadataEntry.UncompressedOffset
+		if fileType == "reg" {
+			end += metadataEntry.UncompressedSize
+		}
+		if fileDigests && fileType == "reg" {
+			digester := digest.Canonical.Digester()
+			if _, err := io.Copy(digester.Hash(), tarRdr); err != nil {
+				return nil, fmt.Errorf("error while reading contents of %s: %w", hdr.Name, err)
+			}
+			metadataEntry.Digest = digester.Digest()
+		}
 		md = append(md, metadataEntry)
 	}
-	return md, uncompressedFileSize, nil
-}
-
-func getFileSize(file string) (FileSize, error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return 0, err
-	}
-	defer f.Close()
-	st, err := f.Stat()
-	if err != nil {
-		return 0, err
-	}
-	return FileSize(st.Size()), nil
-}
-
-func getTarReader(gzipReader io.Reader) (*os.File, *io.SectionReader, FileSize, error) {
-	file, err := os.CreateTemp("/tmp", "tempfile-ztoc-builder")
-	if err != nil {
-		return nil, nil, 0, err
-	}
-	_, err = io.Copy(file, gzipReader)
-	if err != nil {
-		os.Remove(file.Name())
-		return nil, nil, 0, err
-	}
-
-	tarRdr, uncompressedFileSize, err := tarSectionReaderFromFile(file)
-	if err != nil {
-		return nil, nil, 0, err
-	}
-
-	return file, tarRdr, uncompressedFileSize, nil
+	return md, nil
 }
 
 func getType(header *tar.Header) (fileType string, e error) {
@@ -296,7 +289,7 @@ func getType(header *tar.Header) (fileType string, e error) {
 		fileType = "symlink"
 	case tar.TypeDir:
 		fileType = "dir"
-	case tar.TypeReg:
+	case tar.TypeReg, tar.TypeGNUSparse:
 		fileType = "reg"
 	case tar.TypeChar:
 		fileType = "char"
@@ -310,25 +303,14 @@ func getType(header *tar.Header) (fileType string, e error) {
 	return
 }
 
-func tarSectionReaderFromFile(f *os.File) (*io.SectionReader, FileSize, error) {
-	st, err := f.Stat()
-	if err != nil {
-		return nil, 0, err
-	}
-
-	return io.NewSectionReader(f, 0, st.Size()), FileSize(st.Size()), nil
-}
-
 type positionTrackerReader struct {
-	r   io.ReaderAt
+	r   io.Reader
 	pos FileSize
 }
 
 func (p *positionTrackerReader) Read(b []byte) (int, error) {
-	n, err := p.r.ReadAt(b, int64(p.pos))
-	if err == nil {
-		p.pos += FileSize(n)
-	}
+	n, err := p.r.Read(b)
+	p.pos += FileSize(n)
 	return n, err
 }
 
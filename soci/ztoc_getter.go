@@ -18,7 +18,6 @@ package soci
 
 import (
 	"archive/tar"
-	"encoding/gob"
 	"fmt"
 	"io"
 	"os"
@@ -35,21 +34,20 @@ func GetZtocFromFile(filename string) (*Ztoc, error) {
 	return GetZtoc(reader)
 }
 
-// GetZtoc reads and returns the Ztoc
+// GetZtoc reads and returns the Ztoc. Both protobuf encoded ztocs and
+// legacy gob encoded (version 0.1) ztocs are supported.
 func GetZtoc(reader io.Reader) (*Ztoc, error) {
 	zs, err := zstd.NewReader(reader)
 	if err != nil {
-		return nil, fmt.Errorf("cannot create gzip reader: %v", err)
+		return nil, fmt.Errorf("cannot create zstd reader: %v", err)
 	}
 	defer zs.Close()
 
-	decoder := gob.NewDecoder(zs)
-	ztoc := new(Ztoc)
-
-	if err := decoder.Decode(ztoc); err != nil {
-		return nil, fmt.Errorf("cannot decode ztoc: %w", err)
+	b, err := io.ReadAll(zs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress ztoc: %w", err)
 	}
-	return ztoc, nil
+	return unmarshalZtoc(b)
 }
 
 // Get file mode from ztoc
@@ -0,0 +1,415 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	// ZtocVersionGob is the version of the legacy zTOCs encoded with encoding/gob.
+	ZtocVersionGob = "0.1"
+	// ZtocVersionProto is the first version of zTOCs encoded with the protobuf schema in ztoc.proto.
+	ZtocVersionProto = "0.2"
+	// ZtocVersionCompressedWindows is the version of zTOCs whose gzip checkpoints store compressed windows.
+	ZtocVersionCompressedWindows = "0.3"
+	// ZtocVersionSparseFiles is the version of zTOCs with sparse files, whose data is read with their sparse maps.
+	ZtocVersionSparseFiles = "0.4"
+	// ZtocVersion is the version used when serializing new zTOCs without sparse files.
+	ZtocVersion = ZtocVersionCompressedWindows
+)
+
+// ztocVersion returns the version of a ztoc with the given files. Ztocs with sparse files have
+// their own version, so that older readers, which would read the data of the sparse files as
+// the whole files, reject them.
+func ztocVersion(files []FileMetadata) string {
+	for i := range files {
+		if len(files[i].SparseMap) > 0 {
+			return ZtocVersionSparseFiles
+		}
+	}
+	return ZtocVersion
+}
+
+// field numbers of the `Ztoc` message in ztoc.proto
+const (
+	ztocFieldVersion              protowire.Number = 1
+	ztocFieldBuildToolIdentifier  protowire.Number = 2
+	ztocFieldCompressionAlgorithm protowire.Number = 3
+	ztocFieldCompressedFileSize   protowire.Number = 4
+	ztocFieldUncompressedFileSize protowire.Number = 5
+	ztocFieldMaxSpanID            protowire.Number = 6
+	ztocFieldSpanDigests          protowire.Number = 7
+	ztocFieldCheckpoints          protowire.Number = 8
+	ztocFieldMetadata             protowire.Number = 9
+	ztocFieldSpanPlacement        protowire.Number = 10
+)
+
+// field numbers of the `FileMetadata` message in ztoc.proto
+const (
+	fileFieldName               protowire.Number = 1
+	fileFieldType               protowire.Number = 2
+	fileFieldUncompressedOffset protowire.Number = 3
+	fileFieldUncompressedSize   protowire.Number = 4
+	fileFieldSpanStart          protowire.Number = 5
+	fileFieldSpanEnd            protowire.Number = 6
+	fileFieldFirstSpanHasBits   protowire.Number = 7
+	fileFieldLinkname           protowire.Number = 8
+	fileFieldMode               protowire.Number = 9
+	fileFieldUID                protowire.Number = 10
+	fileFieldGID                protowire.Number = 11
+	fileFieldUname              protowire.Number = 12
+	fileFieldGname              protowire.Number = 13
+	fileFieldModTimeSeconds     protowire.Number = 14
+	fileFieldModTimeNanos       protowire.Number = 15
+	fileFieldDevmajor           protowire.Number = 16
+	fileFieldDevminor           protowire.Number = 17
+	fileFieldXattrs             protowire.Number = 18
+	fileFieldDigest             protowire.Number = 19
+	fileFieldSparseMap          protowire.Number = 20
+	fileFieldHasModTime         protowire.Number = 21
+)
+
+// field numbers of the `SparseEntry` message in ztoc.proto
+const (
+	sparseEntryFieldOffset protowire.Number = 1
+	sparseEntryFieldSize   protowire.Number = 2
+)
+
+// field numbers of the `Xattr` message in ztoc.proto
+const (
+	xattrFieldKey   protowire.Number = 1
+	xattrFieldValue protowire.Number = 2
+)
+
+var errUnsupportedZtocVersion = errors.New("unsupported ztoc version")
+
+// marshalZtoc serializes the ztoc with the current version of the schema in ztoc.proto.
+// The version of the ztoc is ignored; the output is of version `ZtocVersion`, or
+// `ZtocVersionSparseFiles` if the ztoc has sparse files.
+func marshalZtoc(ztoc *Ztoc) []byte {
+	var b []byte
+	b = appendString(b, ztocFieldVersion, ztocVersion(ztoc.Metadata))
+	b = appendString(b, ztocFieldBuildToolIdentifier, ztoc.BuildToolIdentifier)
+	b = appendString(b, ztocFieldCompressionAlgorithm, ztoc.CompressionAlgorithm)
+	b = appendVarint(b, ztocFieldCompressedFileSize, uint64(ztoc.CompressedFileSize))
+	b = appendVarint(b, ztocFieldUncompressedFileSize, uint64(ztoc.UncompressedFileSize))
+	b = appendVarint(b, ztocFieldMaxSpanID, uint64(ztoc.MaxSpanId))
+	for _, d := range ztoc.ZtocInfo.SpanDigests {
+		b = protowire.AppendTag(b, ztocFieldSpanDigests, protowire.BytesType)
+		b = protowire.AppendString(b, d.String())
+	}
+	if len(ztoc.IndexByteData) > 0 {
+		b = protowire.AppendTag(b, ztocFieldCheckpoints, protowire.BytesType)
+		b = protowire.AppendBytes(b, ztoc.IndexByteData)
+	}
+	for i := range ztoc.Metadata {
+		b = protowire.AppendTag(b, ztocFieldMetadata, protowire.BytesType)
+		b = protowire.AppendBytes(b, marshalFileMetadata(&ztoc.Metadata[i]))
+	}
+	b = appendString(b, ztocFieldSpanPlacement, ztoc.SpanPlacement)
+	return b
+}
+
+func marshalFileMetadata(m *FileMetadata) []byte {
+	var b []byte
+	b = appendString(b, fileFieldName, m.Name)
+	b = appendString(b, fileFieldType, m.Type)
+	b = appendVarint(b, fileFieldUncompressedOffset, uint64(m.UncompressedOffset))
+	b = appendVarint(b, fileFieldUncompressedSize, uint64(m.UncompressedSize))
+	b = appendVarint(b, fileFieldSpanStart, uint64(m.SpanStart))
+	b = appendVarint(b, fileFieldSpanEnd, uint64(m.SpanEnd))
+	if m.FirstSpanHasBits {
+		b = appendVarint(b, fileFieldFirstSpanHasBits, 1)
+	}
+	b = appendString(b, fileFieldLinkname, m.Linkname)
+	b = appendVarint(b, fileFieldMode, uint64(m.Mode))
+	b = appendVarint(b, fileFieldUID, uint64(m.UID))
+	b = appendVarint(b, fileFieldGID, uint64(m.GID))
+	b = appendString(b, fileFieldUname, m.Uname)
+	b = appendString(b, fileFieldGname, m.Gname)
+	if !m.ModTime.IsZero() {
+		b = appendVarint(b, fileFieldModTimeSeconds, uint64(m.ModTime.Unix()))
+		b = appendVarint(b, fileFieldModTimeNanos, uint64(m.ModTime.Nanosecond()))
+	}
+	b = appendVarint(b, fileFieldDevmajor, uint64(m.Devmajor))
+	b = appendVarint(b, fileFieldDevminor, uint64(m.Devminor))
+
+	keys := make([]string, 0, len(m.Xattrs))
+	for k := range m.Xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var xattr []byte
+		xattr = protowire.AppendTag(xattr, xattrFieldKey, protowire.BytesType)
+		xattr = protowire.AppendString(xattr, k)
+		xattr = protowire.AppendTag(xattr, xattrFieldValue, protowire.BytesType)
+		xattr = protowire.AppendString(xattr, m.Xattrs[k])
+		b = protowire.AppendTag(b, fileFieldXattrs, protowire.BytesType)
+		b = protowire.AppendBytes(b, xattr)
+	}
+	b = appendString(b, fileFieldDigest, m.Digest.String())
+	for _, e := range m.SparseMap {
+		var entry []byte
+		entry = appendVarint(entry, sparseEntryFieldOffset, uint64(e.Offset))
+		entry = appendVarint(entry, sparseEntryFieldSize, uint64(e.Size))
+		b = protowire.AppendTag(b, fileFieldSparseMap, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	if !m.ModTime.IsZero() {
+		// a modification time at the Unix epoch has no seconds and nanoseconds fields
+		b = appendVarint(b, fileFieldHasModTime, 1)
+	}
+	return b
+}
+
+// appendString appends a string field, omitting it if it has the default value as proto3 does.
+func appendString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, v)
+}
+
+// appendVarint appends an integer field, omitting it if it has the default value as proto3 does.
+// Negative values of signed fields are encoded as 10 byte varints, as in the protobuf encoding of int32/int64.
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// unmarshalZtoc deserializes a ztoc. The version of the ztoc determines how the
+// rest of the data is decoded: protobuf encoded ztocs start with their version,
+// anything else is decoded as a legacy gob encoded ztoc.
+func unmarshalZtoc(b []byte) (*Ztoc, error) {
+	version, ok := peekZtocVersion(b)
+	if !ok {
+		return unmarshalGobZtoc(b)
+	}
+	switch version {
+	case ZtocVersionProto, ZtocVersionCompressedWindows, ZtocVersionSparseFiles:
+		return unmarshalProtoZtoc(b)
+	default:
+		return nil, fmt.Errorf("%w: %q", errUnsupportedZtocVersion, version)
+	}
+}
+
+// peekZtocVersion returns the version of a protobuf encoded ztoc, which is always its first field.
+func peekZtocVersion(b []byte) (string, bool) {
+	num, typ, n := protowire.ConsumeTag(b)
+	if n < 0 || num != ztocFieldVersion || typ != protowire.BytesType {
+		return "", false
+	}
+	v, m := protowire.ConsumeString(b[n:])
+	if m < 0 {
+		return "", false
+	}
+	return v, true
+}
+
+func unmarshalGobZtoc(b []byte) (*Ztoc, error) {
+	ztoc := new(Ztoc)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(ztoc); err != nil {
+		return nil, fmt.Errorf("cannot decode ztoc: %w", err)
+	}
+	if ztoc.Version != ZtocVersionGob {
+		return nil, fmt.Errorf("%w: gob encoded ztoc with version %q", errUnsupportedZtocVersion, ztoc.Version)
+	}
+	return ztoc, nil
+}
+
+func unmarshalProtoZtoc(b []byte) (*Ztoc, error) {
+	ztoc := new(Ztoc)
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case ztocFieldVersion:
+			ztoc.Version = string(data)
+		case ztocFieldBuildToolIdentifier:
+			ztoc.BuildToolIdentifier = string(data)
+		case ztocFieldCompressionAlgorithm:
+			ztoc.CompressionAlgorithm = string(data)
+		case ztocFieldCompressedFileSize:
+			ztoc.CompressedFileSize = FileSize(v)
+		case ztocFieldUncompressedFileSize:
+			ztoc.UncompressedFileSize = FileSize(v)
+		case ztocFieldMaxSpanID:
+			ztoc.MaxSpanId = SpanId(v)
+		case ztocFieldSpanDigests:
+			d, err := digest.Parse(string(data))
+			if err != nil {
+				return fmt.Errorf("invalid span digest: %w", err)
+			}
+			ztoc.ZtocInfo.SpanDigests = append(ztoc.ZtocInfo.SpanDigests, d)
+		case ztocFieldCheckpoints:
+			ztoc.IndexByteData = append([]byte(nil), data...)
+		case ztocFieldMetadata:
+			m, err := unmarshalFileMetadata(data)
+			if err != nil {
+				return err
+			}
+			ztoc.Metadata = append(ztoc.Metadata, *m)
+		case ztocFieldSpanPlacement:
+			ztoc.SpanPlacement = string(data)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode ztoc: %w", err)
+	}
+	return ztoc, nil
+}
+
+func unmarshalFileMetadata(b []byte) (*FileMetadata, error) {
+	m := new(FileMetadata)
+	var (
+		modTimeSeconds, modTimeNanos int64
+		hasModTime                   bool
+	)
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error {
+		switch num {
+		case fileFieldName:
+			m.Name = string(data)
+		case fileFieldType:
+			m.Type = string(data)
+		case fileFieldUncompressedOffset:
+			m.UncompressedOffset = FileSize(v)
+		case fileFieldUncompressedSize:
+			m.UncompressedSize = FileSize(v)
+		case fileFieldSpanStart:
+			m.SpanStart = SpanId(v)
+		case fileFieldSpanEnd:
+			m.SpanEnd = SpanId(v)
+		case fileFieldFirstSpanHasBits:
+			m.FirstSpanHasBits = v != 0
+		case fileFieldLinkname:
+			m.Linkname = string(data)
+		case fileFieldMode:
+			m.Mode = int64(v)
+		case fileFieldUID:
+			m.UID = int(int64(v))
+		case fileFieldGID:
+			m.GID = int(int64(v))
+		case fileFieldUname:
+			m.Uname = string(data)
+		case fileFieldGname:
+			m.Gname = string(data)
+		case fileFieldModTimeSeconds:
+			modTimeSeconds = int64(v)
+		case fileFieldModTimeNanos:
+			modTimeNanos = int64(int32(v))
+		case fileFieldHasModTime:
+			hasModTime = v != 0
+		case fileFieldDevmajor:
+			m.Devmajor = int64(v)
+		case fileFieldDevminor:
+			m.Devminor = int64(v)
+		case fileFieldXattrs:
+			var key, value string
+			err := consumeFields(data, func(num protowire.Number, _ protowire.Type, _ uint64, data []byte) error {
+				switch num {
+				case xattrFieldKey:
+					key = string(data)
+				case xattrFieldValue:
+					value = string(data)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if m.Xattrs == nil {
+				m.Xattrs = make(map[string]string)
+			}
+			m.Xattrs[key] = value
+		case fileFieldDigest:
+			m.Digest = digest.Digest(data)
+		case fileFieldSparseMap:
+			var e SparseEntry
+			err := consumeFields(data, func(num protowire.Number, _ protowire.Type, v uint64, _ []byte) error {
+				switch num {
+				case sparseEntryFieldOffset:
+					e.Offset = FileSize(v)
+				case sparseEntryFieldSize:
+					e.Size = FileSize(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			m.SparseMap = append(m.SparseMap, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// ztocs written before has_mod_time only have the seconds and nanoseconds fields
+	if hasModTime || modTimeSeconds != 0 || modTimeNanos != 0 {
+		m.ModTime = time.Unix(modTimeSeconds, modTimeNanos)
+	}
+	return m, nil
+}
+
+// consumeFields calls f for every field of the protobuf message in b. Varint fields are
+// passed in v and length-delimited fields in data. Fields of other types are skipped,
+// so that unknown fields added by newer writers are ignored.
+func consumeFields(b []byte, f func(num protowire.Number, typ protowire.Type, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		var (
+			v    uint64
+			data []byte
+		)
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			data, n = protowire.ConsumeBytes(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := f(num, typ, v, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/containerd/containerd/log"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	orascontent "oras.land/oras-go/v2/content"
+)
+
+// findReusableZtoc looks for an existing ztoc of the layer which was built with the same
+// parameters, so that it doesn't need to be built again. The candidates are the ztocs of the
+// layer recorded in the artifacts db and the ztocs of the layer referenced by the SOCI indices
+// in the store. A candidate is only reused if it can be read from the store and matches the
+// layer and the build parameters. It returns the descriptor of the ztoc along with the ztoc,
+// or nil if no ztoc can be reused.
+func findReusableZtoc(ctx context.Context, db *ArtifactsDb, store orascontent.Storage, layer ocispec.Descriptor, spanSize int64, compression string, cfg *buildConfig) (*ocispec.Descriptor, *Ztoc, error) {
+	candidates, err := findZtocCandidates(ctx, db, store, layer, spanSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, candidate := range candidates {
+		ztoc, err := checkReusableZtoc(ctx, store, candidate, layer, spanSize, compression, cfg)
+		if err == nil {
+			return &candidate, ztoc, nil
+		}
+		log.G(ctx).WithError(err).WithField("digest", candidate.Digest).Debugf("cannot reuse ztoc of layer %s", layer.Digest)
+	}
+	return nil, nil, nil
+}
+
+func findZtocCandidates(ctx context.Context, db *ArtifactsDb, store orascontent.Storage, layer ocispec.Descriptor, spanSize int64) ([]ocispec.Descriptor, error) {
+	var candidates []ocispec.Descriptor
+	seen := make(map[digest.Digest]struct{})
+	add := func(desc ocispec.Descriptor) {
+		if _, ok := seen[desc.Digest]; ok {
+			return
+		}
+		seen[desc.Digest] = struct{}{}
+		candidates = append(candidates, desc)
+	}
+
+	layerEntries, err := db.getLayerArtifactEntries(layer.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range layerEntries {
+		if entry.SpanSize != 0 && entry.SpanSize != spanSize {
+			continue
+		}
+		dgst, err := digest.Parse(entry.Digest)
+		if err != nil {
+			continue
+		}
+		add(ocispec.Descriptor{
+			MediaType: SociLayerMediaType,
+			Digest:    dgst,
+			Size:      entry.Size,
+		})
+	}
+
+	indexEntries, err := db.getAllIndexArtifactEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range indexEntries {
+		dgst, err := digest.Parse(entry.Digest)
+		if err != nil {
+			continue
+		}
+		rc, err := store.Fetch(ctx, ocispec.Descriptor{MediaType: entry.MediaType, Digest: dgst, Size: entry.Size})
+		if err != nil {
+			continue
+		}
+		index, err := NewIndexFromReader(rc)
+		rc.Close()
+		if err != nil {
+			continue
+		}
+		for _, blob := range index.Blobs {
+			if blob.Annotations[IndexAnnotationImageLayerDigest] == layer.Digest.String() && !IsEagerLayer(blob) {
+				add(ocispec.Descriptor{
+					MediaType: SociLayerMediaType,
+					Digest:    blob.Digest,
+					Size:      blob.Size,
+				})
+			}
+		}
+	}
+	return candidates, nil
+}
+
+// checkReusableZtoc checks that the ztoc described by desc is in the store and was built
+// for the layer with the given span size, compression, span placement and build tool, and that it has
+// file digests if they are requested. It returns the ztoc if it can be reused.
+func checkReusableZtoc(ctx context.Context, store orascontent.Storage, desc, layer ocispec.Descriptor, spanSize int64, compression string, cfg *buildConfig) (*Ztoc, error) {
+	rc, err := store.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	verifier := desc.Digest.Verifier()
+	tee := io.TeeReader(io.LimitReader(rc, desc.Size), verifier)
+	ztoc, err := GetZtoc(tee)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, err
+	}
+	if !verifier.Verified() {
+		return nil, fmt.Errorf("content doesn't match digest %v", desc.Digest)
+	}
+
+	algo := ztoc.CompressionAlgorithm
+	if algo == "" {
+		algo = CompressionGzip
+	}
+	if algo != compression {
+		return nil, fmt.Errorf("ztoc was built for %s compression, layer is %s", algo, compression)
+	}
+	if ztoc.CompressedFileSize != FileSize(layer.Size) {
+		return nil, fmt.Errorf("ztoc was built for a layer of %d bytes, layer is %d bytes", ztoc.CompressedFileSize, layer.Size)
+	}
+	if cfg != nil && ztoc.BuildToolIdentifier != cfg.buildToolIdentifier {
+		return nil, fmt.Errorf("ztoc was built by %q", ztoc.BuildToolIdentifier)
+	}
+	if cfg != nil && ztoc.SpanPlacement != recordedSpanPlacement(cfg, compression) {
+		return nil, fmt.Errorf("ztoc was built with span placement %q", ztoc.SpanPlacement)
+	}
+	if cfg != nil && cfg.fileDigests {
+		for _, m := range ztoc.Metadata {
+			if m.Type == "reg" && m.Digest == "" {
+				return nil, fmt.Errorf("ztoc has no digest for file %s", m.Name)
+			}
+		}
+	}
+	zinfo, err := NewZinfoFromZtoc(ztoc)
+	if err != nil {
+		return nil, err
+	}
+	defer zinfo.Close()
+	if int64(zinfo.SpanSize()) != spanSize {
+		return nil, fmt.Errorf("ztoc was built with span size %d", zinfo.SpanSize())
+	}
+	return ztoc, nil
+}
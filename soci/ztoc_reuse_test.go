@@ -0,0 +1,193 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2/content/memory"
+)
+
+func TestFindReusableZtoc(t *testing.T) {
+	const spanSize = 65536
+	layerDigest := digest.FromString("layer")
+
+	testCases := []struct {
+		name          string
+		entrySpanSize int64
+		viaIndex      bool
+		notInStore    bool
+		spanSize      int64
+		compression   string
+		layerSize     int64
+		reused        bool
+	}{
+		{
+			name:          "ztoc with the same span size is reused",
+			entrySpanSize: spanSize,
+			spanSize:      spanSize,
+			compression:   CompressionGzip,
+			reused:        true,
+		},
+		{
+			name:        "ztoc of an entry without span size is reused if its span size matches",
+			spanSize:    spanSize,
+			compression: CompressionGzip,
+			reused:      true,
+		},
+		{
+			name:        "ztoc referenced by an index in the store is reused",
+			viaIndex:    true,
+			spanSize:    spanSize,
+			compression: CompressionGzip,
+			reused:      true,
+		},
+		{
+			name:          "ztoc with a different span size is not reused",
+			entrySpanSize: spanSize,
+			spanSize:      2 * spanSize,
+			compression:   CompressionGzip,
+		},
+		{
+			name:        "ztoc of an entry without span size is not reused if its span size differs",
+			spanSize:    2 * spanSize,
+			compression: CompressionGzip,
+		},
+		{
+			name:          "ztoc with a different compression is not reused",
+			entrySpanSize: spanSize,
+			spanSize:      spanSize,
+			compression:   CompressionZstd,
+		},
+		{
+			name:          "ztoc of a layer with a different size is not reused",
+			entrySpanSize: spanSize,
+			spanSize:      spanSize,
+			compression:   CompressionGzip,
+			layerSize:     1,
+		},
+		{
+			name:          "ztoc missing from the store is not reused",
+			entrySpanSize: spanSize,
+			notInStore:    true,
+			spanSize:      spanSize,
+			compression:   CompressionGzip,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			db, err := newTestableDb()
+			if err != nil {
+				t.Fatalf("can't create a test db")
+			}
+			store := memory.New()
+
+			ents := []testutil.TarEntry{
+				testutil.File("file1", string(genRandomByteData(200000))),
+				testutil.File("file2", string(genRandomByteData(100000))),
+			}
+			ztoc, sr, err := BuildZtocReader(ents, gzip.BestCompression, spanSize)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ztocReader, ztocDesc, err := NewZtocReader(ztoc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ztocDesc.MediaType = SociLayerMediaType
+			if !tc.notInStore {
+				if err := store.Push(ctx, ztocDesc, ztocReader); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			layer := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageLayerGzip,
+				Digest:    layerDigest,
+				Size:      sr.Size(),
+			}
+			if tc.layerSize != 0 {
+				layer.Size = tc.layerSize
+			}
+
+			if tc.viaIndex {
+				blob := ztocDesc
+				blob.Annotations = map[string]string{
+					IndexAnnotationImageLayerDigest: layerDigest.String(),
+				}
+				manifest, err := json.Marshal(NewIndex([]ocispec.Descriptor{blob}, &ocispec.Descriptor{}, nil, ManifestORAS))
+				if err != nil {
+					t.Fatal(err)
+				}
+				indexDesc := ocispec.Descriptor{
+					MediaType: ORASManifestMediaType,
+					Digest:    digest.FromBytes(manifest),
+					Size:      int64(len(manifest)),
+				}
+				if err := store.Push(ctx, indexDesc, bytes.NewReader(manifest)); err != nil {
+					t.Fatal(err)
+				}
+				err = db.WriteArtifactEntry(&ArtifactEntry{
+					Size:           indexDesc.Size,
+					Digest:         indexDesc.Digest.String(),
+					OriginalDigest: digest.FromString("image manifest").String(),
+					Type:           ArtifactEntryTypeIndex,
+					MediaType:      ORASManifestMediaType,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				err = db.WriteArtifactEntry(&ArtifactEntry{
+					Size:           ztocDesc.Size,
+					Digest:         ztocDesc.Digest.String(),
+					OriginalDigest: layerDigest.String(),
+					Type:           ArtifactEntryTypeLayer,
+					Location:       layerDigest.String(),
+					SpanSize:       tc.entrySpanSize,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			desc, _, err := findReusableZtoc(ctx, db, store, layer, tc.spanSize, tc.compression, &buildConfig{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tc.reused {
+				if desc == nil {
+					t.Fatalf("expected ztoc %v to be reused", ztocDesc.Digest)
+				}
+				if desc.Digest != ztocDesc.Digest || desc.Size != ztocDesc.Size {
+					t.Fatalf("unexpected ztoc; expected = %v, got = %v", ztocDesc.Digest, desc.Digest)
+				}
+			} else if desc != nil {
+				t.Fatalf("expected no ztoc to be reused, got %v", desc.Digest)
+			}
+		})
+	}
+}
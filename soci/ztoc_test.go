@@ -17,16 +17,29 @@
 package soci
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 func init() {
@@ -79,7 +92,7 @@ func TestDecompress(t *testing.T) {
 	for _, tc := range tests {
 		spansize := tc.spanSize
 		cfg := &buildConfig{}
-		ztoc, err := BuildZtoc(*tarGzip, spansize, cfg)
+		ztoc, err := buildZtocFromFile(*tarGzip, spansize, CompressionGzip, cfg)
 		if err != nil {
 			t.Fatalf("%s: can't build ztoc: %v", tc.name, err)
 		}
@@ -105,14 +118,15 @@ func TestDecompress(t *testing.T) {
 			configs := make(map[string](*FileExtractConfig))
 			for _, m := range ztoc.Metadata {
 				extractConfig := &FileExtractConfig{
-					UncompressedSize:   m.UncompressedSize,
-					UncompressedOffset: m.UncompressedOffset,
-					SpanStart:          m.SpanStart,
-					SpanEnd:            m.SpanEnd,
-					FirstSpanHasBits:   m.FirstSpanHasBits,
-					IndexByteData:      ztoc.IndexByteData,
-					CompressedFileSize: ztoc.CompressedFileSize,
-					MaxSpanId:          ztoc.MaxSpanId,
+					UncompressedSize:     m.UncompressedSize,
+					UncompressedOffset:   m.UncompressedOffset,
+					SpanStart:            m.SpanStart,
+					SpanEnd:              m.SpanEnd,
+					FirstSpanHasBits:     m.FirstSpanHasBits,
+					IndexByteData:        ztoc.IndexByteData,
+					CompressedFileSize:   ztoc.CompressedFileSize,
+					MaxSpanId:            ztoc.MaxSpanId,
+					CompressionAlgorithm: ztoc.CompressionAlgorithm,
 				}
 				configs[m.Name] = extractConfig
 			}
@@ -195,7 +209,7 @@ func TestZtocGenerationConsistency(t *testing.T) {
 			defer os.Remove(*tarGzip)
 			spansize := tc.spanSize
 			cfg := &buildConfig{}
-			ztoc1, err := BuildZtoc(*tarGzip, spansize, cfg)
+			ztoc1, err := buildZtocFromFile(*tarGzip, spansize, CompressionGzip, cfg)
 			if err != nil {
 				t.Fatalf("can't build ztoc1: %v", err)
 			}
@@ -206,7 +220,7 @@ func TestZtocGenerationConsistency(t *testing.T) {
 				t.Fatalf("ztoc1 metadata file count mismatch. expected: %d, actual: %d", len(fileNames), len(ztoc1.Metadata))
 			}
 
-			ztoc2, err := BuildZtoc(*tarGzip, spansize, cfg)
+			ztoc2, err := buildZtocFromFile(*tarGzip, spansize, CompressionGzip, cfg)
 			if err != nil {
 				t.Fatalf("can't build ztoc2: %v", err)
 			}
@@ -239,11 +253,11 @@ func TestZtocGenerationConsistency(t *testing.T) {
 			if !bytes.Equal(ztoc1.IndexByteData, ztoc2.IndexByteData) {
 
 				// compare IndexByteData within Go
-				index1, err := unmarshalGzipIndex(ztoc1.IndexByteData[0])
+				index1, err := unmarshalGzipIndex(ztoc1.IndexByteData)
 				if err != nil {
 					t.Fatalf("index from ztoc1 should contain data")
 				}
-				index2, err := unmarshalGzipIndex(ztoc2.IndexByteData[0])
+				index2, err := unmarshalGzipIndex(ztoc2.IndexByteData)
 				if err != nil {
 					t.Fatalf("index from ztoc2 should contain data")
 				}
@@ -362,7 +376,7 @@ func TestZtocGeneration(t *testing.T) {
 			cfg := &buildConfig{
 				buildToolIdentifier: tc.buildTool,
 			}
-			ztoc, err := BuildZtoc(*tarGzip, spansize, cfg)
+			ztoc, err := buildZtocFromFile(*tarGzip, spansize, CompressionGzip, cfg)
 			if err != nil {
 				t.Fatalf("can't build ztoc: error=%v", err)
 			}
@@ -405,6 +419,248 @@ func TestZtocGeneration(t *testing.T) {
 
 }
 
+func TestZstdZtocGeneration(t *testing.T) {
+	// a skippable frame, as used by the seekable zstd format for its seek table
+	skippableFrame := []byte{0x5E, 0x2A, 0x4D, 0x18, 0x04, 0x00, 0x00, 0x00, 0xDE, 0xAD, 0xBE, 0xEF}
+	testcases := []struct {
+		name            string
+		frameSize       int
+		spanSize        int64
+		skippableFrames bool
+		expectedSpans   SpanId
+	}{
+		{
+			name:          "single frame layer has a single span",
+			frameSize:     0,
+			spanSize:      65536,
+			expectedSpans: 1,
+		},
+		{
+			name:          "one span per frame when frames are larger than span size",
+			frameSize:     100000,
+			spanSize:      65536,
+			expectedSpans: 8,
+		},
+		{
+			name:          "multiple frames per span when frames are smaller than span size",
+			frameSize:     16384,
+			spanSize:      65536,
+			expectedSpans: 12,
+		},
+		{
+			name:            "skippable frames are part of the surrounding spans",
+			frameSize:       16384,
+			spanSize:        65536,
+			skippableFrames: true,
+			expectedSpans:   12,
+		},
+	}
+
+	contents := [][]byte{
+		genRandomByteData(300000),
+		genRandomByteData(10),
+		genRandomByteData(0),
+		genRandomByteData(400000),
+		genRandomByteData(55333),
+	}
+	var ents []testutil.TarEntry
+	for i, c := range contents {
+		ents = append(ents, testutil.File(fmt.Sprintf("file%d", i), string(c)))
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			zstdData, err := io.ReadAll(testutil.BuildTarZstd(ents, tc.frameSize))
+			if err != nil {
+				t.Fatalf("cannot build tar zstd: %v", err)
+			}
+			if tc.skippableFrames {
+				zstdData = append(append(append([]byte{}, skippableFrame...), zstdData...), skippableFrame...)
+			}
+			zstdFile, err := os.CreateTemp("", "tmp.*.tar.zst")
+			if err != nil {
+				t.Fatalf("cannot create temp file: %v", err)
+			}
+			defer os.Remove(zstdFile.Name())
+			defer zstdFile.Close()
+			if _, err := zstdFile.Write(zstdData); err != nil {
+				t.Fatalf("cannot write temp file: %v", err)
+			}
+
+			ztoc, err := buildZtocFromFile(zstdFile.Name(), tc.spanSize, CompressionZstd, &buildConfig{})
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if ztoc.CompressionAlgorithm != CompressionZstd {
+				t.Fatalf("unexpected compression algorithm; expected %s, got %s", CompressionZstd, ztoc.CompressionAlgorithm)
+			}
+			if ztoc.MaxSpanId+1 != tc.expectedSpans {
+				t.Fatalf("unexpected number of spans; expected %d, got %d", tc.expectedSpans, ztoc.MaxSpanId+1)
+			}
+			if len(ztoc.ZtocInfo.SpanDigests) != int(tc.expectedSpans) {
+				t.Fatalf("unexpected number of span digests; expected %d, got %d", tc.expectedSpans, len(ztoc.ZtocInfo.SpanDigests))
+			}
+			if len(ztoc.Metadata) != len(contents) {
+				t.Fatalf("ztoc metadata count mismatch. expected: %d, actual: %d", len(contents), len(ztoc.Metadata))
+			}
+
+			sr := io.NewSectionReader(bytes.NewReader(zstdData), 0, int64(len(zstdData)))
+			for i, m := range ztoc.Metadata {
+				extractedBytes, err := ExtractFromTarGz(zstdFile.Name(), ztoc, m.Name)
+				if err != nil {
+					t.Fatalf("could not extract file %s using generated ztoc: %v", m.Name, err)
+				}
+				if extractedBytes != string(contents[i]) {
+					t.Fatalf("the extracted content of %s does not match", m.Name)
+				}
+
+				extractConfig := &FileExtractConfig{
+					UncompressedSize:     m.UncompressedSize,
+					UncompressedOffset:   m.UncompressedOffset,
+					SpanStart:            m.SpanStart,
+					SpanEnd:              m.SpanEnd,
+					FirstSpanHasBits:     m.FirstSpanHasBits,
+					IndexByteData:        ztoc.IndexByteData,
+					CompressedFileSize:   ztoc.CompressedFileSize,
+					MaxSpanId:            ztoc.MaxSpanId,
+					CompressionAlgorithm: ztoc.CompressionAlgorithm,
+				}
+				extracted, err := ExtractFile(sr, extractConfig)
+				if err != nil {
+					t.Fatalf("could not extract file %s from spans: %v", m.Name, err)
+				}
+				if !bytes.Equal(extracted, contents[i]) {
+					t.Fatalf("the content of %s extracted from spans does not match", m.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestUncompressedZtocGeneration(t *testing.T) {
+	contents := [][]byte{
+		genRandomByteData(300000),
+		genRandomByteData(10),
+		genRandomByteData(0),
+		genRandomByteData(65536),
+	}
+	var ents []testutil.TarEntry
+	for i, c := range contents {
+		ents = append(ents, testutil.File(fmt.Sprintf("file%d", i), string(c)))
+	}
+
+	for _, spanSize := range []int64{512, 65536, 1 << 22} {
+		t.Run(fmt.Sprintf("span size %d", spanSize), func(t *testing.T) {
+			ztoc, sr, err := BuildTarZtocReader(ents, spanSize)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if ztoc.CompressedFileSize != ztoc.UncompressedFileSize {
+				t.Fatalf("compressed size %d should be equal to uncompressed size %d", ztoc.CompressedFileSize, ztoc.UncompressedFileSize)
+			}
+			expectedMaxSpanID := SpanId((int64(ztoc.UncompressedFileSize) - 1) / spanSize)
+			if ztoc.MaxSpanId != expectedMaxSpanID {
+				t.Fatalf("unexpected max span id; expected %d, got %d", expectedMaxSpanID, ztoc.MaxSpanId)
+			}
+			if len(ztoc.ZtocInfo.SpanDigests) != int(expectedMaxSpanID)+1 {
+				t.Fatalf("unexpected number of span digests; expected %d, got %d", expectedMaxSpanID+1, len(ztoc.ZtocInfo.SpanDigests))
+			}
+
+			for i, m := range ztoc.Metadata {
+				if m.SpanStart != SpanId(int64(m.UncompressedOffset)/spanSize) {
+					t.Fatalf("unexpected start span of %s; offset %d, span %d", m.Name, m.UncompressedOffset, m.SpanStart)
+				}
+				extractConfig := &FileExtractConfig{
+					UncompressedSize:     m.UncompressedSize,
+					UncompressedOffset:   m.UncompressedOffset,
+					SpanStart:            m.SpanStart,
+					SpanEnd:              m.SpanEnd,
+					IndexByteData:        ztoc.IndexByteData,
+					CompressedFileSize:   ztoc.CompressedFileSize,
+					MaxSpanId:            ztoc.MaxSpanId,
+					CompressionAlgorithm: ztoc.CompressionAlgorithm,
+				}
+				extracted, err := ExtractFile(sr, extractConfig)
+				if err != nil {
+					t.Fatalf("could not extract file %s: %v", m.Name, err)
+				}
+				if !bytes.Equal(extracted, contents[i]) {
+					t.Fatalf("the extracted content of %s does not match", m.Name)
+				}
+
+				zinfo, err := NewZinfoFromZtoc(ztoc)
+				if err != nil {
+					t.Fatalf("cannot create zinfo: %v", err)
+				}
+				spanStart := zinfo.StartCompressedOffset(m.SpanStart)
+				spanEnd := zinfo.EndCompressedOffset(m.SpanEnd, ztoc.CompressedFileSize)
+				buf := make([]byte, spanEnd-spanStart)
+				if _, err := sr.ReadAt(buf, int64(spanStart)); err != nil && err != io.EOF {
+					t.Fatalf("cannot read spans: %v", err)
+				}
+				extracted, err = zinfo.ExtractDataFromBuffer(buf, m.UncompressedSize, m.UncompressedOffset, m.SpanStart)
+				if err != nil {
+					t.Fatalf("could not extract file %s from spans: %v", m.Name, err)
+				}
+				if !bytes.Equal(extracted, contents[i]) {
+					t.Fatalf("the content of %s extracted from spans does not match", m.Name)
+				}
+			}
+		})
+	}
+}
+
+type failingWriter struct{ err error }
+
+func (w failingWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestZstdFrameReaderWriteError(t *testing.T) {
+	layer, err := io.ReadAll(testutil.BuildTarZstd([]testutil.TarEntry{testutil.File("file", "contents")}, 0))
+	if err != nil {
+		t.Fatalf("cannot build layer: %v", err)
+	}
+	errWrite := errors.New("write failed")
+	fr := &zstdFrameReader{
+		r:         bufio.NewReader(bytes.NewReader(layer)),
+		w:         failingWriter{err: errWrite},
+		remaining: zstdFrameHeaderSize(layer[4]),
+	}
+	if _, err := io.ReadAll(fr); !errors.Is(err, errWrite) {
+		t.Fatalf("expected the write error, got %v", err)
+	}
+}
+
+func TestZstdZinfoSerialization(t *testing.T) {
+	zinfo := &zstdZinfo{
+		checkpoints: []zstdCheckpoint{{in: 0, out: 0}, {in: 1000, out: 70000}, {in: 2000, out: 140000}},
+		spanSize:    65536,
+	}
+	b, err := zinfo.Bytes()
+	if err != nil {
+		t.Fatalf("cannot serialize zinfo: %v", err)
+	}
+	zinfo2, err := NewZinfo(CompressionZstd, b)
+	if err != nil {
+		t.Fatalf("cannot deserialize zinfo: %v", err)
+	}
+	if !reflect.DeepEqual(zinfo, zinfo2) {
+		t.Fatalf("deserialized zinfo does not match; expected %v, got %v", zinfo, zinfo2)
+	}
+	if _, err := NewZinfo(CompressionZstd, b[:len(b)-1]); err == nil {
+		t.Fatalf("expected truncated zinfo to fail")
+	}
+
+	offsets := map[FileSize]SpanId{0: 0, 69999: 0, 70000: 1, 139999: 1, 140000: 2, 200000: 2}
+	for off, expected := range offsets {
+		if id := zinfo2.UncompressedOffsetToSpanID(off); id != expected {
+			t.Fatalf("unexpected span for offset %d; expected %d, got %d", off, expected, id)
+		}
+	}
+	if end := zinfo2.EndCompressedOffset(2, 3000); end != 3000 {
+		t.Fatalf("unexpected end of last span; expected 3000, got %d", end)
+	}
+}
+
 func TestWriteZtoc(t *testing.T) {
 	testCases := []struct {
 		name                 string
@@ -420,15 +676,15 @@ func TestWriteZtoc(t *testing.T) {
 	}{
 		{
 			name:                 "success write succeeds - same digest and size",
-			version:              "0.1",
+			version:              ZtocVersion,
 			indexByteData:        make([]byte, 1<<16),
 			metadata:             make([]FileMetadata, 2),
 			compressedFileSize:   2000000,
 			uncompressedFileSize: 2500000,
 			maxSpanID:            3,
 			buildTool:            "AWS SOCI CLI",
-			expDigest:            "sha256:4a2322b19c52ff5756b07bbc301e19ca9e95df6c017ababc7690bec03c3c8f25",
-			expSize:              455,
+			expDigest:            "sha256:bb86c823312159587ad6b037f6336f5534783bafd81ffc16817add1bb88bd6a9",
+			expSize:              63,
 		},
 	}
 
@@ -460,8 +716,452 @@ func TestWriteZtoc(t *testing.T) {
 	}
 }
 
+func TestZtocDigestIsReproducible(t *testing.T) {
+	xattrs := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		xattrs[fmt.Sprintf("user.attr%d", i)] = fmt.Sprintf("value%d", i)
+	}
+	ents := []testutil.TarEntry{
+		testutil.Dir("dir/", testutil.WithDirXattrs(xattrs)),
+		testutil.File("dir/file1", string(genRandomByteData(300000)), testutil.WithFileXattrs(xattrs)),
+		testutil.File("dir/file2", string(genRandomByteData(1000)), testutil.WithFileXattrs(xattrs)),
+		testutil.File("file3", string(genRandomByteData(150000))),
+	}
+	for _, algo := range []string{CompressionGzip, CompressionZstd, CompressionUncompressed} {
+		for _, placement := range []SpanPlacement{SpanPlacementFixed, SpanPlacementFileBoundary} {
+			t.Run(fmt.Sprintf("%s_%s", algo, placement), func(t *testing.T) {
+				var layer io.Reader
+				switch algo {
+				case CompressionGzip:
+					layer = testutil.BuildTarGz(ents, gzip.DefaultCompression)
+				case CompressionZstd:
+					layer = testutil.BuildTarZstd(ents, 65536)
+				default:
+					layer = testutil.BuildTar(ents)
+				}
+				b, err := io.ReadAll(layer)
+				if err != nil {
+					t.Fatal(err)
+				}
+				cfg := &buildConfig{buildToolIdentifier: "AWS SOCI CLI", spanPlacement: placement}
+
+				var first []byte
+				var firstDesc ocispec.Descriptor
+				procs := runtime.GOMAXPROCS(0)
+				defer runtime.GOMAXPROCS(procs)
+				for i := 0; i < 5; i++ {
+					// the result must not depend on the number of CPUs either
+					runtime.GOMAXPROCS(1 + i%2*(procs+3))
+					ztoc, err := BuildZtoc(io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b))), 65536, algo, cfg)
+					if err != nil {
+						t.Fatalf("cannot build ztoc: %v", err)
+					}
+					r, desc, err := NewZtocReader(ztoc)
+					if err != nil {
+						t.Fatalf("cannot serialize ztoc: %v", err)
+					}
+					serialized, err := io.ReadAll(r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if i == 0 {
+						first, firstDesc = serialized, desc
+						continue
+					}
+					if !reflect.DeepEqual(desc, firstDesc) {
+						t.Fatalf("build %d has a different descriptor; expected = %+v, got = %+v", i, firstDesc, desc)
+					}
+					if !bytes.Equal(serialized, first) {
+						t.Fatalf("build %d has different bytes", i)
+					}
+				}
+			})
+		}
+	}
+}
+
 func genRandomByteData(size int) []byte {
 	b := make([]byte, size)
 	rand.Read(b)
 	return b
 }
+
+func TestZtocSerialization(t *testing.T) {
+	ztoc := &Ztoc{
+		Version:              ZtocVersionSparseFiles,
+		BuildToolIdentifier:  "AWS SOCI CLI",
+		CompressionAlgorithm: CompressionGzip,
+		SpanPlacement:        string(SpanPlacementFileBoundary),
+		Metadata: []FileMetadata{
+			{
+				Name:               "dir/",
+				Type:               "dir",
+				Mode:               0755,
+				ModTime:            time.Unix(1600000000, 123456789),
+				Xattrs:             map[string]string{"user.b": "2", "user.a": "1"},
+				UncompressedOffset: 512,
+			},
+			{
+				Name:               "dir/file",
+				Type:               "reg",
+				UncompressedOffset: 1536,
+				UncompressedSize:   100000,
+				SpanStart:          1,
+				SpanEnd:            3,
+				FirstSpanHasBits:   true,
+				Mode:               0644,
+				UID:                1000,
+				GID:                -1,
+				Uname:              "user",
+				Gname:              "group",
+				ModTime:            time.Unix(-1, 0),
+				Digest:             digest.FromString("file"),
+			},
+			{
+				Name:               "dir/sparse",
+				Type:               "reg",
+				UncompressedOffset: 102400,
+				UncompressedSize:   3072,
+				SpanStart:          3,
+				SpanEnd:            3,
+				SparseMap: []SparseEntry{
+					{Offset: 0, Size: 1024},
+					{Offset: 1 << 20, Size: 2048},
+					{Offset: 1 << 30},
+				},
+			},
+			{
+				Name:     "dir/link",
+				Type:     "symlink",
+				Linkname: "file",
+				// common in reproducible images, and encoded with no seconds and nanoseconds
+				ModTime: time.Unix(0, 0),
+			},
+			{
+				Name:     "dev",
+				Type:     "char",
+				Devmajor: 1,
+				Devminor: 3,
+			},
+		},
+		CompressedFileSize:   2000000,
+		UncompressedFileSize: 2500000,
+		MaxSpanId:            3,
+		ZtocInfo: ztocInfo{
+			SpanDigests: []digest.Digest{
+				digest.FromString("0"), digest.FromString("1"), digest.FromString("2"), digest.FromString("3"),
+			},
+		},
+		IndexByteData: genRandomByteData(1 << 10),
+	}
+
+	r, _, err := NewZtocReader(ztoc)
+	if err != nil {
+		t.Fatalf("error occurred when getting ztoc reader: %v", err)
+	}
+	got, err := GetZtoc(r)
+	if err != nil {
+		t.Fatalf("error occurred when reading ztoc: %v", err)
+	}
+	if !reflect.DeepEqual(got, ztoc) {
+		t.Fatalf("unexpected ztoc after round trip; expected %+v, got %+v", ztoc, got)
+	}
+}
+
+func TestZtocVersion(t *testing.T) {
+	files := []FileMetadata{{Name: "file", Type: "reg", UncompressedSize: 10}}
+	sparse := FileMetadata{
+		Name:             "sparse",
+		Type:             "reg",
+		UncompressedSize: 10,
+		SparseMap:        []SparseEntry{{Offset: 0, Size: 10}, {Offset: 1 << 20}},
+	}
+	testCases := []struct {
+		name     string
+		files    []FileMetadata
+		expected string
+	}{
+		{name: "no sparse files", files: files, expected: ZtocVersion},
+		{name: "sparse file", files: append(files, sparse), expected: ZtocVersionSparseFiles},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the version of the ztoc is ignored when serializing it
+			version, ok := peekZtocVersion(marshalZtoc(&Ztoc{Version: ZtocVersion, Metadata: tc.files}))
+			if !ok || version != tc.expected {
+				t.Fatalf("unexpected version; expected = %q, got = %q", tc.expected, version)
+			}
+		})
+	}
+}
+
+func TestReadGobZtoc(t *testing.T) {
+	ztoc := &Ztoc{
+		Version:             ZtocVersionGob,
+		BuildToolIdentifier: "AWS SOCI CLI",
+		Metadata: []FileMetadata{
+			{
+				Name:             "file",
+				Type:             "reg",
+				UncompressedSize: 10,
+				ModTime:          time.Unix(1600000000, 0),
+				Xattrs:           map[string]string{"user.a": "1"},
+			},
+		},
+		CompressedFileSize:   2000,
+		UncompressedFileSize: 2500,
+		ZtocInfo: ztocInfo{
+			SpanDigests: []digest.Digest{digest.FromString("0")},
+		},
+		IndexByteData: genRandomByteData(100),
+	}
+
+	got, err := GetZtoc(bytes.NewReader(encodeGobZtoc(t, ztoc)))
+	if err != nil {
+		t.Fatalf("error occurred when reading gob ztoc: %v", err)
+	}
+	// gob doesn't preserve the location of times, so they are compared separately.
+	for i := range got.Metadata {
+		if !got.Metadata[i].ModTime.Equal(ztoc.Metadata[i].ModTime) {
+			t.Fatalf("unexpected modification time of %s; expected %v, got %v", ztoc.Metadata[i].Name, ztoc.Metadata[i].ModTime, got.Metadata[i].ModTime)
+		}
+		got.Metadata[i].ModTime = ztoc.Metadata[i].ModTime
+	}
+	if !reflect.DeepEqual(got, ztoc) {
+		t.Fatalf("unexpected ztoc; expected %+v, got %+v", ztoc, got)
+	}
+}
+
+func TestReadUnsupportedZtocVersion(t *testing.T) {
+	t.Run("gob", func(t *testing.T) {
+		b := encodeGobZtoc(t, &Ztoc{Version: "0.0"})
+		if _, err := GetZtoc(bytes.NewReader(b)); !errors.Is(err, errUnsupportedZtocVersion) {
+			t.Fatalf("expected %v, got %v", errUnsupportedZtocVersion, err)
+		}
+	})
+	t.Run("proto", func(t *testing.T) {
+		b := protowire.AppendTag(nil, ztocFieldVersion, protowire.BytesType)
+		b = protowire.AppendString(b, "99.0")
+		compressed, err := zstdEncode(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := GetZtoc(bytes.NewReader(compressed)); !errors.Is(err, errUnsupportedZtocVersion) {
+			t.Fatalf("expected %v, got %v", errUnsupportedZtocVersion, err)
+		}
+	})
+}
+
+// encodeGobZtoc serializes the ztoc as version 0.1 ztocs were serialized.
+func encodeGobZtoc(t *testing.T, ztoc *Ztoc) []byte {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(*ztoc); err != nil {
+		t.Fatalf("cannot serialize ztoc: %v", err)
+	}
+	compressed, err := zstdEncode(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return compressed
+}
+
+func zstdEncode(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zs, err := zstd.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zs.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zs.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func TestSpanDigests(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; sb.Len() < 1<<20; i++ {
+		fmt.Fprintf(&sb, "line %d: %d\n", i, rand.Intn(1000))
+	}
+	ents := []testutil.TarEntry{
+		testutil.File("text", sb.String()),
+		testutil.File("random", string(genRandomByteData(300000))),
+		testutil.File("small", "small"),
+	}
+	testCases := []struct {
+		name        string
+		buildZtoc   func() (*Ztoc, *io.SectionReader, error)
+		minNumSpans int
+	}{
+		{
+			name: "gzip",
+			buildZtoc: func() (*Ztoc, *io.SectionReader, error) {
+				return BuildZtocReader(ents, gzip.BestCompression, 65536)
+			},
+			minNumSpans: 5,
+		},
+		{
+			name: "zstd",
+			buildZtoc: func() (*Ztoc, *io.SectionReader, error) {
+				return BuildZstdZtocReader(ents, 16384, 65536)
+			},
+			minNumSpans: 5,
+		},
+		{
+			name: "uncompressed",
+			buildZtoc: func() (*Ztoc, *io.SectionReader, error) {
+				return BuildTarZtocReader(ents, 65536)
+			},
+			minNumSpans: 5,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ztoc, sr, err := tc.buildZtoc()
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if ztoc.CompressedFileSize != FileSize(sr.Size()) {
+				t.Fatalf("unexpected compressed size; expected %d, got %d", sr.Size(), ztoc.CompressedFileSize)
+			}
+			zinfo, err := NewZinfoFromZtoc(ztoc)
+			if err != nil {
+				t.Fatalf("can't create zinfo: %v", err)
+			}
+			defer zinfo.Close()
+
+			if len(ztoc.ZtocInfo.SpanDigests) < tc.minNumSpans {
+				t.Fatalf("expected at least %d spans, got %d", tc.minNumSpans, len(ztoc.ZtocInfo.SpanDigests))
+			}
+			if len(ztoc.ZtocInfo.SpanDigests) != int(zinfo.MaxSpanID())+1 {
+				t.Fatalf("unexpected number of span digests; expected %d, got %d", zinfo.MaxSpanID()+1, len(ztoc.ZtocInfo.SpanDigests))
+			}
+			for i, dgst := range ztoc.ZtocInfo.SpanDigests {
+				start := zinfo.StartCompressedOffset(SpanId(i))
+				end := zinfo.EndCompressedOffset(SpanId(i), ztoc.CompressedFileSize)
+				expected, err := digest.FromReader(io.NewSectionReader(sr, int64(start), int64(end-start)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dgst != expected {
+					t.Fatalf("unexpected digest of span %d; expected %v, got %v", i, expected, dgst)
+				}
+			}
+		})
+	}
+}
+
+func TestGzipCompressedWindows(t *testing.T) {
+	var sb strings.Builder
+	for i := 0; sb.Len() < 1<<20; i++ {
+		fmt.Fprintf(&sb, "line %d: %d\n", i, rand.Intn(1000))
+	}
+	contents := map[string]string{
+		"text":   sb.String(),
+		"random": string(genRandomByteData(300000)),
+		"small":  "small",
+	}
+	ents := []testutil.TarEntry{
+		testutil.File("text", contents["text"]),
+		testutil.File("random", contents["random"]),
+		testutil.File("small", contents["small"]),
+	}
+	ztoc, sr, err := BuildZtocReader(ents, gzip.BestCompression, 65536)
+	if err != nil {
+		t.Fatalf("can't build ztoc: %v", err)
+	}
+	index, err := unmarshalGzipIndex(ztoc.IndexByteData)
+	if err != nil {
+		t.Fatalf("can't read gzip index: %v", err)
+	}
+	if index.have < 5 {
+		t.Fatalf("expected at least 5 checkpoints, got %d", index.have)
+	}
+
+	// The same index in the layout used before windows were compressed.
+	legacy := make([]byte, 12)
+	binary.LittleEndian.PutUint32(legacy[0:4], uint32(index.have))
+	binary.LittleEndian.PutUint64(legacy[4:12], index.span_size)
+	for _, pt := range index.list[1:] {
+		if len(pt.window) != windowSize {
+			t.Fatalf("unexpected window size %d", len(pt.window))
+		}
+		var hdr [17]byte
+		binary.LittleEndian.PutUint64(hdr[0:8], uint64(pt.in))
+		binary.LittleEndian.PutUint64(hdr[8:16], uint64(pt.out))
+		hdr[16] = byte(pt.bits)
+		legacy = append(legacy, hdr[:]...)
+		legacy = append(legacy, pt.window...)
+	}
+	if len(ztoc.IndexByteData) >= len(legacy) {
+		t.Fatalf("expected compressed windows to shrink the checkpoints; compressed = %d, uncompressed = %d", len(ztoc.IndexByteData), len(legacy))
+	}
+
+	for _, indexByteData := range [][]byte{ztoc.IndexByteData, legacy} {
+		for _, m := range ztoc.Metadata {
+			extracted, err := ExtractFile(sr, &FileExtractConfig{
+				UncompressedSize:     m.UncompressedSize,
+				UncompressedOffset:   m.UncompressedOffset,
+				SpanStart:            m.SpanStart,
+				SpanEnd:              m.SpanEnd,
+				FirstSpanHasBits:     m.FirstSpanHasBits,
+				IndexByteData:        indexByteData,
+				CompressedFileSize:   ztoc.CompressedFileSize,
+				MaxSpanId:            ztoc.MaxSpanId,
+				CompressionAlgorithm: ztoc.CompressionAlgorithm,
+			})
+			if err != nil {
+				t.Fatalf("can't extract %s: %v", m.Name, err)
+			}
+			if string(extracted) != contents[m.Name] {
+				t.Fatalf("unexpected contents of %s", m.Name)
+			}
+		}
+	}
+}
+
+func TestFileDigests(t *testing.T) {
+	contents := map[string]string{
+		"file1": string(genRandomByteData(200000)),
+		"file2": "small",
+		"empty": "",
+	}
+	ents := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("file1", contents["file1"]),
+		testutil.File("file2", contents["file2"]),
+		testutil.File("empty", contents["empty"]),
+		testutil.Symlink("link", "file1"),
+	}
+	_, sr, err := BuildZtocReader(ents, gzip.DefaultCompression, 65536)
+	if err != nil {
+		t.Fatalf("can't build sample layer: %v", err)
+	}
+
+	for _, fileDigests := range []bool{false, true} {
+		t.Run(fmt.Sprintf("file_digests_%v", fileDigests), func(t *testing.T) {
+			var cfg buildConfig
+			if fileDigests {
+				if err := WithFileDigests()(&cfg); err != nil {
+					t.Fatal(err)
+				}
+			}
+			ztoc, err := BuildZtoc(sr, 65536, CompressionGzip, &cfg)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			for _, m := range ztoc.Metadata {
+				want := digest.Digest("")
+				if fileDigests && m.Type == "reg" {
+					want = digest.FromString(contents[m.Name])
+				}
+				if m.Digest != want {
+					t.Fatalf("unexpected digest of %s; expected = %v, got = %v", m.Name, want, m.Digest)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// DiscrepancyLayer is the kind of a discrepancy between the ztoc and the layer as a whole.
+	DiscrepancyLayer = "layer"
+	// DiscrepancySpan is the kind of a discrepancy in the digest of a span.
+	DiscrepancySpan = "span"
+	// DiscrepancyFile is the kind of a discrepancy between the metadata of a file and the tar entry.
+	DiscrepancyFile = "file"
+)
+
+// ZtocDiscrepancy is an inconsistency between a ztoc and the layer it was built for.
+type ZtocDiscrepancy struct {
+	Kind    string  `json:"kind"`
+	SpanID  *SpanId `json:"spanId,omitempty"`
+	File    string  `json:"file,omitempty"`
+	Message string  `json:"message"`
+}
+
+func (d ZtocDiscrepancy) String() string {
+	switch {
+	case d.SpanID != nil:
+		return fmt.Sprintf("%s %d: %s", d.Kind, *d.SpanID, d.Message)
+	case d.File != "":
+		return fmt.Sprintf("%s %s: %s", d.Kind, d.File, d.Message)
+	default:
+		return fmt.Sprintf("%s: %s", d.Kind, d.Message)
+	}
+}
+
+// VerifyZtoc checks that the ztoc is consistent with the layer read from sr. It recomputes
+// the digest of the compressed data of every span and walks the tar entries of the layer to
+// confirm that the offset and size of each file in the ztoc point to a tar entry with the same
+// name, type and, if the ztoc records it, the same digest.
+// It returns all the discrepancies found, which is empty if the ztoc matches the layer.
+// An error is only returned if the ztoc itself can't be used to read the layer.
+func VerifyZtoc(ztoc *Ztoc, sr *io.SectionReader) ([]ZtocDiscrepancy, error) {
+	var discrepancies []ZtocDiscrepancy
+	if FileSize(sr.Size()) != ztoc.CompressedFileSize {
+		discrepancies = append(discrepancies, ZtocDiscrepancy{
+			Kind:    DiscrepancyLayer,
+			Message: fmt.Sprintf("compressed size is %d, ztoc expects %d", sr.Size(), ztoc.CompressedFileSize),
+		})
+	}
+
+	zinfo, err := NewZinfoFromZtoc(ztoc)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read zinfo of ztoc: %w", err)
+	}
+	defer zinfo.Close()
+
+	spanDiscrepancies, err := verifySpanDigests(ztoc, zinfo, sr)
+	if err != nil {
+		return nil, err
+	}
+	discrepancies = append(discrepancies, spanDiscrepancies...)
+
+	return append(discrepancies, verifyFileMetadata(ztoc, zinfo, sr)...), nil
+}
+
+func verifySpanDigests(ztoc *Ztoc, zinfo Zinfo, sr *io.SectionReader) ([]ZtocDiscrepancy, error) {
+	spanDigests := ztoc.ZtocInfo.SpanDigests
+	if len(spanDigests) == 0 {
+		// ztocs built before span digests were recorded
+		return nil, nil
+	}
+	if len(spanDigests) != int(ztoc.MaxSpanId)+1 {
+		return []ZtocDiscrepancy{{
+			Kind:    DiscrepancyLayer,
+			Message: fmt.Sprintf("ztoc has %d span digests for %d spans", len(spanDigests), ztoc.MaxSpanId+1),
+		}}, nil
+	}
+
+	var discrepancies []ZtocDiscrepancy
+	for i := SpanId(0); i <= ztoc.MaxSpanId; i++ {
+		id := i
+		start := zinfo.StartCompressedOffset(id)
+		end := zinfo.EndCompressedOffset(id, ztoc.CompressedFileSize)
+		if end < start || int64(end) > sr.Size() {
+			discrepancies = append(discrepancies, ZtocDiscrepancy{
+				Kind:    DiscrepancySpan,
+				SpanID:  &id,
+				Message: fmt.Sprintf("compressed range [%d, %d) is outside of the layer", start, end),
+			})
+			continue
+		}
+		verifier := spanDigests[id].Verifier()
+		if _, err := io.Copy(verifier, io.NewSectionReader(sr, int64(start), int64(end-start))); err != nil {
+			return nil, fmt.Errorf("cannot read span %d: %w", id, err)
+		}
+		if !verifier.Verified() {
+			discrepancies = append(discrepancies, ZtocDiscrepancy{
+				Kind:    DiscrepancySpan,
+				SpanID:  &id,
+				Message: fmt.Sprintf("compressed data doesn't match digest %v", spanDigests[id]),
+			})
+		}
+	}
+	return discrepancies, nil
+}
+
+// tarEntry is a tar entry of the layer, keyed by the uncompressed offset of its contents.
+type tarEntry struct {
+	name   string
+	typ    string
+	size   FileSize
+	digest digest.Digest
+	seen   bool
+}
+
+func verifyFileMetadata(ztoc *Ztoc, zinfo Zinfo, sr *io.SectionReader) []ZtocDiscrepancy {
+	var discrepancies []ZtocDiscrepancy
+	entries, err := readTarEntries(ztoc.CompressionAlgorithm, int64(zinfo.SpanSize()), sr)
+	if err != nil {
+		// report the entries read so far, the ones after the error are reported as missing.
+		discrepancies = append(discrepancies, ZtocDiscrepancy{
+			Kind:    DiscrepancyLayer,
+			Message: err.Error(),
+		})
+	}
+
+	for _, m := range ztoc.Metadata {
+		ent, ok := entries[m.UncompressedOffset]
+		if !ok {
+			discrepancies = append(discrepancies, ZtocDiscrepancy{
+				Kind:    DiscrepancyFile,
+				File:    m.Name,
+				Message: fmt.Sprintf("no tar entry at offset %d", m.UncompressedOffset),
+			})
+			continue
+		}
+		ent.seen = true
+		var msgs []string
+		if ent.name != m.Name {
+			msgs = append(msgs, fmt.Sprintf("tar entry at offset %d is %s", m.UncompressedOffset, ent.name))
+		}
+		if ent.typ != m.Type {
+			msgs = append(msgs, fmt.Sprintf("type is %s, tar entry is %s", m.Type, ent.typ))
+		}
+		if ent.size != m.Size() {
+			msgs = append(msgs, fmt.Sprintf("size is %d, tar entry is %d bytes", m.Size(), ent.size))
+		}
+		if m.Digest != "" && ent.digest != m.Digest {
+			msgs = append(msgs, fmt.Sprintf("digest is %v, contents of tar entry are %v", m.Digest, ent.digest))
+		}
+		for _, msg := range msgs {
+			discrepancies = append(discrepancies, ZtocDiscrepancy{
+				Kind:    DiscrepancyFile,
+				File:    m.Name,
+				Message: msg,
+			})
+		}
+	}
+
+	offsets := make([]FileSize, 0, len(entries))
+	for offset := range entries {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	for _, offset := range offsets {
+		if ent := entries[offset]; !ent.seen {
+			discrepancies = append(discrepancies, ZtocDiscrepancy{
+				Kind:    DiscrepancyFile,
+				File:    ent.name,
+				Message: fmt.Sprintf("tar entry at offset %d is missing from the ztoc", offset),
+			})
+		}
+	}
+	return discrepancies
+}
+
+// readTarEntries decompresses the layer and returns its tar entries. If the layer can't be
+// read to the end, the entries read before the error are returned along with the error.
+func readTarEntries(compressionAlgo string, span int64, sr *io.SectionReader) (map[FileSize]*tarEntry, error) {
+	if compressionAlgo == "" {
+		compressionAlgo = CompressionGzip
+	}
+	entries := make(map[FileSize]*tarEntry)
+	builder, err := newZinfoBuilder(compressionAlgo, io.NewSectionReader(sr, 0, sr.Size()), span, &spanDigester{}, nil)
+	if err != nil {
+		return entries, err
+	}
+	defer builder.Close()
+
+	pt := &positionTrackerReader{r: builder}
+	tr := tar.NewReader(pt)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, fmt.Errorf("error while reading tar header: %w", err)
+		}
+		typ, err := getType(hdr)
+		if err != nil {
+			return entries, err
+		}
+		ent := &tarEntry{
+			name: hdr.Name,
+			typ:  typ,
+			size: FileSize(hdr.Size),
+		}
+		offset := pt.CurrentPos()
+		digester := digest.Canonical.Digester()
+		if _, err := io.Copy(digester.Hash(), tr); err != nil {
+			return entries, fmt.Errorf("error while reading contents of %s: %w", hdr.Name, err)
+		}
+		ent.digest = digester.Digest()
+		entries[offset] = ent
+	}
+}
@@ -0,0 +1,148 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package soci
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"testing"
+
+	"github.com/awslabs/soci-snapshotter/util/testutil"
+	"github.com/opencontainers/go-digest"
+)
+
+func TestVerifyZtoc(t *testing.T) {
+	ents := []testutil.TarEntry{
+		testutil.Dir("dir/"),
+		testutil.File("dir/file1", string(genRandomByteData(200000))),
+		testutil.File("dir/file2", string(genRandomByteData(100000))),
+		testutil.Symlink("link", "dir/file1"),
+	}
+
+	testCases := []struct {
+		name          string
+		modifyZtoc    func(*Ztoc)
+		discrepancies []ZtocDiscrepancy
+	}{
+		{
+			name: "matching ztoc",
+		},
+		{
+			name: "renamed file",
+			modifyZtoc: func(z *Ztoc) {
+				z.Metadata[1].Name = "dir/other"
+			},
+			discrepancies: []ZtocDiscrepancy{
+				{Kind: DiscrepancyFile, File: "dir/other"},
+			},
+		},
+		{
+			name: "wrong size and type",
+			modifyZtoc: func(z *Ztoc) {
+				z.Metadata[2].UncompressedSize++
+				z.Metadata[2].Type = "symlink"
+			},
+			discrepancies: []ZtocDiscrepancy{
+				{Kind: DiscrepancyFile, File: "dir/file2"},
+				{Kind: DiscrepancyFile, File: "dir/file2"},
+			},
+		},
+		{
+			name: "wrong offset",
+			modifyZtoc: func(z *Ztoc) {
+				z.Metadata[2].UncompressedOffset++
+			},
+			discrepancies: []ZtocDiscrepancy{
+				{Kind: DiscrepancyFile, File: "dir/file2"},
+				{Kind: DiscrepancyFile, File: "dir/file2"},
+			},
+		},
+		{
+			name: "wrong file digest",
+			modifyZtoc: func(z *Ztoc) {
+				z.Metadata[1].Digest = digest.FromString("dummy")
+			},
+			discrepancies: []ZtocDiscrepancy{
+				{Kind: DiscrepancyFile, File: "dir/file1"},
+			},
+		},
+		{
+			name: "missing file",
+			modifyZtoc: func(z *Ztoc) {
+				z.Metadata = z.Metadata[:len(z.Metadata)-1]
+			},
+			discrepancies: []ZtocDiscrepancy{
+				{Kind: DiscrepancyFile, File: "link"},
+			},
+		},
+		{
+			name: "wrong span digest",
+			modifyZtoc: func(z *Ztoc) {
+				z.ZtocInfo.SpanDigests[1] = digest.FromString("dummy")
+			},
+			discrepancies: []ZtocDiscrepancy{
+				{Kind: DiscrepancySpan},
+			},
+		},
+		{
+			name: "wrong number of span digests",
+			modifyZtoc: func(z *Ztoc) {
+				z.ZtocInfo.SpanDigests = z.ZtocInfo.SpanDigests[1:]
+			},
+			discrepancies: []ZtocDiscrepancy{
+				{Kind: DiscrepancyLayer},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ztoc, sr, err := BuildZtocReader(ents, gzip.DefaultCompression, 65536)
+			if err != nil {
+				t.Fatalf("can't build ztoc: %v", err)
+			}
+			if ztoc.MaxSpanId < 1 {
+				t.Fatalf("expected at least 2 spans, got %d", ztoc.MaxSpanId+1)
+			}
+			layer, err := io.ReadAll(sr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.modifyZtoc != nil {
+				tc.modifyZtoc(ztoc)
+			}
+
+			discrepancies, err := VerifyZtoc(ztoc, io.NewSectionReader(bytes.NewReader(layer), 0, int64(len(layer))))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(discrepancies) != len(tc.discrepancies) {
+				t.Fatalf("unexpected discrepancies; expected %d, got %v", len(tc.discrepancies), discrepancies)
+			}
+			for i, want := range tc.discrepancies {
+				got := discrepancies[i]
+				if got.Kind != want.Kind || got.File != want.File {
+					t.Fatalf("unexpected discrepancy %d; expected %s %s, got %v", i, want.Kind, want.File, got)
+				}
+				if got.Kind == DiscrepancySpan && got.SpanID == nil {
+					t.Fatalf("expected the id of the span in %v", got)
+				}
+			}
+		})
+	}
+}
@@ -42,6 +42,8 @@ import (
 	"os"
 	"strings"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 // TarEntry is an entry of tar.
@@ -75,11 +77,9 @@ func BuildTar(ents []TarEntry, opts ...BuildTarOption) io.Reader {
 	pr, pw := io.Pipe()
 	go func() {
 		tw := tar.NewWriter(pw)
-		for _, ent := range ents {
-			if err := ent.AppendTar(tw, bo); err != nil {
-				pw.CloseWithError(err)
-				return
-			}
+		if err := appendTarEntries(pw, tw, ents, bo); err != nil {
+			pw.CloseWithError(err)
+			return
 		}
 		if err := tw.Close(); err != nil {
 			pw.CloseWithError(err)
@@ -103,11 +103,9 @@ func BuildTarGz(ents []TarEntry, compressionLevel int, opts ...BuildTarOption) i
 			return
 		}
 		tw := tar.NewWriter(gw)
-		for _, ent := range ents {
-			if err := ent.AppendTar(tw, bo); err != nil {
-				pw.CloseWithError(err)
-				return
-			}
+		if err := appendTarEntries(gw, tw, ents, bo); err != nil {
+			pw.CloseWithError(err)
+			return
 		}
 		if err := tw.Close(); err != nil {
 			pw.CloseWithError(err)
@@ -122,6 +120,67 @@ func BuildTarGz(ents []TarEntry, compressionLevel int, opts ...BuildTarOption) i
 	return pr
 }
 
+// BuildTarZstd builds a zstd-compressed tar blob. The tar stream is cut into
+// chunks of frameSize bytes and each chunk is compressed as a separate zstd frame.
+// If frameSize is not positive, the whole tar stream is compressed as a single frame.
+func BuildTarZstd(ents []TarEntry, frameSize int, opts ...BuildTarOption) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		tarData, err := io.ReadAll(BuildTar(ents, opts...))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		enc, err := zstd.NewWriter(nil)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		defer enc.Close()
+		if frameSize <= 0 {
+			frameSize = len(tarData)
+		}
+		for len(tarData) > 0 {
+			n := frameSize
+			if n > len(tarData) {
+				n = len(tarData)
+			}
+			if _, err := pw.Write(enc.EncodeAll(tarData[:n], nil)); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			tarData = tarData[n:]
+		}
+		pw.Close()
+	}()
+	return pr
+}
+
+// rawTarEntry is a tar entry which archive/tar can't write, e.g. a sparse file.
+// It's written as raw tar blocks to the writer under the tar.Writer.
+type rawTarEntry interface {
+	appendRawTar(w io.Writer, opts BuildTarOptions) error
+}
+
+// appendTarEntries appends the entries to tw, which writes to w.
+func appendTarEntries(w io.Writer, tw *tar.Writer, ents []TarEntry, opts BuildTarOptions) error {
+	for _, ent := range ents {
+		if raw, ok := ent.(rawTarEntry); ok {
+			if err := tw.Flush(); err != nil {
+				return err
+			}
+			if err := raw.appendRawTar(w, opts); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ent.AppendTar(tw, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type tarEntryFunc func(*tar.Writer, BuildTarOptions) error
 
 func (f tarEntryFunc) AppendTar(tw *tar.Writer, opts BuildTarOptions) error { return f(tw, opts) }
@@ -201,6 +260,7 @@ type fileOpts struct {
 	xattrs  map[string]string
 	mode    *os.FileMode
 	modTime time.Time
+	format  tar.Format
 }
 
 // WithFileOwner specifies the owner of the file.
@@ -232,6 +292,14 @@ func WithFileMode(mode os.FileMode) FileBuildTarOption {
 	}
 }
 
+// WithFileFormat specifies the tar format of the header of the file,
+// e.g. tar.FormatGNU to store a long name in a GNU long name header.
+func WithFileFormat(format tar.Format) FileBuildTarOption {
+	return func(o *fileOpts) {
+		o.format = format
+	}
+}
+
 // File is a regilar file entry
 func File(name, contents string, opts ...FileBuildTarOption) TarEntry {
 	return tarEntryFunc(func(tw *tar.Writer, buildOpts BuildTarOptions) error {
@@ -255,6 +323,7 @@ func File(name, contents string, opts ...FileBuildTarOption) TarEntry {
 			Size:     int64(len(contents)),
 			Uid:      fOpts.uid,
 			Gid:      fOpts.gid,
+			Format:   fOpts.format,
 		}); err != nil {
 			return err
 		}
@@ -0,0 +1,227 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// archive/tar can read GNU sparse files but can't write them, so sparse file
+// entries are written as raw tar blocks.
+
+// SparseFormat is the encoding of a sparse file in a tar.
+type SparseFormat int
+
+const (
+	// SparseGNU is the old GNU sparse format, with the sparse map in the header
+	// and its extension blocks.
+	SparseGNU SparseFormat = iota
+	// SparsePAX0x0 is the PAX sparse format 0.0, with a PAX record for the offset
+	// and the size of each fragment.
+	SparsePAX0x0
+	// SparsePAX0x1 is the PAX sparse format 0.1, with the sparse map in a single PAX record.
+	SparsePAX0x1
+	// SparsePAX1x0 is the PAX sparse format 1.0, with the sparse map at the start of the data.
+	SparsePAX1x0
+)
+
+// SparseFragment is a fragment of data of a sparse file.
+type SparseFragment struct {
+	Offset int64
+	Data   string
+}
+
+// SparseContents returns the contents of a sparse file of the given size with the fragments.
+func SparseContents(size int64, fragments ...SparseFragment) []byte {
+	contents := make([]byte, size)
+	for _, f := range fragments {
+		copy(contents[f.Offset:], f.Data)
+	}
+	return contents
+}
+
+const (
+	tarBlockSize = 512
+
+	gnuHeaderSparseEntries = 4
+	gnuExtensionEntries    = 21
+)
+
+type sparseFile struct {
+	name      string
+	size      int64
+	format    SparseFormat
+	fragments []SparseFragment
+}
+
+// SparseFile is a regular file entry of the given size, holding the fragments of data and
+// holes everywhere else, encoded in the tar as a sparse file of the given format.
+// Fragments must be sorted and must not overlap.
+func SparseFile(name string, size int64, format SparseFormat, fragments ...SparseFragment) TarEntry {
+	return &sparseFile{name: name, size: size, format: format, fragments: fragments}
+}
+
+func (f *sparseFile) AppendTar(_ *tar.Writer, _ BuildTarOptions) error {
+	return fmt.Errorf("sparse file %q must be written as raw tar blocks", f.name)
+}
+
+func (f *sparseFile) appendRawTar(w io.Writer, opts BuildTarOptions) error {
+	name := opts.Prefix + f.name
+	if len(name) > 100 {
+		return fmt.Errorf("name of sparse file %q is too long", name)
+	}
+	var data bytes.Buffer
+	for _, frag := range f.fragments {
+		data.WriteString(frag.Data)
+	}
+
+	var buf bytes.Buffer
+	switch f.format {
+	case SparseGNU:
+		buf.Write(f.oldGNUHeaders(name, int64(data.Len())))
+	case SparsePAX0x0, SparsePAX0x1:
+		records := []string{paxRecord("GNU.sparse.size", fmt.Sprint(f.size)), paxRecord("GNU.sparse.numblocks", fmt.Sprint(len(f.fragments)))}
+		if f.format == SparsePAX0x0 {
+			for _, frag := range f.fragments {
+				records = append(records, paxRecord("GNU.sparse.offset", fmt.Sprint(frag.Offset)), paxRecord("GNU.sparse.numbytes", fmt.Sprint(len(frag.Data))))
+			}
+		} else {
+			var m []string
+			for _, frag := range f.fragments {
+				m = append(m, fmt.Sprint(frag.Offset), fmt.Sprint(len(frag.Data)))
+			}
+			records = append(records, paxRecord("GNU.sparse.map", strings.Join(m, ",")))
+		}
+		writePAXHeader(&buf, name, records)
+		buf.Write(tarHeader(name, '0', int64(data.Len()), false))
+	case SparsePAX1x0:
+		sparseMap := fmt.Sprintf("%d\n", len(f.fragments))
+		for _, frag := range f.fragments {
+			sparseMap += fmt.Sprintf("%d\n%d\n", frag.Offset, len(frag.Data))
+		}
+		sparseMap += string(make([]byte, tarPadding(int64(len(sparseMap)))))
+		writePAXHeader(&buf, name, []string{
+			paxRecord("GNU.sparse.major", "1"),
+			paxRecord("GNU.sparse.minor", "0"),
+			paxRecord("GNU.sparse.name", name),
+			paxRecord("GNU.sparse.realsize", fmt.Sprint(f.size)),
+		})
+		// GNU tar stores the file under a different name so that tars without
+		// support for sparse files extract it to a separate file
+		buf.Write(tarHeader(path.Join(path.Dir(name), "GNUSparseFile.0", path.Base(name)), '0', int64(len(sparseMap)+data.Len()), false))
+		buf.WriteString(sparseMap)
+	default:
+		return fmt.Errorf("unknown sparse format %d", f.format)
+	}
+	buf.Write(data.Bytes())
+	buf.Write(make([]byte, tarPadding(int64(data.Len()))))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// oldGNUHeaders returns the header block and the extension blocks of the sparse
+// file in the old GNU sparse format.
+func (f *sparseFile) oldGNUHeaders(name string, dataSize int64) []byte {
+	hdr := tarHeader(name, 'S', dataSize, true)
+	copy(hdr[483:495], fmt.Sprintf("%011o\x00", f.size)) // real size
+	fragments := f.fragments
+	n := len(fragments)
+	if n > gnuHeaderSparseEntries {
+		n = gnuHeaderSparseEntries
+		hdr[482] = 1 // isextended
+	}
+	writeGNUSparseEntries(hdr[386:], fragments[:n])
+	blocks := [][]byte{hdr}
+	for fragments = fragments[n:]; len(fragments) > 0; fragments = fragments[n:] {
+		ext := make([]byte, tarBlockSize)
+		n = len(fragments)
+		if n > gnuExtensionEntries {
+			n = gnuExtensionEntries
+			ext[504] = 1 // isextended
+		}
+		writeGNUSparseEntries(ext, fragments[:n])
+		blocks = append(blocks, ext)
+	}
+	// the checksum of the header covers its sparse map
+	setTarChecksum(hdr)
+	return bytes.Join(blocks, nil)
+}
+
+func writeGNUSparseEntries(b []byte, fragments []SparseFragment) {
+	for i, frag := range fragments {
+		copy(b[i*24:], fmt.Sprintf("%011o\x00%011o\x00", frag.Offset, len(frag.Data)))
+	}
+}
+
+// tarHeader returns a header block of a file with a name of at most 100 bytes.
+func tarHeader(name string, typeflag byte, size int64, gnu bool) []byte {
+	hdr := make([]byte, tarBlockSize)
+	copy(hdr[0:100], name)
+	copy(hdr[100:108], "0000644\x00")
+	copy(hdr[108:116], "0000000\x00")
+	copy(hdr[116:124], "0000000\x00")
+	copy(hdr[124:136], fmt.Sprintf("%011o\x00", size))
+	copy(hdr[136:148], "00000000000\x00")
+	hdr[156] = typeflag
+	if gnu {
+		copy(hdr[257:265], "ustar  \x00")
+	} else {
+		copy(hdr[257:265], "ustar\x0000")
+	}
+	setTarChecksum(hdr)
+	return hdr
+}
+
+func setTarChecksum(hdr []byte) {
+	copy(hdr[148:156], "        ")
+	var sum int64
+	for _, c := range hdr {
+		sum += int64(c)
+	}
+	copy(hdr[148:156], fmt.Sprintf("%06o\x00 ", sum))
+}
+
+// writePAXHeader writes a PAX extended header with the records for the file.
+func writePAXHeader(buf *bytes.Buffer, name string, records []string) {
+	body := strings.Join(records, "")
+	buf.Write(tarHeader(path.Join(path.Dir(name), "PaxHeaders.0", path.Base(name)), 'x', int64(len(body)), false))
+	buf.WriteString(body)
+	buf.Write(make([]byte, tarPadding(int64(len(body)))))
+}
+
+// paxRecord formats a PAX record, which starts with its own length.
+func paxRecord(k, v string) string {
+	const padding = 3 // extra padding for ' ', '=', and '\n'
+	size := len(k) + len(v) + padding
+	size += len(fmt.Sprint(size))
+	record := fmt.Sprintf("%d %s=%s\n", size, k, v)
+	if len(record) != size {
+		// the length gained a digit
+		size = len(record)
+		record = fmt.Sprintf("%d %s=%s\n", size, k, v)
+	}
+	return record
+}
+
+func tarPadding(n int64) int64 {
+	return -n & (tarBlockSize - 1)
+}
@@ -0,0 +1,389 @@
+/*
+   Copyright The Soci Snapshotter Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package testutil
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+)
+
+// The layers built here have the layout of the eStargz and zstd:chunked layers built by
+// stargz-snapshotter and containers/storage, with the subset of the TOC fields read by soci.
+
+// EStargzTOCEntry is an entry of the TOC of an eStargz layer.
+type EStargzTOCEntry struct {
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     string            `json:"modtime,omitempty"`
+	LinkName    string            `json:"linkName,omitempty"`
+	Mode        int64             `json:"mode,omitempty"`
+	UID         int               `json:"uid,omitempty"`
+	GID         int               `json:"gid,omitempty"`
+	Uname       string            `json:"userName,omitempty"`
+	Gname       string            `json:"groupName,omitempty"`
+	Offset      int64             `json:"offset,omitempty"`
+	DevMajor    int               `json:"devMajor,omitempty"`
+	DevMinor    int               `json:"devMinor,omitempty"`
+	Xattrs      map[string][]byte `json:"xattrs,omitempty"`
+	Digest      string            `json:"digest,omitempty"`
+	ChunkOffset int64             `json:"chunkOffset,omitempty"`
+	ChunkSize   int64             `json:"chunkSize,omitempty"`
+}
+
+// ZstdChunkedTOCEntry is an entry of the manifest of a zstd:chunked layer.
+type ZstdChunkedTOCEntry struct {
+	Type        string `json:"type"`
+	Name        string `json:"name,omitempty"`
+	LinkName    string `json:"linkName,omitempty"`
+	Mode        int64  `json:"mode,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	Offset      int64  `json:"offset,omitempty"`
+	EndOffset   int64  `json:"endOffset,omitempty"`
+	ChunkSize   int64  `json:"chunkSize,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+}
+
+// tocEntryTypes are the types of the TOC entries of tar entries.
+var tocEntryTypes = map[byte]string{
+	tar.TypeReg:     "reg",
+	tar.TypeDir:     "dir",
+	tar.TypeSymlink: "symlink",
+	tar.TypeLink:    "hardlink",
+	tar.TypeChar:    "char",
+	tar.TypeBlock:   "block",
+	tar.TypeFifo:    "fifo",
+}
+
+// switchWriter writes to a writer which can be switched.
+type switchWriter struct {
+	w io.Writer
+}
+
+func (s *switchWriter) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+// countWriter counts the bytes written to a buffer.
+type countWriter struct {
+	buf bytes.Buffer
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func (c *countWriter) offset() int64 {
+	return int64(c.buf.Len())
+}
+
+// forEachTarEntry calls f with each header of the tar of the entries, and a reader of its contents.
+func forEachTarEntry(ents []TarEntry, opts []BuildTarOption, f func(*tar.Header, io.Reader) error) error {
+	tr := tar.NewReader(BuildTar(ents, opts...))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := f(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// readChunks reads the contents of a file in chunks of chunkSize bytes, the last one being shorter.
+func readChunks(r io.Reader, size, chunkSize int64) ([][]byte, error) {
+	var chunks [][]byte
+	for size > 0 {
+		n := chunkSize
+		if n > size {
+			n = size
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, chunk)
+		size -= n
+	}
+	return chunks, nil
+}
+
+// BuildEStargz builds an eStargz layer. Each chunk of at most chunkSize bytes of the contents
+// of a file starts a new gzip member, and the tar headers are at the end of the previous one.
+// The TOC is in the last tar entry, in its own gzip member, followed by the footer.
+func BuildEStargz(ents []TarEntry, chunkSize int64, opts ...BuildTarOption) (io.Reader, error) {
+	cw := &countWriter{}
+	gw := gzip.NewWriter(cw)
+	sw := &switchWriter{w: gw}
+	tw := tar.NewWriter(sw)
+	// newMember closes the current gzip member and starts a new one
+	newMember := func() error {
+		if err := gw.Close(); err != nil {
+			return err
+		}
+		gw = gzip.NewWriter(cw)
+		sw.w = gw
+		return nil
+	}
+
+	var toc struct {
+		Version int                `json:"version"`
+		Entries []*EStargzTOCEntry `json:"entries"`
+	}
+	toc.Version = 1
+	unames := make(map[int]string)
+	gnames := make(map[int]string)
+	// nameIfChanged returns the name if it's not the last one recorded for the id
+	nameIfChanged := func(names map[int]string, id int, name string) string {
+		if name == "" || names[id] == name {
+			return ""
+		}
+		names[id] = name
+		return name
+	}
+	err := forEachTarEntry(ents, opts, func(hdr *tar.Header, r io.Reader) error {
+		typ, ok := tocEntryTypes[hdr.Typeflag]
+		if !ok {
+			return fmt.Errorf("unsupported type %q of %s", hdr.Typeflag, hdr.Name)
+		}
+		ent := &EStargzTOCEntry{
+			Name:     hdr.Name,
+			Type:     typ,
+			LinkName: hdr.Linkname,
+			Mode:     hdr.Mode,
+			UID:      hdr.Uid,
+			GID:      hdr.Gid,
+			Uname:    nameIfChanged(unames, hdr.Uid, hdr.Uname),
+			Gname:    nameIfChanged(gnames, hdr.Gid, hdr.Gname),
+			DevMajor: int(hdr.Devmajor),
+			DevMinor: int(hdr.Devminor),
+		}
+		if typ == "reg" {
+			ent.Size = hdr.Size
+		}
+		if !hdr.ModTime.IsZero() && hdr.ModTime.Unix() != 0 {
+			ent.ModTime = hdr.ModTime.UTC().Round(time.Second).Format(time.RFC3339)
+		}
+		for k, v := range hdr.Xattrs {
+			if ent.Xattrs == nil {
+				ent.Xattrs = make(map[string][]byte)
+			}
+			ent.Xattrs[k] = []byte(v)
+		}
+		toc.Entries = append(toc.Entries, ent)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		chunks, err := readChunks(r, ent.Size, chunkSize)
+		if err != nil {
+			return err
+		}
+		fileDigest := digest.Canonical.Digester()
+		var chunkOffset int64
+		for i, chunk := range chunks {
+			if err := newMember(); err != nil {
+				return err
+			}
+			chunkEnt := ent
+			if i > 0 {
+				chunkEnt = &EStargzTOCEntry{Name: hdr.Name, Type: "chunk"}
+				toc.Entries = append(toc.Entries, chunkEnt)
+			}
+			chunkEnt.Offset = cw.offset()
+			chunkEnt.ChunkOffset = chunkOffset
+			if len(chunks) > 1 {
+				chunkEnt.ChunkSize = int64(len(chunk))
+			}
+			if _, err := tw.Write(chunk); err != nil {
+				return err
+			}
+			fileDigest.Hash().Write(chunk)
+			chunkOffset += int64(len(chunk))
+		}
+		if len(chunks) > 0 {
+			ent.Digest = fileDigest.Digest().String()
+		}
+		return tw.Flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := newMember(); err != nil {
+		return nil, err
+	}
+	tocOffset := cw.offset()
+	tocJSON, err := json.Marshal(&toc)
+	if err != nil {
+		return nil, err
+	}
+	tw = tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     "stargz.index.json",
+		Mode:     0644,
+		Size:     int64(len(tocJSON)),
+	}); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(tocJSON); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+
+	// the footer is an empty gzip member whose extra field holds the offset of the TOC, with a
+	// stored block as written by stargz-snapshotter, so that it's 51 bytes long
+	footer := []byte{0x1f, 0x8b, 8, 1 << 2, 0, 0, 0, 0, 0, 0xff, 26, 0, 'S', 'G', 22, 0}
+	footer = append(footer, fmt.Sprintf("%016xSTARGZ", tocOffset)...)
+	footer = append(footer, 1, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0)
+	cw.Write(footer)
+	return bytes.NewReader(cw.buf.Bytes()), nil
+}
+
+// BuildZstdChunked builds a zstd:chunked layer. Each chunk of at most chunkSize bytes of the
+// contents of a file is a zstd frame, and the tar headers between them are in their own frames.
+// The manifest is in a skippable frame after the tar, followed by the footer.
+func BuildZstdChunked(ents []TarEntry, chunkSize int64, opts ...BuildTarOption) (io.Reader, error) {
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	cw := &countWriter{}
+	var pending bytes.Buffer // tar data of the next frame
+	sw := &switchWriter{w: &pending}
+	tw := tar.NewWriter(sw)
+	// flush compresses the pending tar data in a frame
+	flush := func() {
+		if pending.Len() > 0 {
+			cw.Write(enc.EncodeAll(pending.Bytes(), nil))
+			pending.Reset()
+		}
+	}
+
+	var manifest struct {
+		Version int                    `json:"version"`
+		Entries []*ZstdChunkedTOCEntry `json:"entries"`
+	}
+	manifest.Version = 1
+	err = forEachTarEntry(ents, opts, func(hdr *tar.Header, r io.Reader) error {
+		typ, ok := tocEntryTypes[hdr.Typeflag]
+		if !ok {
+			return fmt.Errorf("unsupported type %q of %s", hdr.Typeflag, hdr.Name)
+		}
+		ent := &ZstdChunkedTOCEntry{
+			Type:     typ,
+			Name:     hdr.Name,
+			LinkName: hdr.Linkname,
+			Mode:     hdr.Mode,
+		}
+		if typ == "reg" {
+			ent.Size = hdr.Size
+		}
+		manifest.Entries = append(manifest.Entries, ent)
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		chunks, err := readChunks(r, ent.Size, chunkSize)
+		if err != nil {
+			return err
+		}
+		flush()
+		fileDigest := digest.Canonical.Digester()
+		var chunkOffset int64
+		var chunk bytes.Buffer
+		sw.w = &chunk
+		for i, data := range chunks {
+			chunkEnt := ent
+			if i > 0 {
+				chunkEnt = &ZstdChunkedTOCEntry{Type: "chunk", Name: hdr.Name}
+				manifest.Entries = append(manifest.Entries, chunkEnt)
+			}
+			chunkEnt.Offset = cw.offset()
+			chunkEnt.ChunkOffset = chunkOffset
+			chunkEnt.ChunkSize = int64(len(data))
+			if _, err := tw.Write(data); err != nil {
+				return err
+			}
+			cw.Write(enc.EncodeAll(chunk.Bytes(), nil))
+			chunk.Reset()
+			chunkEnt.EndOffset = cw.offset()
+			fileDigest.Hash().Write(data)
+			chunkOffset += int64(len(data))
+		}
+		sw.w = &pending
+		if len(chunks) > 0 {
+			ent.Digest = fileDigest.Digest().String()
+		}
+		return tw.Flush()
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	flush()
+
+	manifestJSON, err := json.Marshal(&manifest)
+	if err != nil {
+		return nil, err
+	}
+	compressedManifest := enc.EncodeAll(manifestJSON, nil)
+	manifestOffset := writeSkippableFrame(cw, compressedManifest)
+
+	footer := make([]byte, 40)
+	binary.LittleEndian.PutUint64(footer[0:8], uint64(manifestOffset))
+	binary.LittleEndian.PutUint64(footer[8:16], uint64(len(compressedManifest)))
+	binary.LittleEndian.PutUint64(footer[16:24], uint64(len(manifestJSON)))
+	binary.LittleEndian.PutUint64(footer[24:32], 1)
+	copy(footer[32:40], "GnUlInUx")
+	writeSkippableFrame(cw, footer)
+	return bytes.NewReader(cw.buf.Bytes()), nil
+}
+
+// writeSkippableFrame writes data in a zstd skippable frame, and returns the offset of the data.
+func writeSkippableFrame(cw *countWriter, data []byte) int64 {
+	hdr := make([]byte, 8)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0x184D2A50)
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(len(data)))
+	cw.Write(hdr)
+	offset := cw.offset()
+	cw.Write(data)
+	return offset
+}